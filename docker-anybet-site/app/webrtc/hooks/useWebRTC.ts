@@ -130,6 +130,9 @@ export const useWebRTC = (
                             pendingIceCandidates.current = [];
                         }
                     }
+                    else if (data.type === 'server_ice_candidate') {
+                        // Кандидат серверного PeerConnection (docker-go/PROTOCOL.md): к P2P-соединению не относится
+                    }
                     else if (data.type === 'ice_candidate') {
                         if (data.ice) {
                             const candidate = new RTCIceCandidate(data.ice);
@@ -766,6 +766,14 @@ export const useWebRTC = (
                         }
                         break;
 
+                    // Сообщения серверного PeerConnection и служебные сообщения сервера (docker-go/PROTOCOL.md).
+                    // Хук не публикует медиа на сервер, поэтому кандидаты сервера не добавляются в P2P-соединение
+                    case 'server_ice_candidate':
+                    case 'publish_request':
+                    case 'clock_sync':
+                    case 'stats':
+                        break;
+
                     case 'reconnect_request':
                         console.log('Сервер запросил переподключение');
                         setTimeout(() => {
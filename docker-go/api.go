@@ -0,0 +1,586 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// roomSummary - комната в ответе API
+type roomSummary struct {
+    Room string `json:"room"`
+    RoomInfo
+    Config *namedRoom `json:"config,omitempty"` // Настройки, если комната есть в реестре
+}
+
+// peerStatus - соединение пира в API комнат
+type peerStatus struct {
+    Username    string    `json:"username"`
+    SessionID   string    `json:"sessionId"`
+    ClientIP    string    `json:"clientIp"`
+    Role        string    `json:"role"` // leader или follower
+    Mode        string    `json:"mode,omitempty"`
+    ConnectedAt time.Time `json:"connectedAt"`
+}
+
+// roomDetails - подробное состояние комнаты с качеством медиа пиров
+type roomDetails struct {
+    roomSummary
+    Stats []*peerQuality `json:"stats"`
+}
+
+// Токен администратора для изменяющих запросов API (Authorization: Bearer <token>
+// или параметр token для ссылок, открываемых плеером). Пустой токен отключает такие запросы.
+var apiAdminToken = envString("API_ADMIN_TOKEN", "")
+
+// requireAdmin проверяет токен администратора и отвечает ошибкой, если он не подходит
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+    if apiAdminToken == "" {
+        writeAPIError(w, http.StatusForbidden, "admin API is disabled")
+        return false
+    }
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if token == "" {
+        token = r.URL.Query().Get("token")
+    }
+    if subtle.ConstantTimeCompare([]byte(token), []byte(apiAdminToken)) != 1 {
+        writeAPIError(w, http.StatusUnauthorized, "invalid admin token")
+        return false
+    }
+    return true
+}
+
+// writeAPIResponse отправляет ответ API в JSON
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        log.Printf("Error writing API response: %v", err)
+    }
+}
+
+// emptyRoomInfo - состояние именованной комнаты, в которой никого нет
+func emptyRoomInfo(cfg namedRoom) RoomInfo {
+    return RoomInfo{Users: []string{}, SFUFollowers: []string{}, Title: cfg.Title,
+        MaxBitrateKbps: cfg.MaxBitrateKbps, MaxViewers: cfg.MaxViewers}
+}
+
+// handleNamedRoomAPI обслуживает настройки именованной комнаты (/api/rooms/{room}/config)
+func handleNamedRoomAPI(w http.ResponseWriter, r *http.Request, room string) {
+    switch r.Method {
+    case http.MethodGet:
+        cfg, ok := namedRooms.get(room)
+        if !ok {
+            writeAPIError(w, http.StatusNotFound, "room is not registered")
+            return
+        }
+        writeAPIResponse(w, http.StatusOK, cfg)
+    case http.MethodPut:
+        if !requireAdmin(w, r) {
+            return
+        }
+        saveNamedRoom(w, r, room, true)
+    case http.MethodDelete:
+        if !requireAdmin(w, r) {
+            return
+        }
+        removed, err := namedRooms.remove(room)
+        if err != nil {
+            log.Printf("Error deleting named room %s: %v", room, err)
+            writeAPIError(w, http.StatusInternalServerError, "failed to delete room")
+            return
+        }
+        if !removed {
+            writeAPIError(w, http.StatusNotFound, "room is not registered")
+            return
+        }
+        log.Printf("Named room %s deleted", room)
+        closeRoom(room, "Room has been deleted")
+        writeAPIResponse(w, http.StatusOK, map[string]interface{}{"room": room, "deleted": true})
+    default:
+        writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+    }
+}
+
+// saveNamedRoom создает (POST /api/rooms) или заменяет (PUT /api/rooms/{room}/config) именованную комнату
+func saveNamedRoom(w http.ResponseWriter, r *http.Request, room string, replace bool) {
+    var req namedRoomRequest
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+        writeAPIError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+        return
+    }
+    if room != "" {
+        if req.Name != "" && req.Name != room {
+            writeAPIError(w, http.StatusBadRequest, "name does not match the room in the path")
+            return
+        }
+        req.Name = room
+    }
+    cfg, err := req.toRoom(time.Now())
+    if err != nil {
+        writeAPIError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    cfg, err = namedRooms.put(cfg, replace)
+    if errors.Is(err, errRoomExists) {
+        writeAPIError(w, http.StatusConflict, err.Error())
+        return
+    }
+    if err != nil {
+        log.Printf("Error saving named room %s: %v", req.Name, err)
+        writeAPIError(w, http.StatusInternalServerError, "failed to save room")
+        return
+    }
+    expires := "never"
+    if cfg.ExpiresAt != nil {
+        expires = cfg.ExpiresAt.Format(time.RFC3339)
+    }
+    log.Printf("Named room %s saved (admission %s, max viewers %d, expires %s)", cfg.Name, cfg.Admission, cfg.MaxViewers, expires)
+    status := http.StatusOK
+    if !replace {
+        status = http.StatusCreated
+    }
+    writeAPIResponse(w, status, cfg)
+    sendRoomInfo(cfg.Name)
+}
+
+// writeAPIError отправляет ошибку API в JSON
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+    writeAPIResponse(w, status, map[string]string{"error": message})
+}
+
+// handleRoomsAPI обслуживает API комнат:
+//   GET  /api/rooms                    - список комнат, включая пустые именованные
+//   POST /api/rooms                    - создать именованную комнату (администратор)
+//   GET  /api/rooms/{room}             - состояние комнаты и качество медиа пиров
+//   GET  /api/rooms/{room}/stats       - только качество медиа пиров
+//   GET  /api/rooms/{room}/peers       - сессии и адреса локальных пиров (администратор)
+//   GET  /api/rooms/{room}/config      - настройки именованной комнаты
+//   PUT  /api/rooms/{room}/config      - создать или заменить настройки (администратор)
+//   DELETE /api/rooms/{room}/config    - удалить комнату из реестра и отключить ее пиров (администратор)
+//   GET  /api/rooms/{room}/talk        - у кого слово (push-to-talk)
+//   POST /api/rooms/{room}/talk/revoke - отобрать слово (администратор)
+func handleRoomsAPI(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rooms"), "/")
+    var parts []string
+    if path != "" {
+        parts = strings.Split(path, "/")
+    }
+
+    if len(parts) == 0 {
+        if r.Method == http.MethodPost {
+            if !requireAdmin(w, r) {
+                return
+            }
+            saveNamedRoom(w, r, "", false)
+            return
+        }
+        if r.Method != http.MethodGet {
+            writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+            return
+        }
+        configs := make(map[string]namedRoom)
+        for _, cfg := range namedRooms.list() {
+            configs[cfg.Name] = cfg
+        }
+        names := make(map[string]bool)
+        for room := range configs {
+            names[room] = true
+        }
+        for room := range activeRooms() {
+            names[room] = true
+        }
+        // Комнаты, все пиры которых подключены к другим узлам
+        for _, room := range roomState.RemoteRooms() {
+            names[room] = true
+        }
+        list := make([]roomSummary, 0, len(names))
+        for room := range names {
+            info, ok := buildRoomInfo(room)
+            cfg, registered := configs[room]
+            if !ok && !registered {
+                continue
+            }
+            summary := roomSummary{Room: room, RoomInfo: info}
+            if registered {
+                summary.Config = &cfg
+                if !ok {
+                    summary.RoomInfo = emptyRoomInfo(cfg)
+                }
+            }
+            list = append(list, summary)
+        }
+        sort.Slice(list, func(i, j int) bool { return list[i].Room < list[j].Room })
+        writeAPIResponse(w, http.StatusOK, list)
+        return
+    }
+
+    room := parts[0]
+    route := strings.Join(parts[1:], "/")
+    if route == "config" {
+        handleNamedRoomAPI(w, r, room)
+        return
+    }
+    info, ok := buildRoomInfo(room)
+    quality := roomQuality(room)
+    var config *namedRoom
+    if cfg, registered := namedRooms.get(room); registered {
+        config = &cfg
+        if !ok {
+            info, ok = emptyRoomInfo(cfg), true
+        }
+    }
+    if !ok {
+        writeAPIError(w, http.StatusNotFound, "room not found")
+        return
+    }
+
+    switch {
+    case route == "" && r.Method == http.MethodGet:
+        writeAPIResponse(w, http.StatusOK, roomDetails{roomSummary: roomSummary{Room: room, RoomInfo: info, Config: config}, Stats: quality})
+    case route == "stats" && r.Method == http.MethodGet:
+        writeAPIResponse(w, http.StatusOK, map[string]interface{}{"room": room, "stats": quality})
+    case route == "peers" && r.Method == http.MethodGet:
+        if !requireAdmin(w, r) {
+            return
+        }
+        list := []peerStatus{}
+        for _, p := range roomPeers(room) {
+            list = append(list, peerStatus{Username: p.username, SessionID: p.sessionID, ClientIP: p.clientIP,
+                Role: map[bool]string{true: "leader", false: "follower"}[p.isLeader], Mode: p.mode, ConnectedAt: p.connectedAt.UTC()})
+        }
+        writeAPIResponse(w, http.StatusOK, map[string]interface{}{"room": room, "peers": list})
+    case route == "talk" && r.Method == http.MethodGet:
+        holder, since := talkState(room)
+        resp := map[string]interface{}{"room": room, "holder": holder}
+        if holder != "" {
+            resp["since"] = since
+        }
+        writeAPIResponse(w, http.StatusOK, resp)
+    case route == "talk/revoke" && r.Method == http.MethodPost:
+        if !requireAdmin(w, r) {
+            return
+        }
+        holder, err := revokeTalkFloor(room, "admin")
+        if err != nil {
+            writeAPIError(w, http.StatusConflict, err.Error())
+            return
+        }
+        writeAPIResponse(w, http.StatusOK, map[string]interface{}{"room": room, "revoked": holder})
+    case route == "" || route == "stats" || route == "peers" || route == "talk" || route == "talk/revoke":
+        writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+    default:
+        writeAPIError(w, http.StatusNotFound, "not found")
+    }
+}
+
+// parseAPITime разбирает время в запросе API: RFC 3339 или Unix-время в секундах
+func parseAPITime(v string) (time.Time, error) {
+    if v == "" {
+        return time.Time{}, nil
+    }
+    if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+        return time.Unix(sec, 0), nil
+    }
+    return time.Parse(time.RFC3339, v)
+}
+
+// handleRecordingsAPI обслуживает каталог записей:
+//   GET    /api/recordings?room=&leader=&from=&to= - список записей
+//   GET    /api/recordings/{id}                    - метаданные записи
+//   GET    /api/recordings/{id}/file               - файл записи (поддерживает Range)
+//   DELETE /api/recordings/{id}                    - удалить запись (администратор)
+// Без RECORDINGS_PUBLIC просмотр тоже требует токен администратора.
+func handleRecordingsAPI(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/recordings"), "/")
+    var parts []string
+    if path != "" {
+        parts = strings.Split(path, "/")
+    }
+    if r.Method == http.MethodDelete || !recordingConfig.Public {
+        if !requireAdmin(w, r) {
+            return
+        }
+    }
+
+    switch {
+    case len(parts) == 0 && r.Method == http.MethodGet:
+        q := r.URL.Query()
+        filter := recordingFilter{Room: q.Get("room"), Leader: q.Get("leader")}
+        var err error
+        if filter.From, err = parseAPITime(q.Get("from")); err != nil {
+            writeAPIError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+            return
+        }
+        if filter.To, err = parseAPITime(q.Get("to")); err != nil {
+            writeAPIError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+            return
+        }
+        list, err := listRecordings(filter)
+        if err != nil {
+            log.Printf("Error listing recordings: %v", err)
+            writeAPIError(w, http.StatusInternalServerError, "failed to list recordings")
+            return
+        }
+        writeAPIResponse(w, http.StatusOK, list)
+    case len(parts) == 1 && r.Method == http.MethodGet:
+        meta, err := loadRecording(parts[0])
+        if err != nil {
+            writeAPIError(w, http.StatusNotFound, "recording not found")
+            return
+        }
+        writeAPIResponse(w, http.StatusOK, meta)
+    case len(parts) == 1 && r.Method == http.MethodDelete:
+        err := deleteRecording(parts[0])
+        switch {
+        case errors.Is(err, os.ErrNotExist):
+            writeAPIError(w, http.StatusNotFound, "recording not found")
+        case errors.Is(err, errRecordingActive):
+            writeAPIError(w, http.StatusConflict, err.Error())
+        case err != nil:
+            log.Printf("Error deleting recording %s: %v", parts[0], err)
+            writeAPIError(w, http.StatusInternalServerError, "failed to delete recording")
+        default:
+            log.Printf("Recording %s deleted via API", parts[0])
+            w.WriteHeader(http.StatusNoContent)
+        }
+    case len(parts) == 2 && parts[1] == "file" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+        meta, err := loadRecording(parts[0])
+        if err != nil {
+            writeAPIError(w, http.StatusNotFound, "recording not found")
+            return
+        }
+        f, err := os.Open(recordingPath(meta.ID, ".mp4"))
+        if err != nil {
+            writeAPIError(w, http.StatusNotFound, "recording file not found")
+            return
+        }
+        defer f.Close()
+        w.Header().Set("Content-Type", "video/mp4")
+        w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", meta.Room+"-"+meta.ID+".mp4"))
+        modTime := meta.StartedAt
+        if meta.EndedAt != nil {
+            modTime = *meta.EndedAt
+        }
+        http.ServeContent(w, r, "", modTime, f)
+    case len(parts) <= 2:
+        writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+    default:
+        writeAPIError(w, http.StatusNotFound, "not found")
+    }
+}
+
+// handleSessionsAPI обслуживает историю сессий (администратор):
+//   GET /api/sessions?sessionId=&room=&username=&role=&from=&to=&limit= - сессии, новые первыми
+//   GET /api/sessions/summary?room=&username=&role=&from=&to= - время в комнате по пользователям
+// from и to выбирают сессии, пересекающиеся с интервалом.
+func handleSessionsAPI(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    if !requireAdmin(w, r) {
+        return
+    }
+    if r.Method != http.MethodGet {
+        writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+        return
+    }
+    route := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+    if route != "" && route != "summary" {
+        writeAPIError(w, http.StatusNotFound, "not found")
+        return
+    }
+
+    q := r.URL.Query()
+    filter := sessionFilter{SessionID: q.Get("sessionId"), Room: q.Get("room"), Username: q.Get("username"), Role: q.Get("role"), Limit: 100}
+    var err error
+    if filter.From, err = parseAPITime(q.Get("from")); err != nil {
+        writeAPIError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+        return
+    }
+    if filter.To, err = parseAPITime(q.Get("to")); err != nil {
+        writeAPIError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+        return
+    }
+    if v := q.Get("limit"); v != "" {
+        if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 || filter.Limit > 1000 {
+            writeAPIError(w, http.StatusBadRequest, "invalid limit: expected 1..1000")
+            return
+        }
+    }
+
+    var result interface{}
+    if route == "summary" {
+        result, err = summarizeSessions(r.Context(), filter)
+    } else {
+        result, err = listSessions(r.Context(), filter)
+    }
+    if errors.Is(err, errSessionHistoryDisabled) {
+        writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+        return
+    }
+    if err != nil {
+        log.Printf("Error querying session history: %v", err)
+        writeAPIError(w, http.StatusInternalServerError, "failed to query session history")
+        return
+    }
+    writeAPIResponse(w, http.StatusOK, result)
+}
+
+// handleTimelapseAPI обслуживает таймлапс комнат:
+//   GET    /api/timelapse                       - комнаты с таймлапсом
+//   GET    /api/timelapse/{room}                - состояние съемки и число кадров
+//   POST   /api/timelapse/{room}/start          - начать съемку ({"interval":"30s"}, администратор)
+//   POST   /api/timelapse/{room}/stop           - остановить съемку, начатую через API (администратор)
+//   GET    /api/timelapse/{room}/video?from=&to= - кадры одним видео (H.264 - MP4, VP8 - IVF)
+//   GET    /api/timelapse/{room}/frames.zip     - кадры zip-архивом в JPEG; кадры H.264 декодируются
+//                                                 через ffmpeg (TIMELAPSE_FFMPEG), без него - 501
+//   DELETE /api/timelapse/{room}                - удалить кадры (администратор)
+// Без TIMELAPSE_PUBLIC просмотр тоже требует токен администратора.
+func handleTimelapseAPI(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/timelapse"), "/")
+    var parts []string
+    if path != "" {
+        parts = strings.Split(path, "/")
+    }
+    if r.Method != http.MethodGet || !timelapseConfig.Public {
+        if !requireAdmin(w, r) {
+            return
+        }
+    }
+
+    if len(parts) == 0 {
+        if r.Method != http.MethodGet {
+            writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+            return
+        }
+        list, err := listTimelapseRooms()
+        if err != nil {
+            log.Printf("Error listing timelapse rooms: %v", err)
+            writeAPIError(w, http.StatusInternalServerError, "failed to list timelapse rooms")
+            return
+        }
+        writeAPIResponse(w, http.StatusOK, list)
+        return
+    }
+
+    room := parts[0]
+    route := strings.Join(parts[1:], "/")
+    switch {
+    case route == "" && r.Method == http.MethodGet:
+        writeTimelapseStatus(w, room)
+    case route == "" && r.Method == http.MethodDelete:
+        if err := deleteTimelapseFrames(room); err != nil {
+            log.Printf("Error deleting timelapse frames of room %s: %v", room, err)
+            writeAPIError(w, http.StatusInternalServerError, "failed to delete frames")
+            return
+        }
+        log.Printf("Timelapse frames of room %s deleted via API", room)
+        w.WriteHeader(http.StatusNoContent)
+    case route == "start" && r.Method == http.MethodPost:
+        var req struct {
+            Interval string `json:"interval"`
+        }
+        if r.ContentLength != 0 {
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+                return
+            }
+        }
+        interval := timelapseConfig.Interval
+        if req.Interval != "" {
+            var err error
+            if interval, err = time.ParseDuration(req.Interval); err != nil {
+                writeAPIError(w, http.StatusBadRequest, "invalid interval: "+err.Error())
+                return
+            }
+        }
+        if interval < timelapseMinInterval {
+            writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("interval must be at least %s", timelapseMinInterval))
+            return
+        }
+        startTimelapseCapture(room, interval)
+        writeTimelapseStatus(w, room)
+    case route == "stop" && r.Method == http.MethodPost:
+        if !stopTimelapseCapture(room) {
+            writeAPIError(w, http.StatusConflict, "timelapse was not started via API")
+            return
+        }
+        writeTimelapseStatus(w, room)
+    case (route == "video" || route == "frames.zip") && r.Method == http.MethodGet:
+        q := r.URL.Query()
+        from, err := parseAPITime(q.Get("from"))
+        if err != nil {
+            writeAPIError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+            return
+        }
+        to, err := parseAPITime(q.Get("to"))
+        if err != nil {
+            writeAPIError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+            return
+        }
+        frames, err := listTimelapseFrames(room, from, to)
+        if err != nil {
+            log.Printf("Error listing timelapse frames of room %s: %v", room, err)
+            writeAPIError(w, http.StatusInternalServerError, "failed to list frames")
+            return
+        }
+        if len(frames) == 0 {
+            writeAPIError(w, http.StatusNotFound, "no frames")
+            return
+        }
+        if route == "frames.zip" {
+            ffmpeg, err := timelapseH264Decoder(frames)
+            if err != nil {
+                writeAPIError(w, http.StatusNotImplemented, err.Error())
+                return
+            }
+            w.Header().Set("Content-Type", "application/zip")
+            w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room+"-timelapse.zip"))
+            if err := writeTimelapseZip(zip.NewWriter(w), frames, ffmpeg); err != nil {
+                log.Printf("Error writing timelapse archive of room %s: %v", room, err)
+            }
+            return
+        }
+        frames = lastCodecFrames(frames)
+        data, contentType, ext := []byte(nil), "video/mp4", ".mp4"
+        if frames[0].codec == "vp8" {
+            data, err = buildTimelapseIVF(frames)
+            contentType, ext = "video/x-ivf", ".ivf"
+        } else {
+            data, err = buildTimelapseMP4(frames)
+        }
+        if err != nil {
+            writeAPIError(w, http.StatusUnprocessableEntity, "failed to assemble video: "+err.Error())
+            return
+        }
+        w.Header().Set("Content-Type", contentType)
+        w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room+"-timelapse"+ext))
+        http.ServeContent(w, r, "", frames[len(frames)-1].at, bytes.NewReader(data))
+    case route == "" || route == "start" || route == "stop" || route == "video" || route == "frames.zip":
+        writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+    default:
+        writeAPIError(w, http.StatusNotFound, "not found")
+    }
+}
+
+func writeTimelapseStatus(w http.ResponseWriter, room string) {
+    st, err := getTimelapseStatus(room)
+    if err != nil {
+        log.Printf("Error reading timelapse of room %s: %v", room, err)
+        writeAPIError(w, http.StatusInternalServerError, "failed to read timelapse")
+        return
+    }
+    writeAPIResponse(w, http.StatusOK, st)
+}
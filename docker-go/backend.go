@@ -0,0 +1,216 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "time"
+)
+
+// Реестр комнат, общий для нескольких экземпляров сервера за балансировщиком.
+// Локальные пиры по-прежнему живут в циклах комнат (rooms); backend сообщает о пирах других узлов
+// и пересылает им сигнальные сообщения (offer, answer, ice_candidate и т.п.).
+// memory - один экземпляр (поведение по умолчанию), redis - реестр в Redis и пересылка через pub/sub.
+// Backend хранит и реестр именованных комнат, чтобы все узлы одинаково применяли их ограничения.
+// Медиа через сервер (sfu, HLS, RTSP, запись) остается на узле, к которому подключен ведущий.
+
+// roomMember - пир комнаты в общем реестре
+type roomMember struct {
+    Node     string    `json:"node"`
+    Room     string    `json:"room"`
+    Username string    `json:"username"`
+    IsLeader bool      `json:"isLeader"`
+    Mode     string    `json:"mode,omitempty"`
+    Codec    string    `json:"codec,omitempty"`
+    ViewMode string    `json:"viewMode,omitempty"`
+    JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Виды пересылаемых сообщений
+const (
+    relaySignal  = "signal"  // сообщение WebSocket пиру как есть
+    relayReplace = "replace" // ведомый заменен ведомым с другого узла: отключить
+    relayTakeover = "takeover" // имя занято новым соединением на другом узле: отключить
+    relayRoomClosed = "room_closed" // комната удалена или истекла: отключить всех её пиров (Broadcast)
+)
+
+// relayEnvelope - сообщение пиру на другом узле
+type relayEnvelope struct {
+    Kind string          `json:"kind"`
+    Room string          `json:"room"`
+    To   string          `json:"to"`
+    From string          `json:"from"`
+    Node string          `json:"node,omitempty"` // узел-отправитель (для Broadcast)
+    Data json.RawMessage `json:"data,omitempty"`
+}
+
+// roomBackend - общий реестр комнат. Методы могут обращаться к сети, кроме RemoteMembers и RemoteRooms,
+// которые читают локальный кэш: только их можно вызывать в цикле комнаты.
+type roomBackend interface {
+    Name() string
+    // Join и Leave публикуют локального пира в общем реестре
+    Join(m roomMember)
+    Leave(m roomMember)
+    // RemoteMembers возвращает пиров комнаты, подключенных к другим узлам
+    RemoteMembers(room string) []roomMember
+    // RemoteRooms возвращает комнаты, в которых есть пиры других узлов
+    RemoteRooms() []string
+    // Relay пересылает сообщение пиру другого узла
+    Relay(to roomMember, env relayEnvelope) error
+    // Broadcast пересылает сообщение всем остальным узлам
+    Broadcast(env relayEnvelope) error
+    // NamedRooms возвращает реестр именованных комнат
+    NamedRooms() namedRoomStore
+    Close() error
+}
+
+var errNotRelayable = errors.New("peer is not connected to another node")
+
+// memoryBackend - один экземпляр сервера: других узлов нет, реестр именованных комнат - файл ROOMS_FILE
+type memoryBackend struct {
+    named *namedRoomRegistry
+}
+
+func (memoryBackend) Name() string                          { return "memory" }
+func (memoryBackend) Join(roomMember)                       {}
+func (memoryBackend) Leave(roomMember)                      {}
+func (memoryBackend) RemoteMembers(string) []roomMember     { return nil }
+func (memoryBackend) RemoteRooms() []string                 { return nil }
+func (memoryBackend) Relay(roomMember, relayEnvelope) error { return errNotRelayable }
+func (memoryBackend) Broadcast(relayEnvelope) error         { return nil }
+func (b memoryBackend) NamedRooms() namedRoomStore          { return b.named }
+func (memoryBackend) Close() error                          { return nil }
+
+// Идентификатор узла: имя хоста и случайный суффикс, чтобы перезапуск не подхватил чужие записи
+var nodeID = envString("NODE_ID", defaultNodeID())
+
+func defaultNodeID() string {
+    host, err := os.Hostname()
+    if err != nil || host == "" {
+        host = "node"
+    }
+    suffix := make([]byte, 3)
+    if _, err := rand.Read(suffix); err != nil {
+        return host
+    }
+    return host + "-" + hex.EncodeToString(suffix)
+}
+
+var roomState roomBackend = memoryBackend{}
+
+// initRoomBackend выбирает реестр комнат по ROOM_BACKEND (memory или redis)
+func initRoomBackend() error {
+    switch kind := envString("ROOM_BACKEND", "memory"); kind {
+    case "memory":
+        roomState = memoryBackend{named: loadNamedRooms(namedRoomsFile)}
+    case "redis":
+        backend, err := newRedisBackend(redisConfig, nodeID)
+        if err != nil {
+            return err
+        }
+        roomState = backend
+    default:
+        return fmt.Errorf("unknown ROOM_BACKEND %q (expected memory or redis)", kind)
+    }
+    namedRooms = roomState.NamedRooms()
+    log.Printf("Room backend: %s (node %s)", roomState.Name(), nodeID)
+    return nil
+}
+
+// memberOf описывает локального пира для общего реестра
+func memberOf(peer *Peer) roomMember {
+    peer.mu.Lock()
+    defer peer.mu.Unlock()
+    return roomMember{
+        Node:     nodeID,
+        Room:     peer.room,
+        Username: peer.username,
+        IsLeader: peer.isLeader,
+        Mode:     peer.mode,
+        Codec:    peer.codec,
+        ViewMode: peer.viewMode,
+        JoinedAt: time.Now().UTC(),
+    }
+}
+
+// remoteLeader возвращает ведущего комнаты на другом узле
+func remoteLeader(room string) (roomMember, bool) {
+    for _, m := range roomState.RemoteMembers(room) {
+        if m.IsLeader {
+            return m, true
+        }
+    }
+    return roomMember{}, false
+}
+
+// remoteSignalingTarget - то же, что signalingTarget, среди пиров других узлов
+func remoteSignalingTarget(current *Peer) (roomMember, bool) {
+    for _, m := range roomState.RemoteMembers(current.room) {
+        if m.Username == current.username {
+            continue
+        }
+        if current.isLeader {
+            if !m.IsLeader && m.Mode != peerModeSFU {
+                return m, true
+            }
+        } else if m.IsLeader {
+            return m, true
+        }
+    }
+    return roomMember{}, false
+}
+
+// relayToMember пересылает сообщение WebSocket пиру другого узла
+func relayToMember(from *Peer, to roomMember, msg []byte) {
+    env := relayEnvelope{Kind: relaySignal, Room: to.Room, To: to.Username, From: from.username, Data: msg}
+    if err := roomState.Relay(to, env); err != nil {
+        log.Printf("Error relaying message from %s to %s on node %s: %v", from.username, to.Username, to.Node, err)
+    }
+}
+
+// deliverRelayed доставляет локальному пиру сообщение с другого узла
+func deliverRelayed(env relayEnvelope) {
+    if env.Kind == relayRoomClosed {
+        var reason string
+        _ = json.Unmarshal(env.Data, &reason)
+        log.Printf("Room %s closed on node %s: %s", env.Room, env.Node, reason)
+        closeLocalRoom(env.Room, reason)
+        return
+    }
+    peer := findPeer(env.Room, env.To)
+    if peer == nil {
+        log.Printf("Relayed %s message for %s in room %s: peer is not connected here", env.Kind, env.To, env.Room)
+        return
+    }
+    switch env.Kind {
+    case relaySignal:
+        if err := peer.writeMessage(env.Data); err != nil {
+            log.Printf("Error delivering relayed message from %s to %s: %v", env.From, env.To, err)
+        }
+    case relayReplace:
+        log.Printf("Follower %s in room %s replaced by %s on another node", env.To, env.Room, env.From)
+        _ = peer.writeJSON(map[string]interface{}{
+            "type": "force_disconnect",
+            "data": "You have been replaced by another viewer",
+        })
+        go closePeerResources(peer, "Replaced by new follower")
+    case relayTakeover:
+        log.Printf("Session %s of %s in room %s taken over by session %s on another node", peer.sessionID, env.To, env.Room, env.From)
+        _ = peer.writeJSON(map[string]interface{}{
+            "type": "force_disconnect",
+            "data": "Your session was taken over by a new connection",
+        })
+        go closePeerResources(peer, "Taken over by new session")
+    }
+}
+
+// onRemoteMembership вызывается backend, когда меняется состав комнаты на другом узле
+func onRemoteMembership(room string) {
+    if len(roomPeers(room)) > 0 {
+        sendRoomInfo(room)
+    }
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+
+    "github.com/pion/rtp"
+    "github.com/pion/rtp/codecs"
+)
+
+// Типы NAL-юнитов H.264, которые нужны серверу
+const (
+    h264NaluIDR   = 5
+    h264NaluSEI   = 6
+    h264NaluSPS   = 7
+    h264NaluPPS   = 8
+    h264NaluAUD   = 9
+    h264NaluSTAPA = 24
+    h264NaluFUA   = 28
+)
+
+// h264Depacketizer собирает NAL-юниты из RTP-пакетов (RFC 6184: single NAL, STAP-A, FU-A)
+type h264Depacketizer struct {
+    fuBuf    []byte
+    fuActive bool
+    lastSeq  uint16
+    started  bool
+}
+
+// push разбирает пакет и возвращает NAL-юниты, которые он завершает
+func (d *h264Depacketizer) push(pkt *rtp.Packet) [][]byte {
+    // При потере пакета незавершенный FU-A собрать уже нельзя
+    if d.started && pkt.SequenceNumber != d.lastSeq+1 {
+        d.fuActive = false
+        d.fuBuf = d.fuBuf[:0]
+    }
+    d.started = true
+    d.lastSeq = pkt.SequenceNumber
+
+    payload := pkt.Payload
+    if len(payload) < 1 {
+        return nil
+    }
+    naluType := payload[0] & 0x1F
+    switch {
+    case naluType >= 1 && naluType <= 23:
+        return [][]byte{payload}
+    case naluType == h264NaluSTAPA:
+        var nalus [][]byte
+        offset := 1
+        for offset+2 <= len(payload) {
+            size := int(payload[offset])<<8 | int(payload[offset+1])
+            offset += 2
+            if size == 0 || offset+size > len(payload) {
+                break
+            }
+            nalus = append(nalus, payload[offset:offset+size])
+            offset += size
+        }
+        return nalus
+    case naluType == h264NaluFUA:
+        if len(payload) < 2 {
+            return nil
+        }
+        start := payload[1]&0x80 != 0
+        end := payload[1]&0x40 != 0
+        if start {
+            d.fuBuf = append(d.fuBuf[:0], (payload[0]&0xE0)|(payload[1]&0x1F))
+            d.fuActive = true
+        } else if !d.fuActive {
+            return nil
+        }
+        d.fuBuf = append(d.fuBuf, payload[2:]...)
+        if end {
+            d.fuActive = false
+            nalu := make([]byte, len(d.fuBuf))
+            copy(nalu, d.fuBuf)
+            d.fuBuf = d.fuBuf[:0]
+            return [][]byte{nalu}
+        }
+    }
+    return nil
+}
+
+// h264AccessUnit - кадр H.264: все NAL-юниты с одной RTP-меткой времени
+type h264AccessUnit struct {
+    timestamp uint32
+    nalus     [][]byte
+    keyframe  bool
+}
+
+// h264FrameAssembler группирует NAL-юниты в кадры по метке времени и маркерному биту
+type h264FrameAssembler struct {
+    depacketizer h264Depacketizer
+    cur          *h264AccessUnit
+}
+
+// push возвращает кадр, если пакет его завершил (или начал следующий)
+func (a *h264FrameAssembler) push(pkt *rtp.Packet) []*h264AccessUnit {
+    var done []*h264AccessUnit
+    if a.cur != nil && a.cur.timestamp != pkt.Timestamp && len(a.cur.nalus) > 0 {
+        done = append(done, a.cur)
+        a.cur = nil
+    }
+    if a.cur == nil {
+        a.cur = &h264AccessUnit{timestamp: pkt.Timestamp}
+    }
+    for _, nalu := range a.depacketizer.push(pkt) {
+        if nalu[0]&0x1F == h264NaluIDR {
+            a.cur.keyframe = true
+        }
+        a.cur.nalus = append(a.cur.nalus, nalu)
+    }
+    if pkt.Marker && len(a.cur.nalus) > 0 {
+        done = append(done, a.cur)
+        a.cur = nil
+    }
+    return done
+}
+
+// vp8Frame - собранный кадр VP8
+type vp8Frame struct {
+    timestamp uint32
+    data      []byte
+    keyframe  bool
+}
+
+// vp8FrameAssembler собирает кадры VP8 из RTP (RFC 7741); кадр с потерянными пакетами отбрасывается
+type vp8FrameAssembler struct {
+    cur     *vp8Frame
+    lastSeq uint16
+    started bool
+}
+
+// push возвращает кадр, если пакет его завершил
+func (a *vp8FrameAssembler) push(pkt *rtp.Packet) *vp8Frame {
+    var desc codecs.VP8Packet
+    payload, err := desc.Unmarshal(pkt.Payload)
+    if err != nil {
+        a.cur = nil
+        return nil
+    }
+    if a.started && pkt.SequenceNumber != a.lastSeq+1 {
+        a.cur = nil
+    }
+    a.lastSeq = pkt.SequenceNumber
+    a.started = true
+
+    if desc.S == 1 && desc.PID == 0 {
+        a.cur = &vp8Frame{timestamp: pkt.Timestamp}
+    }
+    if a.cur == nil || a.cur.timestamp != pkt.Timestamp {
+        a.cur = nil
+        return nil
+    }
+    a.cur.data = append(a.cur.data, payload...)
+    if !pkt.Marker {
+        return nil
+    }
+    frame := a.cur
+    a.cur = nil
+    frame.keyframe = len(frame.data) > 0 && frame.data[0]&0x01 == 0
+    return frame
+}
+
+// vp8KeyframeSize извлекает размер кадра из заголовка ключевого кадра VP8 (RFC 6386, 9.1)
+func vp8KeyframeSize(frame []byte) (width, height int, err error) {
+    if len(frame) < 10 || frame[0]&0x01 != 0 {
+        return 0, 0, errors.New("not a VP8 keyframe")
+    }
+    if frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+        return 0, 0, errors.New("invalid VP8 start code")
+    }
+    width = int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff)
+    height = int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff)
+    return width, height, nil
+}
+
+// h264BitReader читает биты из RBSP (с удаленными байтами эмуляции)
+type h264BitReader struct {
+    data []byte
+    pos  int
+}
+
+func newH264BitReader(nalu []byte) *h264BitReader {
+    rbsp := make([]byte, 0, len(nalu))
+    zeros := 0
+    for _, b := range nalu {
+        if zeros >= 2 && b == 0x03 {
+            zeros = 0
+            continue
+        }
+        if b == 0 {
+            zeros++
+        } else {
+            zeros = 0
+        }
+        rbsp = append(rbsp, b)
+    }
+    return &h264BitReader{data: rbsp}
+}
+
+var errH264ShortSPS = errors.New("sps is truncated")
+
+func (r *h264BitReader) bit() (uint, error) {
+    if r.pos >= len(r.data)*8 {
+        return 0, errH264ShortSPS
+    }
+    b := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+    r.pos++
+    return uint(b), nil
+}
+
+func (r *h264BitReader) bits(n int) (uint, error) {
+    var v uint
+    for i := 0; i < n; i++ {
+        b, err := r.bit()
+        if err != nil {
+            return 0, err
+        }
+        v = v<<1 | b
+    }
+    return v, nil
+}
+
+func (r *h264BitReader) ue() (uint, error) {
+    zeros := 0
+    for {
+        b, err := r.bit()
+        if err != nil {
+            return 0, err
+        }
+        if b == 1 {
+            break
+        }
+        zeros++
+        if zeros > 31 {
+            return 0, errors.New("invalid exp-golomb code")
+        }
+    }
+    v, err := r.bits(zeros)
+    if err != nil {
+        return 0, err
+    }
+    return (1 << uint(zeros)) - 1 + v, nil
+}
+
+func (r *h264BitReader) se() (int, error) {
+    v, err := r.ue()
+    if err != nil {
+        return 0, err
+    }
+    if v%2 == 1 {
+        return int(v+1) / 2, nil
+    }
+    return -int(v / 2), nil
+}
+
+// h264CodecString возвращает строку кодека RFC 6381 (avc1.PPCCLL) по SPS
+func h264CodecString(sps []byte) string {
+    if len(sps) < 4 {
+        return "avc1"
+    }
+    return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+}
+
+// parseH264SPS извлекает разрешение кадра из SPS
+func parseH264SPS(sps []byte) (width, height int, err error) {
+    if len(sps) < 4 {
+        return 0, 0, errH264ShortSPS
+    }
+    r := newH264BitReader(sps[1:])
+    profile, err := r.bits(8)
+    if err != nil {
+        return 0, 0, err
+    }
+    if _, err = r.bits(16); err != nil { // constraint flags + level_idc
+        return 0, 0, err
+    }
+    if _, err = r.ue(); err != nil { // seq_parameter_set_id
+        return 0, 0, err
+    }
+
+    chromaFormat := uint(1)
+    switch profile {
+    case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+        if chromaFormat, err = r.ue(); err != nil {
+            return 0, 0, err
+        }
+        if chromaFormat == 3 {
+            if _, err = r.bit(); err != nil { // separate_colour_plane_flag
+                return 0, 0, err
+            }
+        }
+        if _, err = r.ue(); err != nil { // bit_depth_luma_minus8
+            return 0, 0, err
+        }
+        if _, err = r.ue(); err != nil { // bit_depth_chroma_minus8
+            return 0, 0, err
+        }
+        if _, err = r.bit(); err != nil { // qpprime_y_zero_transform_bypass_flag
+            return 0, 0, err
+        }
+        scalingPresent, err := r.bit()
+        if err != nil {
+            return 0, 0, err
+        }
+        if scalingPresent == 1 {
+            lists := 8
+            if chromaFormat == 3 {
+                lists = 12
+            }
+            for i := 0; i < lists; i++ {
+                present, err := r.bit()
+                if err != nil {
+                    return 0, 0, err
+                }
+                if present == 0 {
+                    continue
+                }
+                size := 16
+                if i >= 6 {
+                    size = 64
+                }
+                last, next := 8, 8
+                for j := 0; j < size; j++ {
+                    if next != 0 {
+                        delta, err := r.se()
+                        if err != nil {
+                            return 0, 0, err
+                        }
+                        next = (last + delta + 256) % 256
+                    }
+                    if next != 0 {
+                        last = next
+                    }
+                }
+            }
+        }
+    }
+
+    if _, err = r.ue(); err != nil { // log2_max_frame_num_minus4
+        return 0, 0, err
+    }
+    pocType, err := r.ue()
+    if err != nil {
+        return 0, 0, err
+    }
+    switch pocType {
+    case 0:
+        if _, err = r.ue(); err != nil {
+            return 0, 0, err
+        }
+    case 1:
+        if _, err = r.bit(); err != nil {
+            return 0, 0, err
+        }
+        if _, err = r.se(); err != nil {
+            return 0, 0, err
+        }
+        if _, err = r.se(); err != nil {
+            return 0, 0, err
+        }
+        n, err := r.ue()
+        if err != nil {
+            return 0, 0, err
+        }
+        for i := uint(0); i < n; i++ {
+            if _, err = r.se(); err != nil {
+                return 0, 0, err
+            }
+        }
+    }
+    if _, err = r.ue(); err != nil { // max_num_ref_frames
+        return 0, 0, err
+    }
+    if _, err = r.bit(); err != nil { // gaps_in_frame_num_value_allowed_flag
+        return 0, 0, err
+    }
+    widthMbs, err := r.ue()
+    if err != nil {
+        return 0, 0, err
+    }
+    heightMapUnits, err := r.ue()
+    if err != nil {
+        return 0, 0, err
+    }
+    frameMbsOnly, err := r.bit()
+    if err != nil {
+        return 0, 0, err
+    }
+    if frameMbsOnly == 0 {
+        if _, err = r.bit(); err != nil { // mb_adaptive_frame_field_flag
+            return 0, 0, err
+        }
+    }
+    if _, err = r.bit(); err != nil { // direct_8x8_inference_flag
+        return 0, 0, err
+    }
+    var cropLeft, cropRight, cropTop, cropBottom uint
+    cropping, err := r.bit()
+    if err != nil {
+        return 0, 0, err
+    }
+    if cropping == 1 {
+        for _, v := range []*uint{&cropLeft, &cropRight, &cropTop, &cropBottom} {
+            if *v, err = r.ue(); err != nil {
+                return 0, 0, err
+            }
+        }
+    }
+
+    cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+    switch chromaFormat {
+    case 1:
+        cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+    case 2:
+        cropUnitX = 2
+    }
+    width = int((widthMbs+1)*16 - (cropLeft+cropRight)*cropUnitX)
+    height = int((2-frameMbsOnly)*(heightMapUnits+1)*16 - (cropTop+cropBottom)*cropUnitY)
+    return width, height, nil
+}
+
+// opusPacketDuration возвращает длительность Opus-пакета в отсчетах 48 кГц (RFC 6716, 3.1)
+func opusPacketDuration(payload []byte) uint32 {
+    if len(payload) < 1 {
+        return 0
+    }
+    toc := payload[0]
+    config := toc >> 3
+    var frame uint32 // в отсчетах 48 кГц
+    switch {
+    case config < 12:
+        frame = []uint32{480, 960, 1920, 2880}[config%4]
+    case config < 16:
+        frame = []uint32{480, 960}[config%2]
+    default:
+        frame = []uint32{120, 240, 480, 960}[config%4]
+    }
+    frames := uint32(1)
+    switch toc & 0x03 {
+    case 1, 2:
+        frames = 2
+    case 3:
+        if len(payload) < 2 {
+            return 0
+        }
+        frames = uint32(payload[1] & 0x3F)
+    }
+    return frame * frames
+}
@@ -0,0 +1,173 @@
+package main
+
+import "testing"
+
+// spsWriter собирает SPS по битам (экспоненциальный код Голомба) для тестов parseH264SPS
+type spsWriter struct {
+    data []byte
+    n    int
+}
+
+func (w *spsWriter) bit(b uint) {
+    if w.n%8 == 0 {
+        w.data = append(w.data, 0)
+    }
+    if b != 0 {
+        w.data[len(w.data)-1] |= 0x80 >> uint(w.n%8)
+    }
+    w.n++
+}
+
+func (w *spsWriter) bits(v uint, n int) {
+    for i := n - 1; i >= 0; i-- {
+        w.bit((v >> uint(i)) & 1)
+    }
+}
+
+func (w *spsWriter) ue(v uint) {
+    v++
+    size := 0
+    for x := v; x > 1; x >>= 1 {
+        size++
+    }
+    w.bits(0, size)
+    w.bits(v, size+1)
+}
+
+type testSPS struct {
+    profile      uint
+    level        uint
+    spsID        uint
+    widthMbs     uint // pic_width_in_mbs_minus1
+    heightUnits  uint // pic_height_in_map_units_minus1
+    frameMbsOnly uint
+    crop         [4]uint // left, right, top, bottom
+    pocType      uint
+}
+
+func (s testSPS) build() []byte {
+    w := &spsWriter{}
+    w.bits(0x67, 8) // заголовок NAL
+    w.bits(s.profile, 8)
+    w.bits(0, 8) // constraint flags
+    w.bits(s.level, 8)
+    w.ue(s.spsID)
+    if s.profile == 100 {
+        w.ue(1)  // chroma_format_idc 4:2:0
+        w.ue(0)  // bit_depth_luma_minus8
+        w.ue(0)  // bit_depth_chroma_minus8
+        w.bit(0) // qpprime_y_zero_transform_bypass_flag
+        w.bit(0) // seq_scaling_matrix_present_flag
+    }
+    w.ue(0) // log2_max_frame_num_minus4
+    w.ue(s.pocType)
+    if s.pocType == 0 {
+        w.ue(0) // log2_max_pic_order_cnt_lsb_minus4
+    }
+    w.ue(1)  // max_num_ref_frames
+    w.bit(0) // gaps_in_frame_num_value_allowed_flag
+    w.ue(s.widthMbs)
+    w.ue(s.heightUnits)
+    w.bit(s.frameMbsOnly)
+    if s.frameMbsOnly == 0 {
+        w.bit(0) // mb_adaptive_frame_field_flag
+    }
+    w.bit(1) // direct_8x8_inference_flag
+    if s.crop != [4]uint{} {
+        w.bit(1)
+        for _, v := range s.crop {
+            w.ue(v)
+        }
+    } else {
+        w.bit(0)
+    }
+    w.bit(0) // vui_parameters_present_flag
+    w.bit(1) // rbsp_stop_one_bit
+    return w.data
+}
+
+func TestParseH264SPS(t *testing.T) {
+    tests := []struct {
+        name          string
+        sps           []byte
+        width, height int
+        wantErr       bool
+    }{
+        {name: "baseline 1280x720", sps: testSPS{profile: 66, level: 31, widthMbs: 79, heightUnits: 44, frameMbsOnly: 1}.build(), width: 1280, height: 720},
+        {name: "high 1920x1080 with cropping", sps: testSPS{profile: 100, level: 40, widthMbs: 119, heightUnits: 67, frameMbsOnly: 1, crop: [4]uint{0, 0, 0, 4}}.build(), width: 1920, height: 1080},
+        {name: "interlaced 720x576", sps: testSPS{profile: 77, level: 30, widthMbs: 44, heightUnits: 17, pocType: 2}.build(), width: 720, height: 576},
+        {name: "poc type 2 640x360", sps: testSPS{profile: 66, level: 30, widthMbs: 39, heightUnits: 22, frameMbsOnly: 1, pocType: 2, crop: [4]uint{0, 0, 0, 4}}.build(), width: 640, height: 360},
+        {name: "too short", sps: []byte{0x67, 0x42, 0x00}, wantErr: true},
+        {name: "truncated", sps: testSPS{profile: 66, level: 31, widthMbs: 79, heightUnits: 44, frameMbsOnly: 1}.build()[:6], wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            width, height, err := parseH264SPS(tt.sps)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("parseH264SPS() = %dx%d, want error", width, height)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("parseH264SPS() error: %v", err)
+            }
+            if width != tt.width || height != tt.height {
+                t.Errorf("parseH264SPS() = %dx%d, want %dx%d", width, height, tt.width, tt.height)
+            }
+        })
+    }
+}
+
+func TestParseH264SPSEmulationPrevention(t *testing.T) {
+    // Нулевой level_idc и длинный код seq_parameter_set_id дают в RBSP 00 00 00,
+    // поэтому кодер вставляет байт эмуляции 03, который парсер должен удалить
+    sps := testSPS{profile: 66, spsID: 255, widthMbs: 79, heightUnits: 44, frameMbsOnly: 1}.build()
+    var escaped []byte
+    zeros := 0
+    for _, b := range sps {
+        if zeros >= 2 && b <= 3 {
+            escaped = append(escaped, 0x03)
+            zeros = 0
+        }
+        if b == 0 {
+            zeros++
+        } else {
+            zeros = 0
+        }
+        escaped = append(escaped, b)
+    }
+    if len(escaped) == len(sps) {
+        t.Fatalf("test SPS % x has no emulation prevention bytes", sps)
+    }
+    width, height, err := parseH264SPS(escaped)
+    if err != nil || width != 1280 || height != 720 {
+        t.Errorf("parseH264SPS(% x) = %dx%d, %v, want 1280x720", escaped, width, height, err)
+    }
+}
+
+func TestOpusPacketDuration(t *testing.T) {
+    toc := func(config, code byte) byte { return config<<3 | code }
+    tests := []struct {
+        name    string
+        payload []byte
+        want    uint32
+    }{
+        {name: "empty", payload: nil, want: 0},
+        {name: "silk 10ms", payload: []byte{toc(0, 0)}, want: 480},
+        {name: "silk 20ms", payload: []byte{toc(1, 0)}, want: 960},
+        {name: "silk 60ms two frames", payload: []byte{toc(3, 1)}, want: 5760},
+        {name: "hybrid 20ms two frames", payload: []byte{toc(13, 2)}, want: 1920},
+        {name: "celt 2.5ms", payload: []byte{toc(16, 0)}, want: 120},
+        {name: "celt 20ms", payload: []byte{toc(31, 0)}, want: 960},
+        {name: "celt 20ms three frames", payload: []byte{toc(31, 3), 3}, want: 2880},
+        {name: "code 3 without frame count", payload: []byte{toc(31, 3)}, want: 0},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := opusPacketDuration(tt.payload); got != tt.want {
+                t.Errorf("opusPacketDuration(%x) = %d, want %d", tt.payload, got, tt.want)
+            }
+        })
+    }
+}
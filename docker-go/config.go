@@ -0,0 +1,74 @@
+package main
+
+import (
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// envString возвращает значение переменной окружения или значение по умолчанию
+func envString(key, def string) string {
+    if v, ok := os.LookupEnv(key); ok && strings.TrimSpace(v) != "" {
+        return strings.TrimSpace(v)
+    }
+    return def
+}
+
+// envBool разбирает булеву переменную окружения (true/false, 1/0, yes/no)
+func envBool(key string, def bool) bool {
+    v := strings.ToLower(envString(key, ""))
+    switch v {
+    case "":
+        return def
+    case "1", "true", "yes", "on":
+        return true
+    case "0", "false", "no", "off":
+        return false
+    }
+    log.Printf("Invalid boolean value %q for %s, using default %v", v, key, def)
+    return def
+}
+
+// envInt разбирает целочисленную переменную окружения
+func envInt(key string, def int) int {
+    v := envString(key, "")
+    if v == "" {
+        return def
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil {
+        log.Printf("Invalid integer value %q for %s, using default %d", v, key, def)
+        return def
+    }
+    return n
+}
+
+// envDuration разбирает длительность в формате time.ParseDuration (например, "2s", "500ms")
+func envDuration(key string, def time.Duration) time.Duration {
+    v := envString(key, "")
+    if v == "" {
+        return def
+    }
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        log.Printf("Invalid duration value %q for %s, using default %s", v, key, def)
+        return def
+    }
+    return d
+}
+
+// envFloat разбирает дробную переменную окружения
+func envFloat(key string, def float64) float64 {
+    v := envString(key, "")
+    if v == "" {
+        return def
+    }
+    f, err := strconv.ParseFloat(v, 64)
+    if err != nil {
+        log.Printf("Invalid number value %q for %s, using default %g", v, key, def)
+        return def
+    }
+    return f
+}
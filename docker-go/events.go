@@ -0,0 +1,30 @@
+package main
+
+import (
+    "log"
+    "time"
+)
+
+// roomEvent - событие комнаты (motion и т.п.), которое рассылается пирам комнаты
+type roomEvent struct {
+    Type      string                 `json:"type"`
+    Room      string                 `json:"room"`
+    Timestamp time.Time              `json:"timestamp"`
+    Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+var roomEventsTotal = newCounterVec("webrtc_room_events_total", "Room events emitted by the server.", "type")
+
+// emitRoomEvent рассылает событие пирам комнаты и вебхукам и учитывает его в метриках.
+// Не блокирует: получатели берутся из снимка комнаты, отправка только ставит сообщения в очереди.
+func emitRoomEvent(room, eventType string, data map[string]interface{}) {
+    event := roomEvent{Type: eventType, Room: room, Timestamp: time.Now().UTC(), Data: data}
+    roomEventsTotal.inc(eventType)
+    notifyRoomEventWebhooks(eventType, room, data)
+
+    for _, peer := range roomPeers(room) {
+        if err := peer.writeJSON(event); err != nil {
+            log.Printf("Error sending %s event to %s in room %s: %v", eventType, peer.username, room, err)
+        }
+    }
+}
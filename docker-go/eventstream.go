@@ -0,0 +1,231 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/segmentio/kafka-go"
+)
+
+// Поток событий жизненного цикла комнат для внешних систем (аналитика, сайты).
+// События ставятся в буфер без блокировки и отправляются в sink отдельной горутиной пачками;
+// при переполнении буфера (медленный или недоступный брокер) новые события отбрасываются.
+
+// Типы событий жизненного цикла
+const (
+    lifecycleRoomCreated       = "room_created"
+    lifecyclePeerJoined        = "peer_joined"
+    lifecyclePeerLeft          = "peer_left"
+    lifecycleFollowerReplaced  = "follower_replaced"
+    lifecycleLeaderOffline     = "leader_offline"
+    lifecycleNegotiationFailed = "negotiation_failed"
+)
+
+// eventStreamSettings - настройки потока событий, задаются переменными окружения
+type eventStreamSettings struct {
+    Sink          string // none, kafka или memory
+    Brokers       []string
+    Topic         string
+    BufferSize    int
+    BatchSize     int
+    FlushInterval time.Duration
+    WriteTimeout  time.Duration
+}
+
+var eventStreamConfig = eventStreamSettings{
+    Sink:          envString("EVENT_STREAM_SINK", "none"),
+    Brokers:       strings.Split(envString("KAFKA_BROKERS", "my-kafka:9092"), ","),
+    Topic:         envString("KAFKA_TOPIC", "webrtc.room-events"),
+    BufferSize:    envInt("EVENT_STREAM_BUFFER", 1000),
+    BatchSize:     envInt("EVENT_STREAM_BATCH", 100),
+    FlushInterval: envDuration("EVENT_STREAM_FLUSH_INTERVAL", time.Second),
+    WriteTimeout:  envDuration("EVENT_STREAM_WRITE_TIMEOUT", 10*time.Second),
+}
+
+// lifecycleEvent - событие жизненного цикла комнаты
+type lifecycleEvent struct {
+    Type      string                 `json:"type"`
+    Room      string                 `json:"room"`
+    Username  string                 `json:"username,omitempty"`
+    Node      string                 `json:"node"`
+    Timestamp time.Time              `json:"timestamp"`
+    Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// eventSink получает пачки событий. Publish вызывается из одной горутины.
+type eventSink interface {
+    Publish(ctx context.Context, events []lifecycleEvent) error
+    Close() error
+}
+
+// memorySink хранит события в памяти (тесты и отладка)
+type memorySink struct {
+    mu     sync.Mutex
+    events []lifecycleEvent
+}
+
+func (s *memorySink) Publish(_ context.Context, events []lifecycleEvent) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.events = append(s.events, events...)
+    return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+// Events возвращает копию полученных событий
+func (s *memorySink) Events() []lifecycleEvent {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]lifecycleEvent(nil), s.events...)
+}
+
+// kafkaSink пишет события в топик Kafka; ключ сообщения - комната, чтобы события комнаты шли по порядку
+type kafkaSink struct {
+    writer *kafka.Writer
+}
+
+func newKafkaSink(cfg eventStreamSettings) *kafkaSink {
+    return &kafkaSink{writer: &kafka.Writer{
+        Addr:         kafka.TCP(cfg.Brokers...),
+        Topic:        cfg.Topic,
+        Balancer:     &kafka.Hash{},
+        RequiredAcks: kafka.RequireOne,
+        WriteTimeout: cfg.WriteTimeout,
+    }}
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, events []lifecycleEvent) error {
+    messages := make([]kafka.Message, 0, len(events))
+    for _, ev := range events {
+        value, err := json.Marshal(ev)
+        if err != nil {
+            return err
+        }
+        messages = append(messages, kafka.Message{
+            Key:     []byte(ev.Room),
+            Value:   value,
+            Time:    ev.Timestamp,
+            Headers: []kafka.Header{{Key: "type", Value: []byte(ev.Type)}},
+        })
+    }
+    return s.writer.WriteMessages(ctx, messages...)
+}
+
+func (s *kafkaSink) Close() error { return s.writer.Close() }
+
+var lifecycleEventsTotal = newCounterVec("webrtc_lifecycle_events_total",
+    "Room lifecycle events by delivery result (published, dropped or failed).", "type", "result")
+
+// eventStream - буфер событий и горутина доставки в sink
+type eventStream struct {
+    sink      eventSink
+    queue     chan lifecycleEvent
+    batchSize int
+    interval  time.Duration
+    timeout   time.Duration
+}
+
+var lifecycleStream *eventStream
+
+func newEventStream(sink eventSink, cfg eventStreamSettings) *eventStream {
+    if cfg.BufferSize <= 0 {
+        cfg.BufferSize = 1000
+    }
+    if cfg.BatchSize <= 0 {
+        cfg.BatchSize = 100
+    }
+    if cfg.FlushInterval <= 0 {
+        cfg.FlushInterval = time.Second
+    }
+    s := &eventStream{
+        sink:      sink,
+        queue:     make(chan lifecycleEvent, cfg.BufferSize),
+        batchSize: cfg.BatchSize,
+        interval:  cfg.FlushInterval,
+        timeout:   cfg.WriteTimeout,
+    }
+    go s.run()
+    return s
+}
+
+// startEventStream включает поток событий по EVENT_STREAM_SINK
+func startEventStream() {
+    var sink eventSink
+    switch eventStreamConfig.Sink {
+    case "", "none":
+        return
+    case "kafka":
+        sink = newKafkaSink(eventStreamConfig)
+        log.Printf("Lifecycle events: Kafka topic %s at %s", eventStreamConfig.Topic, strings.Join(eventStreamConfig.Brokers, ","))
+    case "memory":
+        sink = &memorySink{}
+        log.Printf("Lifecycle events: in-memory sink")
+    default:
+        log.Printf("Lifecycle events disabled: unknown EVENT_STREAM_SINK %q (expected none, kafka or memory)", eventStreamConfig.Sink)
+        return
+    }
+    lifecycleStream = newEventStream(sink, eventStreamConfig)
+}
+
+// publishLifecycle ставит событие в очередь на отправку и передает его вебхукам;
+// никогда не блокирует вызывающего
+func publishLifecycle(eventType, room, username string, data map[string]interface{}) {
+    notifyLifecycleWebhooks(eventType, room, username, data)
+    if lifecycleStream != nil {
+        lifecycleStream.enqueue(lifecycleEvent{Type: eventType, Room: room, Username: username, Node: nodeID,
+            Timestamp: time.Now().UTC(), Data: data})
+    }
+}
+
+func (s *eventStream) enqueue(ev lifecycleEvent) {
+    select {
+    case s.queue <- ev:
+    default:
+        lifecycleEventsTotal.inc(ev.Type, "dropped")
+        log.Printf("Lifecycle event %s for room %s dropped: buffer is full", ev.Type, ev.Room)
+    }
+}
+
+// run собирает события в пачки и отправляет их, когда пачка заполнена или прошло FlushInterval
+func (s *eventStream) run() {
+    ticker := time.NewTicker(s.interval)
+    defer ticker.Stop()
+    batch := make([]lifecycleEvent, 0, s.batchSize)
+    for {
+        select {
+        case ev := <-s.queue:
+            batch = append(batch, ev)
+            if len(batch) < s.batchSize {
+                continue
+            }
+        case <-ticker.C:
+        }
+        s.flush(batch)
+        batch = batch[:0]
+    }
+}
+
+func (s *eventStream) flush(batch []lifecycleEvent) {
+    if len(batch) == 0 {
+        return
+    }
+    ctx := context.Background()
+    if s.timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, s.timeout)
+        defer cancel()
+    }
+    result := "published"
+    if err := s.sink.Publish(ctx, batch); err != nil {
+        result = "failed"
+        log.Printf("Failed to publish %d lifecycle events: %v", len(batch), err)
+    }
+    for _, ev := range batch {
+        lifecycleEventsTotal.inc(ev.Type, result)
+    }
+}
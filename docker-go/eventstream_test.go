@@ -0,0 +1,49 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestEventStreamPublishesToSink(t *testing.T) {
+    tests := []struct {
+        name      string
+        batchSize int
+        events    int
+    }{
+        {name: "full batches", batchSize: 2, events: 4},
+        {name: "partial batch is flushed by interval", batchSize: 10, events: 3},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            sink := &memorySink{}
+            saved := lifecycleStream
+            lifecycleStream = newEventStream(sink, eventStreamSettings{BatchSize: tt.batchSize, FlushInterval: 20 * time.Millisecond})
+            defer func() { lifecycleStream = saved }()
+
+            for i := 0; i < tt.events; i++ {
+                publishLifecycle(lifecycleRoomCreated, "room-1", "alice", map[string]interface{}{"seq": i})
+            }
+            deadline := time.Now().Add(2 * time.Second)
+            for len(sink.Events()) < tt.events && time.Now().Before(deadline) {
+                time.Sleep(5 * time.Millisecond)
+            }
+
+            events := sink.Events()
+            if len(events) != tt.events {
+                t.Fatalf("sink received %d events, want %d", len(events), tt.events)
+            }
+            for i, ev := range events {
+                if ev.Type != lifecycleRoomCreated || ev.Room != "room-1" || ev.Username != "alice" || ev.Node != nodeID {
+                    t.Errorf("event %d = %+v", i, ev)
+                }
+                if ev.Data["seq"] != i {
+                    t.Errorf("event %d has seq %v, events are out of order", i, ev.Data["seq"])
+                }
+                if ev.Timestamp.IsZero() {
+                    t.Errorf("event %d has no timestamp", i)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+    "encoding/binary"
+    "sort"
+)
+
+// Минимальный писатель fragmented MP4 (ISO/IEC 14496-12) для HLS:
+// init-сегмент с H.264 и Opus и фрагменты moof+mdat.
+
+const (
+    fmp4VideoTrackID   = 1
+    fmp4AudioTrackID   = 2
+    fmp4VideoTimescale = 90000
+    fmp4AudioTimescale = 48000
+)
+
+// fmp4Sample - один кадр видео или Opus-пакет
+type fmp4Sample struct {
+    data     []byte
+    duration uint32
+    keyframe bool
+}
+
+// fmp4Track описывает дорожку init-сегмента
+type fmp4Track struct {
+    id        uint32
+    timescale uint32
+    // Видео
+    sps, pps      []byte
+    width, height int
+    // Аудио
+    channels uint16
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+    size := 8
+    for _, p := range payload {
+        size += len(p)
+    }
+    b := make([]byte, 8, size)
+    binary.BigEndian.PutUint32(b, uint32(size))
+    copy(b[4:], typ)
+    for _, p := range payload {
+        b = append(b, p...)
+    }
+    return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+    header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+    return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+func be16(v uint16) []byte {
+    b := make([]byte, 2)
+    binary.BigEndian.PutUint16(b, v)
+    return b
+}
+
+func be32(v uint32) []byte {
+    b := make([]byte, 4)
+    binary.BigEndian.PutUint32(b, v)
+    return b
+}
+
+func be64(v uint64) []byte {
+    b := make([]byte, 8)
+    binary.BigEndian.PutUint64(b, v)
+    return b
+}
+
+// mp4Matrix - единичная матрица преобразования для mvhd/tkhd
+var mp4Matrix = []byte{
+    0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+    0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+    0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+// buildFMP4Init собирает init-сегмент (ftyp + moov) для переданных дорожек
+func buildFMP4Init(video, audio *fmp4Track) []byte {
+    ftyp := mp4Box("ftyp", []byte("iso5"), be32(512), []byte("iso5iso6mp41"))
+
+    mvhd := mp4FullBox("mvhd", 0, 0,
+        be32(0), be32(0), be32(1000), be32(0), // creation, modification, timescale, duration
+        be32(0x00010000), be16(0x0100), make([]byte, 10), // rate, volume, reserved
+        mp4Matrix, make([]byte, 24), be32(fmp4AudioTrackID+1))
+
+    moovPayload := [][]byte{mvhd}
+    var trex [][]byte
+    if video != nil {
+        moovPayload = append(moovPayload, buildFMP4VideoTrak(video))
+        trex = append(trex, buildFMP4Trex(video.id))
+    }
+    if audio != nil {
+        moovPayload = append(moovPayload, buildFMP4AudioTrak(audio))
+        trex = append(trex, buildFMP4Trex(audio.id))
+    }
+    moovPayload = append(moovPayload, mp4Box("mvex", trex...))
+    return append(ftyp, mp4Box("moov", moovPayload...)...)
+}
+
+func buildFMP4Trex(trackID uint32) []byte {
+    return mp4FullBox("trex", 0, 0, be32(trackID), be32(1), be32(0), be32(0), be32(0))
+}
+
+func buildFMP4Tkhd(trackID uint32, volume uint16, width, height int) []byte {
+    return mp4FullBox("tkhd", 0, 3,
+        be32(0), be32(0), be32(trackID), be32(0), be32(0), // creation, modification, id, reserved, duration
+        make([]byte, 8), be16(0), be16(0), be16(volume), be16(0), // reserved, layer, group, volume, reserved
+        mp4Matrix, be32(uint32(width)<<16), be32(uint32(height)<<16))
+}
+
+func buildFMP4Mdhd(timescale uint32) []byte {
+    return mp4FullBox("mdhd", 0, 0, be32(0), be32(0), be32(timescale), be32(0), be16(0x55C4), be16(0))
+}
+
+func buildFMP4Hdlr(handler, name string) []byte {
+    return mp4FullBox("hdlr", 0, 0, be32(0), []byte(handler), make([]byte, 12), append([]byte(name), 0))
+}
+
+func buildFMP4Stbl(stsdEntry []byte) []byte {
+    return mp4Box("stbl",
+        mp4FullBox("stsd", 0, 0, be32(1), stsdEntry),
+        mp4FullBox("stts", 0, 0, be32(0)),
+        mp4FullBox("stsc", 0, 0, be32(0)),
+        mp4FullBox("stsz", 0, 0, be32(0), be32(0)),
+        mp4FullBox("stco", 0, 0, be32(0)))
+}
+
+func buildFMP4Dinf() []byte {
+    return mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+}
+
+func buildFMP4VideoTrak(t *fmp4Track) []byte {
+    avcC := mp4Box("avcC",
+        []byte{1, t.sps[1], t.sps[2], t.sps[3], 0xFF, 0xE1},
+        be16(uint16(len(t.sps))), t.sps,
+        []byte{1}, be16(uint16(len(t.pps))), t.pps)
+    compressor := make([]byte, 32)
+    avc1 := mp4Box("avc1",
+        make([]byte, 6), be16(1), // reserved, data_reference_index
+        make([]byte, 16), be16(uint16(t.width)), be16(uint16(t.height)),
+        be32(0x00480000), be32(0x00480000), be32(0), be16(1), // resolution, reserved, frame_count
+        compressor, be16(0x0018), be16(0xFFFF), avcC)
+    minf := mp4Box("minf",
+        mp4FullBox("vmhd", 0, 1, make([]byte, 8)),
+        buildFMP4Dinf(),
+        buildFMP4Stbl(avc1))
+    return mp4Box("trak",
+        buildFMP4Tkhd(t.id, 0, t.width, t.height),
+        mp4Box("mdia", buildFMP4Mdhd(t.timescale), buildFMP4Hdlr("vide", "VideoHandler"), minf))
+}
+
+func buildFMP4AudioTrak(t *fmp4Track) []byte {
+    dOps := mp4Box("dOps",
+        []byte{0, byte(t.channels)}, be16(312), be32(fmp4AudioTimescale), be16(0), []byte{0})
+    opus := mp4Box("Opus",
+        make([]byte, 6), be16(1), // reserved, data_reference_index
+        make([]byte, 8), be16(t.channels), be16(16), be16(0), be16(0),
+        be32(fmp4AudioTimescale<<16), dOps)
+    minf := mp4Box("minf",
+        mp4FullBox("smhd", 0, 0, make([]byte, 4)),
+        buildFMP4Dinf(),
+        buildFMP4Stbl(opus))
+    return mp4Box("trak",
+        buildFMP4Tkhd(t.id, 0x0100, 0, 0),
+        mp4Box("mdia", buildFMP4Mdhd(t.timescale), buildFMP4Hdlr("soun", "SoundHandler"), minf))
+}
+
+// fmp4TrackRun - сэмплы одной дорожки внутри фрагмента
+type fmp4TrackRun struct {
+    trackID      uint32
+    baseDecodeTS uint64
+    samples      []fmp4Sample
+}
+
+// buildFMP4Fragment собирает фрагмент moof+mdat; пустые дорожки пропускаются
+func buildFMP4Fragment(sequence uint32, runs []fmp4TrackRun) []byte {
+    var trafs [][]byte
+    var offsetPositions []int // позиции поля data_offset внутри moof
+    var mdat [][]byte
+    var dataOffsets []uint32
+    var mdatSize uint32
+
+    // Размер moof до traf: заголовок moof (8) + mfhd (16)
+    moofSize := 8 + 16
+    for _, run := range runs {
+        if len(run.samples) == 0 {
+            continue
+        }
+        entries := make([]byte, 0, len(run.samples)*12)
+        for _, s := range run.samples {
+            flags := uint32(0x01010000) // sample_depends_on=1, non-sync
+            if s.keyframe {
+                flags = 0x02000000
+            }
+            entries = append(entries, be32(s.duration)...)
+            entries = append(entries, be32(uint32(len(s.data)))...)
+            entries = append(entries, be32(flags)...)
+            mdat = append(mdat, s.data)
+        }
+        dataOffsets = append(dataOffsets, mdatSize)
+        for _, s := range run.samples {
+            mdatSize += uint32(len(s.data))
+        }
+        tfhd := mp4FullBox("tfhd", 0, 0x020000, be32(run.trackID))
+        tfdt := mp4FullBox("tfdt", 1, 0, be64(run.baseDecodeTS))
+        trun := mp4FullBox("trun", 0, 0x000701, be32(uint32(len(run.samples))), be32(0), entries)
+        traf := mp4Box("traf", tfhd, tfdt, trun)
+        // data_offset: заголовок traf (8) + tfhd + tfdt + заголовок trun (8+4) + sample_count (4)
+        offsetPositions = append(offsetPositions, moofSize+8+len(tfhd)+len(tfdt)+16)
+        moofSize += len(traf)
+        trafs = append(trafs, traf)
+    }
+    if len(trafs) == 0 {
+        return nil
+    }
+
+    mfhd := mp4FullBox("mfhd", 0, 0, be32(sequence))
+    moof := mp4Box("moof", append([][]byte{mfhd}, trafs...)...)
+    for i, pos := range offsetPositions {
+        binary.BigEndian.PutUint32(moof[pos:], uint32(len(moof))+8+dataOffsets[i])
+    }
+    return append(moof, mp4Box("mdat", mdat...)...)
+}
+
+// fmp4RandomAccess - точка произвольного доступа дорожки для tfra: первый ключевой сэмпл фрагмента
+type fmp4RandomAccess struct {
+    time         uint64 // время декодирования в единицах timescale дорожки
+    moofOffset   uint64 // смещение moof от начала файла
+    trafNumber   uint32 // номера traf, trun и сэмпла начинаются с 1
+    trunNumber   uint32
+    sampleNumber uint32
+}
+
+// scanFMP4RandomAccess находит во фрагментах moof+mdat первый ключевой сэмпл каждой дорожки;
+// base - смещение data от начала файла. Разбирает только то, что пишет buildFMP4Fragment
+func scanFMP4RandomAccess(data []byte, base uint64) map[uint32]fmp4RandomAccess {
+    points := make(map[uint32]fmp4RandomAccess)
+    for pos := 0; pos+8 <= len(data); {
+        size := int(binary.BigEndian.Uint32(data[pos:]))
+        if size < 8 || pos+size > len(data) {
+            break
+        }
+        if string(data[pos+4:pos+8]) == "moof" {
+            trafNumber := uint32(0)
+            forEachMP4Box(data[pos+8:pos+size], func(typ string, traf []byte) {
+                if typ != "traf" {
+                    return
+                }
+                trafNumber++
+                if trackID, point, ok := scanFMP4Traf(traf); ok {
+                    if _, seen := points[trackID]; !seen {
+                        point.moofOffset = base + uint64(pos)
+                        point.trafNumber = trafNumber
+                        points[trackID] = point
+                    }
+                }
+            })
+        }
+        pos += size
+    }
+    return points
+}
+
+// scanFMP4Traf возвращает дорожку traf и её первый ключевой сэмпл
+func scanFMP4Traf(traf []byte) (trackID uint32, point fmp4RandomAccess, found bool) {
+    var baseTime uint64
+    trunNumber := uint32(0)
+    forEachMP4Box(traf, func(typ string, box []byte) {
+        if found || len(box) < 8 {
+            return
+        }
+        flags := binary.BigEndian.Uint32(box) & 0xFFFFFF
+        switch typ {
+        case "tfhd":
+            trackID = binary.BigEndian.Uint32(box[4:])
+        case "tfdt":
+            if box[0] == 1 && len(box) >= 12 {
+                baseTime = binary.BigEndian.Uint64(box[4:])
+            } else {
+                baseTime = uint64(binary.BigEndian.Uint32(box[4:]))
+            }
+        case "trun":
+            trunNumber++
+            count := binary.BigEndian.Uint32(box[4:])
+            pos := 8
+            if flags&0x000001 != 0 { // data_offset
+                pos += 4
+            }
+            firstFlags, hasFirstFlags := uint32(0), flags&0x000004 != 0
+            if hasFirstFlags && pos+4 <= len(box) {
+                firstFlags = binary.BigEndian.Uint32(box[pos:])
+                pos += 4
+            }
+            decodeTS := baseTime
+            for i := uint32(0); i < count; i++ {
+                var duration, sampleFlags uint32
+                if flags&0x000100 != 0 {
+                    if pos+4 > len(box) {
+                        return
+                    }
+                    duration = binary.BigEndian.Uint32(box[pos:])
+                    pos += 4
+                }
+                if flags&0x000200 != 0 {
+                    pos += 4
+                }
+                if flags&0x000400 != 0 {
+                    if pos+4 > len(box) {
+                        return
+                    }
+                    sampleFlags = binary.BigEndian.Uint32(box[pos:])
+                    pos += 4
+                } else if i == 0 && hasFirstFlags {
+                    sampleFlags = firstFlags
+                }
+                if flags&0x000800 != 0 {
+                    pos += 4
+                }
+                // sample_is_non_sync_sample; без флагов сэмпл считается ключевым (аудио)
+                if sampleFlags&0x00010000 == 0 {
+                    point = fmp4RandomAccess{time: decodeTS, trunNumber: trunNumber, sampleNumber: i + 1}
+                    found = true
+                    return
+                }
+                decodeTS += uint64(duration)
+            }
+            baseTime = decodeTS
+        }
+    })
+    return trackID, point, found
+}
+
+// forEachMP4Box вызывает fn для каждого бокса верхнего уровня в data
+func forEachMP4Box(data []byte, fn func(typ string, payload []byte)) {
+    for pos := 0; pos+8 <= len(data); {
+        size := int(binary.BigEndian.Uint32(data[pos:]))
+        if size < 8 || pos+size > len(data) {
+            return
+        }
+        fn(string(data[pos+4:pos+8]), data[pos+8:pos+size])
+        pos += size
+    }
+}
+
+// buildFMP4Mfra собирает mfra (tfra по каждой дорожке + mfro) для перемотки без чтения всех moof
+func buildFMP4Mfra(points map[uint32][]fmp4RandomAccess) []byte {
+    trackIDs := make([]uint32, 0, len(points))
+    for id := range points {
+        trackIDs = append(trackIDs, id)
+    }
+    sort.Slice(trackIDs, func(i, j int) bool { return trackIDs[i] < trackIDs[j] })
+
+    var boxes [][]byte
+    for _, id := range trackIDs {
+        entries := make([]byte, 0, len(points[id])*28)
+        for _, p := range points[id] {
+            entries = append(entries, be64(p.time)...)
+            entries = append(entries, be64(p.moofOffset)...)
+            entries = append(entries, be32(p.trafNumber)...)
+            entries = append(entries, be32(p.trunNumber)...)
+            entries = append(entries, be32(p.sampleNumber)...)
+        }
+        // length_size_of_traf_num/trun_num/sample_num = 3: номера по 4 байта
+        boxes = append(boxes, mp4FullBox("tfra", 1, 0, be32(id), be32(0x3F), be32(uint32(len(points[id]))), entries))
+    }
+    size := 8 + 16 // заголовок mfra + mfro
+    for _, b := range boxes {
+        size += len(b)
+    }
+    boxes = append(boxes, mp4FullBox("mfro", 0, 0, be32(uint32(size))))
+    return mp4Box("mfra", boxes...)
+}
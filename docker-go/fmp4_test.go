@@ -0,0 +1,186 @@
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+)
+
+// testMP4Box - разобранный бокс: тип, содержимое без заголовка и смещение начала бокса в файле
+type testMP4Box struct {
+    typ     string
+    payload []byte
+    offset  int
+}
+
+func parseTestMP4Boxes(t *testing.T, data []byte, base int) []testMP4Box {
+    t.Helper()
+    var boxes []testMP4Box
+    for pos := 0; pos < len(data); {
+        if len(data)-pos < 8 {
+            t.Fatalf("truncated box header at %d", base+pos)
+        }
+        size := int(binary.BigEndian.Uint32(data[pos:]))
+        if size < 8 || pos+size > len(data) {
+            t.Fatalf("invalid box size %d at %d", size, base+pos)
+        }
+        boxes = append(boxes, testMP4Box{typ: string(data[pos+4 : pos+8]), payload: data[pos+8 : pos+size], offset: base + pos})
+        pos += size
+    }
+    return boxes
+}
+
+func TestBuildFMP4Fragment(t *testing.T) {
+    video := []fmp4Sample{
+        {data: []byte{1, 2, 3, 4}, duration: 3000, keyframe: true},
+        {data: []byte{5, 6}, duration: 3000},
+    }
+    audio := []fmp4Sample{{data: []byte{7, 8, 9}, duration: 960, keyframe: true}}
+    tests := []struct {
+        name     string
+        sequence uint32
+        runs     []fmp4TrackRun
+    }{
+        {name: "no samples", sequence: 1, runs: []fmp4TrackRun{{trackID: 1}}},
+        {name: "video", sequence: 2, runs: []fmp4TrackRun{{trackID: 1, baseDecodeTS: 90000, samples: video}}},
+        {name: "video and audio", sequence: 3, runs: []fmp4TrackRun{
+            {trackID: 1, baseDecodeTS: 180000, samples: video},
+            {trackID: 2, baseDecodeTS: 48000, samples: audio},
+        }},
+        {name: "empty run is skipped", sequence: 4, runs: []fmp4TrackRun{
+            {trackID: 1, baseDecodeTS: 270000},
+            {trackID: 2, baseDecodeTS: 96000, samples: audio},
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            fragment := buildFMP4Fragment(tt.sequence, tt.runs)
+            var runs []fmp4TrackRun
+            for _, run := range tt.runs {
+                if len(run.samples) > 0 {
+                    runs = append(runs, run)
+                }
+            }
+            if len(runs) == 0 {
+                if fragment != nil {
+                    t.Fatalf("buildFMP4Fragment() = %d bytes, want nil", len(fragment))
+                }
+                return
+            }
+
+            top := parseTestMP4Boxes(t, fragment, 0)
+            if len(top) != 2 || top[0].typ != "moof" || top[1].typ != "mdat" {
+                t.Fatalf("top-level boxes = %v, want moof, mdat", top)
+            }
+            moof := parseTestMP4Boxes(t, top[0].payload, top[0].offset+8)
+            if len(moof) != 1+len(runs) || moof[0].typ != "mfhd" {
+                t.Fatalf("moof has %d boxes, want mfhd and %d traf", len(moof), len(runs))
+            }
+            if seq := binary.BigEndian.Uint32(moof[0].payload[4:]); seq != tt.sequence {
+                t.Errorf("mfhd sequence = %d, want %d", seq, tt.sequence)
+            }
+
+            for i, run := range runs {
+                traf := parseTestMP4Boxes(t, moof[1+i].payload, moof[1+i].offset+8)
+                if len(traf) != 3 || traf[0].typ != "tfhd" || traf[1].typ != "tfdt" || traf[2].typ != "trun" {
+                    t.Fatalf("traf %d boxes = %v, want tfhd, tfdt, trun", i, traf)
+                }
+                if id := binary.BigEndian.Uint32(traf[0].payload[4:]); id != run.trackID {
+                    t.Errorf("tfhd track = %d, want %d", id, run.trackID)
+                }
+                if ts := binary.BigEndian.Uint64(traf[1].payload[4:]); ts != run.baseDecodeTS {
+                    t.Errorf("tfdt base = %d, want %d", ts, run.baseDecodeTS)
+                }
+                trun := traf[2].payload
+                if count := binary.BigEndian.Uint32(trun[4:]); int(count) != len(run.samples) {
+                    t.Fatalf("trun sample count = %d, want %d", count, len(run.samples))
+                }
+                // data_offset отсчитывается от начала moof и должен указывать на данные сэмплов в mdat
+                offset := int(binary.BigEndian.Uint32(trun[8:])) + top[0].offset
+                var want []byte
+                for j, s := range run.samples {
+                    entry := trun[12+j*12:]
+                    duration := binary.BigEndian.Uint32(entry)
+                    size := binary.BigEndian.Uint32(entry[4:])
+                    flags := binary.BigEndian.Uint32(entry[8:])
+                    if duration != s.duration || int(size) != len(s.data) {
+                        t.Errorf("sample %d: duration %d, size %d, want %d, %d", j, duration, size, s.duration, len(s.data))
+                    }
+                    if keyframe := flags == 0x02000000; keyframe != s.keyframe {
+                        t.Errorf("sample %d: flags %08x, keyframe %v", j, flags, s.keyframe)
+                    }
+                    want = append(want, s.data...)
+                }
+                if offset+len(want) > len(fragment) || !bytes.Equal(fragment[offset:offset+len(want)], want) {
+                    t.Errorf("data_offset of track %d does not point to its samples", run.trackID)
+                }
+            }
+        })
+    }
+}
+
+func TestFMP4MfraIndexesKeyframes(t *testing.T) {
+    first := buildFMP4Fragment(1, []fmp4TrackRun{
+        {trackID: fmp4VideoTrackID, baseDecodeTS: 0, samples: []fmp4Sample{
+            {data: []byte{1}, duration: 3000, keyframe: true},
+            {data: []byte{2}, duration: 3000},
+        }},
+        {trackID: fmp4AudioTrackID, baseDecodeTS: 0, samples: []fmp4Sample{{data: []byte{3}, duration: 960, keyframe: true}}},
+    })
+    // Во втором фрагменте ключевой кадр видео - второй сэмпл
+    second := buildFMP4Fragment(2, []fmp4TrackRun{
+        {trackID: fmp4VideoTrackID, baseDecodeTS: 6000, samples: []fmp4Sample{
+            {data: []byte{4}, duration: 3000},
+            {data: []byte{5}, duration: 3000, keyframe: true},
+        }},
+    })
+    const initSize = 100
+    points := make(map[uint32][]fmp4RandomAccess)
+    for _, f := range []struct {
+        data   []byte
+        offset uint64
+    }{{first, initSize}, {second, initSize + uint64(len(first))}} {
+        for id, p := range scanFMP4RandomAccess(f.data, f.offset) {
+            points[id] = append(points[id], p)
+        }
+    }
+    want := map[uint32][]fmp4RandomAccess{
+        fmp4VideoTrackID: {
+            {time: 0, moofOffset: initSize, trafNumber: 1, trunNumber: 1, sampleNumber: 1},
+            {time: 9000, moofOffset: initSize + uint64(len(first)), trafNumber: 1, trunNumber: 1, sampleNumber: 2},
+        },
+        fmp4AudioTrackID: {{time: 0, moofOffset: initSize, trafNumber: 2, trunNumber: 1, sampleNumber: 1}},
+    }
+    for id, w := range want {
+        if len(points[id]) != len(w) {
+            t.Fatalf("track %d points = %+v, want %+v", id, points[id], w)
+        }
+        for i := range w {
+            if points[id][i] != w[i] {
+                t.Errorf("track %d point %d = %+v, want %+v", id, i, points[id][i], w[i])
+            }
+        }
+    }
+
+    mfra := buildFMP4Mfra(points)
+    top := parseTestMP4Boxes(t, mfra, 0)
+    if len(top) != 1 || top[0].typ != "mfra" {
+        t.Fatalf("top-level boxes = %v, want mfra", top)
+    }
+    children := parseTestMP4Boxes(t, top[0].payload, 8)
+    if len(children) != 3 || children[0].typ != "tfra" || children[1].typ != "tfra" || children[2].typ != "mfro" {
+        t.Fatalf("mfra boxes = %v, want tfra, tfra, mfro", children)
+    }
+    // mfro хранит размер mfra: плеер находит его по последним байтам файла
+    if size := binary.BigEndian.Uint32(children[2].payload[4:]); int(size) != len(mfra) {
+        t.Errorf("mfro size = %d, want %d", size, len(mfra))
+    }
+    video := children[0].payload
+    if id, count := binary.BigEndian.Uint32(video[4:]), binary.BigEndian.Uint32(video[12:]); id != fmp4VideoTrackID || count != 2 {
+        t.Fatalf("video tfra track %d with %d entries", id, count)
+    }
+    entry := video[16+28:]
+    if ts, moof := binary.BigEndian.Uint64(entry), binary.BigEndian.Uint64(entry[8:]); ts != 9000 || moof != initSize+uint64(len(first)) {
+        t.Errorf("second video entry time %d, moof %d", ts, moof)
+    }
+}
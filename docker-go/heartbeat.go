@@ -0,0 +1,70 @@
+package main
+
+import (
+    "errors"
+    "log"
+    "net"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Контроль живости WebSocket: сервер периодически шлет ping (через горутину записи peerWriter),
+// а каждый pong (и любое сообщение клиента) продлевает срок чтения. Если за PongTimeout от клиента ничего не пришло, ReadMessage
+// в handleWebSocket завершается ошибкой таймаута и пир удаляется обычной очисткой.
+// Браузеры отвечают на ping автоматически, менять клиентов не нужно.
+
+// heartbeatSettings - настройки контроля живости, задаются переменными окружения
+type heartbeatSettings struct {
+    PingInterval time.Duration
+    PongTimeout  time.Duration // должен быть больше PingInterval
+    WriteTimeout time.Duration
+}
+
+var heartbeatConfig = loadHeartbeatSettings()
+
+func loadHeartbeatSettings() heartbeatSettings {
+    cfg := heartbeatSettings{
+        PingInterval: envDuration("WS_PING_INTERVAL", 10*time.Second),
+        PongTimeout:  envDuration("WS_PONG_TIMEOUT", 25*time.Second),
+        WriteTimeout: envDuration("WS_WRITE_TIMEOUT", 5*time.Second),
+    }
+    if cfg.PingInterval <= 0 {
+        cfg.PingInterval = 10 * time.Second
+    }
+    if cfg.PongTimeout <= cfg.PingInterval {
+        log.Printf("WS_PONG_TIMEOUT %s must exceed WS_PING_INTERVAL %s, using %s", cfg.PongTimeout, cfg.PingInterval, 2*cfg.PingInterval+cfg.PingInterval/2)
+        cfg.PongTimeout = 2*cfg.PingInterval + cfg.PingInterval/2
+    }
+    if cfg.WriteTimeout <= 0 {
+        cfg.WriteTimeout = 5 * time.Second
+    }
+    return cfg
+}
+
+var heartbeatTimeoutsTotal = newCounterVec("webrtc_ws_heartbeat_timeouts_total",
+    "WebSocket connections closed because the client stopped answering pings.", "role")
+
+// startHeartbeat устанавливает срок чтения и обработчик pong; ping отправляет peerWriter соединения
+func startHeartbeat(conn *websocket.Conn) {
+    _ = conn.SetReadDeadline(time.Now().Add(heartbeatConfig.PongTimeout))
+    conn.SetPongHandler(func(string) error {
+        return conn.SetReadDeadline(time.Now().Add(heartbeatConfig.PongTimeout))
+    })
+}
+
+// extendReadDeadline продлевает срок чтения после сообщения клиента
+func extendReadDeadline(conn *websocket.Conn) {
+    _ = conn.SetReadDeadline(time.Now().Add(heartbeatConfig.PongTimeout))
+}
+
+// isHeartbeatTimeout сообщает, что чтение завершилось из-за пропущенных pong
+func isHeartbeatTimeout(err error) bool {
+    var netErr net.Error
+    return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isClosedConnError сообщает, что соединение уже закрыто этой стороной
+func isClosedConnError(err error) bool {
+    return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+// hlsSettings - настройки HLS-выдачи, задаются переменными окружения
+type hlsSettings struct {
+    Enabled         bool
+    LowLatency      bool
+    SegmentDuration time.Duration
+    PartDuration    time.Duration
+    PlaylistSize    int
+}
+
+var hlsConfig = hlsSettings{
+    Enabled:         envBool("HLS_ENABLED", true),
+    LowLatency:      envBool("HLS_LOW_LATENCY", false),
+    SegmentDuration: envDuration("HLS_SEGMENT_DURATION", 2*time.Second),
+    PartDuration:    envDuration("HLS_PART_DURATION", 500*time.Millisecond),
+    PlaylistSize:    envInt("HLS_PLAYLIST_SIZE", 6),
+}
+
+// hlsPart - часть сегмента LL-HLS (один фрагмент moof+mdat)
+type hlsPart struct {
+    data        []byte
+    duration    float64
+    independent bool
+}
+
+// hlsSegment - сегмент плейлиста; завершенный сегмент - это склейка его частей
+type hlsSegment struct {
+    msn      uint64
+    parts    []*hlsPart
+    duration float64
+    data     []byte
+}
+
+// hlsSession упаковывает H.264/Opus ведущего в fMP4-сегменты со скользящим плейлистом
+type hlsSession struct {
+    room string
+
+    mu     sync.Mutex
+    cond   *sync.Cond
+    closed bool
+    stop   chan struct{}
+
+    hasAudio      bool
+    audioChannels uint16
+    audioInInit   bool
+    warnedCodec   bool
+
+    assembler h264FrameAssembler
+    sps, pps  []byte
+    init      []byte
+    started   time.Time
+
+    pending     *h264AccessUnit
+    videoDTS    uint64
+    audioDTS    uint64
+    audioActive bool
+    fragmentSeq uint32
+
+    partVideo         []fmp4Sample
+    partVideoStartDTS uint64
+    partVideoDuration uint64
+    partAudio         []fmp4Sample
+    partAudioStartDTS uint64
+
+    segments []*hlsSegment
+    cur      *hlsSegment
+
+    viewers map[string]time.Time
+
+    // Параметры потока для записей и получатели завершенных сегментов
+    info      hlsStreamInfo
+    listeners []hlsSegmentListener
+}
+
+// hlsStreamInfo - кодеки и размер кадра упакованного потока
+type hlsStreamInfo struct {
+    VideoCodec string `json:"videoCodec"`
+    AudioCodec string `json:"audioCodec,omitempty"`
+    Width      int    `json:"width"`
+    Height     int    `json:"height"`
+}
+
+// hlsSegmentListener получает завершенные сегменты сессии (запись комнаты).
+// Методы вызываются под блокировкой сессии и не должны блокироваться.
+type hlsSegmentListener interface {
+    hlsSegment(init []byte, info hlsStreamInfo, data []byte, duration float64)
+    hlsClosed()
+}
+
+// addListener подписывает получателя на завершенные сегменты
+func (s *hlsSession) addListener(l hlsSegmentListener) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.listeners = append(s.listeners, l)
+}
+
+func newHLSSession(room string) *hlsSession {
+    s := &hlsSession{
+        room:    room,
+        stop:    make(chan struct{}),
+        cur:     &hlsSegment{},
+        viewers: make(map[string]time.Time),
+    }
+    s.cond = sync.NewCond(&s.mu)
+    go s.viewerJanitor()
+    log.Printf("HLS session created for room %s (low latency: %v)", room, hlsConfig.LowLatency)
+    return s
+}
+
+func (s *hlsSession) AddTrack(t *ingestTrack) {
+    if t.kind != webrtc.RTPCodecTypeAudio {
+        return
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.hasAudio = true
+    s.audioChannels = t.codec.Channels
+    if s.audioChannels == 0 {
+        s.audioChannels = 2
+    }
+}
+
+func (s *hlsSession) WriteRTP(t *ingestTrack, pkt *rtp.Packet) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return
+    }
+    switch {
+    case strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeH264):
+        for _, au := range s.assembler.push(pkt) {
+            s.handleAccessUnit(au)
+        }
+    case strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeOpus):
+        s.handleOpus(pkt)
+    default:
+        if !s.warnedCodec {
+            s.warnedCodec = true
+            log.Printf("HLS for room %s: codec %s is not supported, only H264 and Opus are packaged", s.room, t.codec.MimeType)
+        }
+    }
+}
+
+func (s *hlsSession) Close() {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return
+    }
+    if s.init != nil && len(s.listeners) > 0 {
+        // Последний неполный сегмент нужен записи
+        s.closeSegment()
+    }
+    s.closed = true
+    close(s.stop)
+    s.cond.Broadcast()
+    listeners := s.listeners
+    s.listeners = nil
+    s.mu.Unlock()
+    for _, l := range listeners {
+        l.hlsClosed()
+    }
+    log.Printf("HLS session closed for room %s", s.room)
+    go sendRoomInfo(s.room)
+}
+
+// handleAccessUnit добавляет кадр в текущую часть, закрывая части и сегменты на границах
+func (s *hlsSession) handleAccessUnit(au *h264AccessUnit) {
+    for _, nalu := range au.nalus {
+        switch nalu[0] & 0x1F {
+        case h264NaluSPS:
+            s.sps = append([]byte(nil), nalu...)
+        case h264NaluPPS:
+            s.pps = append([]byte(nil), nalu...)
+        }
+    }
+
+    if s.init == nil {
+        if !au.keyframe || s.sps == nil || s.pps == nil {
+            return
+        }
+        width, height, err := parseH264SPS(s.sps)
+        if err != nil {
+            log.Printf("HLS for room %s: failed to parse SPS: %v", s.room, err)
+            return
+        }
+        video := &fmp4Track{id: fmp4VideoTrackID, timescale: fmp4VideoTimescale, sps: s.sps, pps: s.pps, width: width, height: height}
+        var audio *fmp4Track
+        if s.hasAudio {
+            audio = &fmp4Track{id: fmp4AudioTrackID, timescale: fmp4AudioTimescale, channels: s.audioChannels}
+            s.audioInInit = true
+        }
+        s.init = buildFMP4Init(video, audio)
+        s.started = time.Now()
+        s.info = hlsStreamInfo{VideoCodec: h264CodecString(s.sps), Width: width, Height: height}
+        if s.audioInInit {
+            s.info.AudioCodec = "opus"
+        }
+        log.Printf("HLS for room %s: init segment ready (%dx%d, audio: %v)", s.room, width, height, s.audioInInit)
+    }
+
+    if s.pending != nil {
+        duration := au.timestamp - s.pending.timestamp
+        if duration == 0 || duration > 5*fmp4VideoTimescale {
+            duration = fmp4VideoTimescale / 30
+        }
+        s.appendVideo(s.pending, duration)
+    }
+    s.pending = au
+}
+
+func (s *hlsSession) appendVideo(au *h264AccessUnit, duration uint32) {
+    segmentDuration := s.cur.duration + float64(s.partVideoDuration)/fmp4VideoTimescale
+    if au.keyframe && len(s.partVideo)+len(s.cur.parts) > 0 && segmentDuration >= hlsConfig.SegmentDuration.Seconds() {
+        s.closeSegment()
+    } else if hlsConfig.LowLatency && len(s.partVideo) > 0 &&
+        float64(s.partVideoDuration+uint64(duration))/fmp4VideoTimescale > hlsConfig.PartDuration.Seconds() {
+        s.closePart()
+    }
+
+    var data []byte
+    for _, nalu := range au.nalus {
+        if nalu[0]&0x1F == h264NaluAUD {
+            continue
+        }
+        data = append(data, be32(uint32(len(nalu)))...)
+        data = append(data, nalu...)
+    }
+    if len(s.partVideo) == 0 {
+        s.partVideoStartDTS = s.videoDTS
+    }
+    s.partVideo = append(s.partVideo, fmp4Sample{data: data, duration: duration, keyframe: au.keyframe})
+    s.partVideoDuration += uint64(duration)
+    s.videoDTS += uint64(duration)
+}
+
+func (s *hlsSession) handleOpus(pkt *rtp.Packet) {
+    if s.init == nil || !s.audioInInit || len(pkt.Payload) == 0 {
+        return
+    }
+    if !s.audioActive {
+        // Выравниваем начало аудио по времени прихода относительно первого кадра видео
+        s.audioDTS = uint64(time.Since(s.started).Seconds() * fmp4AudioTimescale)
+        s.audioActive = true
+    }
+    duration := opusPacketDuration(pkt.Payload)
+    if duration == 0 {
+        duration = fmp4AudioTimescale / 50
+    }
+    if len(s.partAudio) == 0 {
+        s.partAudioStartDTS = s.audioDTS
+    }
+    s.partAudio = append(s.partAudio, fmp4Sample{data: pkt.Payload, duration: duration, keyframe: true})
+    s.audioDTS += uint64(duration)
+}
+
+func (s *hlsSession) closePart() {
+    if len(s.partVideo) == 0 {
+        return
+    }
+    s.fragmentSeq++
+    runs := []fmp4TrackRun{{trackID: fmp4VideoTrackID, baseDecodeTS: s.partVideoStartDTS, samples: s.partVideo}}
+    if s.audioInInit {
+        runs = append(runs, fmp4TrackRun{trackID: fmp4AudioTrackID, baseDecodeTS: s.partAudioStartDTS, samples: s.partAudio})
+    }
+    part := &hlsPart{
+        data:        buildFMP4Fragment(s.fragmentSeq, runs),
+        duration:    float64(s.partVideoDuration) / fmp4VideoTimescale,
+        independent: s.partVideo[0].keyframe,
+    }
+    s.cur.parts = append(s.cur.parts, part)
+    s.cur.duration += part.duration
+    s.partVideo = nil
+    s.partAudio = nil
+    s.partVideoDuration = 0
+    s.cond.Broadcast()
+}
+
+func (s *hlsSession) closeSegment() {
+    s.closePart()
+    for _, part := range s.cur.parts {
+        s.cur.data = append(s.cur.data, part.data...)
+    }
+    if len(s.cur.data) > 0 {
+        for _, l := range s.listeners {
+            l.hlsSegment(s.init, s.info, s.cur.data, s.cur.duration)
+        }
+    }
+    s.segments = append(s.segments, s.cur)
+    // Храним пару лишних сегментов для клиентов, которые еще их скачивают
+    if keep := hlsConfig.PlaylistSize + 2; len(s.segments) > keep {
+        s.segments = s.segments[len(s.segments)-keep:]
+    }
+    s.cur = &hlsSegment{msn: s.cur.msn + 1}
+    s.cond.Broadcast()
+}
+
+// visibleSegments возвращает сегменты, которые попадают в плейлист
+func (s *hlsSession) visibleSegments() []*hlsSegment {
+    if n := len(s.segments); n > hlsConfig.PlaylistSize {
+        return s.segments[n-hlsConfig.PlaylistSize:]
+    }
+    return s.segments
+}
+
+// playlist формирует index.m3u8; вызывается под s.mu
+func (s *hlsSession) playlist() string {
+    segments := s.visibleSegments()
+    target := int(math.Ceil(hlsConfig.SegmentDuration.Seconds()))
+    for _, seg := range segments {
+        if d := int(math.Ceil(seg.duration)); d > target {
+            target = d
+        }
+    }
+
+    var b strings.Builder
+    b.WriteString("#EXTM3U\n")
+    if hlsConfig.LowLatency {
+        partTarget := hlsConfig.PartDuration.Seconds()
+        b.WriteString("#EXT-X-VERSION:9\n")
+        fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+        fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+    } else {
+        b.WriteString("#EXT-X-VERSION:7\n")
+    }
+    fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+    firstMSN := s.cur.msn
+    if len(segments) > 0 {
+        firstMSN = segments[0].msn
+    }
+    fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", firstMSN)
+    b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+    b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+    for i, seg := range segments {
+        // Части перечисляем только для последних сегментов, как требует LL-HLS
+        if hlsConfig.LowLatency && i >= len(segments)-2 {
+            writeHLSParts(&b, seg)
+        }
+        fmt.Fprintf(&b, "#EXTINF:%.5f,\nseg%d.m4s\n", seg.duration, seg.msn)
+    }
+    if hlsConfig.LowLatency {
+        writeHLSParts(&b, s.cur)
+        fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", s.cur.msn, len(s.cur.parts))
+    }
+    return b.String()
+}
+
+func writeHLSParts(b *strings.Builder, seg *hlsSegment) {
+    for i, part := range seg.parts {
+        fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.m4s\"", part.duration, seg.msn, i)
+        if part.independent {
+            b.WriteString(",INDEPENDENT=YES")
+        }
+        b.WriteString("\n")
+    }
+}
+
+// waitLocked ждет выполнения условия под s.mu, но не дольше timeout
+func (s *hlsSession) waitLocked(ready func() bool, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    timer := time.AfterFunc(timeout, func() {
+        s.mu.Lock()
+        s.cond.Broadcast()
+        s.mu.Unlock()
+    })
+    defer timer.Stop()
+    for !ready() {
+        if s.closed || !time.Now().Before(deadline) {
+            return false
+        }
+        s.cond.Wait()
+    }
+    return true
+}
+
+// findSegment ищет завершенный сегмент по номеру; вызывается под s.mu
+func (s *hlsSession) findSegment(msn uint64) *hlsSegment {
+    for _, seg := range s.segments {
+        if seg.msn == msn {
+            return seg
+        }
+    }
+    return nil
+}
+
+// findPart ищет часть сегмента (завершенного или текущего); вызывается под s.mu
+func (s *hlsSession) findPart(msn uint64, index int) *hlsPart {
+    seg := s.findSegment(msn)
+    if seg == nil && s.cur.msn == msn {
+        seg = s.cur
+    }
+    if seg == nil || index < 0 || index >= len(seg.parts) {
+        return nil
+    }
+    return seg.parts[index]
+}
+
+// touchViewer отмечает запрос плейлиста зрителем
+func (s *hlsSession) touchViewer(key string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, known := s.viewers[key]
+    s.viewers[key] = time.Now()
+    return !known
+}
+
+// hasViewer сообщает, учтен ли зритель в viewerCount
+func (s *hlsSession) hasViewer(key string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    seen, known := s.viewers[key]
+    return known && time.Since(seen) < hlsViewerTimeout()
+}
+
+// hlsViewerKey определяет зрителя запроса. За прокси RemoteAddr у всех зрителей один,
+// поэтому зритель определяется по адресу клиента и User-Agent.
+func hlsViewerKey(r *http.Request) string {
+    return clientIP(r) + "|" + r.UserAgent()
+}
+
+func hlsViewerTimeout() time.Duration {
+    timeout := 3 * hlsConfig.SegmentDuration
+    if timeout < 10*time.Second {
+        timeout = 10 * time.Second
+    }
+    return timeout
+}
+
+// viewerCount возвращает число зрителей, запрашивавших плейлист недавно
+func (s *hlsSession) viewerCount() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return 0
+    }
+    count := 0
+    for _, seen := range s.viewers {
+        if time.Since(seen) < hlsViewerTimeout() {
+            count++
+        }
+    }
+    return count
+}
+
+// viewerJanitor удаляет ушедших зрителей и обновляет room_info при изменении их числа
+func (s *hlsSession) viewerJanitor() {
+    ticker := time.NewTicker(5 * time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.stop:
+            return
+        case <-ticker.C:
+            s.mu.Lock()
+            removed := 0
+            for key, seen := range s.viewers {
+                if time.Since(seen) >= hlsViewerTimeout() {
+                    delete(s.viewers, key)
+                    removed++
+                }
+            }
+            s.mu.Unlock()
+            if removed > 0 {
+                log.Printf("HLS for room %s: %d passive viewer(s) left", s.room, removed)
+                sendRoomInfo(s.room)
+            }
+        }
+    }
+}
+
+// hlsViewerCount возвращает число пассивных HLS-зрителей комнаты
+func hlsViewerCount(room string) int {
+    rm := getRoomMedia(room)
+    if rm == nil || rm.hls == nil {
+        return 0
+    }
+    return rm.hls.viewerCount()
+}
+
+// handleHLS обслуживает /hls/{room}/index.m3u8, init.mp4, seg{N}.m4s и part{N}.{I}.m4s
+func handleHLS(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        http.NotFound(w, r)
+        return
+    }
+    room, file := parts[0], parts[1]
+
+    // Те же права, что у ведомого в /wsgo: ведущий в комнате, допуск и лимит зрителей именованной комнаты
+    if err := checkViewerAccess(room); err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    rm := getRoomMedia(room)
+    if rm == nil || rm.hls == nil {
+        http.Error(w, "Room is not live", http.StatusNotFound)
+        return
+    }
+    s := rm.hls
+    if err := checkNamedRoomViewer(room, s.hasViewer(hlsViewerKey(r))); err != nil {
+        log.Printf("HLS request for room %s from %s rejected: %v", room, clientIP(r), err)
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    switch {
+    case file == "index.m3u8":
+        serveHLSPlaylist(w, r, s)
+    case file == "init.mp4":
+        s.mu.Lock()
+        s.waitLocked(func() bool { return s.init != nil }, hlsConfig.SegmentDuration*2)
+        data := s.init
+        s.mu.Unlock()
+        writeHLSMedia(w, r, data, "video/mp4")
+    case strings.HasPrefix(file, "seg") && strings.HasSuffix(file, ".m4s"):
+        msn, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "seg"), ".m4s"), 10, 64)
+        if err != nil {
+            http.NotFound(w, r)
+            return
+        }
+        s.mu.Lock()
+        var data []byte
+        if seg := s.findSegment(msn); seg != nil {
+            data = seg.data
+        }
+        s.mu.Unlock()
+        writeHLSMedia(w, r, data, "video/iso.segment")
+    case strings.HasPrefix(file, "part") && strings.HasSuffix(file, ".m4s"):
+        ids := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(file, "part"), ".m4s"), ".", 2)
+        if len(ids) != 2 {
+            http.NotFound(w, r)
+            return
+        }
+        msn, err1 := strconv.ParseUint(ids[0], 10, 64)
+        index, err2 := strconv.Atoi(ids[1])
+        if err1 != nil || err2 != nil {
+            http.NotFound(w, r)
+            return
+        }
+        s.mu.Lock()
+        // Часть из PRELOAD-HINT еще не готова: держим запрос, пока она не появится
+        var part *hlsPart
+        s.waitLocked(func() bool {
+            part = s.findPart(msn, index)
+            return part != nil || s.cur.msn > msn
+        }, 3*hlsConfig.PartDuration+hlsConfig.SegmentDuration)
+        s.mu.Unlock()
+        var data []byte
+        if part != nil {
+            data = part.data
+        }
+        writeHLSMedia(w, r, data, "video/iso.segment")
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+func serveHLSPlaylist(w http.ResponseWriter, r *http.Request, s *hlsSession) {
+    if s.touchViewer(hlsViewerKey(r)) {
+        log.Printf("HLS for room %s: new passive viewer from %s", s.room, clientIP(r))
+        go sendRoomInfo(s.room)
+    }
+
+    s.mu.Lock()
+    waitingForKeyframe := s.init == nil
+    s.mu.Unlock()
+    if waitingForKeyframe {
+        requestRoomKeyframe(s.room, "HLS viewer is waiting for the first segment", false)
+    }
+
+    query := r.URL.Query()
+    s.mu.Lock()
+    ready := func() bool { return len(s.segments) > 0 || (hlsConfig.LowLatency && len(s.cur.parts) > 0) }
+    if msnParam := query.Get("_HLS_msn"); msnParam != "" && hlsConfig.LowLatency {
+        msn, err := strconv.ParseUint(msnParam, 10, 64)
+        if err != nil {
+            s.mu.Unlock()
+            http.Error(w, "Invalid _HLS_msn", http.StatusBadRequest)
+            return
+        }
+        part := -1
+        if partParam := query.Get("_HLS_part"); partParam != "" {
+            if part, err = strconv.Atoi(partParam); err != nil {
+                s.mu.Unlock()
+                http.Error(w, "Invalid _HLS_part", http.StatusBadRequest)
+                return
+            }
+        }
+        if msn > s.cur.msn+2 {
+            s.mu.Unlock()
+            http.Error(w, "Requested segment is too far in the future", http.StatusBadRequest)
+            return
+        }
+        // Блокирующая перезагрузка плейлиста (LL-HLS): ждем запрошенный сегмент или часть
+        ready = func() bool {
+            if part < 0 {
+                return s.cur.msn > msn
+            }
+            return s.cur.msn > msn || (s.cur.msn == msn && len(s.cur.parts) > part)
+        }
+    }
+    ok := s.waitLocked(ready, 3*hlsConfig.SegmentDuration)
+    if !ok && len(s.segments) == 0 && len(s.cur.parts) == 0 {
+        s.mu.Unlock()
+        http.Error(w, "Stream is not ready yet", http.StatusNotFound)
+        return
+    }
+    playlist := s.playlist()
+    s.mu.Unlock()
+
+    w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+    w.Header().Set("Cache-Control", "no-cache")
+    if _, err := w.Write([]byte(playlist)); err != nil {
+        log.Printf("Error writing HLS playlist for room %s: %v", s.room, err)
+    }
+}
+
+func writeHLSMedia(w http.ResponseWriter, r *http.Request, data []byte, contentType string) {
+    if data == nil {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Cache-Control", "max-age=60")
+    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+    if _, err := w.Write(data); err != nil {
+        log.Printf("Error writing HLS media %s: %v", r.URL.Path, err)
+    }
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "log"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// Идентификация подключений. Каждое WebSocket-соединение получает ID сессии, сгенерированный сервером:
+// за обратным прокси (docker-nginx) у всех клиентов один RemoteAddr, и он не может служить идентификатором.
+// Реальный адрес клиента берется из X-Forwarded-For / X-Real-IP, только если запрос пришел
+// от доверенного прокси (TRUSTED_PROXIES - IP или CIDR через запятую); иначе заголовки игнорируются.
+
+var trustedProxies = parseTrustedProxies(envString("TRUSTED_PROXIES", ""))
+
+func parseTrustedProxies(value string) []*net.IPNet {
+    var nets []*net.IPNet
+    for _, item := range strings.Split(value, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" {
+            continue
+        }
+        if !strings.Contains(item, "/") {
+            if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+                item += "/32"
+            } else {
+                item += "/128"
+            }
+        }
+        _, network, err := net.ParseCIDR(item)
+        if err != nil {
+            log.Printf("Ignoring invalid TRUSTED_PROXIES entry %q: %v", item, err)
+            continue
+        }
+        nets = append(nets, network)
+    }
+    return nets
+}
+
+// isTrustedProxy сообщает, входит ли адрес в TRUSTED_PROXIES
+func isTrustedProxy(host string) bool {
+    ip := net.ParseIP(host)
+    if ip == nil {
+        return false
+    }
+    for _, network := range trustedProxies {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientIP возвращает адрес клиента запроса. X-Forwarded-For читается справа налево:
+// адреса доверенных прокси пропускаются, первый недоверенный и есть клиент
+// (левее него значения мог подставить сам клиент).
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    if !isTrustedProxy(host) {
+        return host
+    }
+    if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+        hops := strings.Split(strings.Join(forwarded, ","), ",")
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := strings.TrimSpace(hops[i])
+            if net.ParseIP(hop) == nil {
+                break
+            }
+            host = hop
+            if !isTrustedProxy(hop) {
+                break
+            }
+        }
+        return host
+    }
+    if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+        return realIP
+    }
+    return host
+}
+
+// newSessionID возвращает случайный ID сессии WebSocket-соединения
+func newSessionID() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        log.Printf("Error generating session ID: %v", err)
+    }
+    return hex.EncodeToString(b)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "net/http/httptest"
+    "testing"
+)
+
+func TestClientIP(t *testing.T) {
+    saved := trustedProxies
+    defer func() { trustedProxies = saved }()
+    trustedProxies = parseTrustedProxies("172.16.0.0/12, 10.0.0.1, bogus, 2001:db8::1")
+
+    tests := []struct {
+        name       string
+        remoteAddr string
+        forwarded  []string
+        realIP     string
+        want       string
+    }{
+        {name: "direct client", remoteAddr: "203.0.113.5:1234", want: "203.0.113.5"},
+        {name: "untrusted peer headers are ignored", remoteAddr: "203.0.113.5:1234", forwarded: []string{"198.51.100.1"}, realIP: "198.51.100.2", want: "203.0.113.5"},
+        {name: "trusted proxy", remoteAddr: "172.18.0.3:40000", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+        {name: "spoofed left hops are skipped", remoteAddr: "172.18.0.3:40000", forwarded: []string{"1.2.3.4, 198.51.100.7"}, want: "198.51.100.7"},
+        {name: "chain of trusted proxies", remoteAddr: "172.18.0.3:40000", forwarded: []string{"198.51.100.7, 10.0.0.1"}, want: "198.51.100.7"},
+        {name: "multiple headers", remoteAddr: "172.18.0.3:40000", forwarded: []string{"198.51.100.7", "10.0.0.1"}, want: "198.51.100.7"},
+        {name: "all hops trusted", remoteAddr: "172.18.0.3:40000", forwarded: []string{"10.0.0.1, 172.20.0.2"}, want: "10.0.0.1"},
+        {name: "garbage hop stops the walk", remoteAddr: "172.18.0.3:40000", forwarded: []string{"198.51.100.7, unknown"}, want: "172.18.0.3"},
+        {name: "x-real-ip", remoteAddr: "172.18.0.3:40000", realIP: "198.51.100.9", want: "198.51.100.9"},
+        {name: "invalid x-real-ip", remoteAddr: "172.18.0.3:40000", realIP: "not-an-ip", want: "172.18.0.3"},
+        {name: "ipv6 proxy", remoteAddr: "[2001:db8::1]:443", forwarded: []string{"2001:db8::42"}, want: "2001:db8::42"},
+        {name: "address without port", remoteAddr: "203.0.113.5", want: "203.0.113.5"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest("GET", "/wsgo", nil)
+            r.RemoteAddr = tt.remoteAddr
+            for _, v := range tt.forwarded {
+                r.Header.Add("X-Forwarded-For", v)
+            }
+            if tt.realIP != "" {
+                r.Header.Set("X-Real-IP", tt.realIP)
+            }
+            if got := clientIP(r); got != tt.want {
+                t.Errorf("clientIP() = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/pion/interceptor"
+    "github.com/pion/interceptor/pkg/cc"
+    "github.com/pion/interceptor/pkg/gcc"
+    "github.com/pion/interceptor/pkg/nack"
+    "github.com/pion/interceptor/pkg/report"
+    "github.com/pion/interceptor/pkg/stats"
+    "github.com/pion/interceptor/pkg/twcc"
+    "github.com/pion/sdp/v3"
+    "github.com/pion/webrtc/v3"
+)
+
+// Настройки интерцепторов pion для PeerConnection сервера (переменные окружения INTERCEPTOR_*)
+var interceptorConfig = struct {
+    NACK         bool          // генератор NACK для входящих потоков и ответчик (повтор пакетов) для исходящих
+    NACKBuffer   int           // размер буфера пакетов NACK (степень двойки, до 32768)
+    NACKInterval time.Duration // период отправки NACK
+
+    RTCPReports    bool          // Sender/Receiver Reports
+    ReportInterval time.Duration // период отправки SR/RR
+
+    TWCC         bool          // transport-wide congestion control: отзывы для входящих потоков ведущего
+    TWCCInterval time.Duration // период отправки отзывов TWCC
+
+    BWE            bool // оценка полосы (GCC) по отзывам TWCC для исходящих потоков ведомым
+    BWEInitial     int  // начальная оценка, бит/с
+    BWEMin, BWEMax int  // границы оценки, бит/с
+
+    Stats bool // статистика RTP/RTCP по трекам (сообщения stats и API комнат)
+}{
+    NACK:         envBool("INTERCEPTOR_NACK", true),
+    NACKBuffer:   envInt("INTERCEPTOR_NACK_BUFFER", 1024),
+    NACKInterval: envDuration("INTERCEPTOR_NACK_INTERVAL", 100*time.Millisecond),
+
+    RTCPReports:    envBool("INTERCEPTOR_RTCP_REPORTS", true),
+    ReportInterval: envDuration("INTERCEPTOR_RTCP_REPORT_INTERVAL", time.Second),
+
+    TWCC:         envBool("INTERCEPTOR_TWCC", true),
+    TWCCInterval: envDuration("INTERCEPTOR_TWCC_INTERVAL", 100*time.Millisecond),
+
+    BWE:        envBool("INTERCEPTOR_BWE", true),
+    BWEInitial: envInt("INTERCEPTOR_BWE_INITIAL_BITRATE", 1_000_000),
+    BWEMin:     envInt("INTERCEPTOR_BWE_MIN_BITRATE", 100_000),
+    BWEMax:     envInt("INTERCEPTOR_BWE_MAX_BITRATE", 10_000_000),
+
+    Stats: envBool("INTERCEPTOR_STATS", true),
+}
+
+// peerInterceptors - интерцепторы PeerConnection, к которым обращается сервер (nil, если выключены)
+type peerInterceptors struct {
+    bwe   *bandwidthEstimate
+    stats *peerStats
+}
+
+// bandwidthEstimate хранит оценщик полосы GCC одного PeerConnection
+type bandwidthEstimate struct {
+    mu        sync.Mutex
+    estimator cc.BandwidthEstimator
+    onChange  func(bitrate int)
+}
+
+// targetBitrate возвращает текущую оценку полосы, бит/с (0, если оценки нет)
+func (b *bandwidthEstimate) targetBitrate() uint64 {
+    if b == nil {
+        return 0
+    }
+    b.mu.Lock()
+    estimator := b.estimator
+    b.mu.Unlock()
+    if estimator == nil {
+        return 0
+    }
+    return uint64(estimator.GetTargetBitrate())
+}
+
+// OnChange задает обработчик изменения оценки полосы
+func (b *bandwidthEstimate) OnChange(f func(bitrate int)) {
+    if b == nil {
+        return
+    }
+    b.mu.Lock()
+    b.onChange = f
+    b.mu.Unlock()
+}
+
+func (b *bandwidthEstimate) setEstimator(estimator cc.BandwidthEstimator) {
+    b.mu.Lock()
+    b.estimator = estimator
+    b.mu.Unlock()
+    estimator.OnTargetBitrateChange(func(bitrate int) {
+        b.mu.Lock()
+        f := b.onChange
+        b.mu.Unlock()
+        if f != nil {
+            f(bitrate)
+        }
+    })
+}
+
+// registerInterceptors добавляет в реестр интерцепторы, включенные в interceptorConfig,
+// и регистрирует в MediaEngine нужные им RTCP feedback и расширения заголовка.
+func registerInterceptors(mediaEngine *webrtc.MediaEngine, registry *interceptor.Registry) (peerInterceptors, error) {
+    cfg := interceptorConfig
+    var pi peerInterceptors
+
+    if cfg.NACK {
+        generator, err := nack.NewGeneratorInterceptor(
+            nack.GeneratorSize(uint16(cfg.NACKBuffer)),
+            nack.GeneratorInterval(cfg.NACKInterval),
+        )
+        if err != nil {
+            return pi, fmt.Errorf("nack generator: %w", err)
+        }
+        responder, err := nack.NewResponderInterceptor(nack.ResponderSize(uint16(cfg.NACKBuffer)))
+        if err != nil {
+            return pi, fmt.Errorf("nack responder: %w", err)
+        }
+        mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+        mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+        registry.Add(responder)
+        registry.Add(generator)
+    }
+
+    if cfg.RTCPReports {
+        receiver, err := report.NewReceiverInterceptor(report.ReceiverInterval(cfg.ReportInterval))
+        if err != nil {
+            return pi, fmt.Errorf("receiver reports: %w", err)
+        }
+        sender, err := report.NewSenderInterceptor(report.SenderInterval(cfg.ReportInterval))
+        if err != nil {
+            return pi, fmt.Errorf("sender reports: %w", err)
+        }
+        registry.Add(receiver)
+        registry.Add(sender)
+    }
+
+    if cfg.TWCC || cfg.BWE {
+        for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+            mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, kind)
+            if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+                return pi, fmt.Errorf("transport-cc header extension: %w", err)
+            }
+        }
+    }
+
+    if cfg.TWCC {
+        feedback, err := twcc.NewSenderInterceptor(twcc.SendInterval(cfg.TWCCInterval))
+        if err != nil {
+            return pi, fmt.Errorf("twcc feedback: %w", err)
+        }
+        registry.Add(feedback)
+    }
+
+    if cfg.Stats {
+        statsInterceptor, err := stats.NewInterceptor()
+        if err != nil {
+            return pi, fmt.Errorf("stats: %w", err)
+        }
+        ps := &peerStats{}
+        statsInterceptor.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+            ps.setGetter(getter)
+        })
+        pi.stats = ps
+        registry.Add(statsInterceptor)
+    }
+
+    if !cfg.BWE {
+        return pi, nil
+    }
+    // Номера transport-cc в исходящих пакетах нужны, чтобы ведомый присылал отзывы TWCC
+    headerExtension, err := twcc.NewHeaderExtensionInterceptor()
+    if err != nil {
+        return pi, fmt.Errorf("twcc header extension: %w", err)
+    }
+    congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+        // Пакеты не задерживаются: оценка используется только для выбора слоя simulcast
+        return gcc.NewSendSideBWE(
+            gcc.SendSideBWEInitialBitrate(cfg.BWEInitial),
+            gcc.SendSideBWEMinBitrate(cfg.BWEMin),
+            gcc.SendSideBWEMaxBitrate(cfg.BWEMax),
+            gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+        )
+    })
+    if err != nil {
+        return pi, fmt.Errorf("congestion controller: %w", err)
+    }
+    estimate := &bandwidthEstimate{}
+    congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+        estimate.setEstimator(estimator)
+    })
+    pi.bwe = estimate
+    registry.Add(congestionController)
+    registry.Add(headerExtension)
+    return pi, nil
+}
+
+// newWebRTCAPI создает API с MediaEngine для preferredCodec и реестром интерцепторов.
+// Каждый API обслуживает один PeerConnection, поэтому оценка полосы и статистика относятся к нему.
+func newWebRTCAPI(preferredCodec string) (*webrtc.API, peerInterceptors, error) {
+    mediaEngine := createMediaEngine(preferredCodec)
+    registry := &interceptor.Registry{}
+    pi, err := registerInterceptors(mediaEngine, registry)
+    if err != nil {
+        return nil, pi, err
+    }
+    api := webrtc.NewAPI(
+        webrtc.WithMediaEngine(mediaEngine),
+        webrtc.WithInterceptorRegistry(registry),
+    )
+    return api, pi, nil
+}
+
+// logInterceptorConfig выводит включенные интерцепторы при старте
+func logInterceptorConfig() {
+    cfg := interceptorConfig
+    log.Printf("Interceptors: nack=%v (buffer %d, interval %s), rtcp-reports=%v (interval %s), twcc=%v (interval %s), bwe=%v (%d..%d bps), stats=%v",
+        cfg.NACK, cfg.NACKBuffer, cfg.NACKInterval, cfg.RTCPReports, cfg.ReportInterval,
+        cfg.TWCC, cfg.TWCCInterval, cfg.BWE, cfg.BWEMin, cfg.BWEMax, cfg.Stats)
+}
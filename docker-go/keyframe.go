@@ -0,0 +1,117 @@
+package main
+
+import (
+    "errors"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/pion/rtcp"
+)
+
+// Минимальный интервал между запросами ключевого кадра у ведущего одной комнаты.
+// Запросы чаще этого интервала (PLI/FIR от нескольких зрителей) схлопываются в один.
+var keyframeMinInterval = envDuration("KEYFRAME_MIN_INTERVAL", time.Second)
+
+// keyframeLimiter ограничивает частоту запросов ключевого кадра по комнатам
+type keyframeLimiter struct {
+    mu         sync.Mutex
+    last       map[string]time.Time
+    suppressed map[string]int
+}
+
+var keyframeRequests = &keyframeLimiter{
+    last:       make(map[string]time.Time),
+    suppressed: make(map[string]int),
+}
+
+// allow разрешает запрос, если с предыдущего прошло не меньше keyframeMinInterval.
+// Возвращает также число запросов, отброшенных с момента последнего разрешенного.
+func (l *keyframeLimiter) allow(room string) (bool, int) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    if last, ok := l.last[room]; ok && now.Sub(last) < keyframeMinInterval {
+        l.suppressed[room]++
+        return false, 0
+    }
+    suppressed := l.suppressed[room]
+    delete(l.suppressed, room)
+    l.last[room] = now
+    // Убираем записи давно неактивных комнат
+    for r, t := range l.last {
+        if now.Sub(t) > time.Minute {
+            delete(l.last, r)
+            delete(l.suppressed, r)
+        }
+    }
+    return true, suppressed
+}
+
+// lastAllowed возвращает время последнего запроса ключевого кадра, отправленного ведущему комнаты
+func (l *keyframeLimiter) lastAllowed(room string) time.Time {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.last[room]
+}
+
+// requestKeyframe отправляет PLI (или FIR) на видеотреки ведущего, принятые сервером (на все слои simulcast)
+func (rm *roomMedia) requestKeyframe(fir bool) error {
+    layers := rm.videoLayers()
+    if len(layers) == 0 {
+        return errors.New("no video track from leader")
+    }
+    var pkts []rtcp.Packet
+    for _, t := range layers {
+        if fir {
+            rm.paramMu.Lock()
+            rm.firSeq++
+            seq := rm.firSeq
+            rm.paramMu.Unlock()
+            pkts = append(pkts, &rtcp.FullIntraRequest{MediaSSRC: t.ssrc, FIR: []rtcp.FIREntry{{SSRC: t.ssrc, SequenceNumber: seq}}})
+        } else {
+            pkts = append(pkts, &rtcp.PictureLossIndication{MediaSSRC: t.ssrc})
+        }
+    }
+    return rm.pc.WriteRTCP(pkts)
+}
+
+// requestRoomKeyframe запрашивает ключевой кадр у ведущего комнаты с ограничением частоты.
+// Если ведущий публикует медиа на сервер, запрос уходит как RTCP PLI/FIR,
+// иначе (P2P) ведущему отправляется сообщение request_keyframe.
+func requestRoomKeyframe(room, reason string, fir bool) {
+    allowed, suppressed := keyframeRequests.allow(room)
+    if !allowed {
+        return
+    }
+    log.Printf("Requesting keyframe from leader of room %s: %s (%d request(s) throttled since last)", room, reason, suppressed)
+
+    if rm := getRoomMedia(room); rm != nil {
+        err := rm.requestKeyframe(fir)
+        if err == nil {
+            return
+        }
+        log.Printf("Failed to send keyframe request over RTCP in room %s: %v", room, err)
+    }
+
+    leader := roomLeader(room)
+    if leader == nil {
+        return
+    }
+    if err := leader.writeJSON(map[string]interface{}{"type": "request_keyframe", "reason": reason}); err != nil {
+        log.Printf("Error sending request_keyframe to leader %s: %v", leader.username, err)
+    }
+}
+
+// isKeyframeRequest сообщает, содержит ли пакет RTCP запрос ключевого кадра, и является ли он FIR
+func isKeyframeRequest(pkts []rtcp.Packet) (requested bool, fir bool) {
+    for _, p := range pkts {
+        switch p.(type) {
+        case *rtcp.PictureLossIndication:
+            requested = true
+        case *rtcp.FullIntraRequest:
+            requested, fir = true, true
+        }
+    }
+    return requested, fir
+}
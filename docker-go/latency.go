@@ -0,0 +1,247 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "sync"
+    "time"
+
+    "github.com/pion/rtcp"
+)
+
+// Задержка "от стекла до стекла": от съемки кадра у ведущего до его показа у ведомого.
+// Время съемки берется из RTCP SR ведущего (соответствие NTP и меток RTP) или из captureTime,
+// который ведомый P2P получил от ведущего сам; время показа сообщает ведомый.
+// Часы пиров сводятся к часам сервера обменом clock_sync (по образцу NTP):
+//   сервер -> пир:     {"type":"clock_sync","serverTime":<мс Unix>}
+//   пир -> сервер:     {"type":"clock_sync_reply","serverTime":<эхо>,"clientTime":<Date.now()>}
+//   ведомый -> сервер: {"type":"latency_report","rtpTimestamp":<метка RTP показанного кадра, sfu>,
+//                       "captureTime":<время съемки по часам ведущего, мс, P2P>,"renderedAt":<Date.now()>}
+
+// Период обмена clock_sync; 0 отключает измерение задержки
+var latencySyncInterval = envDuration("LATENCY_SYNC_INTERVAL", 10*time.Second)
+
+const (
+    clockSyncSamples    = 8           // замеров смещения часов, из которых берется замер с наименьшим RTT
+    latencyMaxPlausible = 60 * 1000.0 // мс; больше - ошибка в часах или метках времени
+    latencyWeight       = 0.2         // вес нового замера в сглаженной задержке
+)
+
+var glassToGlassSeconds = newHistogramVec("webrtc_glass_to_glass_latency_seconds",
+    "Glass-to-glass video latency from leader capture to follower render.",
+    []float64{0.05, 0.1, 0.15, 0.2, 0.3, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10}, "room", "mode")
+
+// clockSample - замер смещения часов пира относительно сервера, мс
+type clockSample struct {
+    offset float64 // часы пира минус часы сервера
+    rtt    float64
+}
+
+// peerClock хранит последние замеры смещения часов пира
+type peerClock struct {
+    mu      sync.Mutex
+    samples []clockSample
+}
+
+func (c *peerClock) add(s clockSample) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.samples = append(c.samples, s)
+    if len(c.samples) > clockSyncSamples {
+        c.samples = c.samples[len(c.samples)-clockSyncSamples:]
+    }
+}
+
+// offset возвращает смещение по замеру с наименьшим RTT: у него наименьшая погрешность
+func (c *peerClock) offset() (float64, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if len(c.samples) == 0 {
+        return 0, false
+    }
+    best := c.samples[0]
+    for _, s := range c.samples[1:] {
+        if s.rtt < best.rtt {
+            best = s
+        }
+    }
+    return best.offset, true
+}
+
+// glassToGlass - задержка, измеренная для ведомого, мс
+type glassToGlass struct {
+    mu       sync.Mutex
+    smoothed float64
+    samples  uint64
+}
+
+func (g *glassToGlass) add(ms float64) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if g.samples == 0 {
+        g.smoothed = ms
+    } else {
+        g.smoothed += (ms - g.smoothed) * latencyWeight
+    }
+    g.samples++
+}
+
+// value возвращает сглаженную задержку, округленную до миллисекунды
+func (g *glassToGlass) value() (float64, bool) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return math.Round(g.smoothed), g.samples > 0
+}
+
+func unixMillis(t time.Time) float64 {
+    return float64(t.UnixNano()) / float64(time.Millisecond)
+}
+
+const ntpEpochOffset = 2208988800 // секунд между 1900 и 1970 годом
+
+// ntpToTime переводит 64-битное время NTP (с 1900 года) во время Go
+func ntpToTime(ntp uint64) time.Time {
+    secs := int64(ntp>>32) - ntpEpochOffset
+    nanos := int64((ntp & 0xFFFFFFFF) * uint64(time.Second) >> 32)
+    return time.Unix(secs, nanos)
+}
+
+// timeToNTP переводит время Go в 64-битное время NTP
+func timeToNTP(t time.Time) uint64 {
+    secs := uint64(t.Unix() + ntpEpochOffset)
+    frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+    return secs<<32 | frac
+}
+
+// readSenderReports читает RTCP трека ведущего и запоминает последний SR
+func readSenderReports(t *ingestTrack) {
+    for {
+        var pkts []rtcp.Packet
+        var err error
+        if t.rid != "" {
+            pkts, _, err = t.receiver.ReadSimulcastRTCP(t.rid)
+        } else {
+            pkts, _, err = t.receiver.ReadRTCP()
+        }
+        if err != nil {
+            return
+        }
+        for _, p := range pkts {
+            if sr, ok := p.(*rtcp.SenderReport); ok && sr.SSRC == t.ssrc {
+                t.srMu.Lock()
+                t.srNTP = ntpToTime(sr.NTPTime)
+                t.srRTP = sr.RTPTime
+                t.srKnown = true
+                t.srMu.Unlock()
+            }
+        }
+    }
+}
+
+// captureTime переводит метку RTP трека во время съемки по часам ведущего
+func (t *ingestTrack) captureTime(ts uint32) (time.Time, bool) {
+    t.srMu.Lock()
+    defer t.srMu.Unlock()
+    if !t.srKnown || t.codec.ClockRate == 0 {
+        return time.Time{}, false
+    }
+    // Разница как int32 учитывает переполнение метки времени
+    delta := float64(int32(ts-t.srRTP)) / float64(t.codec.ClockRate)
+    return t.srNTP.Add(time.Duration(delta * float64(time.Second))), true
+}
+
+// handleClockSyncReply принимает ответ пира на clock_sync
+func handleClockSyncReply(peer *Peer, data map[string]interface{}) error {
+    serverTime, ok := data["serverTime"].(float64)
+    clientTime, ok2 := data["clientTime"].(float64)
+    if !ok || !ok2 {
+        return errors.New("clock_sync_reply requires serverTime and clientTime")
+    }
+    rtt := unixMillis(time.Now()) - serverTime
+    if rtt < 0 || rtt > 10000 {
+        return fmt.Errorf("clock_sync_reply has implausible round trip %.0f ms", rtt)
+    }
+    peer.clock.add(clockSample{offset: clientTime - (serverTime + rtt/2), rtt: rtt})
+    return nil
+}
+
+// handleLatencyReport вычисляет задержку по отчету ведомого о показанном кадре
+func handleLatencyReport(peer *Peer, data map[string]interface{}) error {
+    if peer.isLeader {
+        return errors.New("latency reports are sent by followers")
+    }
+    renderedAt, ok := data["renderedAt"].(float64)
+    if !ok {
+        return errors.New("latency_report requires renderedAt")
+    }
+    followerOffset, ok := peer.clock.offset()
+    if !ok {
+        return errors.New("follower clock is not synchronized yet")
+    }
+    leader := roomLeader(peer.room)
+    if leader == nil {
+        return errNoLeader
+    }
+    leaderOffset, ok := leader.clock.offset()
+    if !ok {
+        return errors.New("leader clock is not synchronized yet")
+    }
+
+    // Время съемки по часам ведущего, мс
+    var captured float64
+    if ts, ok := data["rtpTimestamp"].(float64); ok && peer.mode == peerModeSFU {
+        var sub *sfuSubscriber
+        for _, s := range roomSubscribers(peer.room) {
+            if s.peer == peer {
+                sub = s
+                break
+            }
+        }
+        if sub == nil {
+            return errors.New("sfu follower is not subscribed")
+        }
+        track, sourceTS := sub.sourceTimestamp(uint32(ts))
+        if track == nil {
+            return errors.New("no video is forwarded to follower")
+        }
+        at, ok := track.captureTime(sourceTS)
+        if !ok {
+            return errors.New("no sender report from leader yet")
+        }
+        captured = unixMillis(at)
+    } else if at, ok := data["captureTime"].(float64); ok {
+        captured = at
+    } else {
+        return errors.New("latency_report requires rtpTimestamp (sfu) or captureTime")
+    }
+
+    latency := (renderedAt - followerOffset) - (captured - leaderOffset)
+    if latency < 0 || latency > latencyMaxPlausible {
+        return fmt.Errorf("implausible latency %.0f ms", latency)
+    }
+    peer.latency.add(latency)
+    glassToGlassSeconds.observe(latency/1000, peer.room, peer.mode)
+    return nil
+}
+
+// startLatencyProbe периодически отправляет пирам clock_sync
+func startLatencyProbe() {
+    if latencySyncInterval <= 0 {
+        log.Printf("Glass-to-glass latency measurement is disabled")
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(latencySyncInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            for _, peer := range allPeers() {
+                msg := map[string]interface{}{"type": "clock_sync", "serverTime": unixMillis(time.Now())}
+                if err := peer.writeJSON(msg); err != nil {
+                    log.Printf("Error sending clock_sync to %s: %v", peer.username, err)
+                }
+            }
+        }
+    }()
+}
@@ -20,35 +20,87 @@ CheckOrigin: func(r *http.Request) bool { return true },
 type Peer struct {
 conn     *websocket.Conn
 pc       *webrtc.PeerConnection
+sessionID string // ID соединения, выданный сервером (newSessionID)
+clientIP string // адрес клиента с учетом доверенных прокси (clientIP)
+connectedAt time.Time
 username string
 room     string
 isLeader bool
+mode     string // peerModeP2P или peerModeSFU (только для ведомых)
+codec    string // предпочтительный видеокодек пира (H264 или VP8)
+metadata *streamMetadata // описание видео ведущего (stream_metadata); под mu пира
+viewMode string // viewModeFull, viewModeAudio или viewModeSlideshow (только для ведомых); под mu пира
+bwe      *bandwidthEstimate // оценка полосы до пира по отзывам TWCC (nil, если BWE выключен)
+stats    *peerStats // статистика RTP/RTCP PeerConnection сервера (nil, если выключена)
+clock    peerClock // смещение часов пира относительно сервера (clock_sync)
+latency  glassToGlass // задержка от съемки у ведущего до показа у ведомого (только для ведомых)
+closeReason string // первая причина closePeerResources (история сессий); под mu пира
+actor    *roomActor // цикл комнаты пира; задается при входе в комнату
+signaling *eventLoop // согласование серверного PeerConnection вне цикла комнаты (serverNegotiationMessages)
+out      *peerWriter // очередь и горутина записи в conn; задается при создании
 mu       sync.Mutex
 }
 
+// writeJSON ставит сообщение в очередь записи пира; не блокирует
+func (p *Peer) writeJSON(v interface{}) error {
+    msg, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return p.writeMessage(msg)
+}
+
+// writeMessage ставит готовое текстовое сообщение (например, пересланное) в очередь записи пира
+func (p *Peer) writeMessage(msg []byte) error {
+    if p.out == nil {
+        return errConnectionClosed
+    }
+    return p.out.send(msg)
+}
+
 type RoomInfo struct {
 Users    []string `json:"users"`
 Leader   string   `json:"leader"`
 Follower string   `json:"follower"`
+HLSViewers int    `json:"hlsViewers"` // Пассивные зрители HLS
+SFUFollowers []string `json:"sfuFollowers"` // Ведомые, получающие медиа через сервер
+SimulcastLayers []string `json:"simulcastLayers,omitempty"` // RID слоев simulcast ведущего
+TalkHolder string `json:"talkHolder,omitempty"` // Ведомый, которому дано слово (push-to-talk)
+ViewModes map[string]string `json:"viewModes,omitempty"` // Режим просмотра каждого ведомого (full, audio, slideshow)
+Latency map[string]float64 `json:"latency,omitempty"` // Задержка от стекла до стекла по ведомым, мс
+VideoState string `json:"videoState,omitempty"` // Видео ведущего: waiting, active или stalled
+StreamMetadata *streamMetadata `json:"streamMetadata,omitempty"` // Описание видео от ведущего
+Title string `json:"title,omitempty"` // Название именованной комнаты
+MaxBitrateKbps int `json:"maxBitrateKbps,omitempty"` // Ограничение битрейта видео именованной комнаты
+MaxViewers int `json:"maxViewers,omitempty"` // Лимит ведомых именованной комнаты
 }
 
 var (
-    peers     = make(map[string]*Peer)
-    rooms     = make(map[string]map[string]*Peer)
-    mu        sync.Mutex
     // letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") // Не используется, но оставлено для вашего сведения
     webrtcAPI *webrtc.API // Глобальный API с настроенным MediaEngine
 )
 
-func isConnAlive(conn *websocket.Conn) bool {
-    if conn == nil {
-        return false
+// Битрейт видео в P2P SDP, если у комнаты нет своего ограничения, кбит/с
+const defaultSDPBitrateKbps = 300
+
+// normalizeSignalSDP приводит SDP пересылаемого offer/answer к предпочтительному кодеку
+// и ограничению битрейта комнаты (0 - defaultSDPBitrateKbps) и возвращает сообщение для отправки собеседнику
+func normalizeSignalSDP(data map[string]interface{}, msgBytes []byte, fallbackCodec string, maxBitrateKbps int) []byte {
+    preferredCodec, _ := data["preferredCodec"].(string)
+    if preferredCodec == "" {
+        preferredCodec = fallbackCodec
+        if preferredCodec == "" {
+            preferredCodec = "H264"
+        }
+    }
+    if sdp, ok := data["sdp"].(string); ok {
+        data["sdp"] = normalizeSdpForCodec(sdp, preferredCodec, maxBitrateKbps)
+        msgBytes, _ = json.Marshal(data)
     }
-    err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(2*time.Second))
-    return err == nil
+    return msgBytes
 }
 
-func normalizeSdpForCodec(sdp, preferredCodec string) string {
+func normalizeSdpForCodec(sdp, preferredCodec string, maxBitrateKbps int) string {
     log.Printf("Normalizing SDP for codec: %s", preferredCodec)
     lines := strings.Split(sdp, "\r\n")
     var newLines []string
@@ -129,9 +181,12 @@ func normalizeSdpForCodec(sdp, preferredCodec string) string {
     }
 
     // Установить битрейт
+    if maxBitrateKbps <= 0 {
+        maxBitrateKbps = defaultSDPBitrateKbps
+    }
     for i, line := range newLines {
         if strings.HasPrefix(line, "a=mid:video") {
-            newLines = append(newLines[:i+1], append([]string{"b=AS:300"}, newLines[i+1:]...)...)
+            newLines = append(newLines[:i+1], append([]string{fmt.Sprintf("b=AS:%d", maxBitrateKbps)}, newLines[i+1:]...)...)
             break
         }
     }
@@ -141,6 +196,28 @@ func normalizeSdpForCodec(sdp, preferredCodec string) string {
     return newSdp
 }
 
+// limitVideoBandwidth записывает b=AS:<kbps> в видеосекции SDP (после строки c=, как требует
+// порядок полей SDP), заменяя прежние ограничения b=AS и b=TIAS. Отправитель медиа, получивший
+// такое описание, не превышает указанный битрейт.
+func limitVideoBandwidth(sdp string, maxBitrateKbps int) string {
+    lines := strings.Split(sdp, "\r\n")
+    result := make([]string, 0, len(lines)+1)
+    inVideo := false
+    for _, line := range lines {
+        if strings.HasPrefix(line, "m=") {
+            inVideo = strings.HasPrefix(line, "m=video")
+        }
+        if inVideo && (strings.HasPrefix(line, "b=AS:") || strings.HasPrefix(line, "b=TIAS:")) {
+            continue
+        }
+        result = append(result, line)
+        if inVideo && strings.HasPrefix(line, "c=") {
+            result = append(result, fmt.Sprintf("b=AS:%d", maxBitrateKbps))
+        }
+    }
+    return strings.Join(result, "\r\n")
+}
+
 // contains проверяет, есть ли элемент в срезе
 func contains(slice []string, item string) bool {
     for _, s := range slice {
@@ -214,6 +291,17 @@ func createMediaEngine(preferredCodec string) *webrtc.MediaEngine {
         log.Printf("MediaEngine configured with default H.264 (PT: 126)")
     }
 
+    // Расширения заголовка mid/rid нужны для приема simulcast от ведущего
+    for _, uri := range []string{
+        "urn:ietf:params:rtp-hdrext:sdes:mid",
+        "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+        "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+    } {
+        if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+            log.Printf("Header extension %s registration error: %v", uri, err)
+        }
+    }
+
     // Регистрируем Opus аудио
     if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
         RTPCodecCapability: webrtc.RTPCodecCapability{
@@ -236,13 +324,15 @@ func init() {
     initializeMediaAPI() // Инициализируем MediaEngine при старте
 }
 
-// initializeMediaAPI настраивает MediaEngine только с H.264 и Opus
+// initializeMediaAPI настраивает MediaEngine только с H.264 и Opus и реестр интерцепторов
 func initializeMediaAPI() {
-    mediaEngine := createMediaEngine("H264")
-    webrtcAPI = webrtc.NewAPI(
-        webrtc.WithMediaEngine(mediaEngine),
-    )
+    api, _, err := newWebRTCAPI("H264")
+    if err != nil {
+        log.Fatalf("Failed to initialize WebRTC API: %v", err)
+    }
+    webrtcAPI = api
     log.Println("Global MediaEngine initialized with H.264 (PT: 126) and Opus (PT: 111)")
+    logInterceptorConfig()
 }
 
 // getWebRTCConfig осталась вашей функцией
@@ -262,16 +352,19 @@ func getWebRTCConfig() webrtc.Configuration {
 
 // logStatus осталась вашей функцией
 func logStatus() {
-mu.Lock()
-defer mu.Unlock()
+active := activeRooms()
+total := 0
+for _, roomPeers := range active {
+total += len(roomPeers)
+}
 log.Printf("--- Server Status ---")
-log.Printf("Total Connections: %d", len(peers))
-log.Printf("Active Rooms: %d", len(rooms))
-for room, roomPeers := range rooms {
+log.Printf("Total Connections: %d", total)
+log.Printf("Active Rooms: %d", len(active))
+for room, roomPeers := range active {
 var leader, follower string
 users := []string{}
-for username, p := range roomPeers {
-users = append(users, username)
+for _, p := range roomPeers {
+users = append(users, p.username)
 if p.isLeader {
 leader = p.username
 } else {
@@ -280,43 +373,156 @@ follower = p.username
 }
 log.Printf("  Room '%s' (%d users: %v) - Leader: [%s], Follower: [%s]",
 room, len(roomPeers), users, leader, follower)
+for _, p := range roomPeers {
+log.Printf("    %s: session %s from %s", p.username, p.sessionID, p.clientIP)
+}
 }
 log.Printf("---------------------")
 }
 
-// sendRoomInfo осталась вашей функцией
-func sendRoomInfo(room string) {
-    mu.Lock()
-    defer mu.Unlock()
-
-    roomPeers, exists := rooms[room]
-    if !exists || roomPeers == nil {
-        return
+// buildRoomInfo собирает состояние комнаты для room_info и API комнат, включая пиров других узлов
+func buildRoomInfo(room string) (RoomInfo, bool) {
+    roomPeers := roomPeers(room)
+    remote := roomState.RemoteMembers(room)
+    if len(roomPeers) == 0 && len(remote) == 0 {
+        return RoomInfo{}, false
     }
 
     var leader, follower string
+    var metadata *streamMetadata
     users := make([]string, 0, len(roomPeers))
+    sfuFollowers := []string{}
+    viewModes := make(map[string]string)
+    latency := make(map[string]float64)
     for _, peer := range roomPeers {
         users = append(users, peer.username)
+        peer.mu.Lock()
+        viewMode, peerMetadata := peer.viewMode, peer.metadata
+        peer.mu.Unlock()
+        if !peer.isLeader {
+            viewModes[peer.username] = viewMode
+            if ms, ok := peer.latency.value(); ok {
+                latency[peer.username] = ms
+            }
+        }
         if peer.isLeader {
             leader = peer.username
+            metadata = peerMetadata
+        } else if peer.mode == peerModeSFU {
+            sfuFollowers = append(sfuFollowers, peer.username)
         } else {
             follower = peer.username
         }
     }
+    for _, m := range remote {
+        users = append(users, m.Username)
+        switch {
+        case m.IsLeader:
+            leader = m.Username
+        case m.Mode == peerModeSFU:
+            sfuFollowers = append(sfuFollowers, m.Username)
+            viewModes[m.Username] = m.ViewMode
+        default:
+            follower = m.Username
+            viewModes[m.Username] = m.ViewMode
+        }
+    }
 
-    roomInfo := RoomInfo{Users: users, Leader: leader, Follower: follower}
-    for _, peer := range roomPeers {
-        peer.mu.Lock()
-        conn := peer.conn
-        if conn != nil {
-            err := conn.WriteJSON(map[string]interface{}{"type": "room_info", "data": roomInfo})
-            if err != nil {
-                log.Printf("Error sending room info to %s (user: %s): %v", conn.RemoteAddr(), peer.username, err)
+    info := RoomInfo{Users: users, Leader: leader, Follower: follower, HLSViewers: hlsViewerCount(room), SFUFollowers: sfuFollowers,
+        SimulcastLayers: simulcastLayers(room), TalkHolder: talkHolder(room), ViewModes: viewModes, Latency: latency,
+        VideoState: videoFlowState(room), StreamMetadata: metadata}
+    if cfg, ok := namedRooms.get(room); ok {
+        info.Title, info.MaxBitrateKbps, info.MaxViewers = cfg.Title, cfg.MaxBitrateKbps, cfg.MaxViewers
+    }
+    return info, true
+}
+
+// sendRoomInfo рассылает состояние комнаты ее пирам. Рассылка идет в цикле комнаты,
+// поэтому пиры получают room_info в порядке изменений состава; вызывающий не ждет.
+func sendRoomInfo(room string) {
+    a := rooms.lookup(room)
+    if a == nil {
+        return
+    }
+    a.post(func() {
+        roomInfo, exists := buildRoomInfo(room)
+        if !exists {
+            return
+        }
+        for _, peer := range a.peers() {
+            if err := peer.writeJSON(map[string]interface{}{"type": "room_info", "data": roomInfo}); err != nil {
+                log.Printf("Error sending room info to %s: %v", peer.username, err)
             }
         }
-        peer.mu.Unlock()
+    })
+}
+
+var (
+    errRoomNotFound      = errors.New("Room does not exist. Leader must join first.")
+    errNoLeader          = errors.New("No leader in room")
+    errLeaderOnOtherNode = errors.New("Leader is connected to another server node, sfu mode is unavailable")
+)
+
+// checkViewerAccess проверяет, может ли зритель подключиться к комнате.
+// Одни и те же правила действуют для ведомого в /wsgo и для RTSP-клиентов.
+// Ведущий другого узла здесь не учитывается: его медиа на этом узле недоступно.
+func checkViewerAccess(room string) error {
+    roomPeers := roomPeers(room)
+    if len(roomPeers) == 0 {
+        return errRoomNotFound
+    }
+    for _, p := range roomPeers {
+        if p.isLeader {
+            return nil
+        }
     }
+    return errNoLeader
+}
+
+// checkFollowerAccess - checkViewerAccess для ведомого в /wsgo с учетом ведущего на другом узле
+// и именованных комнат, где ведомые могут ждать ведущего (admission open)
+func checkFollowerAccess(room, mode string) error {
+    err := checkViewerAccess(room)
+    if err != nil && roomAdmitsWithoutLeader(room) {
+        return nil
+    }
+    if _, remote := remoteLeader(room); err != nil && remote {
+        // Ведущий подключен к другому узлу: P2P-сигнализация пересылается через backend,
+        // а медиа через сервер есть только на узле ведущего
+        err = nil
+        if mode == peerModeSFU {
+            err = errLeaderOnOtherNode
+        }
+    }
+    return err
+}
+
+// roomLeader возвращает ведущего комнаты или nil
+func roomLeader(room string) *Peer {
+    for _, p := range roomPeers(room) {
+        if p.isLeader {
+            return p
+        }
+    }
+    return nil
+}
+
+// signalingTarget возвращает пира для пересылки P2P-сигнализации:
+// ведомому - ведущего, ведущему - P2P-ведомого
+func signalingTarget(current *Peer) *Peer {
+    for _, p := range roomPeers(current.room) {
+        if p == current {
+            continue
+        }
+        if current.isLeader {
+            if !p.isLeader && p.mode != peerModeSFU {
+                return p
+            }
+        } else if p.isLeader {
+            return p
+        }
+    }
+    return nil
 }
 
 // closePeerResources - унифицированная функция для закрытия ресурсов пира
@@ -324,274 +530,398 @@ func closePeerResources(peer *Peer, reason string) {
 if peer == nil {
 return
 }
+    if peer.signaling != nil {
+        peer.signaling.stop() // Поставленные сообщения согласования увидят закрытый PeerConnection
+    }
 peer.mu.Lock() // Блокируем конкретного пира
+    if peer.closeReason == "" {
+        peer.closeReason = reason
+    }
+    // Ресурсы забираем под блокировкой, а закрываем после нее: закрытие PeerConnection может занять время
+    pc := peer.pc
+    peer.pc = nil // Помечаем как закрытое
+    conn := peer.conn
+    peer.conn = nil // Помечаем как закрытое
+    peer.mu.Unlock()
 
     // Сначала закрываем WebRTC соединение
-    if peer.pc != nil {
+    if pc != nil {
         log.Printf("Closing PeerConnection for %s (Reason: %s)", peer.username, reason)
-        // Небольшая задержка может иногда помочь отправить последние данные, но обычно не нужна
-        // time.Sleep(100 * time.Millisecond)
-        if err := peer.pc.Close(); err != nil {
+        if err := pc.Close(); err != nil {
             // Ошибки типа "invalid PeerConnection state" ожидаемы, если соединение уже закрывается
             // log.Printf("Error closing peer connection for %s: %v", peer.username, err)
         }
-        peer.pc = nil // Помечаем как закрытое
     }
 
     // Затем закрываем WebSocket соединение
-    if peer.conn != nil {
+    if conn != nil {
         log.Printf("Closing WebSocket connection for %s (Reason: %s)", peer.username, reason)
-        // Отправляем управляющее сообщение о закрытии, если возможно
-        _ = peer.conn.WriteControl(websocket.CloseMessage,
-            websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
-            time.Now().Add(time.Second)) // Даем немного времени на отправку
-        peer.conn.Close()
-        peer.conn = nil // Помечаем как закрытое
     }
-    peer.mu.Unlock()
+    if peer.out != nil {
+        // Горутина записи дописывает очередь (например, force_disconnect) и отправляет кадр закрытия
+        peer.out.close(reason)
+        return
+    }
+    if conn == nil {
+        return
+    }
+    _ = conn.WriteControl(websocket.CloseMessage,
+        websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+        time.Now().Add(time.Second)) // Даем немного времени на отправку
+    conn.Close()
 }
 
-// handlePeerJoin осталась вашей функцией с изменениями для создания PeerConnection через webrtcAPI
-func handlePeerJoin(room string, username string, isLeader bool, conn *websocket.Conn, preferredCodec string) (*Peer, error) {
-    mu.Lock()
-    defer mu.Unlock() // Гарантируем разблокировку мьютекса при выходе из функции
-
-    // Очистка устаревших пиров в комнате
-    if roomPeers, exists := rooms[room]; exists {
-        for uname, p := range roomPeers {
-            p.mu.Lock()
-            if p.conn == nil || p.pc == nil || p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
-                log.Printf("Removing stale peer %s from room %s", uname, room)
-                delete(roomPeers, uname)
-                for addr, peer := range peers {
-                    if peer == p {
-                        delete(peers, addr)
-                        break
-                    }
-                }
-                go closePeerResources(p, "Stale peer cleanup")
-            }
-            p.mu.Unlock()
-        }
-        if len(roomPeers) == 0 {
-            delete(rooms, room)
-        }
+// removeFromRoom удаляет пира из комнаты в ее цикле, не дожидаясь этого, и рассылает новый состав
+func removeFromRoom(peer *Peer) {
+    a := peer.actor
+    if a == nil {
+        return
     }
-
-    if _, exists := rooms[room]; !exists {
-        if !isLeader {
-            _ = conn.WriteJSON(map[string]interface{}{"type": "error", "data": "Room does not exist. Leader must join first."})
-            conn.Close()
-            return nil, errors.New("room does not exist for follower")
+    a.post(func() {
+        if a.removeMember(peer) {
+            log.Printf("Removed %s from room %s", peer.username, peer.room)
+            sendRoomInfo(peer.room)
         }
-        rooms[room] = make(map[string]*Peer)
-    }
+    })
+}
 
-    roomPeers := rooms[room]
+// joinRequest - параметры входа из первого сообщения WebSocket и данные соединения;
+// разбирается и нормализуется один раз в handleWebSocket
+type joinRequest struct {
+    Room           string `json:"room"`
+    Username       string `json:"username"`
+    IsLeader       bool   `json:"isLeader"`
+    PreferredCodec string `json:"preferredCodec"`
+    Mode           string `json:"mode"` // p2p (по умолчанию) или sfu
+    ViewMode       string `json:"viewMode"` // full (по умолчанию), audio или slideshow
+
+    SessionID string `json:"-"` // выдается сервером при подключении
+    ClientIP  string `json:"-"` // адрес клиента с учетом доверенных прокси
+}
 
-    // Логика замены ведомого
-    if !isLeader {
-        hasLeader := false
-        for _, p := range roomPeers {
-            if p.isLeader {
-                hasLeader = true
-                break
-            }
-        }
-        if !hasLeader {
-            _ = conn.WriteJSON(map[string]interface{}{"type": "error", "data": "No leader in room"})
+// handlePeerJoin создает пира и его PeerConnection, а решение о входе в комнату
+// (очистка устаревших пиров, проверка доступа, замена ведомого) принимает в цикле комнаты
+func handlePeerJoin(conn *websocket.Conn, req joinRequest) (*Peer, error) {
+    // Ведомого без ведущего и вход в незарегистрированную комнату (ROOMS_STRICT) отклоняем сразу,
+    // не создавая PeerConnection; окончательная проверка - в цикле комнаты
+    if err := checkNamedRoomJoin(req.Room, req.IsLeader, 0); err != nil {
+        _ = conn.WriteJSON(map[string]interface{}{"type": "error", "data": err.Error()})
+        conn.Close()
+        return nil, fmt.Errorf("join rejected: %w", err)
+    }
+    if !req.IsLeader {
+        if err := checkFollowerAccess(req.Room, req.Mode); err != nil {
+            _ = conn.WriteJSON(map[string]interface{}{"type": "error", "data": err.Error()})
             conn.Close()
-            return nil, errors.New("no leader in room")
-        }
-
-        var existingFollower *Peer
-        codec := preferredCodec
-        if codec == "" {
-            codec = "H264"
-        }
-        log.Printf("Follower %s prefers codec: %s in room %s", username, codec, room)
-
-        for _, p := range roomPeers {
-            if !p.isLeader {
-                existingFollower = p
-                break
-            }
+            return nil, fmt.Errorf("follower rejected: %w", err)
         }
+    }
 
-        if existingFollower != nil {
-            log.Printf("Replacing old follower %s with new follower %s in room %s", existingFollower.username, username, room)
-            delete(roomPeers, existingFollower.username)
-            for addr, pItem := range peers {
-                if pItem == existingFollower {
-                    delete(peers, addr)
-                    break
-                }
-            }
-            existingFollower.mu.Lock()
-            if existingFollower.conn != nil {
-                _ = existingFollower.conn.WriteJSON(map[string]interface{}{
-                    "type": "force_disconnect",
-                    "data": "You have been replaced by another viewer",
-                })
-            }
-            existingFollower.mu.Unlock()
-            go closePeerResources(existingFollower, "Replaced by new follower")
+    // Окончательное имя (политика повторяющихся имен) выбирается до создания пира:
+    // очередь отправки, метрики и обработчики PeerConnection используют уже его
+    var reserveErr error
+    actor := rooms.call(req.Room, func(a *roomActor) {
+        req.Username, reserveErr = reserveUsername(a, req.Username, req.SessionID)
+    })
+    if reserveErr != nil {
+        _ = conn.WriteJSON(map[string]interface{}{"type": "error", "data": reserveErr.Error()})
+        conn.Close()
+        return nil, fmt.Errorf("join rejected: %w", reserveErr)
+    }
+    admitting := false
+    defer func() {
+        if !admitting {
+            actor.post(func() { releaseUsername(actor, req.Username, req.SessionID) })
         }
+    }()
 
-        var leaderPeer *Peer
-        for _, p := range roomPeers {
-            if p.isLeader {
-                leaderPeer = p
-                break
-            }
-        }
-        if leaderPeer != nil && isConnAlive(leaderPeer.conn) {
-            log.Printf("Sending rejoin_and_offer command to leader %s for new follower %s with codec %s", leaderPeer.username, username, codec)
-            leaderPeer.mu.Lock()
-            err := leaderPeer.conn.WriteJSON(map[string]interface{}{
-                "type":           "rejoin_and_offer",
-                "room":           room,
-                "preferredCodec": codec,
-            })
-            leaderPeer.mu.Unlock()
-            if err != nil {
-                log.Printf("Error sending rejoin_and_offer to leader %s: %v", leaderPeer.username, err)
-            }
-        }
+    peerAPI, interceptors, err := newWebRTCAPI(req.PreferredCodec)
+    if err != nil {
+        return nil, fmt.Errorf("failed to configure WebRTC API: %w", err)
     }
-
-    mediaEngine := createMediaEngine(preferredCodec)
-    peerAPI := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
     peerConnection, err := peerAPI.NewPeerConnection(getWebRTCConfig())
     if err != nil {
         return nil, fmt.Errorf("failed to create PeerConnection: %w", err)
     }
-    log.Printf("PeerConnection created for %s with preferred codec %s", username, preferredCodec)
+    log.Printf("PeerConnection created for %s with preferred codec %s", req.Username, req.PreferredCodec)
+
+    peer := &Peer{
+        conn:     conn,
+        pc:       peerConnection,
+        sessionID: req.SessionID,
+        clientIP: req.ClientIP,
+        connectedAt: time.Now(),
+        username: req.Username,
+        room:     req.Room,
+        isLeader: req.IsLeader,
+        mode:     req.Mode,
+        codec:    req.PreferredCodec,
+        viewMode: req.ViewMode,
+        bwe:      interceptors.bwe,
+        stats:    interceptors.stats,
+        out:      newPeerWriter(conn, req.Username, req.IsLeader),
+            signaling: newEventLoop(),
+}
 
     peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-        log.Printf("PeerConnection state changed for %s: %s", username, s.String())
+        log.Printf("PeerConnection state changed for %s: %s", peer.username, s.String())
         if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateFailed {
-            log.Printf("PeerConnection for %s is disconnected or failed, closing resources", username)
-            tempPeer := &Peer{
-                conn:     conn,
-                pc:       peerConnection,
-                username: username,
-                room:     room,
-                isLeader: isLeader,
-            }
-            go closePeerResources(tempPeer, "PeerConnection failed or disconnected")
-            mu.Lock()
-            if roomPeers, exists := rooms[room]; exists {
-                log.Printf("Removing %s from room %s", username, room)
-                delete(roomPeers, username)
-                if len(roomPeers) == 0 {
-                    log.Printf("Room %s is empty, deleting", room)
-                    delete(rooms, room)
-                }
+            log.Printf("PeerConnection for %s is disconnected or failed, closing resources", peer.username)
+            if s == webrtc.PeerConnectionStateFailed {
+                publishLifecycle(lifecycleNegotiationFailed, req.Room, peer.username, map[string]interface{}{"stage": "server_connection", "state": s.String()})
             }
-            log.Printf("Removing %s from peers (addr: %s)", username, conn.RemoteAddr().String())
-            delete(peers, conn.RemoteAddr().String())
-            mu.Unlock()
-            log.Printf("Sending updated room info for %s", room)
-            sendRoomInfo(room)
+            go closePeerResources(peer, "PeerConnection failed or disconnected")
+            removeFromRoom(peer)
         }
     })
 
-    peer := &Peer{
-        conn:     conn,
-        pc:       peerConnection,
-        username: username,
-        room:     room,
-        isLeader: isLeader,
-    }
-
-    if isLeader {
-        videoTransceiver, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+    if req.IsLeader {
+        if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
             Direction: webrtc.RTPTransceiverDirectionSendonly,
-        })
-        if err != nil {
-            log.Printf("Failed to add video transceiver for leader %s: %v", username, err)
-            conn.WriteJSON(map[string]interface{}{
+        }); err != nil {
+            log.Printf("Failed to add video transceiver for leader %s: %v", req.Username, err)
+            _ = peer.writeJSON(map[string]interface{}{
                 "type": "error",
                 "data": "Failed to add video transceiver",
             })
-            conn.Close()
+            go peer.out.close("Failed to add video transceiver")
+            peer.signaling.stop()
+            peerConnection.Close()
             return nil, fmt.Errorf("failed to add video transceiver: %w", err)
         }
-        go func() {
-            time.Sleep(5 * time.Second)
-            peer.mu.Lock()
-            defer peer.mu.Unlock()
-            if videoTransceiver.Sender() == nil || videoTransceiver.Sender().Track() == nil {
-                log.Printf("No video track added by leader %s in room %s", username, room)
-                if peer.conn != nil {
-                    peer.conn.WriteJSON(map[string]interface{}{
-                        "type": "error",
-                        "data": "No video track detected. Please ensure camera is active.",
-                    })
-                }
-            } else {
-                log.Printf("Video track confirmed for leader %s in room %s", username, room)
-            }
-        }()
     }
 
-    if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+    if req.IsLeader {
+        // Ведущий слышит ведомого, которому дано слово, через аудиотрек talkback
+        talkback, err := newTalkbackTrack(peer)
+        if err == nil {
+            _, err = peerConnection.AddTransceiverFromTrack(talkback, webrtc.RTPTransceiverInit{
+                Direction: webrtc.RTPTransceiverDirectionSendrecv,
+            })
+        }
+        if err != nil {
+            log.Printf("Failed to add audio transceiver for %s: %v", req.Username, err)
+        }
+    } else if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
         Direction: webrtc.RTPTransceiverDirectionSendrecv,
     }); err != nil {
-        log.Printf("Failed to add audio transceiver for %s: %v", username, err)
+        log.Printf("Failed to add audio transceiver for %s: %v", req.Username, err)
     }
 
     peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
         if c == nil {
-            log.Printf("No more ICE candidates for %s", username)
+            log.Printf("No more ICE candidates for %s", peer.username)
             return
         }
-        log.Printf("ICE candidate for %s: %s", username, c.ToJSON().Candidate)
-        peer.mu.Lock()
-        defer peer.mu.Unlock()
-        if peer.conn != nil && isConnAlive(peer.conn) {
-            err := peer.conn.WriteJSON(map[string]interface{}{"type": "ice_candidate", "ice": c.ToJSON()})
-            if err != nil {
-                log.Printf("Error sending ICE candidate to %s: %v", peer.username, err)
-                go closePeerResources(peer, "Failed to send ICE candidate")
-            }
+        log.Printf("ICE candidate for %s: %s", peer.username, c.ToJSON().Candidate)
+        // Кандидаты серверного PeerConnection, не путать с ice_candidate между пирами
+        if err := peer.writeJSON(map[string]interface{}{"type": "server_ice_candidate", "ice": c.ToJSON()}); err != nil {
+            log.Printf("Error sending ICE candidate to %s: %v", peer.username, err)
         }
     })
 
-    if !isLeader {
+    if !req.IsLeader {
         peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
             log.Printf("Track received for follower %s in room %s: Codec %s",
-                username, room, track.Codec().MimeType)
+                peer.username, req.Room, track.Codec().MimeType)
+            if track.Kind() == webrtc.RTPCodecTypeAudio {
+                forwardTalkback(peer, track)
+            }
+        })
+    } else {
+        // Ведущий может опубликовать медиа на сервер (publish_offer) для выдачи через HLS
+        peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+            startIngest(peer, peerConnection, track, receiver)
         })
     }
 
-    rooms[room][username] = peer
-    peers[conn.RemoteAddr().String()] = peer
+    var joinErr error
+    admitting = true
+    rooms.call(req.Room, func(a *roomActor) {
+        joinErr = admitPeer(a, peer)
+    })
+    if joinErr != nil {
+        _ = peer.writeJSON(map[string]interface{}{"type": "error", "data": joinErr.Error()})
+        peerConnection.Close()
+        peer.signaling.stop()
+        peer.out.close("Join rejected")
+        return nil, fmt.Errorf("join rejected: %w", joinErr)
+    }
+    if req.IsLeader {
+        // Поступление видео проверяется по RTP ведущего и отчетам ведомых, а не по трансиверу сервера
+        trackVideoFlow(peer)
+    }
 
-    err = conn.WriteJSON(map[string]interface{}{
+    err = peer.writeJSON(map[string]interface{}{
         "type": "room_info",
         "data": map[string]interface{}{
-            "room":     room,
-            "username": username,
-            "isLeader": isLeader,
+            "room":     req.Room,
+            "username": req.Username,
+            "isLeader": req.IsLeader,
         },
     })
     if err != nil {
-        log.Printf("Error sending room_info to %s: %v", username, err)
+        log.Printf("Error sending room_info to %s: %v", req.Username, err)
     } else {
-        log.Printf("Sent room_info to %s", username)
+        log.Printf("Sent room_info to %s", req.Username)
     }
 
     return peer, nil
 }
 
+// viewersAfterJoin считает ведомых комнаты (на всех узлах) вместе с новым пиром.
+// Новый P2P-ведомый заменяет прежнего и число ведомых не увеличивает. Вызывается в цикле комнаты.
+func viewersAfterJoin(a *roomActor, peer *Peer) int {
+    viewers, p2p := 1, false
+    for _, p := range a.members {
+        if !p.isLeader {
+            viewers++
+            p2p = p2p || p.mode != peerModeSFU
+        }
+    }
+    for _, m := range roomState.RemoteMembers(a.name) {
+        if !m.IsLeader {
+            viewers++
+            p2p = p2p || m.Mode != peerModeSFU
+        }
+    }
+    if p2p && peer.mode != peerModeSFU {
+        viewers--
+    }
+    return viewers + passiveViewerCount(a.name)
+}
+
+// admitPeer добавляет пира в комнату. Вызывается в цикле комнаты: сетевые отправки только
+// ставятся в очереди пиров, а обращения к backend выполняются в отдельных горутинах.
+func admitPeer(a *roomActor, peer *Peer) error {
+    room := a.name
+
+    // Очистка устаревших пиров в комнате
+    for uname, p := range a.members {
+        p.mu.Lock()
+        stale := p.conn == nil || p.pc == nil || p.pc.ConnectionState() == webrtc.PeerConnectionStateClosed
+        p.mu.Unlock()
+        if stale {
+            log.Printf("Removing stale peer %s from room %s", uname, room)
+            a.removeMember(p)
+            go closePeerResources(p, "Stale peer cleanup")
+        }
+    }
+
+    if err := resolveDuplicateUsername(a, peer); err != nil {
+        return err
+    }
+    username := peer.username
+
+    if !peer.isLeader {
+        if err := checkFollowerAccess(room, peer.mode); err != nil {
+            return err
+        }
+    }
+    if err := checkNamedRoomJoin(room, peer.isLeader, viewersAfterJoin(a, peer)); err != nil {
+        return err
+    }
+
+    // Логика замены ведомого (ведомые в режиме sfu не занимают место P2P-ведомого)
+    if !peer.isLeader && peer.mode != peerModeSFU {
+        var existingFollower *Peer
+        codec := peer.codec
+        if codec == "" {
+            codec = "H264"
+        }
+        log.Printf("Follower %s prefers codec: %s in room %s", username, codec, room)
+
+        for _, p := range a.peers() {
+            if !p.isLeader && p.mode != peerModeSFU {
+                existingFollower = p
+                break
+            }
+        }
+
+        if existingFollower != nil {
+            log.Printf("Replacing old follower %s with new follower %s in room %s", existingFollower.username, username, room)
+            a.removeMember(existingFollower)
+            _ = existingFollower.writeJSON(map[string]interface{}{
+                "type": "force_disconnect",
+                "data": "You have been replaced by another viewer",
+            })
+            go closePeerResources(existingFollower, "Replaced by new follower")
+            publishLifecycle(lifecycleFollowerReplaced, room, existingFollower.username, map[string]interface{}{"replacedBy": username})
+        } else {
+            for _, m := range roomState.RemoteMembers(room) {
+                if !m.IsLeader && m.Mode != peerModeSFU && m.Username != username {
+                    log.Printf("Replacing follower %s on node %s with new follower %s in room %s", m.Username, m.Node, username, room)
+                    publishLifecycle(lifecycleFollowerReplaced, room, m.Username, map[string]interface{}{"replacedBy": username, "node": m.Node})
+                    go func(m roomMember) {
+                        if err := roomState.Relay(m, relayEnvelope{Kind: relayReplace, Room: room, To: m.Username, From: username}); err != nil {
+                            log.Printf("Error replacing follower %s on node %s: %v", m.Username, m.Node, err)
+                        }
+                    }(m)
+                    break
+                }
+            }
+        }
+
+        if leaderPeer := roomLeader(room); leaderPeer != nil {
+            log.Printf("Sending rejoin_and_offer command to leader %s for new follower %s with codec %s", leaderPeer.username, username, codec)
+            err := leaderPeer.writeJSON(map[string]interface{}{
+                "type":           "rejoin_and_offer",
+                "room":           room,
+                "preferredCodec": codec,
+                "viewMode":       peer.viewMode,
+            })
+            if err != nil {
+                log.Printf("Error sending rejoin_and_offer to leader %s: %v", leaderPeer.username, err)
+            }
+        } else if leaderMember, ok := remoteLeader(room); ok {
+            log.Printf("Relaying rejoin_and_offer to leader %s on node %s for new follower %s with codec %s", leaderMember.Username, leaderMember.Node, username, codec)
+            msg, _ := json.Marshal(map[string]interface{}{
+                "type":           "rejoin_and_offer",
+                "room":           room,
+                "preferredCodec": codec,
+                "viewMode":       peer.viewMode,
+            })
+            go relayToMember(&Peer{username: username}, leaderMember, msg)
+        }
+    }
+
+    if len(a.members) == 0 {
+        publishLifecycle(lifecycleRoomCreated, room, username, map[string]interface{}{"isLeader": peer.isLeader})
+    }
+    peer.actor = a
+    a.addMember(peer)
+    return nil
+}
 // main осталась вашей функцией
 func main() {
 
     cleanupPeers()
+    if err := initRoomBackend(); err != nil {
+        log.Fatalf("Failed to initialize room backend: %v", err)
+    }
     initializeMediaAPI()
+    startRTSPServer()
+    startStatsReporter()
+    startSlideshowKeyframes()
+    startRecordingRetention()
+    startTimelapse()
+    startLatencyProbe()
+    startVideoFlowMonitor()
+    startEventStream()
+    startWebhooks()
+    startSessionHistory()
+    startNamedRoomExpiry()
     http.HandleFunc("/wsgo", handleWebSocket)
+    http.HandleFunc("/hls/", handleHLS)
+    http.HandleFunc("/api/rooms", handleRoomsAPI)
+    http.HandleFunc("/api/rooms/", handleRoomsAPI)
+    http.HandleFunc("/api/recordings", handleRecordingsAPI)
+    http.HandleFunc("/api/recordings/", handleRecordingsAPI)
+    http.HandleFunc("/api/timelapse", handleTimelapseAPI)
+    http.HandleFunc("/api/timelapse/", handleTimelapseAPI)
+    http.HandleFunc("/api/sessions", handleSessionsAPI)
+    http.HandleFunc("/api/sessions/", handleSessionsAPI)
+    http.HandleFunc("/metrics", handleMetrics)
     http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
         logStatus()
         w.WriteHeader(http.StatusOK)
@@ -609,14 +939,10 @@ func main() {
 }
 
 func cleanupPeers() {
-    mu.Lock()
-    defer mu.Unlock()
-
-    for _, peer := range peers {
+    // Комнаты останавливаются сами, когда из них выходят закрытые пиры
+    for _, peer := range allPeers() {
         go closePeerResources(peer, "Server cleanup on restart")
     }
-    peers = make(map[string]*Peer)
-    rooms = make(map[string]map[string]*Peer)
     log.Println("All peers and rooms have been cleaned up")
 }
 
@@ -627,17 +953,15 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
         log.Println("WebSocket upgrade error:", err)
         return
     }
-    remoteAddr := conn.RemoteAddr().String()
+    sessionID := newSessionID()
+    clientAddr := clientIP(r)
+    // В журнале соединение обозначается адресом клиента и ID сессии: за прокси адреса совпадают
+    remoteAddr := fmt.Sprintf("%s (session %s)", clientAddr, sessionID)
     log.Printf("New WebSocket connection attempt from: %s", remoteAddr)
 
-    var initData struct {
-        Room           string `json:"room"`
-        Username       string `json:"username"`
-        IsLeader       bool   `json:"isLeader"`
-        PreferredCodec string `json:"preferredCodec"`
-    }
+    req := joinRequest{SessionID: sessionID, ClientIP: clientAddr}
     conn.SetReadDeadline(time.Now().Add(10 * time.Second))
-    err = conn.ReadJSON(&initData)
+    err = conn.ReadJSON(&req)
     conn.SetReadDeadline(time.Time{})
 
     if err != nil {
@@ -645,41 +969,77 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
         conn.Close()
         return
     }
-    if initData.Room == "" || initData.Username == "" {
+    if req.Room == "" || req.Username == "" {
         log.Printf("Invalid init data from %s: Room or Username is empty. Closing.", remoteAddr)
         _ = conn.WriteJSON(map[string]interface{}{"type": "error", "data": "Room and Username cannot be empty"})
         conn.Close()
         return
     }
 
-    log.Printf("User '%s' (isLeader: %v, preferredCodec: %s) attempting to join room '%s' from %s",
-        initData.Username, initData.IsLeader, initData.PreferredCodec, initData.Room, remoteAddr)
+    if req.PreferredCodec == "" {
+        if cfg, ok := namedRooms.get(req.Room); ok {
+            req.PreferredCodec = cfg.DefaultCodec
+        }
+    }
+    if req.IsLeader || req.Mode != peerModeSFU {
+        req.Mode = peerModeP2P
+    }
+    if req.IsLeader {
+        req.ViewMode = ""
+    } else if req.ViewMode, err = normalizeViewMode(req.ViewMode); err != nil {
+        log.Printf("Invalid view mode from %s: %v. Using %s.", remoteAddr, err, viewModeFull)
+        req.ViewMode = viewModeFull
+    }
+
+    log.Printf("User '%s' (isLeader: %v, preferredCodec: %s, mode: %s) attempting to join room '%s' from %s",
+        req.Username, req.IsLeader, req.PreferredCodec, req.Mode, req.Room, remoteAddr)
 
-    currentPeer, err := handlePeerJoin(initData.Room, initData.Username, initData.IsLeader, conn, initData.PreferredCodec)
+    currentPeer, err := handlePeerJoin(conn, req)
     if err != nil {
-        log.Printf("Error handling peer join for %s: %v", initData.Username, err)
+        log.Printf("Error handling peer join for %s: %v", req.Username, err)
         return
     }
     if currentPeer == nil {
-        log.Printf("Peer %s was not created. Connection likely closed by handlePeerJoin.", initData.Username)
+        log.Printf("Peer %s was not created. Connection likely closed by handlePeerJoin.", req.Username)
         return
     }
 
-    log.Printf("User '%s' successfully joined room '%s' as %s", currentPeer.username, currentPeer.room, map[bool]string{true: "leader", false: "follower"}[currentPeer.isLeader])
+    log.Printf("User '%s' successfully joined room '%s' as %s (session %s from %s)", currentPeer.username, currentPeer.room,
+        map[bool]string{true: "leader", false: "follower"}[currentPeer.isLeader], currentPeer.sessionID, currentPeer.clientIP)
     logStatus()
+    member := memberOf(currentPeer)
+    roomState.Join(member)
+    joinedAt := time.Now()
+    recordSessionStart(currentPeer, member.ViewMode)
+    publishLifecycle(lifecyclePeerJoined, currentPeer.room, currentPeer.username, map[string]interface{}{
+        "isLeader": currentPeer.isLeader,
+        "mode":     currentPeer.mode,
+        "codec":    currentPeer.codec,
+        "viewMode": member.ViewMode,
+    })
     sendRoomInfo(currentPeer.room)
+    if currentPeer.mode == peerModeSFU {
+        addSubscriber(currentPeer, currentPeer.pc)
+    }
 
-    // Цикл чтения сообщений от клиента
+    // Цикл чтения сообщений от клиента; пропущенные pong завершают его по таймауту чтения
+    startHeartbeat(conn)
+    var readErr error
     for {
         msgType, msgBytes, err := conn.ReadMessage()
         if err != nil {
-            if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+            readErr = err
+            if isHeartbeatTimeout(err) {
+                log.Printf("No pong from %s (%s) within %s, evicting dead peer", currentPeer.username, remoteAddr, heartbeatConfig.PongTimeout)
+                heartbeatTimeoutsTotal.inc(map[bool]string{true: "leader", false: "follower"}[currentPeer.isLeader])
+            } else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
                 log.Printf("Unexpected WebSocket close error for %s (%s): %v", currentPeer.username, remoteAddr, err)
             } else {
                 log.Printf("WebSocket connection closed/read error for %s (%s): %v", currentPeer.username, remoteAddr, err)
             }
             break
         }
+        extendReadDeadline(conn)
 
         if msgType != websocket.TextMessage {
             log.Printf("Received non-text message type (%d) from %s. Ignoring.", msgType, currentPeer.username)
@@ -689,136 +1049,243 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
             continue
         }
 
-        var data map[string]interface{}
-        if err := json.Unmarshal(msgBytes, &data); err != nil {
-            log.Printf("JSON unmarshal error (for logging type) from %s: %v. Message: %s. Forwarding raw.", currentPeer.username, err, string(msgBytes))
+        // Согласование серверного PeerConnection (pion) не трогает состав комнаты и может занять время:
+        // оно выполняется в очереди согласования пира, по порядку, но без остановки комнаты и чтения (pong)
+        if handled := handleServerNegotiation(currentPeer, msgBytes); handled {
+            continue
         }
-        dataType, _ := data["type"].(string)
 
-        mu.Lock()
-        roomPeers := rooms[currentPeer.room]
-        var targetPeer *Peer
-        if roomPeers != nil {
-            for _, p := range roomPeers {
-                if p.username != currentPeer.username {
-                    targetPeer = p
-                    break
-                }
-            }
+        // Сообщение обрабатывается в цикле комнаты по порядку со входами и выходами пиров;
+        // чтение ждет обработки, поэтому поток сообщений клиента не опережает комнату
+        if !currentPeer.actor.call(func() { handlePeerMessage(currentPeer, req.PreferredCodec, msgBytes) }) {
+            log.Printf("Room %s of %s is closed, ending WebSocket loop", currentPeer.room, currentPeer.username)
+            break
         }
-        mu.Unlock()
+    }
 
-        if targetPeer == nil && (dataType == "offer" || dataType == "answer" || dataType == "ice_candidate") {
-            continue
+    log.Printf("Cleaning up for %s (Addr: %s) in room %s after WebSocket loop ended.", currentPeer.username, remoteAddr, currentPeer.room)
+    currentPeer.mu.Lock()
+    endReason := currentPeer.closeReason
+    bytesSent, bytesReceived := transportBytes(currentPeer.pc)
+    currentPeer.mu.Unlock()
+    if endReason == "" {
+        endReason = "Connection lost"
+        if websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+            endReason = "Closed by client"
+        } else if isHeartbeatTimeout(readErr) {
+            endReason = "Heartbeat timeout"
+        }
+    }
+    recordSessionEnd(currentPeer, endReason, bytesSent, bytesReceived)
+    go closePeerResources(currentPeer, "WebSocket read loop ended")
+    if currentPeer.mode == peerModeSFU {
+        removeSubscriber(currentPeer)
+    }
+    if currentPeer.isLeader {
+        detachTalkback(currentPeer)
+        dropVideoFlow(currentPeer)
+    } else {
+        releaseTalkFloor(currentPeer)
+    }
+
+    // Выход обрабатывается в цикле комнаты; тезка, уже занявший место пира, не затрагивается
+    roomName := currentPeer.room
+    room := currentPeer.actor
+    succeeded := false
+    room.call(func() {
+        room.removeMember(currentPeer)
+        succeeded = room.members[currentPeer.username] != nil
+        if len(room.members) == 0 {
+            log.Printf("Room %s is now empty and will be closed if nobody joins within %s.", roomName, roomIdleGrace)
+            roomName = ""
         }
+    })
+    member = memberOf(currentPeer)
+    // Если место занял тезка (takeover), запись в общем реестре уже принадлежит ему
+    if !succeeded {
+        roomState.Leave(member)
+    }
+    publishLifecycle(lifecyclePeerLeft, currentPeer.room, currentPeer.username, map[string]interface{}{
+        "isLeader":        currentPeer.isLeader,
+        "mode":            currentPeer.mode,
+        "durationSeconds": time.Since(joinedAt).Seconds(),
+    })
+    if currentPeer.isLeader {
+        publishLifecycle(lifecycleLeaderOffline, currentPeer.room, currentPeer.username, nil)
+    }
+
+    logStatus()
+    if roomName != "" {
+        sendRoomInfo(roomName)
+    }
+    log.Printf("Cleanup complete for WebSocket connection %s (User: %s)", remoteAddr, currentPeer.username)
+}
 
+// Сообщения согласования серверного PeerConnection, которые обрабатываются вне цикла комнаты
+var serverNegotiationMessages = map[string]bool{"publish_offer": true, "server_ice_candidate": true, "subscribe_answer": true}
+
+// handleServerNegotiation ставит сообщение согласования серверного PeerConnection в очередь согласования
+// пира и возвращает true; для остальных сообщений возвращает false
+func handleServerNegotiation(currentPeer *Peer, msgBytes []byte) bool {
+    var data map[string]interface{}
+    if err := json.Unmarshal(msgBytes, &data); err != nil {
+        return false
+    }
+    dataType, _ := data["type"].(string)
+    if !serverNegotiationMessages[dataType] {
+        return false
+    }
+    currentPeer.signaling.post(func() {
         switch dataType {
-        case "offer":
-            log.Printf("Received offer from %s: %s", currentPeer.username, string(msgBytes))
-            if currentPeer.isLeader && targetPeer != nil && !targetPeer.isLeader {
-                log.Printf(">>> Forwarding Offer from %s to %s", currentPeer.username, targetPeer.username)
-                preferredCodec, _ := data["preferredCodec"].(string)
-                if preferredCodec == "" {
-                    preferredCodec = initData.PreferredCodec
-                    if preferredCodec == "" {
-                        preferredCodec = "H264"
-                    }
-                }
-                if sdp, ok := data["sdp"].(string); ok {
-                    data["sdp"] = normalizeSdpForCodec(sdp, preferredCodec)
-                    msgBytes, _ = json.Marshal(data)
-                }
-                targetPeer.mu.Lock()
-                targetWsConn := targetPeer.conn
-                targetPeer.mu.Unlock()
-                if targetWsConn != nil && isConnAlive(targetWsConn) {
-                    if err := targetWsConn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-                        log.Printf("!!! Error forwarding offer to %s: %v", targetPeer.username, err)
-                        go closePeerResources(targetPeer, "Failed to forward offer")
-                    }
-                } else {
-                    log.Printf("Target WebSocket connection for %s is not alive, skipping offer forwarding", targetPeer.username)
-                }
-            } else {
-                log.Printf("WARN: Received 'offer' from non-leader or no target.")
+        case "publish_offer":
+            if err := handlePublishOffer(currentPeer, data); err != nil {
+                log.Printf("Error handling publish_offer from %s: %v", currentPeer.username, err)
+                publishLifecycle(lifecycleNegotiationFailed, currentPeer.room, currentPeer.username, map[string]interface{}{"stage": "publish_offer", "error": err.Error()})
+                _ = currentPeer.writeJSON(map[string]interface{}{"type": "error", "data": "Failed to publish media to server"})
             }
 
-        case "answer":
-            if targetPeer != nil && !currentPeer.isLeader && targetPeer.isLeader {
-                log.Printf("<<< Forwarding Answer from %s to %s", currentPeer.username, targetPeer.username)
-                // Нормализуем SDP
-                preferredCodec, _ := data["preferredCodec"].(string)
-                if preferredCodec == "" {
-                    preferredCodec = initData.PreferredCodec
-                    if preferredCodec == "" {
-                        preferredCodec = "H264"
-                    }
-                }
-                if sdp, ok := data["sdp"].(string); ok {
-                    data["sdp"] = normalizeSdpForCodec(sdp, preferredCodec)
-                    msgBytes, _ = json.Marshal(data)
-                }
-                targetPeer.mu.Lock()
-                targetWsConn := targetPeer.conn
-                targetPeer.mu.Unlock()
-                if targetWsConn != nil {
-                    if err := targetWsConn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-                        log.Printf("!!! Error forwarding answer to %s: %v", targetPeer.username, err)
-                    }
-                }
-            } else {
-                log.Printf("WARN: Received 'answer' from non-follower or no target leader.")
+        case "server_ice_candidate":
+            if err := handleServerICECandidate(currentPeer, msgBytes); err != nil {
+                log.Printf("Error adding server ICE candidate from %s: %v", currentPeer.username, err)
             }
 
-        case "ice_candidate":
-            if targetPeer != nil {
-                log.Printf("... Forwarding ICE candidate from %s to %s", currentPeer.username, targetPeer.username)
-                targetPeer.mu.Lock()
-                targetWsConn := targetPeer.conn
-                targetPeer.mu.Unlock()
-                if targetWsConn != nil {
-                    if err := targetWsConn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-                        log.Printf("Error forwarding ICE candidate to %s: %v", targetPeer.username, err)
-                    }
-                }
+        case "subscribe_answer":
+            if err := handleSubscribeAnswer(currentPeer, data); err != nil {
+                log.Printf("Error handling subscribe_answer from %s: %v", currentPeer.username, err)
+                publishLifecycle(lifecycleNegotiationFailed, currentPeer.room, currentPeer.username, map[string]interface{}{"stage": "subscribe_answer", "error": err.Error()})
             }
+        }
+    })
+    return true
+}
 
-        case "switch_camera":
-            if targetPeer != nil {
-                log.Printf("Forwarding '%s' message from %s to %s", dataType, currentPeer.username, targetPeer.username)
-                targetPeer.mu.Lock()
-                targetWsConn := targetPeer.conn
-                targetPeer.mu.Unlock()
-                if targetWsConn != nil {
-                    if err := targetWsConn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-                        log.Printf("Error forwarding '%s' to %s: %v", dataType, targetPeer.username, err)
-                    }
-                }
+// handlePeerMessage обрабатывает сообщение клиента. Вызывается в цикле комнаты пира.
+func handlePeerMessage(currentPeer *Peer, preferredCodec string, msgBytes []byte) {
+    var data map[string]interface{}
+    if err := json.Unmarshal(msgBytes, &data); err != nil {
+        log.Printf("JSON unmarshal error (for logging type) from %s: %v. Message: %s. Forwarding raw.", currentPeer.username, err, string(msgBytes))
+    }
+    dataType, _ := data["type"].(string)
+
+    targetPeer := signalingTarget(currentPeer)
+    // Собеседник может быть подключен к другому узлу: тогда сообщение пересылается через backend
+    var remoteTarget roomMember
+    remote := false
+    if targetPeer == nil {
+        remoteTarget, remote = remoteSignalingTarget(currentPeer)
+    }
+
+    if targetPeer == nil && !remote && (dataType == "offer" || dataType == "answer" || dataType == "ice_candidate") {
+        return
+    }
+
+    switch dataType {
+    case "offer":
+        log.Printf("Received offer from %s: %s", currentPeer.username, string(msgBytes))
+        if currentPeer.isLeader && targetPeer != nil && !targetPeer.isLeader {
+            log.Printf(">>> Forwarding Offer from %s to %s", currentPeer.username, targetPeer.username)
+            msgBytes = normalizeSignalSDP(data, msgBytes, preferredCodec, roomBitrateLimitKbps(currentPeer.room))
+            if err := targetPeer.writeMessage(msgBytes); err != nil {
+                log.Printf("!!! Error forwarding offer to %s: %v", targetPeer.username, err)
             }
-        default:
-            log.Printf("Ignoring message with type '%s' from %s", dataType, currentPeer.username)
+        } else if remote && currentPeer.isLeader {
+            log.Printf(">>> Relaying Offer from %s to %s on node %s", currentPeer.username, remoteTarget.Username, remoteTarget.Node)
+            relayToMember(currentPeer, remoteTarget, normalizeSignalSDP(data, msgBytes, preferredCodec, roomBitrateLimitKbps(currentPeer.room)))
+        } else {
+            log.Printf("WARN: Received 'offer' from non-leader or no target.")
         }
-    }
 
-    log.Printf("Cleaning up for %s (Addr: %s) in room %s after WebSocket loop ended.", currentPeer.username, remoteAddr, currentPeer.room)
-    go closePeerResources(currentPeer, "WebSocket read loop ended")
+    case "answer":
+        if targetPeer != nil && !currentPeer.isLeader && targetPeer.isLeader {
+            log.Printf("<<< Forwarding Answer from %s to %s", currentPeer.username, targetPeer.username)
+            msgBytes = normalizeSignalSDP(data, msgBytes, preferredCodec, roomBitrateLimitKbps(currentPeer.room))
+            if err := targetPeer.writeMessage(msgBytes); err != nil {
+                log.Printf("!!! Error forwarding answer to %s: %v", targetPeer.username, err)
+            }
+        } else if remote && !currentPeer.isLeader {
+            log.Printf("<<< Relaying Answer from %s to %s on node %s", currentPeer.username, remoteTarget.Username, remoteTarget.Node)
+            relayToMember(currentPeer, remoteTarget, normalizeSignalSDP(data, msgBytes, preferredCodec, roomBitrateLimitKbps(currentPeer.room)))
+        } else {
+            log.Printf("WARN: Received 'answer' from non-follower or no target leader.")
+        }
 
-    mu.Lock()
-    roomName := currentPeer.room
-    if currentRoomPeers, roomExists := rooms[roomName]; roomExists {
-        delete(currentRoomPeers, currentPeer.username)
-        if len(currentRoomPeers) == 0 {
-            delete(rooms, roomName)
-            log.Printf("Room %s is now empty and has been deleted.", roomName)
-            roomName = ""
+    case "ice_candidate":
+        if targetPeer != nil {
+            log.Printf("... Forwarding ICE candidate from %s to %s", currentPeer.username, targetPeer.username)
+            if err := targetPeer.writeMessage(msgBytes); err != nil {
+                log.Printf("Error forwarding ICE candidate to %s: %v", targetPeer.username, err)
+            }
+        } else if remote {
+            log.Printf("... Relaying ICE candidate from %s to %s on node %s", currentPeer.username, remoteTarget.Username, remoteTarget.Node)
+            relayToMember(currentPeer, remoteTarget, msgBytes)
         }
-    }
-    delete(peers, remoteAddr)
-    mu.Unlock()
 
-    logStatus()
-    if roomName != "" {
-        sendRoomInfo(roomName)
+    case "select_layer":
+        if err := handleSelectLayer(currentPeer, data); err != nil {
+            log.Printf("Error handling select_layer from %s: %v", currentPeer.username, err)
+            _ = currentPeer.writeJSON(map[string]interface{}{"type": "error", "data": err.Error()})
+        }
+
+    case "request_keyframe":
+        // Ведомый восстанавливается после потерь или начал показ: просим ключевой кадр у ведущего
+        if !currentPeer.isLeader {
+            requestRoomKeyframe(currentPeer.room, fmt.Sprintf("requested by follower %s", currentPeer.username), false)
+        }
+
+    case "set_view_mode":
+        if err := handleSetViewMode(currentPeer, data); err != nil {
+            log.Printf("Error handling set_view_mode from %s: %v", currentPeer.username, err)
+            _ = currentPeer.writeJSON(map[string]interface{}{"type": "error", "data": err.Error()})
+        } else {
+            roomState.Join(memberOf(currentPeer))
+        }
+
+    case "talk_start":
+        if err := handleTalkStart(currentPeer); err != nil {
+            log.Printf("Error handling talk_start from %s: %v", currentPeer.username, err)
+            _ = currentPeer.writeJSON(map[string]interface{}{"type": "error", "data": err.Error()})
+        }
+
+    case "talk_stop":
+        releaseTalkFloor(currentPeer)
+
+    case "talk_revoke":
+        if err := handleTalkRevoke(currentPeer); err != nil {
+            log.Printf("Error handling talk_revoke from %s: %v", currentPeer.username, err)
+            _ = currentPeer.writeJSON(map[string]interface{}{"type": "error", "data": err.Error()})
+        }
+
+    case "clock_sync_reply":
+        if err := handleClockSyncReply(currentPeer, data); err != nil {
+            log.Printf("Error handling clock_sync_reply from %s: %v", currentPeer.username, err)
+        }
+
+    case "latency_report":
+        if err := handleLatencyReport(currentPeer, data); err != nil {
+            log.Printf("Error handling latency_report from %s: %v", currentPeer.username, err)
+        }
+
+    case "video_frame":
+        handleVideoFrame(currentPeer)
+
+    case "stream_metadata":
+        if err := handleStreamMetadata(currentPeer, data); err != nil {
+            log.Printf("Error handling stream_metadata from %s: %v", currentPeer.username, err)
+            _ = currentPeer.writeJSON(map[string]interface{}{"type": "error", "data": err.Error()})
+        }
+
+    case "switch_camera":
+        applyCameraSwitch(currentPeer.room, data)
+        if targetPeer != nil {
+            log.Printf("Forwarding '%s' message from %s to %s", dataType, currentPeer.username, targetPeer.username)
+            if err := targetPeer.writeMessage(msgBytes); err != nil {
+                log.Printf("Error forwarding '%s' to %s: %v", dataType, targetPeer.username, err)
+            }
+        } else if remote {
+            log.Printf("Relaying '%s' message from %s to %s on node %s", dataType, currentPeer.username, remoteTarget.Username, remoteTarget.Node)
+            relayToMember(currentPeer, remoteTarget, msgBytes)
+        }
+    default:
+        log.Printf("Ignoring message with type '%s' from %s", dataType, currentPeer.username)
     }
-    log.Printf("Cleanup complete for WebSocket connection %s (User: %s)", remoteAddr, currentPeer.username)
-}
\ No newline at end of file
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+// ingestTrack - трек ведущего, принятый серверным PeerConnection
+type ingestTrack struct {
+    kind     webrtc.RTPCodecType
+    codec    webrtc.RTPCodecParameters
+    ssrc     uint32
+    rid      string // RID слоя simulcast, пусто без simulcast
+    remote   *webrtc.TrackRemote
+    receiver *webrtc.RTPReceiver
+
+    // Оценка битрейта и частоты кадров; окно обновляется только горутиной чтения трека
+    bitrate      uint64
+    frameRate    uint64 // кадров в секунду * 100
+    windowBytes  uint64
+    windowFrames uint64
+    windowStart  time.Time
+
+    // Последний RTCP SR ведущего: соответствие метки RTP времени NTP (для измерения задержки)
+    srMu    sync.Mutex
+    srNTP   time.Time
+    srRTP   uint32
+    srKnown bool
+}
+
+// mediaSink получает RTP-пакеты ведущего (HLS, RTSP и т.п.).
+// Пакет общий для всех получателей и не должен изменяться;
+// WriteRTP вызывается из горутины чтения трека и не должен надолго блокироваться.
+type mediaSink interface {
+    AddTrack(t *ingestTrack)
+    WriteRTP(t *ingestTrack, pkt *rtp.Packet)
+    Close()
+}
+
+// roomMedia - медиапотоки ведущего комнаты, которые проходят через сервер
+type roomMedia struct {
+    room   string
+    leader *Peer
+    pc     *webrtc.PeerConnection
+    hls    *hlsSession
+
+    mu           sync.RWMutex
+    tracks       []*ingestTrack
+    primaryVideo *ingestTrack // слой, который получают HLS и RTSP
+    sinks        []mediaSink
+    closed       bool
+
+    lastVideo atomic.Int64 // время последнего видеопакета ведущего, нс Unix
+
+    // Последние SPS/PPS ведущего (для sprop-parameter-sets в RTSP DESCRIBE) и номер FIR
+    paramMu  sync.Mutex
+    sps, pps []byte
+    firSeq   uint8
+}
+
+var (
+    mediaRooms = make(map[string]*roomMedia)
+    mediaMu    sync.Mutex
+)
+
+// getRoomMedia возвращает медиапотоки комнаты или nil, если ведущий ничего не публикует на сервер
+func getRoomMedia(room string) *roomMedia {
+    mediaMu.Lock()
+    defer mediaMu.Unlock()
+    return mediaRooms[room]
+}
+
+// attachLeaderMedia возвращает roomMedia для PeerConnection ведущего, создавая её при первом треке.
+// Публикация с другого PeerConnection (переподключение ведущего) заменяет прежнюю.
+func attachLeaderMedia(peer *Peer, pc *webrtc.PeerConnection) *roomMedia {
+    mediaMu.Lock()
+    rm := mediaRooms[peer.room]
+    if rm != nil && rm.pc == pc {
+        mediaMu.Unlock()
+        return rm
+    }
+    old := rm
+    rm = &roomMedia{room: peer.room, leader: peer, pc: pc}
+    if hlsConfig.Enabled {
+        rm.hls = newHLSSession(peer.room)
+        rm.sinks = append(rm.sinks, rm.hls)
+    }
+    mediaRooms[peer.room] = rm
+    mediaMu.Unlock()
+
+    if old != nil {
+        log.Printf("Replacing media ingest of room %s (new leader connection from %s)", peer.room, peer.username)
+        old.close()
+    }
+    log.Printf("Media ingest started for room %s (leader: %s)", peer.room, peer.username)
+    startRecording(rm)
+    startMotionDetection(rm)
+    attachRoomSubscribers(rm)
+    return rm
+}
+
+// releaseRoomMedia закрывает получателей и убирает медиапотоки комнаты из реестра
+func releaseRoomMedia(rm *roomMedia) {
+    mediaMu.Lock()
+    if mediaRooms[rm.room] == rm {
+        delete(mediaRooms, rm.room)
+    }
+    mediaMu.Unlock()
+    rm.close()
+    log.Printf("Media ingest stopped for room %s", rm.room)
+}
+
+func (rm *roomMedia) close() {
+    rm.mu.Lock()
+    if rm.closed {
+        rm.mu.Unlock()
+        return
+    }
+    rm.closed = true
+    sinks := rm.sinks
+    rm.sinks = nil
+    rm.mu.Unlock()
+    for _, s := range sinks {
+        s.Close()
+    }
+}
+
+func (rm *roomMedia) addTrack(t *ingestTrack) {
+    rm.mu.Lock()
+    rm.tracks = append(rm.tracks, t)
+    rm.refreshPrimaryVideo()
+    sinks := append([]mediaSink(nil), rm.sinks...)
+    rm.mu.Unlock()
+    for _, s := range sinks {
+        s.AddTrack(t)
+    }
+}
+
+// removeTrack убирает завершившийся трек; без треков медиапотоки комнаты освобождаются
+func (rm *roomMedia) removeTrack(t *ingestTrack) {
+    rm.mu.Lock()
+    for i, existing := range rm.tracks {
+        if existing == t {
+            rm.tracks = append(rm.tracks[:i], rm.tracks[i+1:]...)
+            break
+        }
+    }
+    rm.refreshPrimaryVideo()
+    empty := len(rm.tracks) == 0
+    rm.mu.Unlock()
+    if empty {
+        releaseRoomMedia(rm)
+    }
+}
+
+// addSink подключает получателя и сообщает ему об уже принятых треках
+func (rm *roomMedia) addSink(s mediaSink) error {
+    rm.mu.Lock()
+    if rm.closed {
+        rm.mu.Unlock()
+        return errors.New("room media is closed")
+    }
+    rm.sinks = append(rm.sinks, s)
+    tracks := append([]*ingestTrack(nil), rm.tracks...)
+    rm.mu.Unlock()
+    for _, t := range tracks {
+        s.AddTrack(t)
+    }
+    return nil
+}
+
+func (rm *roomMedia) removeSink(s mediaSink) {
+    rm.mu.Lock()
+    defer rm.mu.Unlock()
+    for i, existing := range rm.sinks {
+        if existing == s {
+            rm.sinks = append(rm.sinks[:i], rm.sinks[i+1:]...)
+            return
+        }
+    }
+}
+
+// trackBySSRC возвращает трек ведущего по SSRC
+func (rm *roomMedia) trackBySSRC(ssrc uint32) *ingestTrack {
+    rm.mu.RLock()
+    defer rm.mu.RUnlock()
+    for _, t := range rm.tracks {
+        if t.ssrc == ssrc {
+            return t
+        }
+    }
+    return nil
+}
+
+// trackByKind возвращает первый принятый трек указанного типа
+func (rm *roomMedia) trackByKind(kind webrtc.RTPCodecType) *ingestTrack {
+    rm.mu.RLock()
+    defer rm.mu.RUnlock()
+    for _, t := range rm.tracks {
+        if t.kind == kind {
+            return t
+        }
+    }
+    return nil
+}
+
+// observeH264 запоминает SPS/PPS из пакетов single NAL и STAP-A
+func (rm *roomMedia) observeH264(pkt *rtp.Packet) {
+    if len(pkt.Payload) < 1 {
+        return
+    }
+    var nalus [][]byte
+    switch pkt.Payload[0] & 0x1F {
+    case h264NaluSPS, h264NaluPPS:
+        nalus = [][]byte{pkt.Payload}
+    case h264NaluSTAPA:
+        var d h264Depacketizer
+        nalus = d.push(pkt)
+    default:
+        return
+    }
+    rm.paramMu.Lock()
+    defer rm.paramMu.Unlock()
+    for _, nalu := range nalus {
+        switch nalu[0] & 0x1F {
+        case h264NaluSPS:
+            rm.sps = append([]byte(nil), nalu...)
+        case h264NaluPPS:
+            rm.pps = append([]byte(nil), nalu...)
+        }
+    }
+}
+
+// lastVideoAt возвращает время последнего видеопакета ведущего (нулевое, если видео не было)
+func (rm *roomMedia) lastVideoAt() time.Time {
+    if ns := rm.lastVideo.Load(); ns != 0 {
+        return time.Unix(0, ns)
+    }
+    return time.Time{}
+}
+
+// h264Params возвращает последние известные SPS и PPS
+func (rm *roomMedia) h264Params() (sps, pps []byte) {
+    rm.paramMu.Lock()
+    defer rm.paramMu.Unlock()
+    return rm.sps, rm.pps
+}
+
+func (rm *roomMedia) dispatch(t *ingestTrack, pkt *rtp.Packet) {
+    if t.kind == webrtc.RTPCodecTypeVideo && strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeH264) {
+        rm.observeH264(pkt)
+    }
+    rm.mu.RLock()
+    defer rm.mu.RUnlock()
+    primary := t.kind != webrtc.RTPCodecTypeVideo || t == rm.primaryVideo
+    for _, s := range rm.sinks {
+        // Получатели без выбора слоя simulcast получают только лучший слой
+        if ls, ok := s.(layerSink); primary || (ok && ls.acceptsAllLayers()) {
+            s.WriteRTP(t, pkt)
+        }
+    }
+}
+
+// startIngest читает трек ведущего и раздает пакеты получателям комнаты.
+// Вызывается из OnTrack серверного PeerConnection ведущего.
+func startIngest(peer *Peer, pc *webrtc.PeerConnection, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+    rm := attachLeaderMedia(peer, pc)
+    t := &ingestTrack{
+        kind:     track.Kind(),
+        codec:    track.Codec(),
+        ssrc:     uint32(track.SSRC()),
+        rid:      track.RID(),
+        remote:   track,
+        receiver: receiver,
+    }
+    log.Printf("Ingesting %s track from leader %s in room %s: Codec %s, SSRC %d, RID %q",
+        t.kind, peer.username, peer.room, t.codec.MimeType, t.ssrc, t.rid)
+    rm.addTrack(t)
+    defer rm.removeTrack(t)
+    if latencySyncInterval > 0 {
+        go readSenderReports(t)
+    }
+    if t.rid != "" {
+        // Ведомые выбирают слой по списку из room_info
+        go sendRoomInfo(peer.room)
+    }
+
+    for {
+        pkt, _, err := track.ReadRTP()
+        if err != nil {
+            log.Printf("Ingest of %s track from leader %s ended: %v", t.kind, peer.username, err)
+            return
+        }
+        t.updateBitrate(pkt)
+        if t.kind == webrtc.RTPCodecTypeVideo {
+            rm.lastVideo.Store(time.Now().UnixNano())
+        }
+        rm.dispatch(t, pkt)
+    }
+}
+
+// handlePublishOffer принимает offer для серверного PeerConnection и отвечает publish_answer.
+// После этого сервер получает медиапотоки ведущего и может раздавать их через HLS,
+// а ведомый P2P может передавать ведущему аудио push-to-talk.
+func handlePublishOffer(peer *Peer, data map[string]interface{}) error {
+    if !peer.isLeader && peer.mode == peerModeSFU {
+        // У ведомого sfu соединение с сервером согласуется через subscribe_offer
+        return errors.New("sfu follower negotiates with server via subscribe_offer")
+    }
+    sdp, _ := data["sdp"].(string)
+    if sdp == "" {
+        return errors.New("publish offer has no sdp")
+    }
+    peer.mu.Lock()
+    pc := peer.pc
+    peer.mu.Unlock()
+    if pc == nil {
+        return errors.New("peer connection is closed")
+    }
+
+    if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+        return fmt.Errorf("failed to set publish offer: %w", err)
+    }
+    answer, err := pc.CreateAnswer(nil)
+    if err != nil {
+        return fmt.Errorf("failed to create publish answer: %w", err)
+    }
+    if err := pc.SetLocalDescription(answer); err != nil {
+        return fmt.Errorf("failed to set publish answer: %w", err)
+    }
+    // Ограничение битрейта комнаты передается ведущему в ответе: его браузер ограничит
+    // отправку на сервер, в том числе единственного слоя, который получают ведомые sfu
+    answerSDP := answer.SDP
+    if limit := roomBitrateLimitKbps(peer.room); limit > 0 {
+        answerSDP = limitVideoBandwidth(answerSDP, limit)
+    }
+    log.Printf("Sending publish_answer to %s in room %s", peer.username, peer.room)
+    return peer.writeJSON(map[string]interface{}{"type": "publish_answer", "sdp": answerSDP})
+}
+
+// handleServerICECandidate добавляет ICE-кандидата клиента к серверному PeerConnection
+func handleServerICECandidate(peer *Peer, msgBytes []byte) error {
+    var msg struct {
+        ICE webrtc.ICECandidateInit `json:"ice"`
+    }
+    if err := json.Unmarshal(msgBytes, &msg); err != nil {
+        return fmt.Errorf("invalid server_ice_candidate: %w", err)
+    }
+    peer.mu.Lock()
+    pc := peer.pc
+    peer.mu.Unlock()
+    if pc == nil {
+        return errors.New("peer connection is closed")
+    }
+    return pc.AddICECandidate(msg.ICE)
+}
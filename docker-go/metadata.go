@@ -0,0 +1,159 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "time"
+)
+
+// streamMetadata - описание видео, которое отправляет ведущий ({"type":"stream_metadata","data":{...}}).
+// Хранится у ведущего комнаты и попадает в room_info и API комнат.
+type streamMetadata struct {
+    Width        int            `json:"width,omitempty"`
+    Height       int            `json:"height,omitempty"`
+    FrameRate    float64        `json:"frameRate,omitempty"`
+    Orientation  *int           `json:"orientation,omitempty"` // поворот изображения: 0, 90, 180 или 270
+    Cameras      []streamCamera `json:"cameras,omitempty"`
+    ActiveCamera string         `json:"activeCamera,omitempty"` // id камеры из cameras
+    Facing       string         `json:"facing,omitempty"`       // user (фронтальная) или environment (задняя)
+    DeviceModel  string         `json:"deviceModel,omitempty"`
+    UpdatedAt    time.Time      `json:"updatedAt"`
+}
+
+// streamCamera - камера, доступная ведущему
+type streamCamera struct {
+    ID     string `json:"id"`
+    Label  string `json:"label,omitempty"`
+    Facing string `json:"facing,omitempty"`
+}
+
+const (
+    maxStreamCameras   = 16
+    maxMetadataTextLen = 256
+    maxStreamDimension = 8192
+    maxStreamFrameRate = 240
+    cameraFacingUser   = "user"
+    cameraFacingBack   = "environment"
+)
+
+func validCameraFacing(facing string) bool {
+    return facing == "" || facing == cameraFacingUser || facing == cameraFacingBack
+}
+
+// validate проверяет метаданные, присланные ведущим
+func (m *streamMetadata) validate() error {
+    if (m.Width == 0) != (m.Height == 0) {
+        return errors.New("width and height must be set together")
+    }
+    if m.Width < 0 || m.Height < 0 || m.Width > maxStreamDimension || m.Height > maxStreamDimension {
+        return fmt.Errorf("resolution %dx%d is out of range", m.Width, m.Height)
+    }
+    if m.FrameRate < 0 || m.FrameRate > maxStreamFrameRate {
+        return fmt.Errorf("frame rate %g is out of range", m.FrameRate)
+    }
+    if m.Orientation != nil {
+        switch *m.Orientation {
+        case 0, 90, 180, 270:
+        default:
+            return fmt.Errorf("orientation must be 0, 90, 180 or 270, got %d", *m.Orientation)
+        }
+    }
+    if len(m.Cameras) > maxStreamCameras {
+        return fmt.Errorf("too many cameras (%d, max %d)", len(m.Cameras), maxStreamCameras)
+    }
+    ids := make(map[string]bool, len(m.Cameras))
+    for _, c := range m.Cameras {
+        if c.ID == "" || len(c.ID) > maxMetadataTextLen || len(c.Label) > maxMetadataTextLen {
+            return errors.New("camera id is required and camera fields are limited to 256 characters")
+        }
+        if ids[c.ID] {
+            return fmt.Errorf("duplicate camera id %q", c.ID)
+        }
+        if !validCameraFacing(c.Facing) {
+            return fmt.Errorf("unknown camera facing %q", c.Facing)
+        }
+        ids[c.ID] = true
+    }
+    if m.ActiveCamera != "" && len(m.Cameras) > 0 && !ids[m.ActiveCamera] {
+        return fmt.Errorf("active camera %q is not in the camera list", m.ActiveCamera)
+    }
+    if !validCameraFacing(m.Facing) {
+        return fmt.Errorf("unknown camera facing %q", m.Facing)
+    }
+    if len(m.DeviceModel) > maxMetadataTextLen {
+        return errors.New("device model is limited to 256 characters")
+    }
+    return nil
+}
+
+// handleStreamMetadata сохраняет метаданные видео ведущего и рассылает обновленный room_info
+func handleStreamMetadata(peer *Peer, data map[string]interface{}) error {
+    if !peer.isLeader {
+        return errors.New("only leader can publish stream metadata")
+    }
+    raw, err := json.Marshal(data["data"])
+    if err != nil {
+        return err
+    }
+    var meta streamMetadata
+    dec := json.NewDecoder(bytes.NewReader(raw))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&meta); err != nil {
+        return fmt.Errorf("invalid stream metadata: %w", err)
+    }
+    if err := meta.validate(); err != nil {
+        return fmt.Errorf("invalid stream metadata: %w", err)
+    }
+    if meta.Facing == "" && meta.ActiveCamera != "" {
+        for _, c := range meta.Cameras {
+            if c.ID == meta.ActiveCamera {
+                meta.Facing = c.Facing
+            }
+        }
+    }
+    meta.UpdatedAt = time.Now().UTC()
+
+    peer.mu.Lock()
+    peer.metadata = &meta
+    peer.mu.Unlock()
+    log.Printf("Stream metadata from leader %s in room %s: %dx%d@%g, camera %q (%s), device %q",
+        peer.username, peer.room, meta.Width, meta.Height, meta.FrameRate, meta.ActiveCamera, meta.Facing, meta.DeviceModel)
+    go sendRoomInfo(peer.room)
+    return nil
+}
+
+// applyCameraSwitch отражает в метаданных переключение камеры ведущего (switch_camera с useBackCamera).
+// Выбирается первая камера с нужным направлением; точные данные ведущий пришлет новым stream_metadata.
+func applyCameraSwitch(room string, data map[string]interface{}) {
+    useBack, ok := data["useBackCamera"].(bool)
+    if !ok {
+        return
+    }
+    facing := cameraFacingUser
+    if useBack {
+        facing = cameraFacingBack
+    }
+    leader := roomLeader(room)
+    if leader == nil {
+        return
+    }
+    leader.mu.Lock()
+    meta := streamMetadata{}
+    if leader.metadata != nil {
+        meta = *leader.metadata
+    }
+    meta.Facing = facing
+    for _, c := range meta.Cameras {
+        if c.Facing == facing {
+            meta.ActiveCamera = c.ID
+            break
+        }
+    }
+    meta.UpdatedAt = time.Now().UTC()
+    leader.metadata = &meta
+    leader.mu.Unlock()
+    go sendRoomInfo(room)
+}
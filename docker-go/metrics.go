@@ -0,0 +1,206 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// Метрики сервера в текстовом формате Prometheus (GET /metrics).
+// Счетчики и гистограммы создаются при инициализации пакета и обновляются из любых горутин.
+
+// metricVec - метрика с набором меток (counter, gauge или histogram)
+type metricVec struct {
+    name    string
+    help    string
+    kind    string
+    labels  []string
+    buckets []float64 // границы корзин гистограммы
+
+    mu     sync.Mutex
+    series map[string]*metricSeries
+}
+
+// metricSeries - значения метрики для одного набора значений меток
+type metricSeries struct {
+    labelValues []string
+    value       float64  // counter, gauge
+    counts      []uint64 // histogram: число наблюдений в каждой корзине (не накопительно)
+    sum         float64
+    count       uint64
+}
+
+// metricGaugeFunc - метрика, значение которой вычисляется при выдаче
+type metricGaugeFunc struct {
+    name, help string
+    value      func() float64
+}
+
+var (
+    metricVecs       []*metricVec
+    metricGaugeFuncs []*metricGaugeFunc
+    metricsMu        sync.Mutex
+)
+
+func registerMetric(m *metricVec) *metricVec {
+    m.series = make(map[string]*metricSeries)
+    metricsMu.Lock()
+    metricVecs = append(metricVecs, m)
+    metricsMu.Unlock()
+    return m
+}
+
+// newCounterVec регистрирует счетчик
+func newCounterVec(name, help string, labels ...string) *metricVec {
+    return registerMetric(&metricVec{name: name, help: help, kind: "counter", labels: labels})
+}
+
+// newHistogramVec регистрирует гистограмму с заданными верхними границами корзин
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+    return registerMetric(&metricVec{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+// newGaugeFunc регистрирует метрику, значение которой снимается при каждом запросе /metrics
+func newGaugeFunc(name, help string, value func() float64) {
+    metricsMu.Lock()
+    metricGaugeFuncs = append(metricGaugeFuncs, &metricGaugeFunc{name: name, help: help, value: value})
+    metricsMu.Unlock()
+}
+
+// with возвращает серию для значений меток. Вызывается под m.mu.
+func (m *metricVec) with(labelValues []string) *metricSeries {
+    if len(labelValues) != len(m.labels) {
+        panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+    }
+    key := strings.Join(labelValues, "\xff")
+    s := m.series[key]
+    if s == nil {
+        s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+        if m.kind == "histogram" {
+            s.counts = make([]uint64, len(m.buckets))
+        }
+        m.series[key] = s
+    }
+    return s
+}
+
+// add увеличивает счетчик
+func (m *metricVec) add(v float64, labelValues ...string) {
+    m.mu.Lock()
+    m.with(labelValues).value += v
+    m.mu.Unlock()
+}
+
+// inc увеличивает счетчик на единицу
+func (m *metricVec) inc(labelValues ...string) {
+    m.add(1, labelValues...)
+}
+
+// observe добавляет наблюдение в гистограмму
+func (m *metricVec) observe(v float64, labelValues ...string) {
+    m.mu.Lock()
+    s := m.with(labelValues)
+    for i, upper := range m.buckets {
+        if v <= upper {
+            s.counts[i]++
+            break
+        }
+    }
+    s.sum += v
+    s.count++
+    m.mu.Unlock()
+}
+
+// forget удаляет серии, у которых метка с индексом label равна value (например, закрытой комнаты)
+func (m *metricVec) forget(label int, value string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for key, s := range m.series {
+        if s.labelValues[label] == value {
+            delete(m.series, key)
+        }
+    }
+}
+
+func formatMetricLabels(names, values []string, extra ...string) string {
+    if len(names) == 0 && len(extra) == 0 {
+        return ""
+    }
+    pairs := make([]string, 0, len(names)+len(extra)/2)
+    for i, name := range names {
+        pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+    }
+    for i := 0; i+1 < len(extra); i += 2 {
+        pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write выводит метрику в текстовом формате Prometheus
+func (m *metricVec) write(b *strings.Builder) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+    keys := make([]string, 0, len(m.series))
+    for key := range m.series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        s := m.series[key]
+        if m.kind != "histogram" {
+            fmt.Fprintf(b, "%s%s %s\n", m.name, formatMetricLabels(m.labels, s.labelValues), formatMetricValue(s.value))
+            continue
+        }
+        var cumulative uint64
+        for i, upper := range m.buckets {
+            cumulative += s.counts[i]
+            fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, formatMetricLabels(m.labels, s.labelValues, "le", formatMetricValue(upper)), cumulative)
+        }
+        fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, formatMetricLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+        fmt.Fprintf(b, "%s_sum%s %s\n", m.name, formatMetricLabels(m.labels, s.labelValues), formatMetricValue(s.sum))
+        fmt.Fprintf(b, "%s_count%s %d\n", m.name, formatMetricLabels(m.labels, s.labelValues), s.count)
+    }
+}
+
+// handleMetrics отдает метрики сервера для Prometheus
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+    metricsMu.Lock()
+    vecs := append([]*metricVec(nil), metricVecs...)
+    gauges := append([]*metricGaugeFunc(nil), metricGaugeFuncs...)
+    metricsMu.Unlock()
+
+    var b strings.Builder
+    for _, g := range gauges {
+        fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatMetricValue(g.value()))
+    }
+    for _, m := range vecs {
+        m.write(&b)
+    }
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    if _, err := w.Write([]byte(b.String())); err != nil {
+        log.Printf("Error writing /metrics response: %v", err)
+    }
+}
+
+func init() {
+    newGaugeFunc("webrtc_peers", "Connected WebSocket peers.", func() float64 {
+        return float64(len(allPeers()))
+    })
+    newGaugeFunc("webrtc_rooms", "Rooms with at least one peer.", func() float64 {
+        return float64(len(activeRooms()))
+    })
+    newGaugeFunc("webrtc_media_rooms", "Rooms whose leader publishes media to the server.", func() float64 {
+        mediaMu.Lock()
+        defer mediaMu.Unlock()
+        return float64(len(mediaRooms))
+    })
+}
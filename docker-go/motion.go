@@ -0,0 +1,251 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "log"
+    "math"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+    "golang.org/x/image/vp8"
+)
+
+// Обнаружение движения без декодирования всего потока:
+//   frame_size   - несколько межкадров подряд заметно крупнее среднего (кодек тратит биты на изменения);
+//   scene_change - ключевой кадр, который сервер не запрашивал (кодек сам начал новую сцену);
+//   pixels       - для VP8: разница яркости между соседними ключевыми кадрами по сетке 32x24.
+// О каждом срабатывании пиры комнаты получают событие motion.
+
+// motionSettings - настройки обнаружения движения, задаются переменными окружения
+type motionSettings struct {
+    Enabled          bool
+    SizeRatio        float64       // во сколько раз межкадр должен превышать средний
+    SizeFrames       int           // сколько таких межкадров подряд считать движением
+    PixelThreshold   float64       // средняя разница яркости (0-255) между ключевыми кадрами VP8
+    Cooldown         time.Duration // минимальный интервал между событиями комнаты
+    KeyframeInterval time.Duration // период запроса ключевых кадров для сравнения (0 - только свои)
+}
+
+var motionConfig = motionSettings{
+    Enabled:          envBool("MOTION_DETECTION", false),
+    SizeRatio:        envFloat("MOTION_SIZE_RATIO", 2.5),
+    SizeFrames:       envInt("MOTION_SIZE_FRAMES", 3),
+    PixelThreshold:   envFloat("MOTION_PIXEL_THRESHOLD", 12),
+    Cooldown:         envDuration("MOTION_COOLDOWN", 10*time.Second),
+    KeyframeInterval: envDuration("MOTION_KEYFRAME_INTERVAL", 0),
+}
+
+const (
+    motionWarmupFrames = 30   // межкадров до начала сравнения с средним
+    motionMeanWeight   = 0.05 // вес нового межкадра в скользящем среднем
+    motionGridWidth    = 32
+    motionGridHeight   = 24
+)
+
+var motionEventsTotal = newCounterVec("webrtc_motion_events_total", "Motion events detected on leader video.", "room", "method")
+
+// motionDetector - получатель видео ведущего, который ищет движение
+type motionDetector struct {
+    room string
+    rm   *roomMedia
+
+    mu         sync.Mutex
+    track      *ingestTrack // при смене слоя simulcast статистика начинается заново
+    frameTS    uint32
+    frameBytes int
+    frameKey   bool
+    inFrame    bool
+    meanBytes  float64
+    frames     int // межкадров в среднем
+    largeRun   int
+    lastEvent  time.Time
+    vp8        vp8FrameAssembler
+    decoding   bool
+    prevGrid   []float64
+    closed     bool
+}
+
+// startMotionDetection подключает обнаружение движения к медиа ведущего
+func startMotionDetection(rm *roomMedia) {
+    if !motionConfig.Enabled {
+        return
+    }
+    d := &motionDetector{room: rm.room, rm: rm}
+    if err := rm.addSink(d); err != nil {
+        return
+    }
+    if motionConfig.KeyframeInterval > 0 {
+        go d.requestKeyframes()
+    }
+}
+
+func (d *motionDetector) AddTrack(t *ingestTrack) {}
+
+func (d *motionDetector) WriteRTP(t *ingestTrack, pkt *rtp.Packet) {
+    if t.kind != webrtc.RTPCodecTypeVideo {
+        return
+    }
+    mime := t.codec.MimeType
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.track != t {
+        d.track = t
+        d.inFrame, d.frames, d.meanBytes, d.largeRun = false, 0, 0, 0
+        d.vp8 = vp8FrameAssembler{}
+        d.prevGrid = nil
+    }
+
+    if d.inFrame && pkt.Timestamp != d.frameTS {
+        d.finishFrame()
+    }
+    if !d.inFrame {
+        d.inFrame = true
+        d.frameTS = pkt.Timestamp
+        d.frameBytes = 0
+        d.frameKey = false
+    }
+    d.frameBytes += len(pkt.Payload)
+    if isKeyframeStart(mime, pkt.Payload) {
+        d.frameKey = true
+    }
+    if pkt.Marker {
+        d.finishFrame()
+    }
+
+    if strings.EqualFold(mime, webrtc.MimeTypeVP8) {
+        if frame := d.vp8.push(pkt); frame != nil && frame.keyframe && !d.decoding {
+            d.decoding = true
+            go d.comparePixels(frame.data)
+        }
+    }
+}
+
+func (d *motionDetector) Close() {
+    d.mu.Lock()
+    d.closed = true
+    d.mu.Unlock()
+    motionEventsTotal.forget(0, d.room)
+}
+
+// finishFrame оценивает завершенный кадр. Вызывается под d.mu.
+func (d *motionDetector) finishFrame() {
+    d.inFrame = false
+    size := float64(d.frameBytes)
+    if d.frameKey {
+        // Ключевой кадр, запрошенный сервером (зрителями, таймлапсом и т.п.), о сцене ничего не говорит
+        requested := time.Since(keyframeRequests.lastAllowed(d.room)) < 2*time.Second
+        if !requested && d.frames >= motionWarmupFrames {
+            d.detect("scene_change", 1)
+        }
+        d.largeRun = 0
+        return
+    }
+    if d.frames >= motionWarmupFrames && d.meanBytes > 0 && size >= d.meanBytes*motionConfig.SizeRatio {
+        d.largeRun++
+        if d.largeRun == motionConfig.SizeFrames {
+            d.detect("frame_size", size/d.meanBytes)
+        }
+    } else {
+        d.largeRun = 0
+    }
+    if d.frames == 0 {
+        d.meanBytes = size
+    } else {
+        d.meanBytes += (size - d.meanBytes) * motionMeanWeight
+    }
+    d.frames++
+}
+
+// detect отправляет событие motion с учетом паузы между событиями. Вызывается под d.mu.
+func (d *motionDetector) detect(method string, score float64) {
+    if d.closed || time.Since(d.lastEvent) < motionConfig.Cooldown {
+        return
+    }
+    d.lastEvent = time.Now()
+    motionEventsTotal.inc(d.room, method)
+    log.Printf("Motion detected in room %s (%s, score %.2f)", d.room, method, score)
+    // Рассылка и вебхуки - вне блокировки детектора
+    go emitRoomEvent(d.room, "motion", map[string]interface{}{
+        "method": method,
+        "score":  math.Round(score*100) / 100,
+    })
+}
+
+// comparePixels декодирует ключевой кадр VP8 и сравнивает яркость с предыдущим ключевым кадром
+func (d *motionDetector) comparePixels(frame []byte) {
+    grid, err := vp8LumaGrid(frame)
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.decoding = false
+    if err != nil {
+        log.Printf("Motion detection in room %s: failed to decode VP8 keyframe: %v", d.room, err)
+        return
+    }
+    prev := d.prevGrid
+    d.prevGrid = grid
+    if prev == nil {
+        return
+    }
+    var diff float64
+    for i := range grid {
+        diff += math.Abs(grid[i] - prev[i])
+    }
+    diff /= float64(len(grid))
+    if diff >= motionConfig.PixelThreshold {
+        d.detect("pixels", diff)
+    }
+}
+
+// vp8LumaGrid декодирует ключевой кадр VP8 и возвращает среднюю яркость ячеек сетки
+func vp8LumaGrid(frame []byte) ([]float64, error) {
+    dec := vp8.NewDecoder()
+    dec.Init(bytes.NewReader(frame), len(frame))
+    if _, err := dec.DecodeFrameHeader(); err != nil {
+        return nil, err
+    }
+    img, err := dec.DecodeFrame()
+    if err != nil {
+        return nil, err
+    }
+    bounds := img.Bounds()
+    if bounds.Dx() < motionGridWidth || bounds.Dy() < motionGridHeight {
+        return nil, fmt.Errorf("frame %dx%d is too small", bounds.Dx(), bounds.Dy())
+    }
+    grid := make([]float64, motionGridWidth*motionGridHeight)
+    counts := make([]int, len(grid))
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        gy := (y - bounds.Min.Y) * motionGridHeight / bounds.Dy()
+        row := img.Y[(y-img.Rect.Min.Y)*img.YStride:]
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            cell := gy*motionGridWidth + (x-bounds.Min.X)*motionGridWidth/bounds.Dx()
+            grid[cell] += float64(row[x-img.Rect.Min.X])
+            counts[cell]++
+        }
+    }
+    for i := range grid {
+        grid[i] /= float64(counts[i])
+    }
+    return grid, nil
+}
+
+// requestKeyframes периодически запрашивает ключевые кадры для попиксельного сравнения VP8
+func (d *motionDetector) requestKeyframes() {
+    ticker := time.NewTicker(motionConfig.KeyframeInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        d.mu.Lock()
+        closed := d.closed
+        vp8Track := d.track != nil && strings.EqualFold(d.track.codec.MimeType, webrtc.MimeTypeVP8)
+        d.mu.Unlock()
+        if closed {
+            return
+        }
+        if vp8Track {
+            requestRoomKeyframe(d.room, "motion detection", false)
+        }
+    }
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "regexp"
+    "sort"
+    "sync"
+    "time"
+)
+
+// Именованные комнаты: администратор заранее создает комнату с описанием и ограничениями
+// (API /api/rooms). Реестр хранит backend комнат (ROOM_BACKEND): memory - JSON-файл ROOMS_FILE,
+// который переживает перезапуск, redis - хеш, общий для всех узлов.
+// Комната может истекать (expiresAt): после этого она удаляется из реестра, а ее пиры отключаются
+// на всех узлах (closeRoom).
+// В строгом режиме (ROOMS_STRICT) вход в комнату, которой нет в реестре, отклоняется,
+// чтобы опечатка в имени не создавала комнату-призрак. Без строгого режима комнаты по-прежнему
+// создаются первым ведущим, а для именованных действуют их ограничения.
+
+// Политики допуска ведомых
+const (
+    admissionLeader = "leader" // ведомые входят, только когда ведущий в сети (по умолчанию)
+    admissionOpen   = "open"   // ведомые могут войти раньше ведущего и ждать его
+    admissionClosed = "closed" // новые ведомые не допускаются
+)
+
+var (
+    namedRoomsFile   = envString("ROOMS_FILE", "rooms.json")
+    namedRoomsStrict = envBool("ROOMS_STRICT", false)
+
+    namedRoomPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+    errRoomNotRegistered = errors.New("Room is not registered")
+    errRoomClosed        = errors.New("Room is closed for new viewers")
+    errRoomFull          = errors.New("Room has reached its viewer limit")
+    errRoomExists        = errors.New("room already exists")
+)
+
+// namedRoom - комната из реестра
+type namedRoom struct {
+    Name           string     `json:"name"`
+    Title          string     `json:"title,omitempty"`
+    Owner          string     `json:"owner,omitempty"`
+    DefaultCodec   string     `json:"defaultCodec,omitempty"`   // H264 или VP8, если клиент не указал кодек
+    MaxBitrateKbps int        `json:"maxBitrateKbps,omitempty"` // ограничение битрейта видео (0 - без ограничения), см. roomBitrateLimitKbps
+    Admission      string     `json:"admission"`
+    MaxViewers     int        `json:"maxViewers,omitempty"` // 0 - без ограничения
+    CreatedAt      time.Time  `json:"createdAt"`
+    ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+}
+
+// namedRoomRequest - тело запросов создания и изменения комнаты.
+// Срок задается либо expiresAt (RFC 3339 или Unix-время), либо ttl (длительность Go, например "2h").
+type namedRoomRequest struct {
+    Name           string `json:"name"`
+    Title          string `json:"title"`
+    Owner          string `json:"owner"`
+    DefaultCodec   string `json:"defaultCodec"`
+    MaxBitrateKbps int    `json:"maxBitrateKbps"`
+    Admission      string `json:"admission"`
+    MaxViewers     int    `json:"maxViewers"`
+    ExpiresAt      string `json:"expiresAt"`
+    TTL            string `json:"ttl"`
+}
+
+// toRoom проверяет запрос и строит комнату
+func (req namedRoomRequest) toRoom(now time.Time) (namedRoom, error) {
+    room := namedRoom{Name: req.Name, Title: req.Title, Owner: req.Owner, MaxBitrateKbps: req.MaxBitrateKbps,
+        Admission: req.Admission, MaxViewers: req.MaxViewers, CreatedAt: now.UTC()}
+    if !namedRoomPattern.MatchString(room.Name) {
+        return room, errors.New("name must be 1-64 characters: letters, digits, '_', '.' or '-'")
+    }
+    switch req.DefaultCodec {
+    case "":
+    case "H264", "h264":
+        room.DefaultCodec = "H264"
+    case "VP8", "vp8":
+        room.DefaultCodec = "VP8"
+    default:
+        return room, fmt.Errorf("unsupported defaultCodec %q (expected H264 or VP8)", req.DefaultCodec)
+    }
+    switch room.Admission {
+    case "":
+        room.Admission = admissionLeader
+    case admissionLeader, admissionOpen, admissionClosed:
+    default:
+        return room, fmt.Errorf("unknown admission %q (expected leader, open or closed)", room.Admission)
+    }
+    if room.MaxBitrateKbps < 0 || room.MaxViewers < 0 {
+        return room, errors.New("maxBitrateKbps and maxViewers must not be negative")
+    }
+    switch {
+    case req.ExpiresAt != "" && req.TTL != "":
+        return room, errors.New("specify either expiresAt or ttl")
+    case req.ExpiresAt != "":
+        t, err := parseAPITime(req.ExpiresAt)
+        if err != nil {
+            return room, fmt.Errorf("invalid expiresAt: %w", err)
+        }
+        t = t.UTC()
+        room.ExpiresAt = &t
+    case req.TTL != "":
+        ttl, err := time.ParseDuration(req.TTL)
+        if err != nil || ttl <= 0 {
+            return room, fmt.Errorf("invalid ttl %q", req.TTL)
+        }
+        t := now.Add(ttl).UTC()
+        room.ExpiresAt = &t
+    }
+    if room.ExpiresAt != nil && !room.ExpiresAt.After(now) {
+        return room, errors.New("expiry must be in the future")
+    }
+    return room, nil
+}
+
+// expired сообщает, истек ли срок комнаты
+func (r namedRoom) expired(now time.Time) bool {
+    return r.ExpiresAt != nil && !r.ExpiresAt.After(now)
+}
+
+// namedRoomStore - хранилище реестра именованных комнат. get и list читают память,
+// поэтому их можно вызывать в цикле комнаты; остальные методы могут обращаться к сети.
+type namedRoomStore interface {
+    // get возвращает действующую комнату реестра
+    get(name string) (namedRoom, bool)
+    // list возвращает действующие комнаты реестра
+    list() []namedRoom
+    // put создает комнату (replace = false) или заменяет существующую, сохраняя время создания
+    put(room namedRoom, replace bool) (namedRoom, error)
+    // remove удаляет комнату из реестра
+    remove(name string) (bool, error)
+    // removeExpired удаляет истекшие комнаты и возвращает имена тех, что удалил этот узел
+    removeExpired(now time.Time) []string
+}
+
+// namedRoomRegistry - реестр именованных комнат одного узла; path - его файл (пусто - только в памяти)
+type namedRoomRegistry struct {
+    mu    sync.Mutex
+    path  string
+    rooms map[string]namedRoom
+}
+
+// namedRooms - реестр текущего backend комнат (см. initRoomBackend)
+var namedRooms namedRoomStore = &namedRoomRegistry{rooms: make(map[string]namedRoom)}
+
+func loadNamedRooms(path string) *namedRoomRegistry {
+    reg := &namedRoomRegistry{path: path, rooms: make(map[string]namedRoom)}
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return reg
+    }
+    if err != nil {
+        log.Printf("Named rooms: failed to read %s: %v", path, err)
+        return reg
+    }
+    var list []namedRoom
+    if err := json.Unmarshal(data, &list); err != nil {
+        log.Printf("Named rooms: failed to parse %s: %v", path, err)
+        return reg
+    }
+    for _, room := range list {
+        reg.rooms[room.Name] = room
+    }
+    log.Printf("Named rooms: loaded %d rooms from %s", len(reg.rooms), path)
+    return reg
+}
+
+// saveLocked записывает реестр в файл через временный файл. Вызывается под mu.
+func (reg *namedRoomRegistry) saveLocked() error {
+    if reg.path == "" {
+        return nil
+    }
+    data, err := json.MarshalIndent(reg.listLocked(), "", "  ")
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(reg.path+".tmp", data, 0o644); err != nil {
+        return err
+    }
+    return os.Rename(reg.path+".tmp", reg.path)
+}
+
+func (reg *namedRoomRegistry) listLocked() []namedRoom {
+    list := make([]namedRoom, 0, len(reg.rooms))
+    for _, room := range reg.rooms {
+        list = append(list, room)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list
+}
+
+func (reg *namedRoomRegistry) get(name string) (namedRoom, bool) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    room, ok := reg.rooms[name]
+    if !ok || room.expired(time.Now()) {
+        return namedRoom{}, false
+    }
+    return room, true
+}
+
+func (reg *namedRoomRegistry) list() []namedRoom {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    now := time.Now()
+    list := []namedRoom{}
+    for _, room := range reg.listLocked() {
+        if !room.expired(now) {
+            list = append(list, room)
+        }
+    }
+    return list
+}
+
+func (reg *namedRoomRegistry) put(room namedRoom, replace bool) (namedRoom, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    existing, exists := reg.rooms[room.Name]
+    if exists && existing.expired(time.Now()) {
+        exists = false
+    }
+    if exists && !replace {
+        return namedRoom{}, errRoomExists
+    }
+    if exists {
+        room.CreatedAt = existing.CreatedAt
+    }
+    reg.rooms[room.Name] = room
+    if err := reg.saveLocked(); err != nil {
+        if exists {
+            reg.rooms[room.Name] = existing
+        } else {
+            delete(reg.rooms, room.Name)
+        }
+        return namedRoom{}, fmt.Errorf("failed to save %s: %w", reg.path, err)
+    }
+    return room, nil
+}
+
+func (reg *namedRoomRegistry) remove(name string) (bool, error) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    room, ok := reg.rooms[name]
+    if !ok {
+        return false, nil
+    }
+    delete(reg.rooms, name)
+    if err := reg.saveLocked(); err != nil {
+        reg.rooms[name] = room
+        return false, fmt.Errorf("failed to save %s: %w", reg.path, err)
+    }
+    return true, nil
+}
+
+func (reg *namedRoomRegistry) removeExpired(now time.Time) []string {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    var expired []string
+    for name, room := range reg.rooms {
+        if room.expired(now) {
+            expired = append(expired, name)
+            delete(reg.rooms, name)
+        }
+    }
+    if len(expired) > 0 {
+        if err := reg.saveLocked(); err != nil {
+            log.Printf("Named rooms: failed to save %s: %v", reg.path, err)
+        }
+    }
+    return expired
+}
+
+// checkNamedRoomJoin проверяет вход в комнату по реестру: строгий режим, допуск и лимит зрителей.
+// viewers - сколько зрителей (ведомых, RTSP и HLS) останется в комнате вместе с новым. Вызывается в цикле комнаты.
+func checkNamedRoomJoin(room string, isLeader bool, viewers int) error {
+    cfg, ok := namedRooms.get(room)
+    if !ok {
+        if namedRoomsStrict {
+            return errRoomNotRegistered
+        }
+        return nil
+    }
+    if isLeader {
+        return nil
+    }
+    if cfg.Admission == admissionClosed {
+        return errRoomClosed
+    }
+    if cfg.MaxViewers > 0 && viewers > cfg.MaxViewers {
+        return errRoomFull
+    }
+    return nil
+}
+
+// checkNamedRoomViewer проверяет по реестру допуск пассивного зрителя (RTSP, HLS) так же, как вход
+// ведомого в /wsgo. counted - зритель уже учтен в roomViewerCount (повторный запрос того же клиента):
+// для него проверяется только, что комната существует, а закрытие допуска и лимит касаются новых зрителей.
+func checkNamedRoomViewer(room string, counted bool) error {
+    if counted {
+        if _, ok := namedRooms.get(room); !ok && namedRoomsStrict {
+            return errRoomNotRegistered
+        }
+        return nil
+    }
+    return checkNamedRoomJoin(room, false, roomViewerCount(room)+1)
+}
+
+// roomViewerCount возвращает число зрителей комнаты: ведомые /wsgo (локальные и других узлов),
+// RTSP-клиенты и зрители HLS
+func roomViewerCount(room string) int {
+    viewers := passiveViewerCount(room)
+    for _, p := range roomPeers(room) {
+        if !p.isLeader {
+            viewers++
+        }
+    }
+    for _, m := range roomState.RemoteMembers(room) {
+        if !m.IsLeader {
+            viewers++
+        }
+    }
+    return viewers
+}
+
+// passiveViewerCount возвращает число зрителей комнаты без WebRTC: RTSP-клиенты и зрители HLS
+func passiveViewerCount(room string) int {
+    return rtspViewerCount(room) + hlsViewerCount(room)
+}
+
+// roomAdmitsWithoutLeader сообщает, могут ли ведомые ждать ведущего в комнате
+func roomAdmitsWithoutLeader(room string) bool {
+    cfg, ok := namedRooms.get(room)
+    return ok && cfg.Admission == admissionOpen
+}
+
+// roomBitrateLimitKbps возвращает ограничение битрейта видео комнаты, кбит/с (0 - без ограничения).
+// Ограничение попадает в b=AS пересылаемых P2P offer/answer и ответа ведущему на публикацию
+// (publish_answer), поэтому браузеры сами не отправляют видео быстрее; для ведомых sfu
+// оно же служит верхней границей оценки полосы при выборе слоя simulcast.
+func roomBitrateLimitKbps(room string) int {
+    if cfg, ok := namedRooms.get(room); ok && cfg.MaxBitrateKbps > 0 {
+        return cfg.MaxBitrateKbps
+    }
+    return 0
+}
+
+// roomBitrateCap возвращает ограничение битрейта видео комнаты, бит/с (0 - без ограничения)
+func roomBitrateCap(room string) uint64 {
+    return uint64(roomBitrateLimitKbps(room)) * 1000
+}
+
+// startNamedRoomExpiry раз в минуту удаляет истекшие комнаты и отключает их пиров.
+// При общем реестре комнату удаляет один из узлов, а остальные узнают о ней из closeRoom.
+func startNamedRoomExpiry() {
+    go func() {
+        ticker := time.NewTicker(time.Minute)
+        defer ticker.Stop()
+        for now := range ticker.C {
+            for _, name := range namedRooms.removeExpired(now) {
+                log.Printf("Named room %s has expired", name)
+                closeRoom(name, "Room has expired")
+            }
+        }
+    }()
+}
+
+// closeRoom отключает пиров комнаты на этом и на других узлах
+func closeRoom(room, reason string) {
+    closeLocalRoom(room, reason)
+    data, _ := json.Marshal(reason)
+    if err := roomState.Broadcast(relayEnvelope{Kind: relayRoomClosed, Room: room, Data: data}); err != nil {
+        log.Printf("Error notifying other nodes that room %s is closed: %v", room, err)
+    }
+}
+
+// closeLocalRoom отключает всех локальных пиров комнаты
+func closeLocalRoom(room, reason string) {
+    a := rooms.lookup(room)
+    if a == nil {
+        return
+    }
+    a.post(func() {
+        for _, p := range a.peers() {
+            a.removeMember(p)
+            _ = p.writeJSON(map[string]interface{}{"type": "force_disconnect", "data": reason})
+            go closePeerResources(p, reason)
+        }
+    })
+}
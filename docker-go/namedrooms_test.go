@@ -0,0 +1,127 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestNamedRoomRequestToRoom(t *testing.T) {
+    now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name    string
+        req     namedRoomRequest
+        wantErr string
+        check   func(t *testing.T, room namedRoom)
+    }{
+        {name: "defaults", req: namedRoomRequest{Name: "lobby"}, check: func(t *testing.T, room namedRoom) {
+            if room.Admission != admissionLeader || room.DefaultCodec != "" || room.ExpiresAt != nil || !room.CreatedAt.Equal(now) {
+                t.Errorf("unexpected room %+v", room)
+            }
+        }},
+        {name: "codec is normalized", req: namedRoomRequest{Name: "a.b-c_1", DefaultCodec: "vp8", Admission: admissionOpen}, check: func(t *testing.T, room namedRoom) {
+            if room.DefaultCodec != "VP8" || room.Admission != admissionOpen {
+                t.Errorf("unexpected room %+v", room)
+            }
+        }},
+        {name: "ttl", req: namedRoomRequest{Name: "lobby", TTL: "2h"}, check: func(t *testing.T, room namedRoom) {
+            if room.ExpiresAt == nil || !room.ExpiresAt.Equal(now.Add(2*time.Hour)) {
+                t.Errorf("expiresAt = %v, want %v", room.ExpiresAt, now.Add(2*time.Hour))
+            }
+        }},
+        {name: "expiresAt", req: namedRoomRequest{Name: "lobby", ExpiresAt: "2026-03-02T00:00:00Z", MaxViewers: 5, MaxBitrateKbps: 800}, check: func(t *testing.T, room namedRoom) {
+            if room.ExpiresAt == nil || room.ExpiresAt.Day() != 2 || room.MaxViewers != 5 || room.MaxBitrateKbps != 800 {
+                t.Errorf("unexpected room %+v", room)
+            }
+        }},
+        {name: "empty name", req: namedRoomRequest{}, wantErr: "name must be"},
+        {name: "name with slash", req: namedRoomRequest{Name: "a/b"}, wantErr: "name must be"},
+        {name: "name too long", req: namedRoomRequest{Name: strings.Repeat("x", 65)}, wantErr: "name must be"},
+        {name: "unsupported codec", req: namedRoomRequest{Name: "lobby", DefaultCodec: "AV1"}, wantErr: "unsupported defaultCodec"},
+        {name: "unknown admission", req: namedRoomRequest{Name: "lobby", Admission: "invite"}, wantErr: "unknown admission"},
+        {name: "negative viewers", req: namedRoomRequest{Name: "lobby", MaxViewers: -1}, wantErr: "must not be negative"},
+        {name: "negative bitrate", req: namedRoomRequest{Name: "lobby", MaxBitrateKbps: -300}, wantErr: "must not be negative"},
+        {name: "both expiry fields", req: namedRoomRequest{Name: "lobby", TTL: "1h", ExpiresAt: "2026-03-02T00:00:00Z"}, wantErr: "either expiresAt or ttl"},
+        {name: "invalid ttl", req: namedRoomRequest{Name: "lobby", TTL: "soon"}, wantErr: "invalid ttl"},
+        {name: "non-positive ttl", req: namedRoomRequest{Name: "lobby", TTL: "-1h"}, wantErr: "invalid ttl"},
+        {name: "invalid expiresAt", req: namedRoomRequest{Name: "lobby", ExpiresAt: "tomorrow"}, wantErr: "invalid expiresAt"},
+        {name: "expiry in the past", req: namedRoomRequest{Name: "lobby", ExpiresAt: "2026-03-01T11:00:00Z"}, wantErr: "in the future"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            room, err := tt.req.toRoom(now)
+            if tt.wantErr != "" {
+                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                    t.Fatalf("toRoom() error = %v, want %q", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("toRoom() error: %v", err)
+            }
+            tt.check(t, room)
+        })
+    }
+}
+
+func TestNamedRoomRegistryFile(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "rooms.json")
+    reg := loadNamedRooms(path)
+    created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+    past := time.Now().Add(-time.Minute)
+
+    if _, err := reg.put(namedRoom{Name: "lobby", Admission: admissionOpen, CreatedAt: created}, false); err != nil {
+        t.Fatalf("put() error: %v", err)
+    }
+    if _, err := reg.put(namedRoom{Name: "lobby"}, false); !errors.Is(err, errRoomExists) {
+        t.Fatalf("put() of an existing room error = %v, want %v", err, errRoomExists)
+    }
+    replaced, err := reg.put(namedRoom{Name: "lobby", Admission: admissionClosed, CreatedAt: created.Add(time.Hour)}, true)
+    if err != nil || !replaced.CreatedAt.Equal(created) || replaced.Admission != admissionClosed {
+        t.Fatalf("put(replace) = %+v, %v, want the original creation time", replaced, err)
+    }
+    if _, err := reg.put(namedRoom{Name: "old", ExpiresAt: &past}, false); err != nil {
+        t.Fatalf("put() error: %v", err)
+    }
+
+    // Реестр переживает перезапуск; истекшая комната не видна, хотя еще не удалена
+    reloaded := loadNamedRooms(path)
+    if room, ok := reloaded.get("lobby"); !ok || room.Admission != admissionClosed {
+        t.Fatalf("get(lobby) after reload = %+v, %v", room, ok)
+    }
+    if _, ok := reloaded.get("old"); ok {
+        t.Fatal("expired room is still visible")
+    }
+    if got := reloaded.removeExpired(time.Now()); len(got) != 1 || got[0] != "old" {
+        t.Fatalf("removeExpired() = %v, want [old]", got)
+    }
+    if removed, err := reloaded.remove("lobby"); err != nil || !removed {
+        t.Fatalf("remove(lobby) = %v, %v", removed, err)
+    }
+    if removed, _ := reloaded.remove("lobby"); removed {
+        t.Fatal("remove() of a missing room reported success")
+    }
+    if list := loadNamedRooms(path).list(); len(list) != 0 {
+        t.Fatalf("list() after removal = %+v, want empty", list)
+    }
+}
+
+func TestCloseRoomNotifiesOtherNodes(t *testing.T) {
+    backend := &testBackend{}
+    saved := roomState
+    roomState = backend
+    t.Cleanup(func() { roomState = saved })
+
+    closeRoom("lobby", "Room has expired")
+    relays := backend.relays()
+    if len(relays) != 1 || relays[0].Kind != relayRoomClosed || relays[0].Room != "lobby" {
+        t.Fatalf("broadcasts = %+v, want one %s for lobby", relays, relayRoomClosed)
+    }
+    var reason string
+    if err := json.Unmarshal(relays[0].Data, &reason); err != nil || reason != "Room has expired" {
+        t.Fatalf("reason = %q, %v", reason, err)
+    }
+}
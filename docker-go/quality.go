@@ -0,0 +1,260 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+
+    "github.com/pion/interceptor/pkg/stats"
+    "github.com/pion/webrtc/v3"
+)
+
+// Период рассылки сообщений stats; 0 отключает рассылку (API комнат продолжает работать)
+var statsInterval = envDuration("STATS_INTERVAL", 5*time.Second)
+
+// trackQuality - качество одного RTP-потока между пиром и сервером
+type trackQuality struct {
+    Direction   string  `json:"direction"` // inbound - от пира к серверу, outbound - от сервера к пиру
+    Kind        string  `json:"kind"`
+    Codec       string  `json:"codec,omitempty"`
+    RID         string  `json:"rid,omitempty"`
+    SSRC        uint32  `json:"ssrc"`
+    Packets     uint64  `json:"packets"`
+    PacketsLost int64   `json:"packetsLost"`
+    LossPercent float64 `json:"lossPercent"` // потери за последний интервал
+    JitterMs    float64 `json:"jitterMs"`
+    RTTMs       float64 `json:"rttMs"`
+    BitrateKbps float64 `json:"bitrateKbps"`
+    FrameRate   float64 `json:"frameRate,omitempty"`
+    NACKs       uint32  `json:"nacks"`
+    PLIs        uint32  `json:"plis"`
+    FIRs        uint32  `json:"firs"`
+}
+
+// peerQuality - качество медиа пира; пусто, если сервер не принимает и не отправляет ему медиа (P2P)
+type peerQuality struct {
+    Username       string         `json:"username"`
+    Role           string         `json:"role"` // leader или follower
+    Mode           string         `json:"mode,omitempty"`
+    RTTMs          float64        `json:"rttMs"`                    // по ICE
+    GlassToGlassMs float64        `json:"glassToGlassMs,omitempty"` // задержка от съемки у ведущего до показа (ведомые)
+    Tracks         []trackQuality `json:"tracks"`
+    UpdatedAt      time.Time      `json:"updatedAt"`
+}
+
+// statsSample - счетчики потока при предыдущем замере (для расчета битрейта и потерь за интервал)
+type statsSample struct {
+    at      time.Time
+    bytes   uint64
+    packets uint64
+    lost    int64
+}
+
+// peerStats собирает статистику PeerConnection пира из интерцептора stats
+type peerStats struct {
+    mu     sync.Mutex
+    getter stats.Getter
+    prev   map[uint32]statsSample
+    last   *peerQuality
+}
+
+func (ps *peerStats) setGetter(getter stats.Getter) {
+    ps.mu.Lock()
+    ps.getter = getter
+    ps.mu.Unlock()
+}
+
+// latest возвращает последний замер (nil, если замеров еще не было)
+func (ps *peerStats) latest() *peerQuality {
+    if ps == nil {
+        return nil
+    }
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    return ps.last
+}
+
+// iceRTT возвращает RTT выбранной пары кандидатов ICE, мс
+func iceRTT(pc *webrtc.PeerConnection) float64 {
+    for _, s := range pc.GetStats() {
+        if pair, ok := s.(webrtc.ICECandidatePairStats); ok && pair.Nominated && pair.State == webrtc.StatsICECandidatePairStateSucceeded {
+            return pair.CurrentRoundTripTime * 1000
+        }
+    }
+    return 0
+}
+
+// collect снимает статистику всех потоков PeerConnection пира. Нельзя вызывать в цикле комнаты.
+func (ps *peerStats) collect(peer *Peer) *peerQuality {
+    if ps == nil || peer.pc == nil {
+        return nil
+    }
+    role, mode := "follower", peer.mode
+    if peer.isLeader {
+        role, mode = "leader", ""
+    }
+    now := time.Now()
+    q := &peerQuality{Username: peer.username, Role: role, Mode: mode, RTTMs: iceRTT(peer.pc), Tracks: []trackQuality{}, UpdatedAt: now}
+    if ms, ok := peer.latency.value(); ok {
+        q.GlassToGlassMs = ms
+    }
+
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    if ps.getter == nil {
+        ps.last = q
+        return q
+    }
+    if ps.prev == nil {
+        ps.prev = make(map[uint32]statsSample)
+    }
+    seen := make(map[uint32]bool)
+
+    // Входящие потоки (медиа ведущего, опубликованное на сервер)
+    rm := getRoomMedia(peer.room)
+    for _, receiver := range peer.pc.GetReceivers() {
+        for _, remote := range receiver.Tracks() {
+            ssrc := uint32(remote.SSRC())
+            s := ps.getter.Get(ssrc)
+            if ssrc == 0 || s == nil {
+                continue
+            }
+            codec := remote.Codec()
+            in := s.InboundRTPStreamStats
+            tq := trackQuality{
+                Direction:   "inbound",
+                Kind:        remote.Kind().String(),
+                Codec:       codec.MimeType,
+                RID:         remote.RID(),
+                SSRC:        ssrc,
+                Packets:     in.PacketsReceived,
+                PacketsLost: in.PacketsLost,
+                RTTMs:       float64(s.RemoteOutboundRTPStreamStats.RoundTripTime) / float64(time.Millisecond),
+                NACKs:       in.NACKCount,
+                PLIs:        in.PLICount,
+                FIRs:        in.FIRCount,
+            }
+            if codec.ClockRate > 0 {
+                tq.JitterMs = in.Jitter / float64(codec.ClockRate) * 1000
+            }
+            if rm != nil && rm.pc == peer.pc {
+                if t := rm.trackBySSRC(ssrc); t != nil {
+                    tq.FrameRate = t.currentFrameRate()
+                }
+            }
+            if prev, ok := ps.prev[ssrc]; ok {
+                dt := now.Sub(prev.at).Seconds()
+                if dt > 0 {
+                    tq.BitrateKbps = float64(in.BytesReceived-prev.bytes) * 8 / dt / 1000
+                }
+                received := int64(in.PacketsReceived - prev.packets)
+                if lost := in.PacketsLost - prev.lost; lost > 0 && received+lost > 0 {
+                    tq.LossPercent = float64(lost) * 100 / float64(received+lost)
+                }
+            }
+            ps.prev[ssrc] = statsSample{at: now, bytes: in.BytesReceived, packets: in.PacketsReceived, lost: in.PacketsLost}
+            seen[ssrc] = true
+            q.Tracks = append(q.Tracks, tq)
+        }
+    }
+
+    // Исходящие потоки (ведомый в режиме sfu)
+    var frameRate float64
+    if peer.mode == peerModeSFU {
+        for _, sub := range roomSubscribers(peer.room) {
+            if sub.peer == peer {
+                frameRate = sub.forwardedFrameRate()
+                break
+            }
+        }
+    }
+    for _, sender := range peer.pc.GetSenders() {
+        track := sender.Track()
+        params := sender.GetParameters()
+        if track == nil || len(params.Encodings) == 0 {
+            continue
+        }
+        ssrc := uint32(params.Encodings[0].SSRC)
+        s := ps.getter.Get(ssrc)
+        if ssrc == 0 || s == nil {
+            continue
+        }
+        out := s.OutboundRTPStreamStats
+        remote := s.RemoteInboundRTPStreamStats
+        tq := trackQuality{
+            Direction:   "outbound",
+            Kind:        track.Kind().String(),
+            SSRC:        ssrc,
+            Packets:     out.PacketsSent,
+            PacketsLost: remote.PacketsLost,
+            LossPercent: remote.FractionLost * 100,
+            JitterMs:    remote.Jitter * 1000,
+            RTTMs:       float64(remote.RoundTripTime) / float64(time.Millisecond),
+            NACKs:       out.NACKCount,
+            PLIs:        out.PLICount,
+            FIRs:        out.FIRCount,
+        }
+        if len(params.Codecs) > 0 {
+            tq.Codec = params.Codecs[0].MimeType
+        }
+        if track.Kind() == webrtc.RTPCodecTypeVideo {
+            tq.FrameRate = frameRate
+        }
+        if prev, ok := ps.prev[ssrc]; ok {
+            if dt := now.Sub(prev.at).Seconds(); dt > 0 {
+                tq.BitrateKbps = float64(out.BytesSent-prev.bytes) * 8 / dt / 1000
+            }
+        }
+        ps.prev[ssrc] = statsSample{at: now, bytes: out.BytesSent, packets: out.PacketsSent}
+        seen[ssrc] = true
+        q.Tracks = append(q.Tracks, tq)
+    }
+
+    for ssrc := range ps.prev {
+        if !seen[ssrc] {
+            delete(ps.prev, ssrc)
+        }
+    }
+    ps.last = q
+    return q
+}
+
+// roomQuality возвращает последние замеры качества пиров комнаты
+func roomQuality(room string) []*peerQuality {
+    result := []*peerQuality{}
+    for _, peer := range roomPeers(room) {
+        if q := peer.stats.latest(); q != nil {
+            result = append(result, q)
+        }
+    }
+    return result
+}
+
+// startStatsReporter периодически снимает статистику со всех PeerConnection сервера
+// и рассылает каждой комнате сообщение stats с качеством всех её пиров
+func startStatsReporter() {
+    if statsInterval <= 0 || !interceptorConfig.Stats {
+        log.Printf("Periodic stats messages are disabled")
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(statsInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            for room, roomPeers := range activeRooms() {
+                report := make([]*peerQuality, 0, len(roomPeers))
+                for _, peer := range roomPeers {
+                    if q := peer.stats.collect(peer); q != nil {
+                        report = append(report, q)
+                    }
+                }
+                msg := map[string]interface{}{"type": "stats", "room": room, "data": report}
+                for _, peer := range roomPeers {
+                    if err := peer.writeJSON(msg); err != nil {
+                        log.Printf("Error sending stats to %s in room %s: %v", peer.username, room, err)
+                    }
+                }
+            }
+        }
+    }()
+}
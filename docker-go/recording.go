@@ -0,0 +1,368 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// recordingSettings - настройки записи комнат, задаются переменными окружения
+type recordingSettings struct {
+    Enabled           bool
+    Dir               string
+    Public            bool          // просмотр записей без токена администратора
+    MaxAge            time.Duration // 0 - без ограничения по возрасту
+    QuotaMB           int           // 0 - без ограничения по объему
+    RetentionInterval time.Duration
+}
+
+var recordingConfig = recordingSettings{
+    Enabled:           envBool("RECORDING_ENABLED", false),
+    Dir:               envString("RECORDINGS_DIR", "recordings"),
+    Public:            envBool("RECORDINGS_PUBLIC", false),
+    MaxAge:            envDuration("RECORDING_MAX_AGE", 0),
+    QuotaMB:           envInt("RECORDING_QUOTA_MB", 0),
+    RetentionInterval: envDuration("RECORDING_RETENTION_INTERVAL", 10*time.Minute),
+}
+
+// recordingMeta - метаданные записи; хранятся рядом с файлом записи (<id>.json)
+type recordingMeta struct {
+    ID        string     `json:"id"`
+    Room      string     `json:"room"`
+    Leader    string     `json:"leader"`
+    StartedAt time.Time  `json:"startedAt"`
+    EndedAt   *time.Time `json:"endedAt,omitempty"`
+    Duration  float64    `json:"duration"` // секунды
+    Size      int64      `json:"size"`     // байты
+    Active    bool       `json:"active"`
+    hlsStreamInfo
+}
+
+// end возвращает время окончания записи (для идущей записи - по записанной длительности)
+func (m *recordingMeta) end() time.Time {
+    if m.EndedAt != nil {
+        return *m.EndedAt
+    }
+    return m.StartedAt.Add(time.Duration(m.Duration * float64(time.Second)))
+}
+
+var recordingIDPattern = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+
+func recordingPath(id, ext string) string {
+    return filepath.Join(recordingConfig.Dir, id+ext)
+}
+
+// roomRecorder пишет сегменты HLS-сессии комнаты в один фрагментированный MP4;
+// при завершении дописывает mfra, чтобы плееры могли перематывать без чтения всех moof
+type roomRecorder struct {
+    meta         recordingMeta
+    file         *os.File
+    wroteInit    bool
+    randomAccess map[uint32][]fmp4RandomAccess // точки перемотки по дорожкам для mfra
+    queue        chan recordingChunk
+    closeOnce    sync.Once
+}
+
+type recordingChunk struct {
+    init     []byte
+    info     hlsStreamInfo
+    data     []byte
+    duration float64
+}
+
+var (
+    activeRecordings   = make(map[string]*roomRecorder)
+    activeRecordingsMu sync.Mutex
+)
+
+func isRecordingActive(id string) bool {
+    activeRecordingsMu.Lock()
+    defer activeRecordingsMu.Unlock()
+    return activeRecordings[id] != nil
+}
+
+// startRecording начинает запись медиа ведущего, упакованного HLS-сессией комнаты
+func startRecording(rm *roomMedia) {
+    if !recordingConfig.Enabled {
+        return
+    }
+    if rm.hls == nil {
+        log.Printf("Recording of room %s skipped: recordings are packaged by HLS, which is disabled", rm.room)
+        return
+    }
+    if err := os.MkdirAll(recordingConfig.Dir, 0o755); err != nil {
+        log.Printf("Recording of room %s failed: %v", rm.room, err)
+        return
+    }
+    suffix := make([]byte, 4)
+    if _, err := rand.Read(suffix); err != nil {
+        log.Printf("Recording of room %s failed: %v", rm.room, err)
+        return
+    }
+    now := time.Now().UTC()
+    id := now.Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+    file, err := os.Create(recordingPath(id, ".mp4"))
+    if err != nil {
+        log.Printf("Recording of room %s failed: %v", rm.room, err)
+        return
+    }
+    rec := &roomRecorder{
+        meta:         recordingMeta{ID: id, Room: rm.room, Leader: rm.leader.username, StartedAt: now, Active: true},
+        file:         file,
+        randomAccess: make(map[uint32][]fmp4RandomAccess),
+        queue:        make(chan recordingChunk, 64),
+    }
+    activeRecordingsMu.Lock()
+    activeRecordings[id] = rec
+    activeRecordingsMu.Unlock()
+    rec.saveMeta()
+    rm.hls.addListener(rec)
+    go rec.run()
+    log.Printf("Recording %s started for room %s (leader: %s)", id, rm.room, rm.leader.username)
+}
+
+func (r *roomRecorder) hlsSegment(init []byte, info hlsStreamInfo, data []byte, duration float64) {
+    select {
+    case r.queue <- recordingChunk{init: init, info: info, data: data, duration: duration}:
+    default:
+        log.Printf("Recording %s: disk is too slow, segment of %.1fs dropped", r.meta.ID, duration)
+    }
+}
+
+func (r *roomRecorder) hlsClosed() {
+    r.closeOnce.Do(func() { close(r.queue) })
+}
+
+// run записывает сегменты на диск и обновляет метаданные после каждого сегмента
+func (r *roomRecorder) run() {
+    failed := false
+    for chunk := range r.queue {
+        if failed {
+            continue
+        }
+        if !r.wroteInit {
+            if err := r.write(chunk.init); err != nil {
+                failed = true
+                continue
+            }
+            r.wroteInit = true
+        }
+        offset := uint64(r.meta.Size)
+        if err := r.write(chunk.data); err != nil {
+            failed = true
+            continue
+        }
+        for trackID, point := range scanFMP4RandomAccess(chunk.data, offset) {
+            r.randomAccess[trackID] = append(r.randomAccess[trackID], point)
+        }
+        r.meta.Duration += chunk.duration
+        r.meta.hlsStreamInfo = chunk.info
+        r.saveMeta()
+    }
+    if !failed && len(r.randomAccess) > 0 {
+        _ = r.write(buildFMP4Mfra(r.randomAccess))
+    }
+
+    if err := r.file.Close(); err != nil {
+        log.Printf("Recording %s: failed to close file: %v", r.meta.ID, err)
+    }
+    ended := time.Now().UTC()
+    r.meta.EndedAt = &ended
+    r.meta.Active = false
+    activeRecordingsMu.Lock()
+    delete(activeRecordings, r.meta.ID)
+    activeRecordingsMu.Unlock()
+    if !r.wroteInit {
+        // Медиа так и не пришло: пустую запись не храним
+        _ = os.Remove(recordingPath(r.meta.ID, ".mp4"))
+        _ = os.Remove(recordingPath(r.meta.ID, ".json"))
+        log.Printf("Recording %s of room %s is empty and has been removed", r.meta.ID, r.meta.Room)
+        return
+    }
+    r.saveMeta()
+    log.Printf("Recording %s of room %s finished (%.1fs, %d bytes)", r.meta.ID, r.meta.Room, r.meta.Duration, r.meta.Size)
+}
+
+func (r *roomRecorder) write(data []byte) error {
+    n, err := r.file.Write(data)
+    r.meta.Size += int64(n)
+    if err != nil {
+        log.Printf("Recording %s: write failed, recording stopped: %v", r.meta.ID, err)
+    }
+    return err
+}
+
+func (r *roomRecorder) saveMeta() {
+    data, err := json.MarshalIndent(r.meta, "", "  ")
+    if err != nil {
+        log.Printf("Recording %s: failed to encode metadata: %v", r.meta.ID, err)
+        return
+    }
+    // Пишем через временный файл, чтобы каталог не увидел метаданные наполовину
+    tmp := recordingPath(r.meta.ID, ".json.tmp")
+    if err := os.WriteFile(tmp, data, 0o644); err != nil {
+        log.Printf("Recording %s: failed to save metadata: %v", r.meta.ID, err)
+        return
+    }
+    if err := os.Rename(tmp, recordingPath(r.meta.ID, ".json")); err != nil {
+        log.Printf("Recording %s: failed to save metadata: %v", r.meta.ID, err)
+    }
+}
+
+// recordingFilter - условия выборки каталога; пустые поля не ограничивают выборку
+type recordingFilter struct {
+    Room     string
+    Leader   string
+    From, To time.Time
+}
+
+func (f recordingFilter) match(m *recordingMeta) bool {
+    if f.Room != "" && m.Room != f.Room {
+        return false
+    }
+    if f.Leader != "" && m.Leader != f.Leader {
+        return false
+    }
+    if !f.From.IsZero() && m.end().Before(f.From) {
+        return false
+    }
+    if !f.To.IsZero() && m.StartedAt.After(f.To) {
+        return false
+    }
+    return true
+}
+
+// loadRecording читает метаданные записи
+func loadRecording(id string) (*recordingMeta, error) {
+    if !recordingIDPattern.MatchString(id) {
+        return nil, os.ErrNotExist
+    }
+    data, err := os.ReadFile(recordingPath(id, ".json"))
+    if err != nil {
+        return nil, err
+    }
+    var m recordingMeta
+    if err := json.Unmarshal(data, &m); err != nil {
+        return nil, fmt.Errorf("recording %s: invalid metadata: %w", id, err)
+    }
+    // Запись, прерванная перезапуском сервера, считается завершенной
+    m.Active = isRecordingActive(id)
+    return &m, nil
+}
+
+// listRecordings возвращает записи каталога, новые первыми
+func listRecordings(filter recordingFilter) ([]*recordingMeta, error) {
+    entries, err := os.ReadDir(recordingConfig.Dir)
+    if errors.Is(err, os.ErrNotExist) {
+        return []*recordingMeta{}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    result := []*recordingMeta{}
+    for _, e := range entries {
+        name := e.Name()
+        if e.IsDir() || !strings.HasSuffix(name, ".json") {
+            continue
+        }
+        m, err := loadRecording(strings.TrimSuffix(name, ".json"))
+        if err != nil {
+            log.Printf("Skipping recording %s: %v", name, err)
+            continue
+        }
+        if filter.match(m) {
+            result = append(result, m)
+        }
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i].StartedAt.After(result[j].StartedAt) })
+    return result, nil
+}
+
+var errRecordingActive = errors.New("recording is in progress")
+
+// deleteRecording удаляет файл записи и её метаданные
+func deleteRecording(id string) error {
+    if !recordingIDPattern.MatchString(id) {
+        return os.ErrNotExist
+    }
+    if isRecordingActive(id) {
+        return errRecordingActive
+    }
+    if err := os.Remove(recordingPath(id, ".json")); err != nil {
+        return err
+    }
+    if err := os.Remove(recordingPath(id, ".mp4")); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    return nil
+}
+
+// enforceRecordingRetention удаляет завершенные записи старше MaxAge,
+// затем самые старые записи, пока общий объем превышает квоту
+func enforceRecordingRetention() {
+    recordings, err := listRecordings(recordingFilter{})
+    if err != nil {
+        log.Printf("Recording retention: %v", err)
+        return
+    }
+    var total int64
+    var kept []*recordingMeta
+    for _, m := range recordings {
+        if !m.Active && recordingConfig.MaxAge > 0 && time.Since(m.end()) > recordingConfig.MaxAge {
+            if err := deleteRecording(m.ID); err != nil {
+                log.Printf("Recording retention: failed to delete %s: %v", m.ID, err)
+            } else {
+                log.Printf("Recording retention: deleted %s of room %s (older than %s)", m.ID, m.Room, recordingConfig.MaxAge)
+            }
+            continue
+        }
+        total += m.Size
+        kept = append(kept, m)
+    }
+
+    quota := int64(recordingConfig.QuotaMB) << 20
+    if quota <= 0 {
+        return
+    }
+    // kept отсортирован от новых к старым
+    for i := len(kept) - 1; i >= 0 && total > quota; i-- {
+        m := kept[i]
+        if m.Active {
+            continue
+        }
+        if err := deleteRecording(m.ID); err != nil {
+            log.Printf("Recording retention: failed to delete %s: %v", m.ID, err)
+            continue
+        }
+        total -= m.Size
+        log.Printf("Recording retention: deleted %s of room %s (disk quota %d MB exceeded)", m.ID, m.Room, recordingConfig.QuotaMB)
+    }
+}
+
+// startRecordingRetention периодически применяет политику хранения записей
+func startRecordingRetention() {
+    if recordingConfig.Enabled && !hlsConfig.Enabled {
+        log.Printf("RECORDING_ENABLED has no effect: recordings are packaged by HLS, which is disabled")
+    }
+    if recordingConfig.RetentionInterval <= 0 || (recordingConfig.MaxAge <= 0 && recordingConfig.QuotaMB <= 0) {
+        return
+    }
+    go func() {
+        enforceRecordingRetention()
+        ticker := time.NewTicker(recordingConfig.RetentionInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            enforceRecordingRetention()
+        }
+    }()
+}
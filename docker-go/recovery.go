@@ -0,0 +1,138 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// Восстановление остановившегося видео ведущего, пока его WebSocket подключен.
+// Шаги выполняются по очереди, пока видео не возобновится: запрос ключевого кадра,
+// перезапуск ICE, полное пересогласование. Каждый шаг и результат рассылаются событиями
+// video_recovery_step, video_recovered и video_recovery_failed.
+
+// recoverySettings - настройки восстановления, задаются переменными окружения
+type recoverySettings struct {
+    Enabled            bool
+    KeyframeTimeout    time.Duration
+    ICERestartTimeout  time.Duration
+    RenegotiateTimeout time.Duration
+}
+
+var recoveryConfig = recoverySettings{
+    Enabled:            envBool("RECOVERY_ENABLED", true),
+    KeyframeTimeout:    envDuration("RECOVERY_KEYFRAME_TIMEOUT", 3*time.Second),
+    ICERestartTimeout:  envDuration("RECOVERY_ICE_RESTART_TIMEOUT", 10*time.Second),
+    RenegotiateTimeout: envDuration("RECOVERY_RENEGOTIATE_TIMEOUT", 15*time.Second),
+}
+
+var videoRecoveriesTotal = newCounterVec("webrtc_video_recoveries_total",
+    "Stalled leader video recoveries by the step that fixed the stream (failed - none did).", "step")
+
+// recoveryStep - шаг восстановления; run получает источник, по которому видео было видно (rtp или follower:<имя>)
+type recoveryStep struct {
+    name    string
+    timeout func() time.Duration
+    run     func(room string, leader *Peer, source string)
+}
+
+var recoverySteps = []recoveryStep{
+    {name: "keyframe", timeout: func() time.Duration { return recoveryConfig.KeyframeTimeout }, run: recoverWithKeyframe},
+    {name: "ice_restart", timeout: func() time.Duration { return recoveryConfig.ICERestartTimeout }, run: recoverWithICERestart},
+    {name: "renegotiate", timeout: func() time.Duration { return recoveryConfig.RenegotiateTimeout }, run: recoverWithRenegotiation},
+}
+
+// advanceRecovery запускает следующий шаг, если предыдущий не помог за отведенное время.
+// Вызывается под videoFlowMu; действие шага возвращается для выполнения без блокировки.
+func (f *videoFlow) advanceRecovery(room string, now time.Time) ([]pendingRoomEvent, func()) {
+    if !recoveryConfig.Enabled || f.recoveryFailed {
+        return nil, nil
+    }
+    if f.recoveryStep > 0 && now.Sub(f.stepStarted) < recoverySteps[f.recoveryStep-1].timeout() {
+        return nil, nil
+    }
+    if f.recoveryStep == len(recoverySteps) {
+        f.recoveryFailed = true
+        videoRecoveriesTotal.inc("failed")
+        log.Printf("Video recovery in room %s failed: no step restored leader %s video", room, f.leader.username)
+        return []pendingRoomEvent{{"video_recovery_failed", map[string]interface{}{
+            "stalledMs": now.Sub(f.stalledAt).Milliseconds(),
+        }}}, nil
+    }
+    step := recoverySteps[f.recoveryStep]
+    f.recoveryStep++
+    f.stepStarted = now
+    log.Printf("Video recovery in room %s: step %d (%s), timeout %s", room, f.recoveryStep, step.name, step.timeout())
+    event := pendingRoomEvent{"video_recovery_step", map[string]interface{}{
+        "step":      step.name,
+        "attempt":   f.recoveryStep,
+        "timeoutMs": step.timeout().Milliseconds(),
+    }}
+    leader, source := f.leader, f.source
+    return []pendingRoomEvent{event}, func() { step.run(room, leader, source) }
+}
+
+// finishRecovery сообщает, какой шаг вернул видео. Вызывается под videoFlowMu.
+func (f *videoFlow) finishRecovery(room string, now time.Time) []pendingRoomEvent {
+    if f.recoveryStep == 0 {
+        return nil
+    }
+    step := "none"
+    if !f.recoveryFailed {
+        step = recoverySteps[f.recoveryStep-1].name
+    }
+    f.recoveryStep, f.recoveryFailed = 0, false
+    videoRecoveriesTotal.inc(step)
+    log.Printf("Video in room %s recovered (step: %s)", room, step)
+    return []pendingRoomEvent{{"video_recovered", map[string]interface{}{
+        "step":      step,
+        "stalledMs": now.Sub(f.stalledAt).Milliseconds(),
+    }}}
+}
+
+func recoverWithKeyframe(room string, leader *Peer, source string) {
+    requestRoomKeyframe(room, "stalled video recovery", true)
+}
+
+// recoverWithICERestart просит ведущего перезапустить ICE на соединении, по которому шло видео:
+// серверном (публикация) или P2P с ведомым. Offer с iceRestart создает ведущий.
+func recoverWithICERestart(room string, leader *Peer, source string) {
+    msg := map[string]interface{}{"type": "ice_restart", "room": room, "target": "server"}
+    if follower, ok := strings.CutPrefix(source, "follower:"); ok {
+        msg["target"] = "p2p"
+        msg["follower"] = follower
+    }
+    if err := leader.writeJSON(msg); err != nil {
+        log.Printf("Error sending ice_restart to leader %s: %v", leader.username, err)
+    }
+}
+
+// recoverWithRenegotiation запускает полное пересогласование: публикацию на сервер
+// (publish_request) или P2P-соединение с ведомым (rejoin_and_offer)
+func recoverWithRenegotiation(room string, leader *Peer, source string) {
+    if !strings.HasPrefix(source, "follower:") {
+        requestLeaderPublish(room)
+        return
+    }
+    follower := signalingTarget(leader)
+    var codec, viewMode string
+    if follower != nil {
+        follower.mu.Lock()
+        codec, viewMode = follower.codec, follower.viewMode
+        follower.mu.Unlock()
+    }
+    if follower == nil {
+        return
+    }
+    log.Printf("Sending rejoin_and_offer command to leader %s to recover video for follower %s", leader.username, follower.username)
+    if err := leader.writeJSON(map[string]interface{}{
+        "type":           "rejoin_and_offer",
+        "room":           room,
+        "preferredCodec": codec,
+        "viewMode":       viewMode,
+        "reason":         fmt.Sprintf("video stalled for follower %s", follower.username),
+    }); err != nil {
+        log.Printf("Error sending rejoin_and_offer to leader %s: %v", leader.username, err)
+    }
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// redisSettings - подключение к Redis (docker-redis), задается переменными окружения
+type redisSettings struct {
+    Addr     string
+    Password string
+    DB       int
+}
+
+var redisConfig = redisSettings{
+    Addr:     envString("REDIS_ADDR", "my-redis:6379"),
+    Password: envString("REDIS_PASSWORD", ""),
+    DB:       envInt("REDIS_DB", 0),
+}
+
+// Ключи и каналы Redis:
+//   webrtc:rooms            - множество комнат с пирами
+//   webrtc:room:<room>      - хеш username -> roomMember (JSON)
+//   webrtc:node:<node>      - признак живого узла с TTL
+//   webrtc:membership       - канал изменений состава комнат
+//   webrtc:relay:<node>     - канал сообщений пирам узла
+//   webrtc:broadcast        - канал сообщений всем узлам (закрытие комнаты)
+//   webrtc:named-rooms      - хеш name -> namedRoom (JSON) и канал его изменений
+const (
+    redisRoomsKey          = "webrtc:rooms"
+    redisMembershipChannel = "webrtc:membership"
+    redisBroadcastChannel  = "webrtc:broadcast"
+    redisNamedRoomsKey     = "webrtc:named-rooms"
+    redisNamedRoomsChannel = "webrtc:named-rooms"
+    redisNodeTTL           = 15 * time.Second
+    redisHeartbeatInterval = 5 * time.Second
+    redisOpTimeout         = 3 * time.Second
+)
+
+func redisRoomKey(room string) string     { return "webrtc:room:" + room }
+func redisNodeKey(node string) string     { return "webrtc:node:" + node }
+func redisRelayChannel(node string) string { return "webrtc:relay:" + node }
+
+// Удаляет пира, только если запись принадлежит этому узлу (пир мог переподключиться к другому)
+var redisLeaveScript = redis.NewScript(`
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v and cjson.decode(v).node == ARGV[2] then
+    redis.call('HDEL', KEYS[1], ARGV[1])
+end
+if redis.call('HLEN', KEYS[1]) == 0 then
+    redis.call('SREM', KEYS[2], ARGV[3])
+end
+return 0
+`)
+
+// membershipEvent - сообщение канала webrtc:membership
+type membershipEvent struct {
+    Action string     `json:"action"` // join или leave
+    Member roomMember `json:"member"`
+}
+
+// redisBackend хранит пиров в Redis и держит в памяти кэш пиров других узлов
+type redisBackend struct {
+    client *redis.Client
+    node   string
+    ctx    context.Context
+    cancel context.CancelFunc
+
+    mu     sync.Mutex
+    remote map[string]map[string]roomMember // комната -> username -> пир другого узла
+
+    named *redisNamedRooms
+}
+
+func newRedisBackend(cfg redisSettings, node string) (*redisBackend, error) {
+    client := redis.NewClient(&redis.Options{Addr: cfg.Addr, Password: cfg.Password, DB: cfg.DB})
+    ctx, cancel := context.WithCancel(context.Background())
+    b := &redisBackend{client: client, node: node, ctx: ctx, cancel: cancel, remote: make(map[string]map[string]roomMember)}
+    b.named = &redisNamedRooms{b: b, rooms: make(map[string]namedRoom)}
+
+    pingCtx, pingCancel := context.WithTimeout(ctx, redisOpTimeout)
+    defer pingCancel()
+    if err := client.Ping(pingCtx).Err(); err != nil {
+        cancel()
+        client.Close()
+        return nil, fmt.Errorf("redis %s: %w", cfg.Addr, err)
+    }
+    if err := b.heartbeat(); err != nil {
+        cancel()
+        client.Close()
+        return nil, fmt.Errorf("redis %s: %w", cfg.Addr, err)
+    }
+
+    sub := client.Subscribe(ctx, redisMembershipChannel, redisRelayChannel(node), redisBroadcastChannel, redisNamedRoomsChannel)
+    if _, err := sub.Receive(pingCtx); err != nil {
+        cancel()
+        client.Close()
+        return nil, fmt.Errorf("redis %s: subscribe: %w", cfg.Addr, err)
+    }
+    go b.listen(sub)
+    b.resync()
+    go b.maintain()
+    return b, nil
+}
+
+func (b *redisBackend) Name() string { return "redis" }
+
+func (b *redisBackend) opContext() (context.Context, context.CancelFunc) {
+    return context.WithTimeout(b.ctx, redisOpTimeout)
+}
+
+func (b *redisBackend) Join(m roomMember) {
+    data, err := json.Marshal(m)
+    if err != nil {
+        return
+    }
+    ctx, cancel := b.opContext()
+    defer cancel()
+    _, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.HSet(ctx, redisRoomKey(m.Room), m.Username, data)
+        pipe.SAdd(ctx, redisRoomsKey, m.Room)
+        return nil
+    })
+    if err == nil {
+        err = b.publishMembership("join", m)
+    }
+    if err != nil {
+        log.Printf("Redis backend: failed to register %s in room %s: %v", m.Username, m.Room, err)
+    }
+}
+
+func (b *redisBackend) Leave(m roomMember) {
+    ctx, cancel := b.opContext()
+    defer cancel()
+    err := redisLeaveScript.Run(ctx, b.client, []string{redisRoomKey(m.Room), redisRoomsKey}, m.Username, b.node, m.Room).Err()
+    if err == nil {
+        err = b.publishMembership("leave", m)
+    }
+    if err != nil {
+        log.Printf("Redis backend: failed to unregister %s from room %s: %v", m.Username, m.Room, err)
+    }
+}
+
+func (b *redisBackend) publishMembership(action string, m roomMember) error {
+    data, err := json.Marshal(membershipEvent{Action: action, Member: m})
+    if err != nil {
+        return err
+    }
+    ctx, cancel := b.opContext()
+    defer cancel()
+    return b.client.Publish(ctx, redisMembershipChannel, data).Err()
+}
+
+func (b *redisBackend) RemoteMembers(room string) []roomMember {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    members := make([]roomMember, 0, len(b.remote[room]))
+    for _, m := range b.remote[room] {
+        members = append(members, m)
+    }
+    sort.Slice(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+    return members
+}
+
+func (b *redisBackend) RemoteRooms() []string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    result := make([]string, 0, len(b.remote))
+    for room := range b.remote {
+        result = append(result, room)
+    }
+    return result
+}
+
+func (b *redisBackend) Relay(to roomMember, env relayEnvelope) error {
+    if to.Node == "" || to.Node == b.node {
+        return errNotRelayable
+    }
+    data, err := json.Marshal(env)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := b.opContext()
+    defer cancel()
+    receivers, err := b.client.Publish(ctx, redisRelayChannel(to.Node), data).Result()
+    if err == nil && receivers == 0 {
+        err = fmt.Errorf("node %s is not listening", to.Node)
+    }
+    return err
+}
+
+func (b *redisBackend) Broadcast(env relayEnvelope) error {
+    env.Node = b.node
+    data, err := json.Marshal(env)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := b.opContext()
+    defer cancel()
+    return b.client.Publish(ctx, redisBroadcastChannel, data).Err()
+}
+
+func (b *redisBackend) NamedRooms() namedRoomStore { return b.named }
+
+func (b *redisBackend) Close() error {
+    // Пиры этого узла уходят вместе с ним
+    ctx, cancel := b.opContext()
+    b.client.Del(ctx, redisNodeKey(b.node))
+    cancel()
+    b.cancel()
+    return b.client.Close()
+}
+
+// listen обрабатывает сообщения каналов: изменения состава комнат, реестра именованных комнат
+// и сообщения пирам узла
+func (b *redisBackend) listen(sub *redis.PubSub) {
+    defer sub.Close()
+    for msg := range sub.Channel() {
+        if msg.Channel == redisNamedRoomsChannel {
+            var ev namedRoomEvent
+            if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil || ev.Node == b.node {
+                continue
+            }
+            b.named.apply(ev.Name, ev.Room)
+            continue
+        }
+        if msg.Channel == redisMembershipChannel {
+            var ev membershipEvent
+            if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil || ev.Member.Node == b.node {
+                continue
+            }
+            b.mu.Lock()
+            members := b.remote[ev.Member.Room]
+            switch ev.Action {
+            case "join":
+                if members == nil {
+                    members = make(map[string]roomMember)
+                    b.remote[ev.Member.Room] = members
+                }
+                members[ev.Member.Username] = ev.Member
+            case "leave":
+                if existing, ok := members[ev.Member.Username]; ok && existing.Node == ev.Member.Node {
+                    delete(members, ev.Member.Username)
+                    if len(members) == 0 {
+                        delete(b.remote, ev.Member.Room)
+                    }
+                }
+            }
+            b.mu.Unlock()
+            go onRemoteMembership(ev.Member.Room)
+            continue
+        }
+        var env relayEnvelope
+        if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+            log.Printf("Redis backend: invalid relayed message: %v", err)
+            continue
+        }
+        if msg.Channel == redisBroadcastChannel && env.Node == b.node {
+            continue
+        }
+        go deliverRelayed(env)
+    }
+}
+
+func (b *redisBackend) heartbeat() error {
+    ctx, cancel := b.opContext()
+    defer cancel()
+    return b.client.Set(ctx, redisNodeKey(b.node), time.Now().Unix(), redisNodeTTL).Err()
+}
+
+// maintain продлевает признак живого узла и периодически сверяет кэш с Redis
+func (b *redisBackend) maintain() {
+    ticker := time.NewTicker(redisHeartbeatInterval)
+    defer ticker.Stop()
+    ticks := 0
+    for {
+        select {
+        case <-b.ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        if err := b.heartbeat(); err != nil {
+            log.Printf("Redis backend: heartbeat failed: %v", err)
+        }
+        ticks++
+        if ticks%3 == 0 {
+            b.resync()
+        }
+    }
+}
+
+// resync перечитывает реестр: пиры упавших узлов удаляются, кэш пиров других узлов
+// и именованных комнат обновляется
+func (b *redisBackend) resync() {
+    ctx, cancel := context.WithTimeout(b.ctx, 2*redisOpTimeout)
+    defer cancel()
+    if err := b.named.reload(ctx); err != nil {
+        log.Printf("Redis backend: resync of named rooms failed: %v", err)
+    }
+    roomNames, err := b.client.SMembers(ctx, redisRoomsKey).Result()
+    if err != nil {
+        log.Printf("Redis backend: resync failed: %v", err)
+        return
+    }
+    alive := map[string]bool{b.node: true}
+    remote := make(map[string]map[string]roomMember)
+    for _, room := range roomNames {
+        entries, err := b.client.HGetAll(ctx, redisRoomKey(room)).Result()
+        if err != nil {
+            log.Printf("Redis backend: resync of room %s failed: %v", room, err)
+            continue
+        }
+        for username, raw := range entries {
+            var m roomMember
+            if err := json.Unmarshal([]byte(raw), &m); err != nil {
+                continue
+            }
+            live, known := alive[m.Node]
+            if !known {
+                n, err := b.client.Exists(ctx, redisNodeKey(m.Node)).Result()
+                live = err != nil || n > 0 // при ошибке Redis не удаляем
+                alive[m.Node] = live
+            }
+            if !live {
+                log.Printf("Redis backend: removing %s from room %s (node %s is gone)", username, room, m.Node)
+                redisLeaveScript.Run(ctx, b.client, []string{redisRoomKey(room), redisRoomsKey}, username, m.Node, room)
+                continue
+            }
+            if m.Node == b.node {
+                continue
+            }
+            if remote[room] == nil {
+                remote[room] = make(map[string]roomMember)
+            }
+            remote[room][username] = m
+        }
+        if len(entries) == 0 {
+            b.client.SRem(ctx, redisRoomsKey, room)
+        }
+    }
+
+    b.mu.Lock()
+    changed := make(map[string]bool)
+    for room, members := range remote {
+        if len(members) != len(b.remote[room]) {
+            changed[room] = true
+            continue
+        }
+        for username, m := range members {
+            if old, ok := b.remote[room][username]; !ok || old.Node != m.Node {
+                changed[room] = true
+            }
+        }
+    }
+    for room := range b.remote {
+        if remote[room] == nil {
+            changed[room] = true
+        }
+    }
+    b.remote = remote
+    b.mu.Unlock()
+    for room := range changed {
+        go onRemoteMembership(room)
+    }
+}
+
+// namedRoomEvent - сообщение канала webrtc:named-rooms: комната создана, изменена или удалена (Room == nil)
+type namedRoomEvent struct {
+    Node string     `json:"node"`
+    Name string     `json:"name"`
+    Room *namedRoom `json:"room,omitempty"`
+}
+
+// redisNamedRooms - реестр именованных комнат в хеше Redis. get и list читают кэш в памяти,
+// который обновляют сообщения канала webrtc:named-rooms и периодическая сверка (resync).
+type redisNamedRooms struct {
+    b *redisBackend
+
+    mu    sync.Mutex
+    rooms map[string]namedRoom
+}
+
+var errNamedRoomConflict = errors.New("named room was changed concurrently, try again")
+
+func (n *redisNamedRooms) get(name string) (namedRoom, bool) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    room, ok := n.rooms[name]
+    if !ok || room.expired(time.Now()) {
+        return namedRoom{}, false
+    }
+    return room, true
+}
+
+func (n *redisNamedRooms) list() []namedRoom {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    now := time.Now()
+    list := []namedRoom{}
+    for _, room := range n.rooms {
+        if !room.expired(now) {
+            list = append(list, room)
+        }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+    return list
+}
+
+func (n *redisNamedRooms) put(room namedRoom, replace bool) (namedRoom, error) {
+    var saved namedRoom
+    err := n.update(room.Name, func(existing namedRoom, exists bool) (*namedRoom, bool, error) {
+        if exists && existing.expired(time.Now()) {
+            exists = false
+        }
+        if exists && !replace {
+            return nil, false, errRoomExists
+        }
+        saved = room
+        if exists {
+            saved.CreatedAt = existing.CreatedAt
+        }
+        return &saved, true, nil
+    })
+    if err != nil {
+        return namedRoom{}, err
+    }
+    return saved, nil
+}
+
+func (n *redisNamedRooms) remove(name string) (bool, error) {
+    removed := false
+    err := n.update(name, func(_ namedRoom, exists bool) (*namedRoom, bool, error) {
+        removed = exists
+        return nil, exists, nil
+    })
+    return removed, err
+}
+
+func (n *redisNamedRooms) removeExpired(now time.Time) []string {
+    n.mu.Lock()
+    var candidates []string
+    for name, room := range n.rooms {
+        if room.expired(now) {
+            candidates = append(candidates, name)
+        }
+    }
+    n.mu.Unlock()
+
+    var expired []string
+    for _, name := range candidates {
+        // Комнату могли продлить или уже удалить на другом узле: решение принимается по записи в Redis
+        removed := false
+        err := n.update(name, func(existing namedRoom, exists bool) (*namedRoom, bool, error) {
+            removed = exists && existing.expired(now)
+            return nil, removed, nil
+        })
+        if err != nil {
+            log.Printf("Redis backend: failed to remove expired named room %s: %v", name, err)
+            continue
+        }
+        if removed {
+            expired = append(expired, name)
+        }
+    }
+    return expired
+}
+
+// update атомарно (WATCH/MULTI) меняет запись комнаты. fn получает текущую запись и возвращает новую
+// (nil - удалить) и признак, нужно ли ее записывать. Записанное изменение попадает в кэш и рассылается узлам.
+func (n *redisNamedRooms) update(name string, fn func(existing namedRoom, exists bool) (*namedRoom, bool, error)) error {
+    ctx, cancel := n.b.opContext()
+    defer cancel()
+    for attempt := 0; attempt < 3; attempt++ {
+        var next *namedRoom
+        write := false
+        err := n.b.client.Watch(ctx, func(tx *redis.Tx) error {
+            var existing namedRoom
+            raw, err := tx.HGet(ctx, redisNamedRoomsKey, name).Result()
+            exists := err == nil
+            if err != nil && err != redis.Nil {
+                return err
+            }
+            if exists {
+                if err := json.Unmarshal([]byte(raw), &existing); err != nil {
+                    return fmt.Errorf("invalid named room %s: %w", name, err)
+                }
+            }
+            if next, write, err = fn(existing, exists); err != nil || !write {
+                return err
+            }
+            var data []byte
+            if next != nil {
+                if data, err = json.Marshal(next); err != nil {
+                    return err
+                }
+            }
+            _, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+                if next == nil {
+                    pipe.HDel(ctx, redisNamedRoomsKey, name)
+                } else {
+                    pipe.HSet(ctx, redisNamedRoomsKey, name, data)
+                }
+                return nil
+            })
+            return err
+        }, redisNamedRoomsKey)
+        if err == redis.TxFailedErr {
+            continue
+        }
+        if err != nil || !write {
+            return err
+        }
+        n.apply(name, next)
+        event, err := json.Marshal(namedRoomEvent{Node: n.b.node, Name: name, Room: next})
+        if err == nil {
+            err = n.b.client.Publish(ctx, redisNamedRoomsChannel, event).Err()
+        }
+        if err != nil {
+            // Остальные узлы получат изменение при следующей сверке
+            log.Printf("Redis backend: failed to announce change of named room %s: %v", name, err)
+        }
+        return nil
+    }
+    return errNamedRoomConflict
+}
+
+// apply обновляет кэш: room == nil - комната удалена
+func (n *redisNamedRooms) apply(name string, room *namedRoom) {
+    n.mu.Lock()
+    defer n.mu.Unlock()
+    if room == nil {
+        delete(n.rooms, name)
+    } else {
+        n.rooms[name] = *room
+    }
+}
+
+// reload перечитывает реестр из Redis
+func (n *redisNamedRooms) reload(ctx context.Context) error {
+    entries, err := n.b.client.HGetAll(ctx, redisNamedRoomsKey).Result()
+    if err != nil {
+        return err
+    }
+    rooms := make(map[string]namedRoom, len(entries))
+    for name, raw := range entries {
+        var room namedRoom
+        if err := json.Unmarshal([]byte(raw), &room); err != nil {
+            log.Printf("Redis backend: skipping invalid named room %s: %v", name, err)
+            continue
+        }
+        rooms[name] = room
+    }
+    n.mu.Lock()
+    n.rooms = rooms
+    n.mu.Unlock()
+    return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Каждая комната - отдельный цикл событий (roomActor): вход, выход, сообщения пиров и таймеры комнаты
+// выполняются по одному и по порядку. Состав комнаты меняется только в ее цикле, поэтому общей блокировки
+// нет, а медленный пир задерживает только свою комнату. Согласование серверного PeerConnection (pion)
+// выполняется вне цикла комнаты, в очереди согласования пира (Peer.signaling), по тому же eventLoop.
+// Каталог комнат (rooms) лишь сопоставляет имя комнаты с циклом. Вне цикла (API, метрики, рассылки)
+// состав читается из неизменяемого снимка без блокировок.
+
+// Сколько пустая комната ждет новых пиров, прежде чем ее цикл остановится
+const roomIdleGrace = 30 * time.Second
+
+// eventLoop - очередь событий, которые выполняются по одному и по порядку в своей горутине (run)
+type eventLoop struct {
+    mu      sync.Mutex // защищает queue и stopped
+    queue   []func()
+    stopped bool
+    wake    chan struct{}
+}
+
+func newEventLoop() *eventLoop {
+    l := &eventLoop{wake: make(chan struct{}, 1)}
+    go l.run()
+    return l
+}
+
+// post ставит событие в очередь и не ждет его выполнения.
+// Возвращает false, если цикл уже остановлен.
+func (l *eventLoop) post(event func()) bool {
+    l.mu.Lock()
+    if l.stopped {
+        l.mu.Unlock()
+        return false
+    }
+    l.queue = append(l.queue, event)
+    l.mu.Unlock()
+    l.notify()
+    return true
+}
+
+func (l *eventLoop) notify() {
+    select {
+    case l.wake <- struct{}{}:
+    default:
+    }
+}
+
+// call выполняет событие в цикле и ждет его завершения. Нельзя вызывать из самого цикла.
+func (l *eventLoop) call(event func()) bool {
+    done := make(chan struct{})
+    if !l.post(func() {
+        defer close(done)
+        event()
+    }) {
+        return false
+    }
+    <-done
+    return true
+}
+
+// after выполняет событие в цикле через d (таймер)
+func (l *eventLoop) after(d time.Duration, event func()) *time.Timer {
+    return time.AfterFunc(d, func() { l.post(event) })
+}
+
+// stop останавливает цикл: уже поставленные события выполняются, новые отклоняются
+func (l *eventLoop) stop() {
+    l.mu.Lock()
+    l.stopped = true
+    l.mu.Unlock()
+    l.notify()
+}
+
+func (l *eventLoop) run() {
+    for range l.wake {
+        for {
+            l.mu.Lock()
+            if len(l.queue) == 0 {
+                stopped := l.stopped
+                l.mu.Unlock()
+                if stopped {
+                    return
+                }
+                break
+            }
+            event := l.queue[0]
+            l.queue[0] = nil
+            l.queue = l.queue[1:]
+            l.mu.Unlock()
+            event()
+        }
+    }
+}
+
+// roomActor - цикл событий одной комнаты
+type roomActor struct {
+    *eventLoop
+    name string
+
+    members  map[string]*Peer         // меняется только в цикле комнаты
+    reserved map[string]string        // имена входящих соединений -> ID сессии (reserveUsername), в цикле комнаты
+    view     atomic.Pointer[[]*Peer] // снимок members для чтения вне цикла
+}
+
+func newRoomActor(name string) *roomActor {
+    a := &roomActor{
+        eventLoop: newEventLoop(),
+        name:      name,
+        members:   make(map[string]*Peer),
+        reserved:  make(map[string]string),
+    }
+    a.view.Store(&[]*Peer{})
+    return a
+}
+
+// peers возвращает снимок пиров комнаты, упорядоченный по имени
+func (a *roomActor) peers() []*Peer {
+    return *a.view.Load()
+}
+
+// publish обновляет снимок после изменения состава. Вызывается в цикле комнаты.
+func (a *roomActor) publish() {
+    snapshot := make([]*Peer, 0, len(a.members))
+    for _, p := range a.members {
+        snapshot = append(snapshot, p)
+    }
+    sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].username < snapshot[j].username })
+    a.view.Store(&snapshot)
+}
+
+// addMember добавляет пира в комнату. Вызывается в цикле комнаты.
+func (a *roomActor) addMember(p *Peer) {
+    a.members[p.username] = p
+    a.publish()
+}
+
+// removeMember удаляет именно этого пира (а не его тезку, подключившегося позже).
+// Вызывается в цикле комнаты; опустевшая комната останавливается через roomIdleGrace.
+func (a *roomActor) removeMember(p *Peer) bool {
+    if a.members[p.username] != p {
+        return false
+    }
+    delete(a.members, p.username)
+    a.publish()
+    if len(a.members) == 0 {
+        a.after(roomIdleGrace, a.stopIfIdle)
+    }
+    return true
+}
+
+// stopIfIdle останавливает цикл пустой комнаты и убирает ее из каталога.
+// Если в очереди уже есть события или за входящим соединением закреплено имя, комната продолжает работу.
+func (a *roomActor) stopIfIdle() {
+    if len(a.members) > 0 || len(a.reserved) > 0 {
+        return
+    }
+    rooms.mu.Lock()
+    defer rooms.mu.Unlock()
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if len(a.queue) > 0 {
+        return
+    }
+    a.stopped = true
+    if rooms.actors[a.name] == a {
+        delete(rooms.actors, a.name)
+    }
+}
+
+// roomDirectory - каталог циклов комнат по имени. Блокировка держится только на время поиска в карте.
+type roomDirectory struct {
+    mu     sync.Mutex
+    actors map[string]*roomActor
+}
+
+var rooms = &roomDirectory{actors: make(map[string]*roomActor)}
+
+// lookup возвращает цикл комнаты или nil
+func (d *roomDirectory) lookup(name string) *roomActor {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.actors[name]
+}
+
+// open возвращает цикл комнаты, создавая его при необходимости
+func (d *roomDirectory) open(name string) *roomActor {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    a := d.actors[name]
+    if a == nil {
+        a = newRoomActor(name)
+        d.actors[name] = a
+    }
+    return a
+}
+
+// call выполняет событие в цикле комнаты, создавая ее при необходимости, и возвращает этот цикл.
+// Если цикл остановился между поиском и постановкой события, берется новый.
+func (d *roomDirectory) call(name string, event func(a *roomActor)) *roomActor {
+    for {
+        a := d.open(name)
+        if a.call(func() { event(a) }) {
+            return a
+        }
+    }
+}
+
+// list возвращает циклы всех комнат, включая пустые
+func (d *roomDirectory) list() []*roomActor {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    list := make([]*roomActor, 0, len(d.actors))
+    for _, a := range d.actors {
+        list = append(list, a)
+    }
+    return list
+}
+
+// roomPeers возвращает снимок локальных пиров комнаты
+func roomPeers(room string) []*Peer {
+    if a := rooms.lookup(room); a != nil {
+        return a.peers()
+    }
+    return nil
+}
+
+// findPeer возвращает локального пира комнаты по имени или nil
+func findPeer(room, username string) *Peer {
+    for _, p := range roomPeers(room) {
+        if p.username == username {
+            return p
+        }
+    }
+    return nil
+}
+
+// activeRooms возвращает снимки пиров всех комнат, где есть локальные пиры
+func activeRooms() map[string][]*Peer {
+    result := make(map[string][]*Peer)
+    for _, a := range rooms.list() {
+        if peers := a.peers(); len(peers) > 0 {
+            result[a.name] = peers
+        }
+    }
+    return result
+}
+
+// allPeers возвращает снимок всех локальных пиров
+func allPeers() []*Peer {
+    var all []*Peer
+    for _, a := range rooms.list() {
+        all = append(all, a.peers()...)
+    }
+    return all
+}
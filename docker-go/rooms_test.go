@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+)
+
+func TestEventLoopRunsEventsInOrder(t *testing.T) {
+    l := newEventLoop()
+    var got []int
+    for i := 0; i < 100; i++ {
+        i := i
+        if !l.post(func() { got = append(got, i) }) {
+            t.Fatalf("post %d rejected by a running loop", i)
+        }
+    }
+    if !l.call(func() {}) {
+        t.Fatal("call rejected by a running loop")
+    }
+    for i, v := range got {
+        if v != i {
+            t.Fatalf("event %d ran at position %d", v, i)
+        }
+    }
+    if len(got) != 100 {
+        t.Fatalf("ran %d events, want 100", len(got))
+    }
+}
+
+func TestEventLoopStop(t *testing.T) {
+    l := newEventLoop()
+    ran := make(chan struct{})
+    block := make(chan struct{})
+    l.post(func() { <-block })
+    l.post(func() { close(ran) })
+    l.stop()
+    if l.post(func() {}) || l.call(func() {}) {
+        t.Fatal("stopped loop accepted a new event")
+    }
+    close(block)
+    <-ran // события, поставленные до остановки, выполняются
+}
+
+func TestRoomActorMembership(t *testing.T) {
+    a := newRoomActor("members")
+    alice, bob := &Peer{username: "alice"}, &Peer{username: "bob"}
+    aliceAgain := &Peer{username: "alice"}
+    steps := []struct {
+        name    string
+        event   func() bool
+        want    bool
+        members []*Peer
+    }{
+        {name: "add bob", event: func() bool { a.addMember(bob); return true }, want: true, members: []*Peer{bob}},
+        {name: "add alice", event: func() bool { a.addMember(alice); return true }, want: true, members: []*Peer{alice, bob}},
+        {name: "alice reconnects", event: func() bool { a.addMember(aliceAgain); return true }, want: true, members: []*Peer{aliceAgain, bob}},
+        {name: "old alice leaves", event: func() bool { return a.removeMember(alice) }, want: false, members: []*Peer{aliceAgain, bob}},
+        {name: "bob leaves", event: func() bool { return a.removeMember(bob) }, want: true, members: []*Peer{aliceAgain}},
+        {name: "bob leaves twice", event: func() bool { return a.removeMember(bob) }, want: false, members: []*Peer{aliceAgain}},
+    }
+    for _, step := range steps {
+        var got bool
+        a.call(func() { got = step.event() })
+        if got != step.want {
+            t.Errorf("%s: result %v, want %v", step.name, got, step.want)
+        }
+        peers := a.peers()
+        if len(peers) != len(step.members) {
+            t.Fatalf("%s: snapshot has %d peers, want %d", step.name, len(peers), len(step.members))
+        }
+        for i := range peers {
+            if peers[i] != step.members[i] {
+                t.Errorf("%s: snapshot[%d] = %s, want %s", step.name, i, peers[i].username, step.members[i].username)
+            }
+        }
+    }
+}
+
+func TestRoomActorStopIfIdle(t *testing.T) {
+    tests := []struct {
+        name     string
+        prepare  func(a *roomActor)
+        wantStop bool
+    }{
+        {name: "empty room stops", prepare: func(a *roomActor) {}, wantStop: true},
+        {name: "room with a peer keeps running", prepare: func(a *roomActor) { a.addMember(&Peer{username: "alice"}) }},
+        {name: "reserved name keeps running", prepare: func(a *roomActor) { a.reserved["alice"] = "s1" }},
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            name := fmt.Sprintf("idle-%d", i)
+            a := rooms.open(name)
+            a.call(func() {
+                tt.prepare(a)
+                a.stopIfIdle()
+            })
+            stopped := rooms.lookup(name) != a
+            if stopped != tt.wantStop {
+                t.Fatalf("stopped = %v, want %v", stopped, tt.wantStop)
+            }
+            if stopped && a.post(func() {}) {
+                t.Fatal("stopped room accepted an event")
+            }
+            // Каталог открывает новую комнату вместо остановленной
+            var ran *roomActor
+            got := rooms.call(name, func(b *roomActor) { ran = b })
+            if ran != got || (stopped && got == a) || (!stopped && got != a) {
+                t.Fatalf("rooms.call ran on %p and returned %p, stopped actor %p", ran, got, a)
+            }
+        })
+    }
+}
+
+func TestRoomsAreIndependent(t *testing.T) {
+    // Пока одна комната занята долгим событием, другие продолжают обрабатывать свои
+    slow := rooms.open("slow")
+    block := make(chan struct{})
+    slow.post(func() { <-block })
+    defer close(block)
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            room := fmt.Sprintf("fast-%d", i%2)
+            for j := 0; j < 50; j++ {
+                p := &Peer{username: fmt.Sprintf("user-%d-%d", i, j)}
+                rooms.call(room, func(a *roomActor) { a.addMember(p) })
+                rooms.call(room, func(a *roomActor) { a.removeMember(p) })
+            }
+        }(i)
+    }
+    wg.Wait()
+    for _, room := range []string{"fast-0", "fast-1"} {
+        if n := len(roomPeers(room)); n != 0 {
+            t.Errorf("room %s has %d peers after all left", room, n)
+        }
+    }
+}
@@ -0,0 +1,775 @@
+package main
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/rtcp"
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+// rtspSettings - настройки RTSP-выдачи комнат
+type rtspSettings struct {
+    Enabled        bool
+    Addr           string
+    UDPRTPPort     int
+    SessionTimeout time.Duration
+}
+
+var rtspConfig = rtspSettings{
+    Enabled:        envBool("RTSP_ENABLED", true),
+    Addr:           envString("RTSP_ADDR", ":8554"),
+    UDPRTPPort:     envInt("RTSP_UDP_RTP_PORT", 8000),
+    SessionTimeout: envDuration("RTSP_SESSION_TIMEOUT", 60*time.Second),
+}
+
+// Ограничения запроса RTSP: разбираются до проверки комнаты, поэтому размер ограничен
+const (
+    rtspMaxLineBytes = 4096      // строка запроса или заголовка
+    rtspMaxHeaders   = 64        // число заголовков
+    rtspMaxBodyBytes = 64 * 1024 // тело запроса (Content-Length)
+)
+
+// Интервал RTCP Sender Report по каждому треку сессии
+const rtspSenderReportInterval = 5 * time.Second
+
+var errRTSPRequestTooLarge = errors.New("RTSP request exceeds size limits")
+
+// Общие UDP-сокеты для RTP/RTCP (порт RTCP = порт RTP + 1)
+var rtspUDPRTP, rtspUDPRTCP *net.UDPConn
+
+// Порядок треков в DESCRIBE: trackID=0 - видео, trackID=1 - аудио
+var rtspTrackKinds = []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}
+
+// rtspTrackOutput - состояние одного трека, выданного клиенту через SETUP
+type rtspTrackOutput struct {
+    ssrc        uint32
+    seq         uint16
+    tsOffset    uint32
+    interleaved int          // канал RTP для TCP interleaved, -1 для UDP
+    udpAddr     *net.UDPAddr // адрес RTP клиента для UDP
+
+    // Статистика и последняя метка времени для RTCP SR
+    track       *ingestTrack
+    packets     uint32
+    octets      uint32
+    lastSrcTS   uint32 // метка RTP ведущего в последнем пакете
+    lastArrival time.Time
+}
+
+// rtspSession - RTSP-сессия клиента; получает RTP ведущего как mediaSink
+type rtspSession struct {
+    id   string
+    room string
+    conn *rtspConn
+
+    mu       sync.Mutex
+    outputs  map[webrtc.RTPCodecType]*rtspTrackOutput
+    media    *roomMedia
+    playing  bool
+    closed   bool
+    lastSeen time.Time
+}
+
+// rtspConn - TCP-соединение RTSP-клиента
+type rtspConn struct {
+    netConn net.Conn
+    writeMu sync.Mutex
+    frames  chan []byte
+    done    chan struct{}
+    once    sync.Once
+}
+
+var (
+    rtspSessions   = make(map[string]*rtspSession)
+    rtspSessionsMu sync.Mutex
+)
+
+// startRTSPServer запускает RTSP-сервер, публикующий живые комнаты как rtsp://host:port/{room}
+func startRTSPServer() {
+    if !rtspConfig.Enabled {
+        log.Println("RTSP output is disabled")
+        return
+    }
+    var err error
+    rtspUDPRTP, err = net.ListenUDP("udp", &net.UDPAddr{Port: rtspConfig.UDPRTPPort})
+    if err != nil {
+        log.Printf("RTSP UDP transport disabled, failed to listen on port %d: %v", rtspConfig.UDPRTPPort, err)
+    } else if rtspUDPRTCP, err = net.ListenUDP("udp", &net.UDPAddr{Port: rtspConfig.UDPRTPPort + 1}); err != nil {
+        log.Printf("RTSP UDP transport disabled, failed to listen on port %d: %v", rtspConfig.UDPRTPPort+1, err)
+        rtspUDPRTP.Close()
+        rtspUDPRTP = nil
+    } else {
+        go drainUDP(rtspUDPRTP)
+        go drainUDP(rtspUDPRTCP)
+    }
+
+    listener, err := net.Listen("tcp", rtspConfig.Addr)
+    if err != nil {
+        log.Printf("Failed to start RTSP server on %s: %v", rtspConfig.Addr, err)
+        return
+    }
+    log.Printf("RTSP server listening on %s (UDP RTP/RTCP ports %d-%d)", rtspConfig.Addr, rtspConfig.UDPRTPPort, rtspConfig.UDPRTPPort+1)
+    go rtspSessionJanitor()
+    go func() {
+        for {
+            netConn, err := listener.Accept()
+            if err != nil {
+                log.Printf("RTSP accept error: %v", err)
+                time.Sleep(time.Second)
+                continue
+            }
+            go handleRTSPConn(netConn)
+        }
+    }()
+}
+
+// drainUDP читает и отбрасывает входящие пакеты (RTCP-отчеты и пробивку NAT от клиентов)
+func drainUDP(conn *net.UDPConn) {
+    buf := make([]byte, 1500)
+    for {
+        if _, _, err := conn.ReadFromUDP(buf); err != nil {
+            return
+        }
+    }
+}
+
+// rtspSessionJanitor закрывает UDP-сессии, клиенты которых перестали слать keep-alive
+func rtspSessionJanitor() {
+    ticker := time.NewTicker(10 * time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        rtspSessionsMu.Lock()
+        var expired []*rtspSession
+        for _, s := range rtspSessions {
+            s.mu.Lock()
+            if !s.usesTCP() && time.Since(s.lastSeen) > rtspConfig.SessionTimeout {
+                expired = append(expired, s)
+            }
+            s.mu.Unlock()
+        }
+        rtspSessionsMu.Unlock()
+        for _, s := range expired {
+            log.Printf("RTSP session %s for room %s timed out", s.id, s.room)
+            s.teardown()
+        }
+    }
+}
+
+type rtspRequest struct {
+    method  string
+    url     string
+    headers map[string]string
+}
+
+func (r *rtspRequest) header(name string) string {
+    return r.headers[strings.ToLower(name)]
+}
+
+// readRTSPLine читает строку запроса не длиннее буфера reader (rtspMaxLineBytes)
+func readRTSPLine(reader *bufio.Reader) (string, error) {
+    line, err := reader.ReadSlice('\n')
+    if err == bufio.ErrBufferFull {
+        return "", errRTSPRequestTooLarge
+    }
+    return string(line), err
+}
+
+func readRTSPRequest(reader *bufio.Reader) (*rtspRequest, error) {
+    line, err := readRTSPLine(reader)
+    if err != nil {
+        return nil, err
+    }
+    fields := strings.Fields(line)
+    if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/") {
+        return nil, fmt.Errorf("malformed request line %q", strings.TrimSpace(line))
+    }
+    req := &rtspRequest{method: fields[0], url: fields[1], headers: make(map[string]string)}
+    for headers := 0; ; headers++ {
+        line, err := readRTSPLine(reader)
+        if err != nil {
+            return nil, err
+        }
+        line = strings.TrimRight(line, "\r\n")
+        if line == "" {
+            break
+        }
+        if headers == rtspMaxHeaders {
+            return nil, errRTSPRequestTooLarge
+        }
+        if i := strings.IndexByte(line, ':'); i > 0 {
+            req.headers[strings.ToLower(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+        }
+    }
+    if n, _ := strconv.Atoi(req.header("Content-Length")); n > 0 {
+        if n > rtspMaxBodyBytes {
+            return nil, errRTSPRequestTooLarge
+        }
+        if _, err := io.CopyN(io.Discard, reader, int64(n)); err != nil {
+            return nil, err
+        }
+    }
+    return req, nil
+}
+
+func (c *rtspConn) writeResponse(status int, reason string, cseq string, headers map[string]string, body string) error {
+    var b strings.Builder
+    fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\nCSeq: %s\r\nServer: webrtc-server\r\n", status, reason, cseq)
+    for k, v := range headers {
+        fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+    }
+    if body != "" {
+        fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+    }
+    b.WriteString("\r\n")
+    b.WriteString(body)
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    _, err := c.netConn.Write([]byte(b.String()))
+    return err
+}
+
+// frameWriter отправляет interleaved-кадры; очередь отвязывает медленного клиента от чтения трека
+func (c *rtspConn) frameWriter() {
+    for {
+        select {
+        case <-c.done:
+            return
+        case frame := <-c.frames:
+            c.writeMu.Lock()
+            _ = c.netConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+            _, err := c.netConn.Write(frame)
+            _ = c.netConn.SetWriteDeadline(time.Time{})
+            c.writeMu.Unlock()
+            if err != nil {
+                log.Printf("RTSP write error to %s: %v", c.netConn.RemoteAddr(), err)
+                c.close()
+                return
+            }
+        }
+    }
+}
+
+// writeInterleaved ставит RTP/RTCP-пакет в очередь RTSP-соединения на канал channel
+func (c *rtspConn) writeInterleaved(channel int, data []byte) {
+    frame := make([]byte, 4+len(data))
+    frame[0] = '$'
+    frame[1] = byte(channel)
+    binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+    copy(frame[4:], data)
+    select {
+    case c.frames <- frame:
+    case <-c.done:
+    default:
+        // Клиент не успевает забирать данные: пакет отбрасывается
+    }
+}
+
+func (c *rtspConn) close() {
+    c.once.Do(func() {
+        close(c.done)
+        c.netConn.Close()
+    })
+}
+
+// parseRTSPPath извлекает комнату и номер трека из rtsp://host:port/{room}[/trackID=N]
+func parseRTSPPath(rawURL string) (room string, trackID int, err error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return "", -1, err
+    }
+    segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+    if len(segments) == 0 || segments[0] == "" {
+        return "", -1, errors.New("room is not specified")
+    }
+    room, err = url.PathUnescape(segments[0])
+    if err != nil {
+        return "", -1, err
+    }
+    trackID = -1
+    if len(segments) > 1 {
+        last := segments[len(segments)-1]
+        if !strings.HasPrefix(last, "trackID=") {
+            return "", -1, fmt.Errorf("unknown control %q", last)
+        }
+        if trackID, err = strconv.Atoi(strings.TrimPrefix(last, "trackID=")); err != nil || trackID < 0 || trackID >= len(rtspTrackKinds) {
+            return "", -1, fmt.Errorf("invalid track %q", last)
+        }
+    }
+    return room, trackID, nil
+}
+
+// rtspRoomMedia проверяет права доступа к комнате (как для ведомого в /wsgo, включая допуск и лимит
+// зрителей именованной комнаты) и наличие медиа на сервере. counted - клиент уже воспроизводит комнату.
+func rtspRoomMedia(room string, counted bool) (*roomMedia, int, error) {
+    if err := checkViewerAccess(room); err != nil {
+        return nil, 404, err
+    }
+    if err := checkNamedRoomViewer(room, counted); err != nil {
+        return nil, 403, err
+    }
+    rm := getRoomMedia(room)
+    if rm == nil || rm.trackByKind(webrtc.RTPCodecTypeVideo) == nil {
+        return nil, 404, errors.New("leader does not publish media to server")
+    }
+    return rm, 200, nil
+}
+
+// rtspStatusText возвращает текст статуса ответа об отказе
+func rtspStatusText(status int) string {
+    switch status {
+    case 403:
+        return "Forbidden"
+    case 455:
+        return "Method Not Valid in This State"
+    }
+    return "Not Found"
+}
+
+// rtspViewerCount возвращает число RTSP-клиентов, воспроизводящих комнату
+func rtspViewerCount(room string) int {
+    rtspSessionsMu.Lock()
+    defer rtspSessionsMu.Unlock()
+    count := 0
+    for _, s := range rtspSessions {
+        if s.room == room && s.isPlaying() {
+            count++
+        }
+    }
+    return count
+}
+
+// buildRTSPDescription формирует SDP для DESCRIBE по трекам ведущего
+func buildRTSPDescription(room string, rm *roomMedia) string {
+    var b strings.Builder
+    b.WriteString("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\n")
+    fmt.Fprintf(&b, "s=%s\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\n", room)
+    for id, kind := range rtspTrackKinds {
+        t := rm.trackByKind(kind)
+        if t == nil {
+            continue
+        }
+        pt := uint8(t.codec.PayloadType)
+        encoding := strings.TrimPrefix(t.codec.MimeType, kind.String()+"/")
+        fmt.Fprintf(&b, "m=%s 0 RTP/AVP %d\r\n", kind.String(), pt)
+        if t.codec.Channels > 0 {
+            fmt.Fprintf(&b, "a=rtpmap:%d %s/%d/%d\r\n", pt, encoding, t.codec.ClockRate, t.codec.Channels)
+        } else {
+            fmt.Fprintf(&b, "a=rtpmap:%d %s/%d\r\n", pt, encoding, t.codec.ClockRate)
+        }
+        if strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeH264) {
+            fmtp := "packetization-mode=1"
+            if sps, pps := rm.h264Params(); sps != nil && pps != nil {
+                fmtp += fmt.Sprintf(";profile-level-id=%s;sprop-parameter-sets=%s,%s",
+                    hex.EncodeToString(sps[1:4]), base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(pps))
+            }
+            fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", pt, fmtp)
+        } else if t.codec.SDPFmtpLine != "" {
+            fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", pt, t.codec.SDPFmtpLine)
+        }
+        fmt.Fprintf(&b, "a=control:trackID=%d\r\n", id)
+    }
+    return b.String()
+}
+
+func randomUint32() uint32 {
+    var b [4]byte
+    _, _ = rand.Read(b[:])
+    return binary.BigEndian.Uint32(b[:])
+}
+
+func newRTSPSessionID() string {
+    var b [8]byte
+    _, _ = rand.Read(b[:])
+    return hex.EncodeToString(b[:])
+}
+
+func handleRTSPConn(netConn net.Conn) {
+    remote := netConn.RemoteAddr().String()
+    log.Printf("New RTSP connection from %s", remote)
+    c := &rtspConn{netConn: netConn, frames: make(chan []byte, 512), done: make(chan struct{})}
+    go c.frameWriter()
+    defer c.close()
+
+    var sessions []*rtspSession
+    defer func() {
+        for _, s := range sessions {
+            s.mu.Lock()
+            tcp := s.usesTCP()
+            s.mu.Unlock()
+            if tcp {
+                s.teardown()
+            }
+        }
+        log.Printf("RTSP connection from %s closed", remote)
+    }()
+
+    reader := bufio.NewReaderSize(netConn, rtspMaxLineBytes)
+    for {
+        // Interleaved RTCP от клиента при TCP-транспорте: '$', канал, длина, данные
+        if first, err := reader.Peek(1); err == nil && first[0] == '$' {
+            header := make([]byte, 4)
+            if _, err := io.ReadFull(reader, header); err != nil {
+                return
+            }
+            if _, err := io.CopyN(io.Discard, reader, int64(binary.BigEndian.Uint16(header[2:]))); err != nil {
+                return
+            }
+            continue
+        }
+        req, err := readRTSPRequest(reader)
+        if err != nil {
+            if errors.Is(err, errRTSPRequestTooLarge) {
+                log.Printf("RTSP request from %s rejected: %v", remote, err)
+                _ = c.writeResponse(400, "Bad Request", "0", nil, "")
+            } else if err != io.EOF {
+                log.Printf("RTSP read error from %s: %v", remote, err)
+            }
+            return
+        }
+        cseq := req.header("CSeq")
+        var session *rtspSession
+        if id := strings.SplitN(req.header("Session"), ";", 2)[0]; id != "" {
+            rtspSessionsMu.Lock()
+            session = rtspSessions[id]
+            rtspSessionsMu.Unlock()
+            if session == nil {
+                _ = c.writeResponse(454, "Session Not Found", cseq, nil, "")
+                continue
+            }
+            session.mu.Lock()
+            session.lastSeen = time.Now()
+            session.mu.Unlock()
+        }
+
+        switch req.method {
+        case "OPTIONS":
+            _ = c.writeResponse(200, "OK", cseq, map[string]string{
+                "Public": "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER, SET_PARAMETER",
+            }, "")
+
+        case "DESCRIBE":
+            room, _, err := parseRTSPPath(req.url)
+            if err != nil {
+                _ = c.writeResponse(400, "Bad Request", cseq, nil, "")
+                continue
+            }
+            rm, status, err := rtspRoomMedia(room, session != nil && session.room == room && session.isPlaying())
+            if err != nil {
+                log.Printf("RTSP DESCRIBE for room %s from %s rejected: %v", room, remote, err)
+                _ = c.writeResponse(status, rtspStatusText(status), cseq, nil, "")
+                continue
+            }
+            _ = c.writeResponse(200, "OK", cseq, map[string]string{
+                "Content-Type": "application/sdp",
+                "Content-Base": strings.TrimSuffix(req.url, "/") + "/",
+            }, buildRTSPDescription(room, rm))
+
+        case "SETUP":
+            room, trackID, err := parseRTSPPath(req.url)
+            if err != nil || trackID < 0 {
+                _ = c.writeResponse(400, "Bad Request", cseq, nil, "")
+                continue
+            }
+            if _, status, err := rtspRoomMedia(room, session != nil && session.room == room && session.isPlaying()); err != nil {
+                log.Printf("RTSP SETUP for room %s from %s rejected: %v", room, remote, err)
+                _ = c.writeResponse(status, rtspStatusText(status), cseq, nil, "")
+                continue
+            }
+            if session == nil {
+                session = &rtspSession{
+                    id:       newRTSPSessionID(),
+                    room:     room,
+                    conn:     c,
+                    outputs:  make(map[webrtc.RTPCodecType]*rtspTrackOutput),
+                    lastSeen: time.Now(),
+                }
+                rtspSessionsMu.Lock()
+                rtspSessions[session.id] = session
+                rtspSessionsMu.Unlock()
+                sessions = append(sessions, session)
+            } else if session.room != room {
+                _ = c.writeResponse(459, "Aggregate Operation Not Allowed", cseq, nil, "")
+                continue
+            }
+            transport, output, err := parseRTSPTransport(req.header("Transport"), netConn.RemoteAddr())
+            if err != nil {
+                log.Printf("RTSP SETUP from %s: %v", remote, err)
+                _ = c.writeResponse(461, "Unsupported Transport", cseq, nil, "")
+                continue
+            }
+            session.mu.Lock()
+            session.outputs[rtspTrackKinds[trackID]] = output
+            session.mu.Unlock()
+            _ = c.writeResponse(200, "OK", cseq, map[string]string{
+                "Transport": transport,
+                "Session":   fmt.Sprintf("%s;timeout=%d", session.id, int(rtspConfig.SessionTimeout.Seconds())),
+            }, "")
+
+        case "PLAY":
+            if session == nil {
+                _ = c.writeResponse(454, "Session Not Found", cseq, nil, "")
+                continue
+            }
+            rm, status, err := rtspRoomMedia(session.room, session.isPlaying())
+            if err == nil {
+                if err = session.play(rm); err != nil {
+                    status = 455
+                }
+            }
+            if err != nil {
+                log.Printf("RTSP PLAY for room %s from %s rejected: %v", session.room, remote, err)
+                _ = c.writeResponse(status, rtspStatusText(status), cseq, nil, "")
+                continue
+            }
+            log.Printf("RTSP client %s is playing room %s (session %s)", remote, session.room, session.id)
+            requestRoomKeyframe(session.room, "RTSP client started playing", false)
+            _ = c.writeResponse(200, "OK", cseq, map[string]string{
+                "Session": session.id,
+                "Range":   "npt=0.000-",
+            }, "")
+
+        case "TEARDOWN":
+            if session != nil {
+                session.teardown()
+            }
+            _ = c.writeResponse(200, "OK", cseq, nil, "")
+
+        case "GET_PARAMETER", "SET_PARAMETER":
+            _ = c.writeResponse(200, "OK", cseq, nil, "")
+
+        default:
+            _ = c.writeResponse(405, "Method Not Allowed", cseq, nil, "")
+        }
+    }
+}
+
+// parseRTSPTransport разбирает заголовок Transport и возвращает ответный заголовок
+func parseRTSPTransport(header string, remote net.Addr) (string, *rtspTrackOutput, error) {
+    output := &rtspTrackOutput{ssrc: randomUint32(), seq: uint16(randomUint32()), tsOffset: randomUint32(), interleaved: -1}
+    for _, spec := range strings.Split(header, ",") {
+        params := strings.Split(strings.TrimSpace(spec), ";")
+        if strings.HasPrefix(params[0], "RTP/AVP/TCP") {
+            for _, p := range params[1:] {
+                if strings.HasPrefix(p, "interleaved=") {
+                    ch, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(p, "interleaved="), "-", 2)[0])
+                    if err != nil || ch < 0 || ch > 254 {
+                        return "", nil, fmt.Errorf("invalid interleaved channel %q", p)
+                    }
+                    output.interleaved = ch
+                }
+            }
+            if output.interleaved < 0 {
+                output.interleaved = 0
+            }
+            return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", output.interleaved, output.interleaved+1, output.ssrc), output, nil
+        }
+        if params[0] == "RTP/AVP" || params[0] == "RTP/AVP/UDP" {
+            if rtspUDPRTP == nil {
+                continue
+            }
+            for _, p := range params[1:] {
+                if strings.HasPrefix(p, "client_port=") {
+                    port, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(p, "client_port="), "-", 2)[0])
+                    if err != nil || port <= 0 || port > 65535 {
+                        return "", nil, fmt.Errorf("invalid client_port %q", p)
+                    }
+                    host, _, _ := net.SplitHostPort(remote.String())
+                    output.udpAddr = &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+                }
+            }
+            if output.udpAddr == nil {
+                return "", nil, errors.New("client_port is required for UDP transport")
+            }
+            return fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+                output.udpAddr.Port, output.udpAddr.Port+1, rtspConfig.UDPRTPPort, rtspConfig.UDPRTPPort+1, output.ssrc), output, nil
+        }
+    }
+    return "", nil, fmt.Errorf("no supported transport in %q", header)
+}
+
+// usesTCP сообщает, идут ли RTP-пакеты сессии внутри RTSP-соединения; вызывается под s.mu
+func (s *rtspSession) usesTCP() bool {
+    for _, o := range s.outputs {
+        if o.interleaved >= 0 {
+            return true
+        }
+    }
+    return false
+}
+
+func (s *rtspSession) play(rm *roomMedia) error {
+    s.mu.Lock()
+    if s.playing {
+        s.mu.Unlock()
+        return nil
+    }
+    if len(s.outputs) == 0 {
+        s.mu.Unlock()
+        return errors.New("no tracks were set up")
+    }
+    s.playing = true
+    s.media = rm
+    s.mu.Unlock()
+    if err := rm.addSink(s); err != nil {
+        return err
+    }
+    go s.sendSenderReports()
+    return nil
+}
+
+// sendSenderReports периодически отправляет RTCP SR по каждому треку, пока сессия открыта:
+// без них клиент не может сопоставить метки времени видео и аудио
+func (s *rtspSession) sendSenderReports() {
+    ticker := time.NewTicker(rtspSenderReportInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        type report struct {
+            interleaved int
+            udpAddr     *net.UDPAddr
+            data        []byte
+        }
+        var reports []report
+        now := time.Now()
+        s.mu.Lock()
+        if s.closed {
+            s.mu.Unlock()
+            return
+        }
+        for _, out := range s.outputs {
+            if out.packets == 0 {
+                continue
+            }
+            data, err := out.senderReport(s.id, now)
+            if err != nil {
+                continue
+            }
+            reports = append(reports, report{out.interleaved, out.udpAddr, data})
+        }
+        s.mu.Unlock()
+
+        for _, r := range reports {
+            if r.interleaved >= 0 {
+                s.conn.writeInterleaved(r.interleaved+1, r.data)
+            } else if rtspUDPRTCP != nil && r.udpAddr != nil {
+                _, _ = rtspUDPRTCP.WriteToUDP(r.data, &net.UDPAddr{IP: r.udpAddr.IP, Port: r.udpAddr.Port + 1})
+            }
+        }
+    }
+}
+
+// senderReport строит RTCP SR с SDES CNAME на момент now; вызывается под s.mu.
+// Время NTP берется по часам ведущего из его SR, если он их присылал, иначе по времени приема,
+// так что видео и аудио ведущего получают общую шкалу времени
+func (o *rtspTrackOutput) senderReport(cname string, now time.Time) ([]byte, error) {
+    elapsed := now.Sub(o.lastArrival)
+    wallclock := now
+    if captured, ok := o.track.captureTime(o.lastSrcTS); ok {
+        wallclock = captured.Add(elapsed)
+    }
+    rtpTime := o.lastSrcTS + o.tsOffset + uint32(elapsed.Seconds()*float64(o.track.codec.ClockRate))
+    return rtcp.Marshal([]rtcp.Packet{
+        &rtcp.SenderReport{
+            SSRC:        o.ssrc,
+            NTPTime:     timeToNTP(wallclock),
+            RTPTime:     rtpTime,
+            PacketCount: o.packets,
+            OctetCount:  o.octets,
+        },
+        &rtcp.SourceDescription{Chunks: []rtcp.SourceDescriptionChunk{{
+            Source: o.ssrc,
+            Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: cname}},
+        }}},
+    })
+}
+
+// isPlaying сообщает, воспроизводит ли сессия комнату
+func (s *rtspSession) isPlaying() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.playing && !s.closed
+}
+
+// teardown отключает сессию от медиапотоков комнаты и удаляет её из реестра
+func (s *rtspSession) teardown() {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return
+    }
+    s.closed = true
+    rm := s.media
+    s.mu.Unlock()
+    if rm != nil {
+        rm.removeSink(s)
+    }
+    rtspSessionsMu.Lock()
+    delete(rtspSessions, s.id)
+    rtspSessionsMu.Unlock()
+    log.Printf("RTSP session %s for room %s closed", s.id, s.room)
+}
+
+func (s *rtspSession) AddTrack(t *ingestTrack) {}
+
+// WriteRTP переупаковывает пакет ведущего: собственные SSRC, нумерация и метки времени, без расширений WebRTC
+func (s *rtspSession) WriteRTP(t *ingestTrack, pkt *rtp.Packet) {
+    s.mu.Lock()
+    out := s.outputs[t.kind]
+    if out == nil || s.closed {
+        s.mu.Unlock()
+        return
+    }
+    header := pkt.Header
+    header.Extension = false
+    header.Extensions = nil
+    header.ExtensionProfile = 0
+    header.SSRC = out.ssrc
+    header.SequenceNumber = out.seq
+    header.Timestamp = pkt.Timestamp + out.tsOffset
+    out.seq++
+    out.track = t
+    out.packets++
+    out.octets += uint32(len(pkt.Payload))
+    out.lastSrcTS = pkt.Timestamp
+    out.lastArrival = time.Now()
+    interleaved, udpAddr := out.interleaved, out.udpAddr
+    s.mu.Unlock()
+
+    data, err := (&rtp.Packet{Header: header, Payload: pkt.Payload}).Marshal()
+    if err != nil {
+        return
+    }
+    if interleaved >= 0 {
+        s.conn.writeInterleaved(interleaved, data)
+        return
+    }
+    if rtspUDPRTP != nil && udpAddr != nil {
+        _, _ = rtspUDPRTP.WriteToUDP(data, udpAddr)
+    }
+}
+
+// Close вызывается, когда ведущий перестает публиковать медиа: клиент отключается
+func (s *rtspSession) Close() {
+    s.mu.Lock()
+    s.media = nil
+    tcp := s.usesTCP()
+    s.mu.Unlock()
+    s.teardown()
+    if tcp {
+        s.conn.close()
+    }
+}
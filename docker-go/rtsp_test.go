@@ -0,0 +1,145 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/pion/rtcp"
+    "github.com/pion/webrtc/v3"
+)
+
+func TestParseRTSPTransport(t *testing.T) {
+    remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000}
+    tests := []struct {
+        name            string
+        header          string
+        udp             bool // сервер принимает RTP по UDP
+        wantPrefix      string
+        wantInterleaved int
+        wantUDPPort     int
+        wantErr         bool
+    }{
+        {name: "tcp interleaved", header: "RTP/AVP/TCP;unicast;interleaved=2-3", wantPrefix: "RTP/AVP/TCP;unicast;interleaved=2-3;ssrc=", wantInterleaved: 2},
+        {name: "tcp without channel", header: "RTP/AVP/TCP;unicast", wantPrefix: "RTP/AVP/TCP;unicast;interleaved=0-1;ssrc=", wantInterleaved: 0},
+        {name: "invalid channel", header: "RTP/AVP/TCP;interleaved=255-256", wantErr: true},
+        {name: "udp disabled", header: "RTP/AVP;unicast;client_port=5000-5001", wantErr: true},
+        {name: "udp disabled falls back to tcp", header: "RTP/AVP;unicast;client_port=5000-5001,RTP/AVP/TCP;unicast;interleaved=0-1",
+            wantPrefix: "RTP/AVP/TCP;unicast;interleaved=0-1;", wantInterleaved: 0},
+        {name: "udp", header: "RTP/AVP;unicast;client_port=5000-5001", udp: true,
+            wantPrefix: "RTP/AVP;unicast;client_port=5000-5001;server_port=", wantInterleaved: -1, wantUDPPort: 5000},
+        {name: "udp without client port", header: "RTP/AVP/UDP;unicast", udp: true, wantErr: true},
+        {name: "udp invalid client port", header: "RTP/AVP;unicast;client_port=70000-70001", udp: true, wantErr: true},
+        {name: "unsupported", header: "RTP/SAVP;unicast", wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rtspUDPRTP = nil
+            if tt.udp {
+                conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+                if err != nil {
+                    t.Fatalf("listen udp: %v", err)
+                }
+                defer conn.Close()
+                rtspUDPRTP = conn
+                defer func() { rtspUDPRTP = nil }()
+            }
+            transport, output, err := parseRTSPTransport(tt.header, remote)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("parseRTSPTransport(%q) = %q, want error", tt.header, transport)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("parseRTSPTransport(%q) error: %v", tt.header, err)
+            }
+            if !strings.HasPrefix(transport, tt.wantPrefix) {
+                t.Errorf("transport = %q, want prefix %q", transport, tt.wantPrefix)
+            }
+            if output.interleaved != tt.wantInterleaved {
+                t.Errorf("interleaved = %d, want %d", output.interleaved, tt.wantInterleaved)
+            }
+            if tt.wantUDPPort != 0 {
+                if output.udpAddr == nil || output.udpAddr.Port != tt.wantUDPPort || !output.udpAddr.IP.Equal(remote.IP) {
+                    t.Errorf("udpAddr = %v, want %s:%d", output.udpAddr, remote.IP, tt.wantUDPPort)
+                }
+            }
+        })
+    }
+}
+
+func TestReadRTSPRequestLimits(t *testing.T) {
+    tests := []struct {
+        name    string
+        request string
+        wantErr error
+    }{
+        {name: "valid", request: "OPTIONS rtsp://host/room RTSP/1.0\r\nCSeq: 1\r\n\r\n"},
+        {name: "long request line", request: "OPTIONS rtsp://host/" + strings.Repeat("a", rtspMaxLineBytes) + " RTSP/1.0\r\n\r\n",
+            wantErr: errRTSPRequestTooLarge},
+        {name: "long header", request: "OPTIONS rtsp://host/room RTSP/1.0\r\nX-Pad: " + strings.Repeat("a", rtspMaxLineBytes) + "\r\n\r\n",
+            wantErr: errRTSPRequestTooLarge},
+        {name: "too many headers", request: "OPTIONS rtsp://host/room RTSP/1.0\r\n" + strings.Repeat("X-Pad: a\r\n", rtspMaxHeaders+1) + "\r\n",
+            wantErr: errRTSPRequestTooLarge},
+        {name: "large body", request: "SET_PARAMETER rtsp://host/room RTSP/1.0\r\nContent-Length: 1000000\r\n\r\n",
+            wantErr: errRTSPRequestTooLarge},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            reader := bufio.NewReaderSize(strings.NewReader(tt.request), rtspMaxLineBytes)
+            req, err := readRTSPRequest(reader)
+            if tt.wantErr != nil {
+                if !errors.Is(err, tt.wantErr) {
+                    t.Fatalf("readRTSPRequest() error = %v, want %v", err, tt.wantErr)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("readRTSPRequest() error = %v", err)
+            }
+            if req.method != "OPTIONS" || req.header("CSeq") != "1" {
+                t.Fatalf("readRTSPRequest() = %+v", req)
+            }
+        })
+    }
+}
+
+func TestRTSPSenderReportUsesLeaderClock(t *testing.T) {
+    captured := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+    track := &ingestTrack{
+        codec:   webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{ClockRate: 90000}},
+        srNTP:   captured,
+        srRTP:   1000,
+        srKnown: true,
+    }
+    arrival := time.Now()
+    out := &rtspTrackOutput{ssrc: 0x1234, tsOffset: 500, track: track, packets: 3, octets: 300, lastSrcTS: 1000 + 90000, lastArrival: arrival}
+
+    data, err := out.senderReport("session", arrival.Add(500*time.Millisecond))
+    if err != nil {
+        t.Fatalf("senderReport() error = %v", err)
+    }
+    pkts, err := rtcp.Unmarshal(data)
+    if err != nil || len(pkts) != 2 {
+        t.Fatalf("rtcp.Unmarshal() = %v, %v", pkts, err)
+    }
+    sr, ok := pkts[0].(*rtcp.SenderReport)
+    if !ok {
+        t.Fatalf("first packet is %T, want *rtcp.SenderReport", pkts[0])
+    }
+    // Последний пакет снят через секунду после SR ведущего, отчет отправлен еще через 0,5 с
+    wantNTP := captured.Add(1500 * time.Millisecond)
+    if got := ntpToTime(sr.NTPTime); got.Sub(wantNTP).Abs() > time.Millisecond {
+        t.Fatalf("NTP time = %v, want %v", got, wantNTP)
+    }
+    if want := uint32(1000 + 90000 + 500 + 45000); sr.RTPTime != want {
+        t.Fatalf("RTP time = %d, want %d", sr.RTPTime, want)
+    }
+    if sr.SSRC != 0x1234 || sr.PacketCount != 3 || sr.OctetCount != 300 {
+        t.Fatalf("sender report = %+v", sr)
+    }
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    _ "github.com/lib/pq"
+    "github.com/pion/webrtc/v3"
+)
+
+// История сессий в PostgreSQL (docker-postgres): каждая запись - одно подключение пира к комнате.
+// Запись ведет одна горутина через буфер, так что медленная база не задерживает handleWebSocket.
+// Схема создается и обновляется сервером при старте (таблица schema_migrations).
+
+// sessionHistorySettings - настройки истории сессий, задаются переменными окружения
+type sessionHistorySettings struct {
+    DSN        string // пустая строка - история выключена
+    BufferSize int
+}
+
+var sessionHistoryConfig = sessionHistorySettings{
+    DSN:        envString("SESSION_DB_DSN", ""),
+    BufferSize: envInt("SESSION_DB_BUFFER", 1000),
+}
+
+// Миграции схемы; номер миграции - индекс в срезе плюс один. Применённые миграции не меняются.
+var sessionMigrations = []string{
+    `CREATE TABLE sessions (
+        id             BIGSERIAL PRIMARY KEY,
+        room           TEXT NOT NULL,
+        username       TEXT NOT NULL,
+        role           TEXT NOT NULL,
+        mode           TEXT NOT NULL DEFAULT '',
+        remote_addr    TEXT NOT NULL DEFAULT '',
+        codec          TEXT NOT NULL DEFAULT '',
+        view_mode      TEXT NOT NULL DEFAULT '',
+        node           TEXT NOT NULL DEFAULT '',
+        started_at     TIMESTAMPTZ NOT NULL,
+        ended_at       TIMESTAMPTZ,
+        end_reason     TEXT,
+        bytes_sent     BIGINT,
+        bytes_received BIGINT
+    );
+    CREATE INDEX sessions_room_started_idx ON sessions (room, started_at);
+    CREATE INDEX sessions_username_started_idx ON sessions (username, started_at);
+    CREATE INDEX sessions_open_idx ON sessions (node) WHERE ended_at IS NULL;`,
+    // ID сессии WebSocket-соединения; remote_addr с этой версии - адрес клиента с учетом доверенных прокси
+    `ALTER TABLE sessions ADD COLUMN session_id TEXT NOT NULL DEFAULT '';
+    CREATE INDEX sessions_session_id_idx ON sessions (session_id);`,
+}
+
+// Ключ pg_advisory_xact_lock: миграции нескольких экземпляров не выполняются одновременно
+const sessionMigrationLock = 72810431
+
+// sessionRecord - сессия в истории
+type sessionRecord struct {
+    ID            int64      `json:"id"`
+    SessionID     string     `json:"sessionId,omitempty"`
+    Room          string     `json:"room"`
+    Username      string     `json:"username"`
+    Role          string     `json:"role"` // leader или follower
+    Mode          string     `json:"mode,omitempty"`
+    RemoteAddr    string     `json:"remoteAddr,omitempty"`
+    Codec         string     `json:"codec,omitempty"`
+    ViewMode      string     `json:"viewMode,omitempty"`
+    Node          string     `json:"node,omitempty"`
+    StartedAt     time.Time  `json:"startedAt"`
+    EndedAt       *time.Time `json:"endedAt,omitempty"`
+    EndReason     string     `json:"endReason,omitempty"`
+    BytesSent     *int64     `json:"bytesSent,omitempty"`
+    BytesReceived *int64     `json:"bytesReceived,omitempty"`
+    Duration      float64    `json:"duration"` // секунды; для открытой сессии - до текущего момента
+    Active        bool       `json:"active"`
+}
+
+// sessionEnd - завершение сессии
+type sessionEnd struct {
+    EndedAt       time.Time
+    Reason        string
+    BytesSent     *int64
+    BytesReceived *int64
+}
+
+// sessionOp - операция очереди записи: начало (start) или конец (end) сессии пира
+type sessionOp struct {
+    peer  *Peer
+    start *sessionRecord
+    end   *sessionEnd
+}
+
+// sessionHistory - подключение к базе и очередь записи
+type sessionHistory struct {
+    db    *sql.DB
+    queue chan sessionOp
+    ids   map[*Peer]int64 // открытые сессии; только в горутине run
+}
+
+var sessions *sessionHistory
+
+// startSessionHistory подключается к базе по SESSION_DB_DSN; миграции выполняются в фоне
+// с повторами, пока база недоступна, а события сессий тем временем копятся в буфере
+func startSessionHistory() {
+    if sessionHistoryConfig.DSN == "" {
+        return
+    }
+    db, err := sql.Open("postgres", sessionHistoryConfig.DSN)
+    if err != nil {
+        log.Printf("Session history disabled: %v", err)
+        return
+    }
+    db.SetMaxOpenConns(4)
+    size := sessionHistoryConfig.BufferSize
+    if size <= 0 {
+        size = 1000
+    }
+    sessions = &sessionHistory{db: db, queue: make(chan sessionOp, size), ids: make(map[*Peer]int64)}
+    go sessions.run()
+}
+
+// migrate применяет недостающие миграции в одной транзакции
+func (h *sessionHistory) migrate(ctx context.Context) error {
+    tx, err := h.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+    if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, sessionMigrationLock); err != nil {
+        return err
+    }
+    if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+        version    INTEGER PRIMARY KEY,
+        applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`); err != nil {
+        return err
+    }
+    var current int
+    if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+        return err
+    }
+    for i := current; i < len(sessionMigrations); i++ {
+        if _, err := tx.ExecContext(ctx, sessionMigrations[i]); err != nil {
+            return fmt.Errorf("migration %d: %w", i+1, err)
+        }
+        if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+            return err
+        }
+        log.Printf("Session history: applied migration %d", i+1)
+    }
+    return tx.Commit()
+}
+
+// closeStaleSessions завершает сессии, оставшиеся открытыми после падения или перезапуска сервера.
+// Один экземпляр закрывает все открытые сессии, несколько (общий реестр комнат) - только свои.
+func (h *sessionHistory) closeStaleSessions(ctx context.Context) error {
+    query := `UPDATE sessions SET ended_at = now(), end_reason = 'Server restart' WHERE ended_at IS NULL`
+    args := []interface{}{}
+    if roomState.Name() != "memory" {
+        query += ` AND node = $1`
+        args = append(args, nodeID)
+    }
+    res, err := h.db.ExecContext(ctx, query, args...)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n > 0 {
+        log.Printf("Session history: closed %d sessions left open by a previous run", n)
+    }
+    return nil
+}
+
+func (h *sessionHistory) run() {
+    for {
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        err := h.migrate(ctx)
+        if err == nil {
+            err = h.closeStaleSessions(ctx)
+        }
+        cancel()
+        if err == nil {
+            break
+        }
+        log.Printf("Session history: database is not ready, retrying in 5s: %v", err)
+        time.Sleep(5 * time.Second)
+    }
+    log.Printf("Session history: recording sessions to PostgreSQL")
+
+    for op := range h.queue {
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        if op.start != nil {
+            h.insert(ctx, op.peer, op.start)
+        } else if id, ok := h.ids[op.peer]; ok {
+            delete(h.ids, op.peer)
+            h.finish(ctx, id, op.end)
+        }
+        cancel()
+    }
+}
+
+func (h *sessionHistory) insert(ctx context.Context, peer *Peer, s *sessionRecord) {
+    var id int64
+    err := h.db.QueryRowContext(ctx, `INSERT INTO sessions
+        (session_id, room, username, role, mode, remote_addr, codec, view_mode, node, started_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+        s.SessionID, s.Room, s.Username, s.Role, s.Mode, s.RemoteAddr, s.Codec, s.ViewMode, s.Node, s.StartedAt).Scan(&id)
+    if err != nil {
+        log.Printf("Session history: failed to record join of %s to room %s: %v", s.Username, s.Room, err)
+        return
+    }
+    h.ids[peer] = id
+}
+
+func (h *sessionHistory) finish(ctx context.Context, id int64, e *sessionEnd) {
+    _, err := h.db.ExecContext(ctx, `UPDATE sessions
+        SET ended_at = $2, end_reason = $3, bytes_sent = $4, bytes_received = $5 WHERE id = $1`,
+        id, e.EndedAt, e.Reason, e.BytesSent, e.BytesReceived)
+    if err != nil {
+        log.Printf("Session history: failed to record end of session %d: %v", id, err)
+    }
+}
+
+func (h *sessionHistory) enqueue(op sessionOp) {
+    select {
+    case h.queue <- op:
+    default:
+        log.Printf("Session history: buffer is full, event for %s in room %s dropped", op.peer.username, op.peer.room)
+    }
+}
+
+// recordSessionStart ставит в очередь начало сессии пира
+func recordSessionStart(peer *Peer, viewMode string) {
+    if sessions == nil {
+        return
+    }
+    role := "follower"
+    if peer.isLeader {
+        role = "leader"
+    }
+    sessions.enqueue(sessionOp{peer: peer, start: &sessionRecord{
+        SessionID: peer.sessionID, Room: peer.room, Username: peer.username, Role: role, Mode: peer.mode, RemoteAddr: peer.clientIP,
+        Codec: peer.codec, ViewMode: viewMode, Node: nodeID, StartedAt: time.Now().UTC(),
+    }})
+}
+
+// recordSessionEnd ставит в очередь конец сессии пира. bytes - объем медиа через
+// PeerConnection сервера (nil, если неизвестен).
+func recordSessionEnd(peer *Peer, reason string, bytesSent, bytesReceived *int64) {
+    if sessions == nil {
+        return
+    }
+    sessions.enqueue(sessionOp{peer: peer, end: &sessionEnd{
+        EndedAt: time.Now().UTC(), Reason: reason, BytesSent: bytesSent, BytesReceived: bytesReceived,
+    }})
+}
+
+// transportBytes возвращает объем данных, переданных через PeerConnection сервера
+func transportBytes(pc *webrtc.PeerConnection) (sent, received *int64) {
+    if pc == nil {
+        return nil, nil
+    }
+    var s, r int64
+    found := false
+    for _, st := range pc.GetStats() {
+        if t, ok := st.(webrtc.TransportStats); ok {
+            s += int64(t.BytesSent)
+            r += int64(t.BytesReceived)
+            found = true
+        }
+    }
+    if !found {
+        return nil, nil
+    }
+    return &s, &r
+}
+
+// sessionFilter - условия выборки истории; пустые поля не ограничивают выборку.
+// From и To выбирают сессии, пересекающиеся с интервалом.
+type sessionFilter struct {
+    SessionID string
+    Room     string
+    Username string
+    Role     string
+    From, To time.Time
+    Limit    int
+}
+
+// where строит условие WHERE и его аргументы
+func (f sessionFilter) where() (string, []interface{}) {
+    var conds []string
+    var args []interface{}
+    add := func(cond string, v interface{}) {
+        args = append(args, v)
+        conds = append(conds, fmt.Sprintf(cond, len(args)))
+    }
+    if f.SessionID != "" {
+        add("session_id = $%d", f.SessionID)
+    }
+    if f.Room != "" {
+        add("room = $%d", f.Room)
+    }
+    if f.Username != "" {
+        add("username = $%d", f.Username)
+    }
+    if f.Role != "" {
+        add("role = $%d", f.Role)
+    }
+    if !f.From.IsZero() {
+        add("(ended_at IS NULL OR ended_at >= $%d)", f.From)
+    }
+    if !f.To.IsZero() {
+        add("started_at <= $%d", f.To)
+    }
+    if len(conds) == 0 {
+        return "", args
+    }
+    return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+var errSessionHistoryDisabled = errors.New("session history is disabled (SESSION_DB_DSN is not set)")
+
+// listSessions возвращает сессии, новые первыми
+func listSessions(ctx context.Context, f sessionFilter) ([]sessionRecord, error) {
+    if sessions == nil {
+        return nil, errSessionHistoryDisabled
+    }
+    where, args := f.where()
+    args = append(args, f.Limit)
+    rows, err := sessions.db.QueryContext(ctx, `SELECT id, session_id, room, username, role, mode, remote_addr, codec, view_mode, node,
+        started_at, ended_at, COALESCE(end_reason, ''), bytes_sent, bytes_received,
+        EXTRACT(EPOCH FROM COALESCE(ended_at, now()) - started_at)::float8
+        FROM sessions`+where+fmt.Sprintf(` ORDER BY started_at DESC LIMIT $%d`, len(args)), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    result := []sessionRecord{}
+    for rows.Next() {
+        var s sessionRecord
+        var ended sql.NullTime
+        var sent, received sql.NullInt64
+        if err := rows.Scan(&s.ID, &s.SessionID, &s.Room, &s.Username, &s.Role, &s.Mode, &s.RemoteAddr, &s.Codec, &s.ViewMode, &s.Node,
+            &s.StartedAt, &ended, &s.EndReason, &sent, &received, &s.Duration); err != nil {
+            return nil, err
+        }
+        if ended.Valid {
+            s.EndedAt = &ended.Time
+        } else {
+            s.Active = true
+        }
+        if sent.Valid {
+            s.BytesSent = &sent.Int64
+        }
+        if received.Valid {
+            s.BytesReceived = &received.Int64
+        }
+        result = append(result, s)
+    }
+    return result, rows.Err()
+}
+
+// sessionSummary - сессии одного пользователя за интервал
+type sessionSummary struct {
+    Username     string    `json:"username"`
+    Role         string    `json:"role"`
+    Sessions     int       `json:"sessions"`
+    TotalSeconds float64   `json:"totalSeconds"` // с учетом только части сессий внутри интервала
+    FirstStarted time.Time `json:"firstStarted"`
+    LastSeen     time.Time `json:"lastSeen"`
+}
+
+// summarizeSessions отвечает на вопрос "кто смотрел комнату за интервал и сколько":
+// сумма длительностей по пользователям, обрезанная по границам интервала
+func summarizeSessions(ctx context.Context, f sessionFilter) ([]sessionSummary, error) {
+    if sessions == nil {
+        return nil, errSessionHistoryDisabled
+    }
+    where, args := f.where()
+    from, to := "started_at", "COALESCE(ended_at, now())"
+    if !f.From.IsZero() {
+        args = append(args, f.From)
+        from = fmt.Sprintf("GREATEST(started_at, $%d)", len(args))
+    }
+    if !f.To.IsZero() {
+        args = append(args, f.To)
+        to = fmt.Sprintf("LEAST(COALESCE(ended_at, now()), $%d)", len(args))
+    }
+    rows, err := sessions.db.QueryContext(ctx, `SELECT username, role, COUNT(*),
+        COALESCE(SUM(GREATEST(EXTRACT(EPOCH FROM `+to+` - `+from+`), 0)), 0)::float8,
+        MIN(started_at), MAX(COALESCE(ended_at, now()))
+        FROM sessions`+where+` GROUP BY username, role ORDER BY 4 DESC, username`, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    result := []sessionSummary{}
+    for rows.Next() {
+        var s sessionSummary
+        if err := rows.Scan(&s.Username, &s.Role, &s.Sessions, &s.TotalSeconds, &s.FirstStarted, &s.LastSeen); err != nil {
+            return nil, err
+        }
+        result = append(result, s)
+    }
+    return result, rows.Err()
+}
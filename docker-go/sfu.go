@@ -0,0 +1,398 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/pion/rtcp"
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+// Режимы ведомого: p2p - медиа идет напрямую от ведущего (по умолчанию),
+// sfu - ведомый получает медиа ведущего через сервер
+const (
+    peerModeP2P = "p2p"
+    peerModeSFU = "sfu"
+)
+
+// sfuSubscriber - ведомый в режиме sfu; получает RTP ведущего как mediaSink
+// и пересылает его в серверный PeerConnection ведомого
+type sfuSubscriber struct {
+    peer *Peer
+    pc   *webrtc.PeerConnection
+
+    mu          sync.Mutex
+    tracks      map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP
+    negotiating bool
+    renegotiate bool
+    closed      bool
+
+    // Выбор слоя simulcast: закрепленный RID (select_layer) или auto по оценке полосы (REMB или TWCC)
+    video      layerForwarder
+    pinned     string
+    estimate   uint64
+    lastSwitch time.Time
+
+    // Режим просмотра (full, audio, slideshow)
+    gate videoGate
+}
+
+var (
+    sfuSubscribers   = make(map[string][]*sfuSubscriber) // комната -> подписчики
+    sfuSubscribersMu sync.Mutex
+)
+
+// addSubscriber регистрирует ведомого в режиме sfu и подключает его к медиа комнаты, если оно уже есть
+func addSubscriber(peer *Peer, pc *webrtc.PeerConnection) *sfuSubscriber {
+    peer.mu.Lock()
+    viewMode := peer.viewMode
+    peer.mu.Unlock()
+    sub := &sfuSubscriber{
+        peer:   peer,
+        pc:     pc,
+        tracks: make(map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP),
+        pinned: layerAuto,
+        gate:   videoGate{mode: viewMode},
+    }
+    sfuSubscribersMu.Lock()
+    sfuSubscribers[peer.room] = append(sfuSubscribers[peer.room], sub)
+    sfuSubscribersMu.Unlock()
+
+    pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+        if state == webrtc.ICEConnectionStateConnected {
+            // Новый зритель не должен ждать следующего естественного ключевого кадра
+            requestRoomKeyframe(peer.room, fmt.Sprintf("sfu follower %s connected", peer.username), false)
+        }
+    })
+    // Оценка полосы по TWCC (браузеры с transport-cc не присылают REMB)
+    peer.bwe.OnChange(func(int) {
+        go sub.evaluateLayer()
+    })
+
+    if rm := getRoomMedia(peer.room); rm != nil {
+        if err := rm.addSink(sub); err != nil {
+            log.Printf("Failed to attach sfu follower %s to room media: %v", peer.username, err)
+        }
+    } else {
+        log.Printf("Sfu follower %s is waiting for leader of room %s to publish media", peer.username, peer.room)
+        requestLeaderPublish(peer.room)
+    }
+    return sub
+}
+
+// removeSubscriber отключает ведомого от медиа комнаты
+func removeSubscriber(peer *Peer) {
+    sfuSubscribersMu.Lock()
+    var sub *sfuSubscriber
+    subs := sfuSubscribers[peer.room]
+    for i, s := range subs {
+        if s.peer == peer {
+            sub = s
+            subs = append(subs[:i], subs[i+1:]...)
+            break
+        }
+    }
+    if len(subs) == 0 {
+        delete(sfuSubscribers, peer.room)
+    } else {
+        sfuSubscribers[peer.room] = subs
+    }
+    sfuSubscribersMu.Unlock()
+    if sub == nil {
+        return
+    }
+    sub.mu.Lock()
+    sub.closed = true
+    sub.mu.Unlock()
+    if rm := getRoomMedia(peer.room); rm != nil {
+        rm.removeSink(sub)
+    }
+    log.Printf("Sfu follower %s removed from room %s", peer.username, peer.room)
+}
+
+// roomSubscribers возвращает подписчиков комнаты
+func roomSubscribers(room string) []*sfuSubscriber {
+    sfuSubscribersMu.Lock()
+    defer sfuSubscribersMu.Unlock()
+    return append([]*sfuSubscriber(nil), sfuSubscribers[room]...)
+}
+
+// requestLeaderPublish просит ведущего опубликовать медиа на сервер (publish_offer)
+func requestLeaderPublish(room string) {
+    leader := roomLeader(room)
+    if leader == nil {
+        return
+    }
+    if err := leader.writeJSON(map[string]interface{}{"type": "publish_request", "room": room}); err != nil {
+        log.Printf("Error sending publish_request to leader %s: %v", leader.username, err)
+    }
+}
+
+// AddTrack создает локальный трек для ведомого; при смене ведущего используется прежний трек
+func (s *sfuSubscriber) AddTrack(t *ingestTrack) {
+    if t.kind == webrtc.RTPCodecTypeVideo {
+        // Новый слой (или новый ведущий): пересматриваем выбор слоя.
+        // AddTrack может вызываться под блокировкой медиа комнаты, поэтому асинхронно.
+        go s.evaluateLayer()
+    }
+    s.mu.Lock()
+    if s.closed || s.tracks[t.kind] != nil {
+        s.mu.Unlock()
+        return
+    }
+    local, err := webrtc.NewTrackLocalStaticRTP(t.codec.RTPCodecCapability, t.kind.String(), "leader")
+    if err != nil {
+        s.mu.Unlock()
+        log.Printf("Failed to create %s track for sfu follower %s: %v", t.kind, s.peer.username, err)
+        return
+    }
+    s.tracks[t.kind] = local
+    s.mu.Unlock()
+
+    sender, err := s.pc.AddTrack(local)
+    if err != nil {
+        log.Printf("Failed to add %s track to sfu follower %s: %v", t.kind, s.peer.username, err)
+        return
+    }
+    go s.readRTCP(sender)
+    log.Printf("Forwarding leader %s track (%s) to sfu follower %s", t.kind, t.codec.MimeType, s.peer.username)
+    s.negotiate()
+}
+
+func (s *sfuSubscriber) acceptsAllLayers() bool { return true }
+
+// forwardedFrameRate возвращает частоту кадров пересылаемого ведомому слоя
+func (s *sfuSubscriber) forwardedFrameRate() float64 {
+    s.mu.Lock()
+    current := s.video.current
+    s.mu.Unlock()
+    if current == nil {
+        return 0
+    }
+    return current.currentFrameRate()
+}
+
+// sourceTimestamp переводит метку времени видео, пересланного ведомому, в метку слоя ведущего
+func (s *sfuSubscriber) sourceTimestamp(ts uint32) (*ingestTrack, uint32) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.video.current, ts - s.video.tsOffset
+}
+
+// WriteRTP пересылает пакет ведущего; расширения заголовка не пересылаются,
+// так как их идентификаторы согласованы отдельно на каждом соединении.
+// Для видео пересылается только выбранный слой с непрерывной нумерацией
+// и только пакеты, разрешенные режимом просмотра.
+func (s *sfuSubscriber) WriteRTP(t *ingestTrack, pkt *rtp.Packet) {
+    s.mu.Lock()
+    local := s.tracks[t.kind]
+    if local == nil {
+        s.mu.Unlock()
+        return
+    }
+    var out *rtp.Packet
+    if t.kind == webrtc.RTPCodecTypeVideo {
+        var switched bool
+        out, switched = s.video.rewrite(t, pkt)
+        if out != nil && !s.gate.pass(t.codec.MimeType, out) {
+            out = nil
+        }
+        if switched {
+            s.lastSwitch = time.Now()
+            log.Printf("Sfu follower %s switched to layer %q in room %s", s.peer.username, t.rid, s.peer.room)
+            go func(rid string) {
+                _ = s.peer.writeJSON(map[string]interface{}{"type": "layer_changed", "rid": rid})
+            }(t.rid)
+        }
+    } else {
+        out = &rtp.Packet{Header: pkt.Header, Payload: pkt.Payload}
+        out.Header.Extension = false
+        out.Header.Extensions = nil
+    }
+    s.mu.Unlock()
+    if out == nil {
+        return
+    }
+    if err := local.WriteRTP(out); err != nil && !errors.Is(err, webrtc.ErrConnectionClosed) {
+        log.Printf("Error forwarding RTP to sfu follower %s: %v", s.peer.username, err)
+    }
+}
+
+// Close вызывается, когда ведущий перестает публиковать; соединение ведомого остается открытым
+func (s *sfuSubscriber) Close() {
+    log.Printf("Leader media ended for sfu follower %s in room %s", s.peer.username, s.peer.room)
+}
+
+// readRTCP читает RTCP ведомого и пересылает PLI/FIR ведущему с ограничением частоты
+func (s *sfuSubscriber) readRTCP(sender *webrtc.RTPSender) {
+    for {
+        pkts, _, err := sender.ReadRTCP()
+        if err != nil {
+            return
+        }
+        if requested, fir := isKeyframeRequest(pkts); requested {
+            requestRoomKeyframe(s.peer.room, fmt.Sprintf("PLI/FIR from sfu follower %s", s.peer.username), fir)
+        }
+        for _, p := range pkts {
+            if remb, ok := p.(*rtcp.ReceiverEstimatedMaximumBitrate); ok {
+                s.mu.Lock()
+                s.estimate = uint64(remb.Bitrate)
+                s.mu.Unlock()
+                s.evaluateLayer()
+            }
+        }
+    }
+}
+
+// evaluateLayer выбирает слой для ведомого и, если он изменился, ждет на нем ключевой кадр.
+// Переход на слой выше выполняется не чаще simulcastUpswitchDelay, вниз - сразу.
+func (s *sfuSubscriber) evaluateLayer() {
+    rm := getRoomMedia(s.peer.room)
+    if rm == nil {
+        return
+    }
+    layers := rm.videoLayers()
+    s.mu.Lock()
+    estimate := s.estimate
+    if estimate == 0 {
+        estimate = s.peer.bwe.targetBitrate()
+    }
+    // Ограничение битрейта именованной комнаты действует как верхняя граница оценки полосы
+    if limit := roomBitrateCap(s.peer.room); limit > 0 && (estimate == 0 || estimate > limit) {
+        estimate = limit
+    }
+    want := chooseLayer(layers, s.pinned, estimate)
+    cur := s.video.current
+    if want == nil || want == s.video.target || (want == cur && s.video.target == nil) {
+        s.mu.Unlock()
+        return
+    }
+    if cur != nil && s.pinned == layerAuto && simulcastRank(want.rid) > simulcastRank(cur.rid) &&
+        time.Since(s.lastSwitch) < simulcastUpswitchDelay {
+        s.mu.Unlock()
+        return
+    }
+    if want == cur {
+        // Отменяем незавершенное переключение
+        s.video.target = nil
+        s.mu.Unlock()
+        return
+    }
+    s.video.target = want
+    s.mu.Unlock()
+    requestRoomKeyframe(s.peer.room, fmt.Sprintf("layer %q selected for sfu follower %s", want.rid, s.peer.username), false)
+}
+
+// handleSelectLayer закрепляет слой simulcast за ведомым ({"type":"select_layer","rid":"h"})
+// или возвращает автоматический выбор ("rid":"auto")
+func handleSelectLayer(peer *Peer, data map[string]interface{}) error {
+    var sub *sfuSubscriber
+    for _, s := range roomSubscribers(peer.room) {
+        if s.peer == peer {
+            sub = s
+            break
+        }
+    }
+    if sub == nil {
+        return errors.New("layer selection is only available in sfu mode")
+    }
+    rid, _ := data["rid"].(string)
+    if rid == "" {
+        rid = layerAuto
+    }
+    if rid != layerAuto && !contains(simulcastLayers(peer.room), rid) {
+        return fmt.Errorf("unknown layer %q", rid)
+    }
+    sub.mu.Lock()
+    sub.pinned = rid
+    sub.mu.Unlock()
+    log.Printf("Sfu follower %s selected layer %q in room %s", peer.username, rid, peer.room)
+    sub.evaluateLayer()
+    return nil
+}
+
+// negotiate отправляет ведомому subscribe_offer; повторное согласование откладывается до ответа
+func (s *sfuSubscriber) negotiate() {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return
+    }
+    if s.negotiating {
+        s.renegotiate = true
+        s.mu.Unlock()
+        return
+    }
+    s.negotiating = true
+    s.mu.Unlock()
+
+    offer, err := s.pc.CreateOffer(nil)
+    if err == nil {
+        err = s.pc.SetLocalDescription(offer)
+    }
+    if err != nil {
+        log.Printf("Failed to create subscribe_offer for %s: %v", s.peer.username, err)
+        s.mu.Lock()
+        s.negotiating = false
+        s.mu.Unlock()
+        return
+    }
+    log.Printf("Sending subscribe_offer to sfu follower %s", s.peer.username)
+    if err := s.peer.writeJSON(map[string]interface{}{"type": "subscribe_offer", "sdp": offer.SDP}); err != nil {
+        log.Printf("Error sending subscribe_offer to %s: %v", s.peer.username, err)
+    }
+}
+
+// handleSubscribeAnswer применяет ответ ведомого на subscribe_offer
+func handleSubscribeAnswer(peer *Peer, data map[string]interface{}) error {
+    var sub *sfuSubscriber
+    for _, s := range roomSubscribers(peer.room) {
+        if s.peer == peer {
+            sub = s
+            break
+        }
+    }
+    if sub == nil {
+        return errors.New("peer is not an sfu follower")
+    }
+    sdp, _ := data["sdp"].(string)
+    if sdp == "" {
+        return errors.New("subscribe answer has no sdp")
+    }
+    setErr := sub.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp})
+    sub.mu.Lock()
+    sub.negotiating = false
+    again := sub.renegotiate
+    sub.renegotiate = false
+    sub.mu.Unlock()
+    if setErr != nil && sub.pc.SignalingState() != webrtc.SignalingStateStable {
+        // pion не умеет откатывать собственный offer: без принятого ответа соединение ведомого
+        // больше не согласовать, поэтому ведомый отключается и переподключится сам
+        _ = peer.writeJSON(map[string]interface{}{
+            "type": "force_disconnect",
+            "data": "Failed to negotiate media, please reconnect",
+        })
+        go closePeerResources(peer, "Subscribe negotiation failed")
+        return fmt.Errorf("failed to set subscribe answer: %w", setErr)
+    }
+    if again {
+        sub.negotiate()
+    }
+    if setErr != nil {
+        return fmt.Errorf("failed to set subscribe answer: %w", setErr)
+    }
+    return nil
+}
+
+// attachRoomSubscribers подключает ожидающих ведомых к новым медиапотокам ведущего
+func attachRoomSubscribers(rm *roomMedia) {
+    for _, sub := range roomSubscribers(rm.room) {
+        if err := rm.addSink(sub); err != nil {
+            log.Printf("Failed to attach sfu follower %s to room media: %v", sub.peer.username, err)
+        }
+    }
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+    "sort"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+// Порядок RID слоев simulcast от худшего к лучшему; неизвестные RID идут после известных
+var simulcastRIDOrder = strings.Split(envString("SIMULCAST_RIDS", "q,h,f,low,mid,high"), ",")
+
+// Запас по оценке полосы ведомого при выборе слоя и задержка перед переходом на слой выше
+var (
+    simulcastBandwidthHeadroom = 0.85
+    simulcastUpswitchDelay     = envDuration("SIMULCAST_UPSWITCH_DELAY", 5*time.Second)
+)
+
+// layerAuto - автоматический выбор слоя по полосе ведомого
+const layerAuto = "auto"
+
+// simulcastRank возвращает позицию RID в порядке качества
+func simulcastRank(rid string) int {
+    for i, r := range simulcastRIDOrder {
+        if strings.TrimSpace(r) == rid {
+            return i
+        }
+    }
+    return len(simulcastRIDOrder)
+}
+
+// updateBitrate учитывает пакет в оценке битрейта и частоты кадров трека (пересчет раз в секунду).
+// Конец видеокадра отмечен битом marker.
+func (t *ingestTrack) updateBitrate(pkt *rtp.Packet) {
+    t.windowBytes += uint64(len(pkt.Payload) + 12)
+    if pkt.Marker && t.kind == webrtc.RTPCodecTypeVideo {
+        t.windowFrames++
+    }
+    now := time.Now()
+    if t.windowStart.IsZero() {
+        t.windowStart = now
+        return
+    }
+    if elapsed := now.Sub(t.windowStart); elapsed >= time.Second {
+        atomic.StoreUint64(&t.bitrate, uint64(float64(t.windowBytes*8)/elapsed.Seconds()))
+        atomic.StoreUint64(&t.frameRate, uint64(float64(t.windowFrames*100)/elapsed.Seconds()))
+        t.windowBytes = 0
+        t.windowFrames = 0
+        t.windowStart = now
+    }
+}
+
+// currentBitrate возвращает последний измеренный битрейт трека, бит/с
+func (t *ingestTrack) currentBitrate() uint64 {
+    return atomic.LoadUint64(&t.bitrate)
+}
+
+// currentFrameRate возвращает последнюю измеренную частоту кадров видеотрека
+func (t *ingestTrack) currentFrameRate() float64 {
+    return float64(atomic.LoadUint64(&t.frameRate)) / 100
+}
+
+// videoLayers возвращает видеотреки ведущего от худшего слоя к лучшему
+func (rm *roomMedia) videoLayers() []*ingestTrack {
+    rm.mu.RLock()
+    var layers []*ingestTrack
+    for _, t := range rm.tracks {
+        if t.kind == webrtc.RTPCodecTypeVideo {
+            layers = append(layers, t)
+        }
+    }
+    rm.mu.RUnlock()
+    sort.SliceStable(layers, func(i, j int) bool {
+        return simulcastRank(layers[i].rid) < simulcastRank(layers[j].rid)
+    })
+    return layers
+}
+
+// layerRIDs возвращает RID слоев simulcast (пусто, если ведущий публикует один поток)
+func (rm *roomMedia) layerRIDs() []string {
+    var rids []string
+    for _, t := range rm.videoLayers() {
+        if t.rid != "" {
+            rids = append(rids, t.rid)
+        }
+    }
+    return rids
+}
+
+// simulcastLayers возвращает слои simulcast комнаты для room_info
+func simulcastLayers(room string) []string {
+    rm := getRoomMedia(room)
+    if rm == nil {
+        return nil
+    }
+    return rm.layerRIDs()
+}
+
+// refreshPrimaryVideo выбирает лучший слой для получателей без выбора слоя (HLS, RTSP). Вызывается под rm.mu.
+func (rm *roomMedia) refreshPrimaryVideo() {
+    var primary *ingestTrack
+    for _, t := range rm.tracks {
+        if t.kind != webrtc.RTPCodecTypeVideo {
+            continue
+        }
+        if primary == nil || simulcastRank(t.rid) > simulcastRank(primary.rid) {
+            primary = t
+        }
+    }
+    rm.primaryVideo = primary
+}
+
+// layerSink - получатель, который сам выбирает слой simulcast и получает пакеты всех слоев
+type layerSink interface {
+    acceptsAllLayers() bool
+}
+
+// layerForwarder пересылает один слой simulcast и переключает слои на ключевом кадре,
+// переписывая номера пакетов и метки времени так, чтобы для получателя поток оставался непрерывным
+type layerForwarder struct {
+    current *ingestTrack
+    target  *ingestTrack
+
+    started   bool
+    lastSeq   uint16
+    lastTS    uint32
+    seqOffset uint16
+    tsOffset  uint32
+}
+
+// rewrite возвращает переписанный пакет или nil, если пакет не из пересылаемого слоя
+func (f *layerForwarder) rewrite(t *ingestTrack, pkt *rtp.Packet) (*rtp.Packet, bool) {
+    switched := false
+    if t == f.target && isKeyframeStart(t.codec.MimeType, pkt.Payload) {
+        if f.started {
+            // Продолжаем нумерацию предыдущего слоя; метку времени сдвигаем на один кадр
+            f.seqOffset = f.lastSeq + 1 - pkt.SequenceNumber
+            f.tsOffset = f.lastTS + 3000 - pkt.Timestamp
+        } else {
+            f.seqOffset, f.tsOffset = 0, 0
+        }
+        f.current = t
+        f.target = nil
+        f.started = true
+        switched = true
+    }
+    if t != f.current {
+        return nil, false
+    }
+    out := &rtp.Packet{Header: pkt.Header, Payload: pkt.Payload}
+    out.Header.Extension = false
+    out.Header.Extensions = nil
+    out.SequenceNumber = pkt.SequenceNumber + f.seqOffset
+    out.Timestamp = pkt.Timestamp + f.tsOffset
+    f.lastSeq = out.SequenceNumber
+    f.lastTS = out.Timestamp
+    return out, switched
+}
+
+// isKeyframeStart определяет первый пакет ключевого кадра H.264 или VP8
+func isKeyframeStart(mimeType string, payload []byte) bool {
+    if len(payload) < 1 {
+        return false
+    }
+    switch {
+    case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+        switch payload[0] & 0x1F {
+        case h264NaluIDR, h264NaluSPS:
+            return true
+        case h264NaluSTAPA:
+            offset := 1
+            for offset+2 < len(payload) {
+                size := int(payload[offset])<<8 | int(payload[offset+1])
+                naluType := payload[offset+2] & 0x1F
+                if naluType == h264NaluSPS || naluType == h264NaluIDR {
+                    return true
+                }
+                offset += 2 + size
+            }
+        case h264NaluFUA:
+            return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1F == h264NaluIDR
+        }
+    case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+        // Дескриптор VP8 (RFC 7741): S=1, PID=0, затем бит P=0 в заголовке кадра
+        offset := 1
+        if payload[0]&0x80 != 0 { // X
+            if len(payload) < 2 {
+                return false
+            }
+            ext := payload[1]
+            offset++
+            if ext&0x80 != 0 { // I
+                if len(payload) <= offset {
+                    return false
+                }
+                if payload[offset]&0x80 != 0 {
+                    offset++
+                }
+                offset++
+            }
+            if ext&0x40 != 0 { // L
+                offset++
+            }
+            if ext&0x30 != 0 { // T или K
+                offset++
+            }
+        }
+        return payload[0]&0x10 != 0 && payload[0]&0x07 == 0 && len(payload) > offset && payload[offset]&0x01 == 0
+    }
+    return false
+}
+
+// chooseLayer выбирает слой для ведомого: закрепленный RID или лучший слой, который помещается в полосу
+func chooseLayer(layers []*ingestTrack, pinned string, estimate uint64) *ingestTrack {
+    if len(layers) == 0 {
+        return nil
+    }
+    if pinned != "" && pinned != layerAuto {
+        for _, t := range layers {
+            if t.rid == pinned {
+                return t
+            }
+        }
+    }
+    if estimate == 0 {
+        return layers[len(layers)-1]
+    }
+    chosen := layers[0]
+    budget := uint64(float64(estimate) * simulcastBandwidthHeadroom)
+    for _, t := range layers[1:] {
+        if bitrate := t.currentBitrate(); bitrate > 0 && bitrate <= budget {
+            chosen = t
+        }
+    }
+    return chosen
+}
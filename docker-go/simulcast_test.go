@@ -0,0 +1,103 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+func TestChooseLayer(t *testing.T) {
+    low := &ingestTrack{rid: "q", bitrate: 150_000}
+    mid := &ingestTrack{rid: "h", bitrate: 500_000}
+    high := &ingestTrack{rid: "f", bitrate: 1_500_000}
+    idle := &ingestTrack{rid: "f"} // слой еще не измерен
+    layers := []*ingestTrack{low, mid, high}
+    tests := []struct {
+        name     string
+        layers   []*ingestTrack
+        pinned   string
+        estimate uint64
+        want     *ingestTrack
+    }{
+        {name: "no layers", layers: nil, pinned: layerAuto, want: nil},
+        {name: "pinned", layers: layers, pinned: "h", estimate: 100_000, want: mid},
+        {name: "unknown pin falls back to auto", layers: layers, pinned: "x", estimate: 700_000, want: mid},
+        {name: "no estimate takes best", layers: layers, pinned: layerAuto, want: high},
+        {name: "fits all", layers: layers, pinned: layerAuto, estimate: 5_000_000, want: high},
+        {name: "fits middle with headroom", layers: layers, pinned: layerAuto, estimate: 1_500_000, want: mid},
+        {name: "below lowest keeps lowest", layers: layers, pinned: layerAuto, estimate: 50_000, want: low},
+        {name: "unmeasured layer is skipped", layers: []*ingestTrack{low, idle}, pinned: layerAuto, estimate: 5_000_000, want: low},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := chooseLayer(tt.layers, tt.pinned, tt.estimate); got != tt.want {
+                t.Errorf("chooseLayer() = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestLayerForwarderRewrite(t *testing.T) {
+    h264 := webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}}
+    low := &ingestTrack{rid: "q", codec: h264}
+    high := &ingestTrack{rid: "f", codec: h264}
+    idr := []byte{0x65, 0x88}   // NAL IDR
+    delta := []byte{0x41, 0x9a} // NAL без ключевого кадра
+
+    f := &layerForwarder{target: low}
+    steps := []struct {
+        name       string
+        target     *ingestTrack // новый целевой слой перед пакетом
+        track      *ingestTrack
+        seq        uint16
+        ts         uint32
+        payload    []byte
+        wantOut    bool
+        wantSeq    uint16
+        wantTS     uint32
+        wantSwitch bool
+    }{
+        {name: "waits for keyframe", track: low, seq: 100, ts: 1000, payload: delta},
+        {name: "starts on keyframe", track: low, seq: 101, ts: 1000, payload: idr, wantOut: true, wantSeq: 101, wantTS: 1000, wantSwitch: true},
+        {name: "forwards current layer", track: low, seq: 102, ts: 4000, payload: delta, wantOut: true, wantSeq: 102, wantTS: 4000},
+        {name: "other layer is dropped", track: high, seq: 7000, ts: 500000, payload: idr},
+        {name: "target waits for its keyframe", target: high, track: high, seq: 7001, ts: 503000, payload: delta},
+        {name: "current layer continues meanwhile", track: low, seq: 103, ts: 7000, payload: delta, wantOut: true, wantSeq: 103, wantTS: 7000},
+        {name: "switches on target keyframe", track: high, seq: 7002, ts: 506000, payload: idr, wantOut: true, wantSeq: 104, wantTS: 10000, wantSwitch: true},
+        {name: "new layer keeps numbering", track: high, seq: 7003, ts: 509000, payload: delta, wantOut: true, wantSeq: 105, wantTS: 13000},
+        {name: "old layer is dropped", track: low, seq: 104, ts: 10000, payload: delta},
+        {name: "offset wraps around", track: high, seq: 7004, ts: 512000, payload: delta, wantOut: true, wantSeq: 106, wantTS: 16000},
+    }
+    for _, step := range steps {
+        if step.target != nil {
+            f.target = step.target
+        }
+        pkt := &rtp.Packet{
+            Header:  rtp.Header{Version: 2, SequenceNumber: step.seq, Timestamp: step.ts},
+            Payload: step.payload,
+        }
+        if err := pkt.Header.SetExtension(1, []byte{1}); err != nil {
+            t.Fatalf("SetExtension: %v", err)
+        }
+        out, switched := f.rewrite(step.track, pkt)
+        if switched != step.wantSwitch {
+            t.Errorf("%s: switched = %v, want %v", step.name, switched, step.wantSwitch)
+        }
+        if (out != nil) != step.wantOut {
+            t.Fatalf("%s: forwarded = %v, want %v", step.name, out != nil, step.wantOut)
+        }
+        if out == nil {
+            continue
+        }
+        if out.SequenceNumber != step.wantSeq || out.Timestamp != step.wantTS {
+            t.Errorf("%s: seq %d ts %d, want seq %d ts %d", step.name, out.SequenceNumber, out.Timestamp, step.wantSeq, step.wantTS)
+        }
+        if out.Extension || out.Extensions != nil {
+            t.Errorf("%s: header extensions were not stripped", step.name)
+        }
+        if pkt.SequenceNumber != step.seq || !pkt.Extension {
+            t.Errorf("%s: source packet was modified", step.name)
+        }
+    }
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+)
+
+// Push-to-talk: ведомый просит слово (talk_start), и пока оно за ним, сервер пересылает
+// его аудио ведущему через аудиотрек talkback серверного PeerConnection ведущего.
+// Слово одно на комнату; ведущий (talk_revoke) или администратор (API) может его отобрать.
+
+// talkRoom - состояние push-to-talk комнаты
+type talkRoom struct {
+    holder *Peer          // ведомый, у которого слово (nil - никто не говорит)
+    since  time.Time      // когда слово было выдано
+    relay  *talkbackRelay // аудиотрек к ведущему (nil, пока ведущего нет)
+}
+
+var (
+    talkRooms = make(map[string]*talkRoom)
+    talkMu    sync.Mutex
+)
+
+// talkbackRelay пересылает ведущему аудио говорящего ведомого с непрерывной нумерацией пакетов
+type talkbackRelay struct {
+    leader *Peer
+    track  *webrtc.TrackLocalStaticRTP
+
+    mu        sync.Mutex
+    source    *Peer
+    resync    bool
+    started   bool
+    lastSeq   uint16
+    lastTS    uint32
+    lastAt    time.Time
+    seqOffset uint16
+    tsOffset  uint32
+}
+
+// getTalkRoom возвращает состояние комнаты, создавая его. Вызывается под talkMu.
+func getTalkRoom(room string) *talkRoom {
+    tr := talkRooms[room]
+    if tr == nil {
+        tr = &talkRoom{}
+        talkRooms[room] = tr
+    }
+    return tr
+}
+
+// pruneTalkRoom удаляет пустое состояние комнаты. Вызывается под talkMu.
+func pruneTalkRoom(room string) {
+    if tr := talkRooms[room]; tr != nil && tr.holder == nil && tr.relay == nil {
+        delete(talkRooms, room)
+    }
+}
+
+// newTalkbackTrack создает аудиотрек, по которому ведущий слышит говорящего ведомого
+func newTalkbackTrack(leader *Peer) (*webrtc.TrackLocalStaticRTP, error) {
+    track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+        MimeType:    webrtc.MimeTypeOpus,
+        ClockRate:   48000,
+        Channels:    2,
+        SDPFmtpLine: "minptime=10;useinbandfec=1",
+    }, "audio", "talkback-"+leader.room)
+    if err != nil {
+        return nil, err
+    }
+    talkMu.Lock()
+    getTalkRoom(leader.room).relay = &talkbackRelay{leader: leader, track: track}
+    talkMu.Unlock()
+    return track, nil
+}
+
+// detachTalkback убирает трек ушедшего ведущего и отбирает слово: говорить некому
+func detachTalkback(leader *Peer) {
+    talkMu.Lock()
+    tr := talkRooms[leader.room]
+    if tr == nil || tr.relay == nil || tr.relay.leader != leader {
+        talkMu.Unlock()
+        return
+    }
+    tr.relay = nil
+    holder := tr.holder
+    tr.holder = nil
+    pruneTalkRoom(leader.room)
+    talkMu.Unlock()
+
+    if holder != nil {
+        notifyTalkRevoked(holder, "leader left")
+        go sendRoomInfo(leader.room)
+    }
+}
+
+// talkState возвращает, у кого слово в комнате и с какого момента
+func talkState(room string) (string, time.Time) {
+    talkMu.Lock()
+    defer talkMu.Unlock()
+    if tr := talkRooms[room]; tr != nil && tr.holder != nil {
+        return tr.holder.username, tr.since
+    }
+    return "", time.Time{}
+}
+
+// talkHolder возвращает имя ведомого, у которого слово
+func talkHolder(room string) string {
+    talkMu.Lock()
+    defer talkMu.Unlock()
+    if tr := talkRooms[room]; tr != nil && tr.holder != nil {
+        return tr.holder.username
+    }
+    return ""
+}
+
+// handleTalkStart выдает слово ведомому, если оно свободно
+func handleTalkStart(peer *Peer) error {
+    if peer.isLeader {
+        return errors.New("only followers can request the floor")
+    }
+    talkMu.Lock()
+    tr := getTalkRoom(peer.room)
+    if tr.holder != nil && tr.holder != peer {
+        holder := tr.holder.username
+        talkMu.Unlock()
+        log.Printf("Floor in room %s denied to %s: held by %s", peer.room, peer.username, holder)
+        return peer.writeJSON(map[string]interface{}{"type": "talk_denied", "holder": holder})
+    }
+    granted := tr.holder == nil
+    if granted {
+        tr.holder = peer
+        tr.since = time.Now()
+        if tr.relay != nil {
+            tr.relay.mu.Lock()
+            tr.relay.resync = true
+            tr.relay.mu.Unlock()
+        }
+    }
+    talkMu.Unlock()
+
+    if granted {
+        log.Printf("Floor in room %s granted to %s", peer.room, peer.username)
+        go sendRoomInfo(peer.room)
+    }
+    if getRoomMedia(peer.room) == nil {
+        // Аудио идет ведущему через серверный PeerConnection; просим ведущего подключиться
+        requestLeaderPublish(peer.room)
+    }
+    return peer.writeJSON(map[string]interface{}{"type": "talk_granted"})
+}
+
+// releaseTalkFloor забирает слово у ведомого (talk_stop или отключение). Возвращает true, если слово было у него.
+func releaseTalkFloor(peer *Peer) bool {
+    talkMu.Lock()
+    tr := talkRooms[peer.room]
+    if tr == nil || tr.holder != peer {
+        talkMu.Unlock()
+        return false
+    }
+    tr.holder = nil
+    pruneTalkRoom(peer.room)
+    talkMu.Unlock()
+    log.Printf("Floor in room %s released by %s", peer.room, peer.username)
+    go sendRoomInfo(peer.room)
+    return true
+}
+
+// revokeTalkFloor отбирает слово в комнате; by - кто отобрал (ведущий или admin)
+func revokeTalkFloor(room, by string) (string, error) {
+    talkMu.Lock()
+    tr := talkRooms[room]
+    if tr == nil || tr.holder == nil {
+        talkMu.Unlock()
+        return "", errors.New("nobody holds the floor")
+    }
+    holder := tr.holder
+    tr.holder = nil
+    pruneTalkRoom(room)
+    talkMu.Unlock()
+
+    log.Printf("Floor in room %s revoked from %s by %s", room, holder.username, by)
+    notifyTalkRevoked(holder, by)
+    go sendRoomInfo(room)
+    return holder.username, nil
+}
+
+func notifyTalkRevoked(holder *Peer, by string) {
+    if err := holder.writeJSON(map[string]interface{}{"type": "talk_revoked", "by": by}); err != nil {
+        log.Printf("Error sending talk_revoked to %s: %v", holder.username, err)
+    }
+}
+
+// handleTalkRevoke - ведущий отбирает слово у ведомого
+func handleTalkRevoke(peer *Peer) error {
+    if !peer.isLeader {
+        return errors.New("only leader can revoke the floor")
+    }
+    _, err := revokeTalkFloor(peer.room, fmt.Sprintf("leader %s", peer.username))
+    return err
+}
+
+// forwardTalkback читает аудио ведомого с серверного PeerConnection
+// и пересылает ведущему только пакеты, пришедшие, пока у ведомого слово
+func forwardTalkback(peer *Peer, track *webrtc.TrackRemote) {
+    log.Printf("Talkback audio from follower %s in room %s is available", peer.username, peer.room)
+    for {
+        pkt, _, err := track.ReadRTP()
+        if err != nil {
+            return
+        }
+        talkMu.Lock()
+        var relay *talkbackRelay
+        if tr := talkRooms[peer.room]; tr != nil && tr.holder == peer {
+            relay = tr.relay
+        }
+        talkMu.Unlock()
+        if relay != nil {
+            relay.write(peer, pkt)
+        }
+    }
+}
+
+// write пересылает пакет ведущему. При смене говорящего и при новой выдаче слова
+// нумерация продолжается, а метка времени сдвигается на время паузы.
+func (r *talkbackRelay) write(source *Peer, pkt *rtp.Packet) {
+    r.mu.Lock()
+    now := time.Now()
+    if r.source != source || r.resync {
+        if r.started {
+            gap := uint32(now.Sub(r.lastAt).Seconds() * 48000)
+            if gap < 960 {
+                gap = 960
+            }
+            r.seqOffset = r.lastSeq + 1 - pkt.SequenceNumber
+            r.tsOffset = r.lastTS + gap - pkt.Timestamp
+        } else {
+            r.seqOffset, r.tsOffset = 0, 0
+        }
+        r.source = source
+        r.resync = false
+        r.started = true
+    }
+    out := &rtp.Packet{Header: pkt.Header, Payload: pkt.Payload}
+    out.Header.Extension = false
+    out.Header.Extensions = nil
+    out.SequenceNumber = pkt.SequenceNumber + r.seqOffset
+    out.Timestamp = pkt.Timestamp + r.tsOffset
+    r.lastSeq = out.SequenceNumber
+    r.lastTS = out.Timestamp
+    r.lastAt = now
+    r.mu.Unlock()
+
+    if err := r.track.WriteRTP(out); err != nil && !errors.Is(err, webrtc.ErrConnectionClosed) {
+        log.Printf("Error forwarding talkback audio to leader %s: %v", r.leader.username, err)
+    }
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image/jpeg"
+    "log"
+    "net/url"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pion/rtp"
+    "github.com/pion/webrtc/v3"
+    "golang.org/x/image/vp8"
+)
+
+// Таймлапс: пока ведущий публикует медиа на сервер, раз в заданный интервал сохраняется
+// один ключевой кадр его видео. Съемку включает расписание (TIMELAPSE_SCHEDULE) или
+// администратор через API; кадры выгружаются одним видео или zip-архивом.
+
+// timelapseSettings - настройки таймлапса, задаются переменными окружения
+type timelapseSettings struct {
+    Dir      string
+    Interval time.Duration // интервал по умолчанию для запуска через API
+    FPS      int           // частота кадров собранного видео
+    Public   bool          // выгрузка без токена администратора
+    Schedule map[string]timelapseSchedule
+    FFmpeg   string // ffmpeg для перекодирования кадров H.264 в JPEG при выгрузке zip
+}
+
+// timelapseSchedule - запись расписания комнаты: интервал съемки и окно времени суток.
+// Окно задается смещением от полуночи по местному времени; From == To - круглосуточно.
+type timelapseSchedule struct {
+    Interval time.Duration
+    From, To time.Duration
+}
+
+// TIMELAPSE_SCHEDULE: "room1=30s;room2=1m@08:00-18:00" (окно может переходить через полночь)
+var timelapseConfig = timelapseSettings{
+    Dir:      envString("TIMELAPSE_DIR", "timelapse"),
+    Interval: envDuration("TIMELAPSE_INTERVAL", 30*time.Second),
+    FPS:      envInt("TIMELAPSE_FPS", 10),
+    Public:   envBool("TIMELAPSE_PUBLIC", false),
+    Schedule: parseTimelapseSchedule(envString("TIMELAPSE_SCHEDULE", "")),
+    FFmpeg:   envString("TIMELAPSE_FFMPEG", "ffmpeg"),
+}
+
+// Минимальный интервал съемки: чаще ключевые кадры у ведущего не запросить (см. KEYFRAME_MIN_INTERVAL)
+const timelapseMinInterval = time.Second
+
+// parseTimelapseSchedule разбирает TIMELAPSE_SCHEDULE; ошибочные записи пропускаются
+func parseTimelapseSchedule(value string) map[string]timelapseSchedule {
+    schedule := make(map[string]timelapseSchedule)
+    for _, entry := range strings.Split(value, ";") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        s, room, err := parseTimelapseScheduleEntry(entry)
+        if err != nil {
+            log.Printf("Invalid TIMELAPSE_SCHEDULE entry %q: %v", entry, err)
+            continue
+        }
+        schedule[room] = s
+    }
+    return schedule
+}
+
+func parseTimelapseScheduleEntry(entry string) (timelapseSchedule, string, error) {
+    var s timelapseSchedule
+    room, spec, ok := strings.Cut(entry, "=")
+    room = strings.TrimSpace(room)
+    if !ok || room == "" {
+        return s, "", errors.New("expected room=interval[@HH:MM-HH:MM]")
+    }
+    interval, window, hasWindow := strings.Cut(strings.TrimSpace(spec), "@")
+    var err error
+    if s.Interval, err = time.ParseDuration(interval); err != nil {
+        return s, "", err
+    }
+    if s.Interval < timelapseMinInterval {
+        return s, "", fmt.Errorf("interval must be at least %s", timelapseMinInterval)
+    }
+    if hasWindow {
+        from, to, ok := strings.Cut(window, "-")
+        if !ok {
+            return s, "", errors.New("expected window HH:MM-HH:MM")
+        }
+        if s.From, err = parseClock(from); err != nil {
+            return s, "", err
+        }
+        if s.To, err = parseClock(to); err != nil {
+            return s, "", err
+        }
+    }
+    return s, room, nil
+}
+
+// parseClock разбирает время суток HH:MM в смещение от полуночи
+func parseClock(v string) (time.Duration, error) {
+    t, err := time.Parse("15:04", strings.TrimSpace(v))
+    if err != nil {
+        return 0, fmt.Errorf("invalid time of day %q", v)
+    }
+    return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active сообщает, попадает ли момент в окно расписания
+func (s timelapseSchedule) active(now time.Time) bool {
+    if s.From == s.To {
+        return true
+    }
+    midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+    offset := now.Sub(midnight)
+    if s.From < s.To {
+        return offset >= s.From && offset < s.To
+    }
+    return offset >= s.From || offset < s.To
+}
+
+func (s timelapseSchedule) String() string {
+    if s.From == s.To {
+        return s.Interval.String()
+    }
+    clock := func(d time.Duration) string {
+        return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+    }
+    return fmt.Sprintf("%s@%s-%s", s.Interval, clock(s.From), clock(s.To))
+}
+
+// timelapseRoom - состояние съемки комнаты
+type timelapseRoom struct {
+    manual      time.Duration     // интервал, заданный через API (0 - съемка только по расписанию)
+    lastCapture time.Time         // когда был запрошен последний кадр
+    capture     *timelapseCapture // получатель кадров, подключенный к медиа ведущего
+}
+
+var (
+    timelapseRooms = make(map[string]*timelapseRoom)
+    timelapseMu    sync.Mutex
+)
+
+// timelapseInterval возвращает текущий интервал съемки комнаты и его источник (api или schedule).
+// Вызывается под timelapseMu.
+func timelapseInterval(room string, now time.Time) (time.Duration, string) {
+    if tl := timelapseRooms[room]; tl != nil && tl.manual > 0 {
+        return tl.manual, "api"
+    }
+    if s, ok := timelapseConfig.Schedule[room]; ok && s.active(now) {
+        return s.Interval, "schedule"
+    }
+    return 0, ""
+}
+
+// timelapseCapture получает видео ведущего и сохраняет первый ключевой кадр после запроса
+type timelapseCapture struct {
+    room string
+    rm   *roomMedia
+
+    mu          sync.Mutex
+    armed       bool
+    armedAt     time.Time
+    skipPartial bool // первый кадр после запроса мог начаться до него
+    h264        h264FrameAssembler
+    vp8         vp8FrameAssembler
+    warned      bool
+}
+
+// arm запрашивает сохранение следующего ключевого кадра
+func (c *timelapseCapture) arm(now time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.armed {
+        c.armed = true
+        c.skipPartial = true
+        c.h264 = h264FrameAssembler{}
+        c.vp8 = vp8FrameAssembler{}
+    }
+    c.armedAt = now
+}
+
+func (c *timelapseCapture) AddTrack(t *ingestTrack) {}
+
+func (c *timelapseCapture) WriteRTP(t *ingestTrack, pkt *rtp.Packet) {
+    if t.kind != webrtc.RTPCodecTypeVideo {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.armed {
+        return
+    }
+    switch {
+    case strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeH264):
+        for _, au := range c.h264.push(pkt) {
+            if c.skipPartial {
+                c.skipPartial = false
+                continue
+            }
+            if au.keyframe {
+                c.armed = false
+                go saveTimelapseFrame(c.room, ".h264", c.annexB(au), time.Now())
+                return
+            }
+        }
+    case strings.EqualFold(t.codec.MimeType, webrtc.MimeTypeVP8):
+        if frame := c.vp8.push(pkt); frame != nil && frame.keyframe {
+            c.armed = false
+            go saveTimelapseFrame(c.room, ".vp8", frame.data, time.Now())
+        }
+    default:
+        if !c.warned {
+            c.warned = true
+            log.Printf("Timelapse for room %s: codec %s is not supported, frames are not captured", c.room, t.codec.MimeType)
+        }
+    }
+}
+
+func (c *timelapseCapture) Close() {}
+
+// annexB упаковывает кадр в Annex-B, добавляя SPS/PPS, если ведущий не прислал их в самом кадре
+func (c *timelapseCapture) annexB(au *h264AccessUnit) []byte {
+    nalus := au.nalus
+    hasParams := false
+    for _, nalu := range nalus {
+        if nalu[0]&0x1F == h264NaluSPS {
+            hasParams = true
+        }
+    }
+    if sps, pps := c.rm.h264Params(); !hasParams && sps != nil && pps != nil {
+        nalus = append([][]byte{sps, pps}, nalus...)
+    }
+    var data []byte
+    for _, nalu := range nalus {
+        if nalu[0]&0x1F == h264NaluAUD {
+            continue
+        }
+        data = append(data, 0, 0, 0, 1)
+        data = append(data, nalu...)
+    }
+    return data
+}
+
+// timelapseRoomDir возвращает каталог кадров комнаты
+func timelapseRoomDir(room string) string {
+    name := url.PathEscape(room)
+    if strings.HasPrefix(name, ".") {
+        name = "%2E" + name[1:]
+    }
+    return filepath.Join(timelapseConfig.Dir, name)
+}
+
+// saveTimelapseFrame сохраняет кадр как <каталог комнаты>/<Unix-время в мс><ext>
+func saveTimelapseFrame(room, ext string, data []byte, at time.Time) {
+    dir := timelapseRoomDir(room)
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        log.Printf("Timelapse for room %s: failed to save frame: %v", room, err)
+        return
+    }
+    path := filepath.Join(dir, strconv.FormatInt(at.UnixMilli(), 10)+ext)
+    // Пишем через временный файл, чтобы выгрузка не увидела кадр наполовину
+    if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+        log.Printf("Timelapse for room %s: failed to save frame: %v", room, err)
+        return
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        log.Printf("Timelapse for room %s: failed to save frame: %v", room, err)
+    }
+}
+
+// startTimelapse запускает планировщик: раз в секунду подключает получателей кадров
+// к медиа ведущих комнат, где идет съемка, и запрашивает кадры по интервалу
+func startTimelapse() {
+    for room, s := range timelapseConfig.Schedule {
+        log.Printf("Timelapse scheduled for room %s: %s", room, s)
+    }
+    go func() {
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        for now := range ticker.C {
+            timelapseTick(now)
+        }
+    }()
+}
+
+func timelapseTick(now time.Time) {
+    timelapseMu.Lock()
+    var roomNames []string
+    for room := range timelapseConfig.Schedule {
+        roomNames = append(roomNames, room)
+    }
+    for room := range timelapseRooms {
+        if _, scheduled := timelapseConfig.Schedule[room]; !scheduled {
+            roomNames = append(roomNames, room)
+        }
+    }
+    timelapseMu.Unlock()
+
+    for _, room := range roomNames {
+        rm := getRoomMedia(room)
+
+        timelapseMu.Lock()
+        interval, _ := timelapseInterval(room, now)
+        tl := timelapseRooms[room]
+        if tl == nil && interval > 0 && rm != nil {
+            tl = &timelapseRoom{}
+            timelapseRooms[room] = tl
+        }
+        if tl == nil {
+            timelapseMu.Unlock()
+            continue
+        }
+        stale := tl.capture
+        if stale != nil && (interval == 0 || stale.rm != rm) {
+            tl.capture = nil
+        } else {
+            stale = nil
+        }
+        if interval == 0 || rm == nil {
+            if tl.manual == 0 {
+                delete(timelapseRooms, room)
+            }
+            timelapseMu.Unlock()
+            if stale != nil {
+                stale.rm.removeSink(stale)
+            }
+            continue
+        }
+        capture := tl.capture
+        attach := capture == nil
+        if attach {
+            capture = &timelapseCapture{room: room, rm: rm}
+            tl.capture = capture
+        }
+        due := now.Sub(tl.lastCapture) >= interval
+        if due {
+            tl.lastCapture = now
+        }
+        timelapseMu.Unlock()
+
+        if stale != nil {
+            stale.rm.removeSink(stale)
+        }
+        if attach {
+            if err := rm.addSink(capture); err != nil {
+                continue
+            }
+            log.Printf("Timelapse capture attached to room %s (every %s)", room, interval)
+        }
+        if due {
+            capture.arm(now)
+            requestRoomKeyframe(room, "timelapse", false)
+        }
+    }
+}
+
+// startTimelapseCapture включает съемку комнаты через API
+func startTimelapseCapture(room string, interval time.Duration) {
+    timelapseMu.Lock()
+    tl := timelapseRooms[room]
+    if tl == nil {
+        tl = &timelapseRoom{}
+        timelapseRooms[room] = tl
+    }
+    tl.manual = interval
+    timelapseMu.Unlock()
+    log.Printf("Timelapse for room %s started via API (every %s)", room, interval)
+}
+
+// stopTimelapseCapture выключает съемку, включенную через API; расписание продолжает действовать
+func stopTimelapseCapture(room string) bool {
+    timelapseMu.Lock()
+    defer timelapseMu.Unlock()
+    tl := timelapseRooms[room]
+    if tl == nil || tl.manual == 0 {
+        return false
+    }
+    tl.manual = 0
+    log.Printf("Timelapse for room %s stopped via API", room)
+    return true
+}
+
+// timelapseFrame - сохраненный кадр
+type timelapseFrame struct {
+    path  string
+    at    time.Time
+    codec string // h264 или vp8
+}
+
+// listTimelapseFrames возвращает кадры комнаты по времени съемки; нулевые from/to не ограничивают выборку
+func listTimelapseFrames(room string, from, to time.Time) ([]timelapseFrame, error) {
+    dir := timelapseRoomDir(room)
+    entries, err := os.ReadDir(dir)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var frames []timelapseFrame
+    for _, e := range entries {
+        ext := filepath.Ext(e.Name())
+        if e.IsDir() || (ext != ".h264" && ext != ".vp8") {
+            continue
+        }
+        ms, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), ext), 10, 64)
+        if err != nil {
+            continue
+        }
+        at := time.UnixMilli(ms).UTC()
+        if (!from.IsZero() && at.Before(from)) || (!to.IsZero() && at.After(to)) {
+            continue
+        }
+        frames = append(frames, timelapseFrame{path: filepath.Join(dir, e.Name()), at: at, codec: ext[1:]})
+    }
+    sort.Slice(frames, func(i, j int) bool { return frames[i].at.Before(frames[j].at) })
+    return frames, nil
+}
+
+// timelapseStatus - состояние таймлапса комнаты в ответе API
+type timelapseStatus struct {
+    Room       string     `json:"room"`
+    Active     bool       `json:"active"`             // съемка включена сейчас
+    Source     string     `json:"source,omitempty"`   // api или schedule
+    Interval   string     `json:"interval,omitempty"` // текущий интервал съемки
+    Schedule   string     `json:"schedule,omitempty"`
+    Live       bool       `json:"live"` // ведущий публикует медиа на сервер
+    Frames     int        `json:"frames"`
+    Codec      string     `json:"codec,omitempty"` // кодек последнего кадра
+    FirstFrame *time.Time `json:"firstFrame,omitempty"`
+    LastFrame  *time.Time `json:"lastFrame,omitempty"`
+}
+
+func getTimelapseStatus(room string) (*timelapseStatus, error) {
+    frames, err := listTimelapseFrames(room, time.Time{}, time.Time{})
+    if err != nil {
+        return nil, err
+    }
+    st := &timelapseStatus{Room: room, Frames: len(frames), Live: getRoomMedia(room) != nil}
+    timelapseMu.Lock()
+    interval, source := timelapseInterval(room, time.Now())
+    timelapseMu.Unlock()
+    if interval > 0 {
+        st.Active, st.Source, st.Interval = true, source, interval.String()
+    }
+    if s, ok := timelapseConfig.Schedule[room]; ok {
+        st.Schedule = s.String()
+    }
+    if len(frames) > 0 {
+        first, last := frames[0], frames[len(frames)-1]
+        st.FirstFrame, st.LastFrame, st.Codec = &first.at, &last.at, last.codec
+    }
+    return st, nil
+}
+
+// listTimelapseRooms возвращает комнаты с расписанием, включенной съемкой или сохраненными кадрами
+func listTimelapseRooms() ([]*timelapseStatus, error) {
+    names := make(map[string]bool)
+    timelapseMu.Lock()
+    for room := range timelapseConfig.Schedule {
+        names[room] = true
+    }
+    for room, tl := range timelapseRooms {
+        if tl.manual > 0 {
+            names[room] = true
+        }
+    }
+    timelapseMu.Unlock()
+    entries, err := os.ReadDir(timelapseConfig.Dir)
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+        return nil, err
+    }
+    for _, e := range entries {
+        if room, err := url.PathUnescape(e.Name()); e.IsDir() && err == nil {
+            names[room] = true
+        }
+    }
+
+    result := []*timelapseStatus{}
+    for room := range names {
+        st, err := getTimelapseStatus(room)
+        if err != nil {
+            return nil, err
+        }
+        result = append(result, st)
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i].Room < result[j].Room })
+    return result, nil
+}
+
+// deleteTimelapseFrames удаляет все сохраненные кадры комнаты
+func deleteTimelapseFrames(room string) error {
+    return os.RemoveAll(timelapseRoomDir(room))
+}
+
+// lastCodecFrames оставляет кадры кодека последнего кадра: видео собирается в одном кодеке
+func lastCodecFrames(frames []timelapseFrame) []timelapseFrame {
+    if len(frames) == 0 {
+        return nil
+    }
+    codec := frames[len(frames)-1].codec
+    var result []timelapseFrame
+    for _, f := range frames {
+        if f.codec == codec {
+            result = append(result, f)
+        }
+    }
+    return result
+}
+
+// splitAnnexB разбивает поток Annex-B на NAL-юниты
+func splitAnnexB(data []byte) [][]byte {
+    var nalus [][]byte
+    start := -1
+    for i := 0; i+3 <= len(data); i++ {
+        if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+            continue
+        }
+        if start >= 0 {
+            nalus = append(nalus, bytes.TrimRight(data[start:i], "\x00"))
+        }
+        start = i + 3
+        i += 2
+    }
+    if start >= 0 && start < len(data) {
+        nalus = append(nalus, data[start:])
+    }
+    return nalus
+}
+
+// buildTimelapseMP4 собирает кадры H.264 в фрагментированный MP4 с частотой TIMELAPSE_FPS
+func buildTimelapseMP4(frames []timelapseFrame) ([]byte, error) {
+    duration := uint32(fmp4VideoTimescale / timelapseFPS())
+    var video *fmp4Track
+    var samples []fmp4Sample
+    for _, f := range frames {
+        data, err := os.ReadFile(f.path)
+        if err != nil {
+            return nil, err
+        }
+        var sample []byte
+        for _, nalu := range splitAnnexB(data) {
+            if len(nalu) == 0 {
+                continue
+            }
+            if video == nil && nalu[0]&0x1F == h264NaluSPS {
+                width, height, err := parseH264SPS(nalu)
+                if err != nil {
+                    return nil, fmt.Errorf("frame %s: %w", filepath.Base(f.path), err)
+                }
+                video = &fmp4Track{id: fmp4VideoTrackID, timescale: fmp4VideoTimescale, sps: nalu, width: width, height: height}
+            }
+            if video != nil && video.pps == nil && nalu[0]&0x1F == h264NaluPPS {
+                video.pps = nalu
+            }
+            sample = append(sample, be32(uint32(len(nalu)))...)
+            sample = append(sample, nalu...)
+        }
+        // Кадры до первого SPS/PPS декодировать нельзя
+        if video != nil && video.pps != nil {
+            samples = append(samples, fmp4Sample{data: sample, duration: duration, keyframe: true})
+        }
+    }
+    if len(samples) == 0 {
+        return nil, errors.New("no decodable frames")
+    }
+
+    out := buildFMP4Init(video, nil)
+    const samplesPerFragment = 250
+    for i := 0; i < len(samples); i += samplesPerFragment {
+        end := min(i+samplesPerFragment, len(samples))
+        run := fmp4TrackRun{trackID: fmp4VideoTrackID, baseDecodeTS: uint64(i) * uint64(duration), samples: samples[i:end]}
+        out = append(out, buildFMP4Fragment(uint32(i/samplesPerFragment+1), []fmp4TrackRun{run})...)
+    }
+    return out, nil
+}
+
+// buildTimelapseIVF собирает кадры VP8 в контейнер IVF с частотой TIMELAPSE_FPS
+func buildTimelapseIVF(frames []timelapseFrame) ([]byte, error) {
+    var body []byte
+    var width, height, count int
+    for _, f := range frames {
+        data, err := os.ReadFile(f.path)
+        if err != nil {
+            return nil, err
+        }
+        w, h, err := vp8KeyframeSize(data)
+        if err != nil {
+            continue
+        }
+        if count == 0 {
+            width, height = w, h
+        }
+        header := make([]byte, 12)
+        binary.LittleEndian.PutUint32(header[0:], uint32(len(data)))
+        binary.LittleEndian.PutUint64(header[4:], uint64(count))
+        body = append(body, header...)
+        body = append(body, data...)
+        count++
+    }
+    if count == 0 {
+        return nil, errors.New("no decodable frames")
+    }
+    header := make([]byte, 32)
+    copy(header[0:], "DKIF")
+    binary.LittleEndian.PutUint16(header[6:], 32)
+    copy(header[8:], "VP80")
+    binary.LittleEndian.PutUint16(header[12:], uint16(width))
+    binary.LittleEndian.PutUint16(header[14:], uint16(height))
+    binary.LittleEndian.PutUint32(header[16:], uint32(timelapseFPS()))
+    binary.LittleEndian.PutUint32(header[20:], 1)
+    binary.LittleEndian.PutUint32(header[24:], uint32(count))
+    return append(header, body...), nil
+}
+
+func timelapseFPS() int {
+    if timelapseConfig.FPS <= 0 {
+        return 10
+    }
+    return timelapseConfig.FPS
+}
+
+// errH264DecoderUnavailable - кадры H.264 нечем перекодировать в JPEG (нет ffmpeg)
+var errH264DecoderUnavailable = errors.New("H.264 frames cannot be exported as images: ffmpeg is not available")
+
+// Предельное время декодирования одного кадра H.264
+const timelapseDecodeTimeout = 10 * time.Second
+
+// timelapseH264Decoder возвращает путь к ffmpeg, если среди кадров есть H.264;
+// без ffmpeg такие кадры в архив не выгрузить
+func timelapseH264Decoder(frames []timelapseFrame) (string, error) {
+    for _, f := range frames {
+        if f.codec == "h264" {
+            path, err := exec.LookPath(timelapseConfig.FFmpeg)
+            if err != nil {
+                return "", errH264DecoderUnavailable
+            }
+            return path, nil
+        }
+    }
+    return "", nil
+}
+
+// writeTimelapseZip пишет архив кадров в JPEG: VP8 декодируется на месте, H.264 - через ffmpeg
+// (путь из timelapseH264Decoder). Кадры, которые не удалось декодировать, пропускаются
+func writeTimelapseZip(w *zip.Writer, frames []timelapseFrame, ffmpeg string) error {
+    for _, f := range frames {
+        data, err := os.ReadFile(f.path)
+        if err != nil {
+            return err
+        }
+        var jpg []byte
+        if f.codec == "vp8" {
+            jpg, err = vp8ToJPEG(data)
+        } else {
+            jpg, err = h264ToJPEG(ffmpeg, data)
+        }
+        if err != nil {
+            log.Printf("Timelapse: skipping undecodable frame %s: %v", f.path, err)
+            continue
+        }
+        name := f.at.Format("20060102T150405.000Z") + ".jpg"
+        entry, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: f.at})
+        if err != nil {
+            return err
+        }
+        if _, err := entry.Write(jpg); err != nil {
+            return err
+        }
+    }
+    return w.Close()
+}
+
+// vp8ToJPEG декодирует ключевой кадр VP8 в JPEG
+func vp8ToJPEG(frame []byte) ([]byte, error) {
+    d := vp8.NewDecoder()
+    d.Init(bytes.NewReader(frame), len(frame))
+    if _, err := d.DecodeFrameHeader(); err != nil {
+        return nil, err
+    }
+    img, err := d.DecodeFrame()
+    if err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// h264ToJPEG декодирует ключевой кадр H.264 (Annex-B с SPS/PPS) в JPEG через ffmpeg
+func h264ToJPEG(ffmpeg string, frame []byte) ([]byte, error) {
+    if ffmpeg == "" {
+        return nil, errH264DecoderUnavailable
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), timelapseDecodeTimeout)
+    defer cancel()
+    cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-loglevel", "error",
+        "-f", "h264", "-i", "pipe:0", "-frames:v", "1", "-q:v", "3", "-f", "image2pipe", "-c:v", "mjpeg", "pipe:1")
+    var out, stderr bytes.Buffer
+    cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(frame), &out, &stderr
+    if err := cmd.Run(); err != nil {
+        return nil, fmt.Errorf("ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+    }
+    if out.Len() == 0 {
+        return nil, errors.New("ffmpeg produced no image")
+    }
+    return out.Bytes(), nil
+}
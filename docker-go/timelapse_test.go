@@ -0,0 +1,49 @@
+package main
+
+import (
+    "archive/zip"
+    "bytes"
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestTimelapseH264Decoder(t *testing.T) {
+    saved := timelapseConfig.FFmpeg
+    defer func() { timelapseConfig.FFmpeg = saved }()
+    timelapseConfig.FFmpeg = filepath.Join(t.TempDir(), "no-ffmpeg")
+
+    vp8Only := []timelapseFrame{{codec: "vp8"}, {codec: "vp8"}}
+    if path, err := timelapseH264Decoder(vp8Only); err != nil || path != "" {
+        t.Fatalf("timelapseH264Decoder(vp8) = %q, %v, want no decoder needed", path, err)
+    }
+    mixed := []timelapseFrame{{codec: "vp8"}, {codec: "h264"}}
+    if _, err := timelapseH264Decoder(mixed); !errors.Is(err, errH264DecoderUnavailable) {
+        t.Fatalf("timelapseH264Decoder(h264) error = %v, want %v", err, errH264DecoderUnavailable)
+    }
+}
+
+func TestWriteTimelapseZipSkipsUndecodableFrames(t *testing.T) {
+    dir := t.TempDir()
+    at := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+    path := filepath.Join(dir, "frame.h264")
+    if err := os.WriteFile(path, []byte{0, 0, 0, 1, 0x65, 0x88}, 0o644); err != nil {
+        t.Fatal(err)
+    }
+    frames := []timelapseFrame{{path: path, at: at, codec: "h264"}}
+
+    var buf bytes.Buffer
+    if err := writeTimelapseZip(zip.NewWriter(&buf), frames, ""); err != nil {
+        t.Fatalf("writeTimelapseZip() error = %v", err)
+    }
+    archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+    if err != nil {
+        t.Fatalf("zip.NewReader() error = %v", err)
+    }
+    // Сырые кадры H.264 в архив не попадают: без декодера кадр пропускается
+    if len(archive.File) != 0 {
+        t.Fatalf("archive has %d files, want 0", len(archive.File))
+    }
+}
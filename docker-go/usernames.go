@@ -0,0 +1,138 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "log"
+)
+
+// Политика повторяющихся имен в комнате (DUPLICATE_USERNAME_POLICY):
+//   takeover - новое соединение занимает место старого, старому отправляется force_disconnect (по умолчанию);
+//   reject   - новое соединение с занятым именем отклоняется;
+//   suffix   - новому соединению выдается свободное имя вида name-2, name-3 и т.д.
+// Имя выбирается в цикле комнаты до создания PeerConnection (reserveUsername) и закрепляется
+// за входящим соединением, поэтому пир, его очередь отправки и обработчики создаются уже
+// с окончательным именем. Политика учитывает пиров других узлов.
+// Выход пира, место которого уже занято тезкой, не трогает запись тезки в общем реестре.
+
+const (
+    duplicateTakeover = "takeover"
+    duplicateReject   = "reject"
+    duplicateSuffix   = "suffix"
+)
+
+var duplicateUsernamePolicy = loadDuplicateUsernamePolicy()
+
+func loadDuplicateUsernamePolicy() string {
+    policy := envString("DUPLICATE_USERNAME_POLICY", duplicateTakeover)
+    switch policy {
+    case duplicateTakeover, duplicateReject, duplicateSuffix:
+        return policy
+    }
+    log.Printf("Unknown DUPLICATE_USERNAME_POLICY %q (expected takeover, reject or suffix), using %s", policy, duplicateTakeover)
+    return duplicateTakeover
+}
+
+// Сколько вариантов имени перебирает политика suffix
+const maxUsernameSuffix = 100
+
+var (
+    errUsernameTaken = errors.New("Username is already taken in this room")
+
+    duplicateUsernamesTotal = newCounterVec("webrtc_duplicate_usernames_total",
+        "Joins with a username already present in the room, by policy applied.", "policy")
+)
+
+// usernameTaken сообщает, занято ли имя в комнате локальным пиром или пиром другого узла.
+// Вызывается в цикле комнаты.
+func usernameTaken(a *roomActor, username string) (local *Peer, remote *roomMember) {
+    if p := a.members[username]; p != nil {
+        return p, nil
+    }
+    for _, m := range roomState.RemoteMembers(a.name) {
+        if m.Username == username {
+            return nil, &m
+        }
+    }
+    return nil, nil
+}
+
+// usernameFree сообщает, свободно ли имя: его нет в комнате и оно не закреплено за другим входящим соединением.
+// Вызывается в цикле комнаты.
+func usernameFree(a *roomActor, username, sessionID string) bool {
+    if owner, ok := a.reserved[username]; ok && owner != sessionID {
+        return false
+    }
+    local, remote := usernameTaken(a, username)
+    return local == nil && remote == nil
+}
+
+// reserveUsername выбирает имя входящего соединения по политике и закрепляет его до admitPeer.
+// Вызывается в цикле комнаты; резерв снимает admitPeer или releaseUsername.
+func reserveUsername(a *roomActor, username, sessionID string) (string, error) {
+    if duplicateUsernamePolicy != duplicateTakeover && !usernameFree(a, username, sessionID) {
+        duplicateUsernamesTotal.inc(duplicateUsernamePolicy)
+        if duplicateUsernamePolicy == duplicateReject {
+            log.Printf("Rejecting %s in room %s: username is already taken", username, a.name)
+            return "", errUsernameTaken
+        }
+        candidate := ""
+        for i := 2; i <= maxUsernameSuffix && candidate == ""; i++ {
+            if name := fmt.Sprintf("%s-%d", username, i); usernameFree(a, name, sessionID) {
+                candidate = name
+            }
+        }
+        if candidate == "" {
+            return "", errUsernameTaken
+        }
+        log.Printf("Username %s is taken in room %s, joining as %s", username, a.name, candidate)
+        username = candidate
+    }
+    a.reserved[username] = sessionID
+    return username, nil
+}
+
+// releaseUsername снимает резерв имени, если он принадлежит этому соединению. Вызывается в цикле комнаты.
+func releaseUsername(a *roomActor, username, sessionID string) {
+    if owner, ok := a.reserved[username]; !ok || owner != sessionID {
+        return
+    }
+    delete(a.reserved, username)
+    if len(a.members) == 0 && len(a.reserved) == 0 {
+        a.after(roomIdleGrace, a.stopIfIdle)
+    }
+}
+
+// resolveDuplicateUsername снимает резерв имени и применяет политику, если имя все же занято
+// (тезка вошел на другом узле после резерва или политика takeover). Вызывается в цикле комнаты
+// до добавления пира; имя пира не меняется.
+func resolveDuplicateUsername(a *roomActor, peer *Peer) error {
+    releaseUsername(a, peer.username, peer.sessionID)
+    local, remote := usernameTaken(a, peer.username)
+    if local == nil && remote == nil {
+        return nil
+    }
+
+    if duplicateUsernamePolicy != duplicateTakeover {
+        log.Printf("Rejecting %s in room %s: username was taken while joining", peer.username, a.name)
+        return errUsernameTaken
+    }
+    duplicateUsernamesTotal.inc(duplicateUsernamePolicy)
+    if local != nil {
+        log.Printf("New session %s of %s takes over session %s in room %s", peer.sessionID, peer.username, local.sessionID, a.name)
+        a.removeMember(local)
+        _ = local.writeJSON(map[string]interface{}{
+            "type": "force_disconnect",
+            "data": "Your session was taken over by a new connection",
+        })
+        go closePeerResources(local, "Taken over by new session")
+        return nil
+    }
+    log.Printf("New session %s of %s takes over the session on node %s in room %s", peer.sessionID, peer.username, remote.Node, a.name)
+    go func(m roomMember) {
+        if err := roomState.Relay(m, relayEnvelope{Kind: relayTakeover, Room: m.Room, To: m.Username, From: peer.sessionID}); err != nil {
+            log.Printf("Error taking over session of %s on node %s: %v", m.Username, m.Node, err)
+        }
+    }(*remote)
+    return nil
+}
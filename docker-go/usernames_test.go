@@ -0,0 +1,190 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// testBackend - реестр комнат с пирами "других узлов" для тестов
+type testBackend struct {
+    memoryBackend
+    remote []roomMember
+
+    mu      sync.Mutex
+    relayed []relayEnvelope
+}
+
+func (b *testBackend) RemoteMembers(room string) []roomMember {
+    var members []roomMember
+    for _, m := range b.remote {
+        if m.Room == room {
+            members = append(members, m)
+        }
+    }
+    return members
+}
+
+func (b *testBackend) Relay(to roomMember, env relayEnvelope) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.relayed = append(b.relayed, env)
+    return nil
+}
+
+func (b *testBackend) Broadcast(env relayEnvelope) error {
+    return b.Relay(roomMember{}, env)
+}
+
+func (b *testBackend) relays() []relayEnvelope {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return append([]relayEnvelope(nil), b.relayed...)
+}
+
+// withUsernamePolicy задает политику и реестр на время теста
+func withUsernamePolicy(t *testing.T, policy string, backend roomBackend) {
+    t.Helper()
+    savedPolicy, savedState := duplicateUsernamePolicy, roomState
+    duplicateUsernamePolicy, roomState = policy, backend
+    t.Cleanup(func() { duplicateUsernamePolicy, roomState = savedPolicy, savedState })
+}
+
+func TestReserveUsername(t *testing.T) {
+    tests := []struct {
+        name     string
+        policy   string
+        local    []string // пиры комнаты на этом узле
+        reserved []string // имена, закрепленные за другими входящими соединениями
+        remote   []string // пиры комнаты на других узлах
+        want     string
+        wantErr  error
+    }{
+        {name: "free name", policy: duplicateReject, want: "bob"},
+        {name: "takeover keeps the name", policy: duplicateTakeover, local: []string{"bob"}, reserved: []string{"bob"}, want: "bob"},
+        {name: "reject local", policy: duplicateReject, local: []string{"bob"}, wantErr: errUsernameTaken},
+        {name: "reject reserved", policy: duplicateReject, reserved: []string{"bob"}, wantErr: errUsernameTaken},
+        {name: "reject remote", policy: duplicateReject, remote: []string{"bob"}, wantErr: errUsernameTaken},
+        {name: "suffix", policy: duplicateSuffix, local: []string{"bob"}, want: "bob-2"},
+        {name: "suffix skips taken candidates", policy: duplicateSuffix, local: []string{"bob", "bob-2"}, reserved: []string{"bob-3"}, remote: []string{"bob-4"}, want: "bob-5"},
+        {name: "suffix exhausted", policy: duplicateSuffix, local: usernameRange("bob", maxUsernameSuffix), wantErr: errUsernameTaken},
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            room := fmt.Sprintf("reserve-%d", i)
+            backend := &testBackend{}
+            for _, name := range tt.remote {
+                backend.remote = append(backend.remote, roomMember{Node: "node-b", Room: room, Username: name})
+            }
+            withUsernamePolicy(t, tt.policy, backend)
+
+            var got string
+            var err error
+            a := rooms.call(room, func(a *roomActor) {
+                for _, name := range tt.local {
+                    a.addMember(&Peer{username: name})
+                }
+                for _, name := range tt.reserved {
+                    a.reserved[name] = "other-session"
+                }
+                got, err = reserveUsername(a, "bob", "session-1")
+            })
+            if err != tt.wantErr || got != tt.want {
+                t.Fatalf("reserveUsername() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+            }
+            if err == nil {
+                a.call(func() {
+                    if owner := a.reserved[got]; owner != "session-1" {
+                        t.Errorf("name %s is reserved by %q, want session-1", got, owner)
+                    }
+                })
+            }
+        })
+    }
+}
+
+// usernameRange возвращает name, name-2 ... name-n
+func usernameRange(name string, n int) []string {
+    names := []string{name}
+    for i := 2; i <= n; i++ {
+        names = append(names, fmt.Sprintf("%s-%d", name, i))
+    }
+    return names
+}
+
+func TestReleaseUsername(t *testing.T) {
+    a := rooms.open("release")
+    a.call(func() {
+        a.reserved["bob"] = "session-2"
+        releaseUsername(a, "bob", "session-1") // чужой резерв не снимается
+        if a.reserved["bob"] != "session-2" {
+            t.Fatal("release removed a reservation of another session")
+        }
+        releaseUsername(a, "bob", "session-2")
+        if _, ok := a.reserved["bob"]; ok {
+            t.Fatal("release kept the reservation")
+        }
+    })
+}
+
+func TestResolveDuplicateUsername(t *testing.T) {
+    tests := []struct {
+        name        string
+        policy      string
+        local       bool // имя занято пиром этого узла
+        remote      bool // имя занято пиром другого узла
+        wantErr     error
+        wantRemoved bool // прежний локальный пир удален из комнаты
+        wantRelay   bool // пиру другого узла отправлен takeover
+    }{
+        {name: "free name", policy: duplicateTakeover},
+        {name: "takeover local", policy: duplicateTakeover, local: true, wantRemoved: true},
+        {name: "takeover remote", policy: duplicateTakeover, remote: true, wantRelay: true},
+        {name: "reject after reservation", policy: duplicateReject, remote: true, wantErr: errUsernameTaken},
+        {name: "suffix after reservation", policy: duplicateSuffix, local: true, wantErr: errUsernameTaken},
+    }
+    for i, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            room := fmt.Sprintf("resolve-%d", i)
+            backend := &testBackend{}
+            if tt.remote {
+                backend.remote = []roomMember{{Node: "node-b", Room: room, Username: "bob"}}
+            }
+            withUsernamePolicy(t, tt.policy, backend)
+
+            old := &Peer{username: "bob", room: room, sessionID: "old-session"}
+            peer := &Peer{username: "bob", room: room, sessionID: "new-session"}
+            var err error
+            a := rooms.call(room, func(a *roomActor) {
+                if tt.local {
+                    a.addMember(old)
+                }
+                a.reserved["bob"] = peer.sessionID
+                err = resolveDuplicateUsername(a, peer)
+            })
+            if err != tt.wantErr {
+                t.Fatalf("resolveDuplicateUsername() = %v, want %v", err, tt.wantErr)
+            }
+            a.call(func() {
+                if _, ok := a.reserved["bob"]; ok {
+                    t.Error("reservation was not released")
+                }
+                if removed := tt.local && a.members["bob"] != old; removed != tt.wantRemoved {
+                    t.Errorf("old peer removed = %v, want %v", removed, tt.wantRemoved)
+                }
+            })
+            deadline := time.Now().Add(2 * time.Second)
+            for tt.wantRelay && len(backend.relays()) == 0 && time.Now().Before(deadline) {
+                time.Sleep(5 * time.Millisecond)
+            }
+            relays := backend.relays()
+            if (len(relays) > 0) != tt.wantRelay {
+                t.Fatalf("relayed %v, want relay %v", relays, tt.wantRelay)
+            }
+            if tt.wantRelay && (relays[0].Kind != relayTakeover || relays[0].To != "bob" || relays[0].From != "new-session") {
+                t.Errorf("relay = %+v, want takeover of bob from new-session", relays[0])
+            }
+        })
+    }
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+    "log"
+    "sync"
+    "time"
+)
+
+// Контроль поступления видео ведущего. Доказательство того, что видео идет:
+// RTP видеотрека ведущего, принятый сервером, или сообщение ведомого о показанных кадрах
+// ({"type":"video_frame"}: после первого кадра и затем периодически; нужно ведомым P2P,
+// чье видео сервер не видит). Переходы состояния рассылаются пирам комнаты событиями
+// video_active, video_stalled и video_resumed.
+
+// videoFlowSettings - настройки контроля видео, задаются переменными окружения
+type videoFlowSettings struct {
+    StartTimeout time.Duration // сколько ждать первого кадра, когда видео уже кому-то нужно
+    StallTimeout time.Duration // сколько без кадров считать остановкой
+}
+
+var videoFlowConfig = videoFlowSettings{
+    StartTimeout: envDuration("VIDEO_START_TIMEOUT", 10*time.Second),
+    StallTimeout: envDuration("VIDEO_STALL_TIMEOUT", 3*time.Second),
+}
+
+// Состояния видео комнаты
+const (
+    videoFlowWaiting = "waiting"
+    videoFlowActive  = "active"
+    videoFlowStalled = "stalled"
+)
+
+var (
+    videoStallSeconds = newHistogramVec("webrtc_video_stall_seconds", "Duration of leader video stalls.",
+        []float64{1, 2, 5, 10, 30, 60, 120, 300, 600}, "room")
+    videoStallsTotal = newCounterVec("webrtc_video_stalls_total", "Leader video stalls.", "room")
+)
+
+// videoFlow - состояние видео ведущего комнаты
+type videoFlow struct {
+    leader      *Peer
+    state       string
+    lastSeen    time.Time // последнее доказательство, что видео идет
+    source      string    // rtp или follower:<имя>
+    stalledAt   time.Time
+    neededSince time.Time // с какого момента видео кому-то нужно (ведомый или публикация на сервер)
+    warned      bool      // ведущему уже сообщено, что видео так и не пришло
+
+    // Восстановление остановившегося видео (recovery.go)
+    recoveryStep   int // номер выполняемого шага, 0 - восстановление не начиналось
+    stepStarted    time.Time
+    recoveryFailed bool
+}
+
+// pendingRoomEvent - событие, которое рассылается после снятия videoFlowMu
+type pendingRoomEvent struct {
+    eventType string
+    data      map[string]interface{}
+}
+
+var (
+    videoFlows  = make(map[string]*videoFlow)
+    videoFlowMu sync.Mutex
+)
+
+func init() {
+    newGaugeFunc("webrtc_video_stalled_rooms", "Rooms whose leader video is stalled.", func() float64 {
+        videoFlowMu.Lock()
+        defer videoFlowMu.Unlock()
+        stalled := 0
+        for _, f := range videoFlows {
+            if f.state == videoFlowStalled {
+                stalled++
+            }
+        }
+        return float64(stalled)
+    })
+}
+
+// trackVideoFlow начинает контроль видео нового ведущего
+func trackVideoFlow(leader *Peer) {
+    videoFlowMu.Lock()
+    videoFlows[leader.room] = &videoFlow{leader: leader, state: videoFlowWaiting}
+    videoFlowMu.Unlock()
+}
+
+// dropVideoFlow прекращает контроль, когда ведущий уходит
+func dropVideoFlow(leader *Peer) {
+    videoFlowMu.Lock()
+    defer videoFlowMu.Unlock()
+    if f := videoFlows[leader.room]; f != nil && f.leader == leader {
+        delete(videoFlows, leader.room)
+        videoStallsTotal.forget(0, leader.room)
+        videoStallSeconds.forget(0, leader.room)
+    }
+}
+
+// videoFlowState возвращает состояние видео комнаты (пусто, если ведущего нет)
+func videoFlowState(room string) string {
+    videoFlowMu.Lock()
+    defer videoFlowMu.Unlock()
+    if f := videoFlows[room]; f != nil {
+        return f.state
+    }
+    return ""
+}
+
+// handleVideoFrame принимает сообщение ведомого о показанных кадрах
+func handleVideoFrame(peer *Peer) {
+    if peer.isLeader {
+        return
+    }
+    now := time.Now()
+    videoFlowMu.Lock()
+    f := videoFlows[peer.room]
+    var events []pendingRoomEvent
+    var action func()
+    if f != nil {
+        f.lastSeen = now
+        f.source = "follower:" + peer.username
+        events, action = f.evaluate(peer.room, now, true)
+    }
+    videoFlowMu.Unlock()
+    dispatchVideoFlow(peer.room, events, action)
+}
+
+// dispatchVideoFlow рассылает события и выполняет действие восстановления вне videoFlowMu
+func dispatchVideoFlow(room string, events []pendingRoomEvent, action func()) {
+    for _, e := range events {
+        emitRoomEvent(room, e.eventType, e.data)
+    }
+    if action != nil {
+        action()
+    }
+}
+
+// evaluate переводит состояние по последнему доказательству и возвращает события для рассылки
+// и действие восстановления. needed - видео кому-то нужно. Вызывается под videoFlowMu.
+func (f *videoFlow) evaluate(room string, now time.Time, needed bool) ([]pendingRoomEvent, func()) {
+    if !needed {
+        // Смотреть некому: ждем следующего зрителя без событий
+        f.state, f.lastSeen, f.source, f.neededSince, f.warned = videoFlowWaiting, time.Time{}, "", time.Time{}, false
+        f.recoveryStep, f.recoveryFailed = 0, false
+        return nil, nil
+    }
+    if f.neededSince.IsZero() {
+        f.neededSince = now
+    }
+    switch f.state {
+    case videoFlowWaiting:
+        if !f.lastSeen.IsZero() {
+            f.state = videoFlowActive
+            log.Printf("Video of leader %s in room %s is active (source: %s)", f.leader.username, room, f.source)
+            return []pendingRoomEvent{{"video_active", map[string]interface{}{
+                "source":   f.source,
+                "waitedMs": now.Sub(f.neededSince).Milliseconds(),
+            }}}, nil
+        }
+        if !f.warned && videoFlowConfig.StartTimeout > 0 && now.Sub(f.neededSince) > videoFlowConfig.StartTimeout {
+            f.warned = true
+            log.Printf("No video received from leader %s in room %s after %s", f.leader.username, room, videoFlowConfig.StartTimeout)
+            go func(leader *Peer) {
+                _ = leader.writeJSON(map[string]interface{}{
+                    "type": "error",
+                    "data": "No video track detected. Please ensure camera is active.",
+                })
+            }(f.leader)
+        }
+    case videoFlowActive:
+        if now.Sub(f.lastSeen) > videoFlowConfig.StallTimeout {
+            f.state = videoFlowStalled
+            f.stalledAt = f.lastSeen
+            videoStallsTotal.inc(room)
+            log.Printf("Video of leader %s in room %s stalled (last media %s ago, source: %s)",
+                f.leader.username, room, now.Sub(f.lastSeen).Round(time.Millisecond), f.source)
+            events := []pendingRoomEvent{{"video_stalled", map[string]interface{}{
+                "source":      f.source,
+                "lastMediaAt": f.lastSeen.UTC(),
+            }}}
+            recoveryEvents, action := f.advanceRecovery(room, now)
+            return append(events, recoveryEvents...), action
+        }
+    case videoFlowStalled:
+        if f.lastSeen.After(f.stalledAt) {
+            f.state = videoFlowActive
+            stalled := f.lastSeen.Sub(f.stalledAt)
+            videoStallSeconds.observe(stalled.Seconds(), room)
+            log.Printf("Video of leader %s in room %s resumed after %s (source: %s)",
+                f.leader.username, room, stalled.Round(time.Millisecond), f.source)
+            events := []pendingRoomEvent{{"video_resumed", map[string]interface{}{
+                "source":    f.source,
+                "stalledMs": stalled.Milliseconds(),
+            }}}
+            return append(events, f.finishRecovery(room, now)...), nil
+        }
+        return f.advanceRecovery(room, now)
+    }
+    return nil, nil
+}
+
+// startVideoFlowMonitor периодически сверяет состояние видео комнат с RTP, принятым сервером
+func startVideoFlowMonitor() {
+    if videoFlowConfig.StallTimeout <= 0 {
+        log.Printf("Video flow monitoring is disabled")
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(500 * time.Millisecond)
+        defer ticker.Stop()
+        for now := range ticker.C {
+            checkVideoFlows(now)
+        }
+    }()
+}
+
+func checkVideoFlows(now time.Time) {
+    // Видео нужно, если в комнате есть ведомый или ведущий публикует медиа на сервер
+    followers := make(map[string]bool)
+    for room, roomPeers := range activeRooms() {
+        for _, p := range roomPeers {
+            if !p.isLeader {
+                followers[room] = true
+                break
+            }
+        }
+    }
+
+    videoFlowMu.Lock()
+    roomNames := make([]string, 0, len(videoFlows))
+    for room := range videoFlows {
+        roomNames = append(roomNames, room)
+    }
+    videoFlowMu.Unlock()
+
+    for _, room := range roomNames {
+        rm := getRoomMedia(room)
+        var lastRTP time.Time
+        if rm != nil {
+            lastRTP = rm.lastVideoAt()
+        }
+
+        videoFlowMu.Lock()
+        f := videoFlows[room]
+        if f == nil {
+            videoFlowMu.Unlock()
+            continue
+        }
+        if rm != nil && rm.leader != f.leader {
+            lastRTP = time.Time{}
+        }
+        if lastRTP.After(f.lastSeen) {
+            f.lastSeen = lastRTP
+            f.source = "rtp"
+        }
+        events, action := f.evaluate(room, now, followers[room] || rm != nil)
+        videoFlowMu.Unlock()
+        dispatchVideoFlow(room, events, action)
+    }
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    "github.com/pion/rtp"
+)
+
+// Режимы просмотра ведомого: full - полное видео, audio - только звук,
+// slideshow - только ключевые кадры (для слабых каналов)
+const (
+    viewModeFull      = "full"
+    viewModeAudio     = "audio"
+    viewModeSlideshow = "slideshow"
+)
+
+// Период запроса ключевых кадров для ведомых sfu в режиме slideshow
+var slideshowInterval = envDuration("SLIDESHOW_INTERVAL", 3*time.Second)
+
+// normalizeViewMode проверяет режим просмотра; пустой режим означает full
+func normalizeViewMode(mode string) (string, error) {
+    switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+    case "":
+        return viewModeFull, nil
+    case viewModeFull, viewModeAudio, viewModeSlideshow:
+        return mode, nil
+    }
+    return "", fmt.Errorf("unknown view mode %q", mode)
+}
+
+// videoGate отбирает видеопакеты для ведомого sfu по режиму просмотра.
+// Отброшенные пакеты вычитаются из нумерации, чтобы ведомый не запрашивал их через NACK.
+type videoGate struct {
+    mode         string
+    needKeyframe bool   // после audio/slideshow полное видео возобновляется с ключевого кадра
+    keyframeTS   uint32 // метка времени пересылаемого ключевого кадра (slideshow)
+    inKeyframe   bool
+    dropped      uint16
+}
+
+// pass сообщает, пересылать ли пакет, и исправляет его номер с учетом отброшенных
+func (g *videoGate) pass(mimeType string, pkt *rtp.Packet) bool {
+    keyframeStart := isKeyframeStart(mimeType, pkt.Payload)
+    forward := false
+    switch g.mode {
+    case viewModeAudio:
+    case viewModeSlideshow:
+        if keyframeStart {
+            g.keyframeTS = pkt.Timestamp
+            g.inKeyframe = true
+        }
+        forward = g.inKeyframe && pkt.Timestamp == g.keyframeTS
+        if !forward {
+            g.inKeyframe = false
+        }
+    default:
+        if g.needKeyframe && keyframeStart {
+            g.needKeyframe = false
+        }
+        forward = !g.needKeyframe
+    }
+    if !forward {
+        g.dropped++
+        return false
+    }
+    pkt.SequenceNumber -= g.dropped
+    return true
+}
+
+// setViewMode меняет режим просмотра ведомого sfu
+func (s *sfuSubscriber) setViewMode(mode string) {
+    s.mu.Lock()
+    previous := s.gate.mode
+    s.gate.mode = mode
+    if mode == viewModeFull && previous != viewModeFull {
+        s.gate.needKeyframe = true
+    }
+    s.mu.Unlock()
+    if mode != viewModeAudio && mode != previous {
+        requestRoomKeyframe(s.peer.room, fmt.Sprintf("sfu follower %s switched to %s view", s.peer.username, mode), false)
+    }
+}
+
+// handleSetViewMode меняет режим просмотра ведомого ({"type":"set_view_mode","viewMode":"audio"}).
+// Ведомому sfu сервер сам перестает пересылать видео; в P2P ведущий получает запрос renegotiate.
+func handleSetViewMode(peer *Peer, data map[string]interface{}) error {
+    if peer.isLeader {
+        return fmt.Errorf("view mode is only available to followers")
+    }
+    requested, _ := data["viewMode"].(string)
+    mode, err := normalizeViewMode(requested)
+    if err != nil {
+        return err
+    }
+
+    peer.mu.Lock()
+    previous := peer.viewMode
+    peer.viewMode = mode
+    peer.mu.Unlock()
+    leader := roomLeader(peer.room)
+    if previous == mode {
+        return peer.writeJSON(map[string]interface{}{"type": "view_mode_changed", "viewMode": mode})
+    }
+    log.Printf("Follower %s in room %s switched view mode from %s to %s", peer.username, peer.room, previous, mode)
+
+    if peer.mode == peerModeSFU {
+        for _, s := range roomSubscribers(peer.room) {
+            if s.peer == peer {
+                s.setViewMode(mode)
+                break
+            }
+        }
+    } else if leader != nil {
+        // В P2P медиа не проходит через сервер: ведущий пересогласует соединение с нужными треками
+        if err := leader.writeJSON(map[string]interface{}{
+            "type":     "renegotiate",
+            "room":     peer.room,
+            "follower": peer.username,
+            "viewMode": mode,
+        }); err != nil {
+            log.Printf("Error sending renegotiate to leader %s: %v", leader.username, err)
+        }
+    }
+
+    go sendRoomInfo(peer.room)
+    return peer.writeJSON(map[string]interface{}{"type": "view_mode_changed", "viewMode": mode})
+}
+
+// startSlideshowKeyframes периодически запрашивает ключевые кадры в комнатах,
+// где есть ведомые sfu в режиме slideshow (браузер ведущего сам шлет их редко)
+func startSlideshowKeyframes() {
+    if slideshowInterval <= 0 {
+        return
+    }
+    go func() {
+        ticker := time.NewTicker(slideshowInterval)
+        defer ticker.Stop()
+        for range ticker.C {
+            sfuSubscribersMu.Lock()
+            var subs []*sfuSubscriber
+            for _, roomSubs := range sfuSubscribers {
+                subs = append(subs, roomSubs...)
+            }
+            sfuSubscribersMu.Unlock()
+
+            requested := make(map[string]bool)
+            for _, s := range subs {
+                s.mu.Lock()
+                slideshow := s.gate.mode == viewModeSlideshow
+                s.mu.Unlock()
+                if slideshow && !requested[s.peer.room] {
+                    requested[s.peer.room] = true
+                    requestRoomKeyframe(s.peer.room, "slideshow viewers", false)
+                }
+            }
+        }
+    }()
+}
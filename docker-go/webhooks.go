@@ -0,0 +1,369 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Исходящие вебхуки о событиях комнат (например, уведомление в Telegram, когда робот в сети).
+// Адреса задаются по комнатам и арендаторам в файле WEBHOOKS_CONFIG:
+//
+//   {"endpoints": [
+//     {"url": "https://site/api/webhooks/camera", "secret": "s3cr3t", "tenant": "coins",
+//      "rooms": ["coins-*"], "events": ["leader_online", "leader_offline"]}
+//   ]}
+//
+// rooms - шаблоны path.Match имени комнаты (пусто - все комнаты), events - типы событий (пусто - все).
+// WEBHOOK_URL и WEBHOOK_SECRET добавляют адрес для всех комнат без файла.
+//
+// Запрос подписывается HMAC-SHA256 секрета адреса от "<X-Webhook-Timestamp>.<тело>":
+//   X-Webhook-Signature: sha256=<hex>
+// Неудачная доставка (сеть, 429, 5xx) повторяется с экспоненциальной задержкой; после последней
+// попытки или при другом ответе 4xx событие пишется в журнал недоставленных (JSON Lines).
+
+// Типы событий вебхуков
+const (
+    webhookLeaderOnline     = "leader_online"
+    webhookLeaderOffline    = "leader_offline"
+    webhookFollowerJoined   = "follower_joined"
+    webhookFollowerLeft     = "follower_left"
+    webhookFollowerReplaced = "follower_replaced"
+    webhookStreamStalled    = "stream_stalled"
+    webhookStreamResumed    = "stream_resumed"
+)
+
+// webhookSettings - настройки доставки вебхуков, задаются переменными окружения
+type webhookSettings struct {
+    ConfigFile     string
+    URL            string
+    Secret         string
+    Timeout        time.Duration
+    MaxAttempts    int
+    RetryBase      time.Duration
+    RetryMax       time.Duration
+    Workers        int
+    QueueSize      int
+    DeadLetterFile string
+}
+
+var webhookConfig = webhookSettings{
+    ConfigFile:     envString("WEBHOOKS_CONFIG", ""),
+    URL:            envString("WEBHOOK_URL", ""),
+    Secret:         envString("WEBHOOK_SECRET", ""),
+    Timeout:        envDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+    MaxAttempts:    envInt("WEBHOOK_MAX_ATTEMPTS", 6),
+    RetryBase:      envDuration("WEBHOOK_RETRY_BASE", time.Second),
+    RetryMax:       envDuration("WEBHOOK_RETRY_MAX", 5*time.Minute),
+    Workers:        envInt("WEBHOOK_WORKERS", 4),
+    QueueSize:      envInt("WEBHOOK_QUEUE", 1000),
+    DeadLetterFile: envString("WEBHOOK_DEAD_LETTER_FILE", "webhooks-dead-letter.jsonl"),
+}
+
+// webhookEndpoint - адрес вебхуков комнаты или арендатора
+type webhookEndpoint struct {
+    URL    string   `json:"url"`
+    Secret string   `json:"secret"`
+    Tenant string   `json:"tenant,omitempty"`
+    Rooms  []string `json:"rooms,omitempty"`
+    Events []string `json:"events,omitempty"`
+}
+
+func (e *webhookEndpoint) matches(eventType, room string) bool {
+    if len(e.Events) > 0 && !contains(e.Events, eventType) {
+        return false
+    }
+    if len(e.Rooms) == 0 {
+        return true
+    }
+    for _, pattern := range e.Rooms {
+        if ok, _ := path.Match(pattern, room); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// webhookPayload - тело запроса вебхука
+type webhookPayload struct {
+    ID        string                 `json:"id"`
+    Event     string                 `json:"event"`
+    Room      string                 `json:"room"`
+    Tenant    string                 `json:"tenant,omitempty"`
+    Username  string                 `json:"username,omitempty"`
+    Timestamp time.Time              `json:"timestamp"`
+    Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// webhookDelivery - доставка события на один адрес
+type webhookDelivery struct {
+    endpoint  *webhookEndpoint
+    payload   webhookPayload
+    body      []byte
+    attempt   int
+    lastError string
+}
+
+var (
+    webhookEndpoints []*webhookEndpoint
+    webhookQueue     chan *webhookDelivery
+    webhookClient    = &http.Client{}
+    deadLetterMu     sync.Mutex
+
+    webhookDeliveriesTotal = newCounterVec("webrtc_webhook_deliveries_total",
+        "Webhook delivery attempts by result (delivered, retry or dead_letter).", "event", "result")
+)
+
+// loadWebhookEndpoints читает адреса из WEBHOOKS_CONFIG и WEBHOOK_URL
+func loadWebhookEndpoints(cfg webhookSettings) ([]*webhookEndpoint, error) {
+    var endpoints []*webhookEndpoint
+    if cfg.ConfigFile != "" {
+        data, err := os.ReadFile(cfg.ConfigFile)
+        if err != nil {
+            return nil, err
+        }
+        var file struct {
+            Endpoints []*webhookEndpoint `json:"endpoints"`
+        }
+        if err := json.Unmarshal(data, &file); err != nil {
+            return nil, fmt.Errorf("%s: %w", cfg.ConfigFile, err)
+        }
+        endpoints = file.Endpoints
+    }
+    if cfg.URL != "" {
+        endpoints = append(endpoints, &webhookEndpoint{URL: cfg.URL, Secret: cfg.Secret})
+    }
+    for i, e := range endpoints {
+        if e.URL == "" {
+            return nil, fmt.Errorf("webhook endpoint %d: url is required", i+1)
+        }
+        for _, pattern := range e.Rooms {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return nil, fmt.Errorf("webhook endpoint %s: invalid room pattern %q", e.URL, pattern)
+            }
+        }
+        if e.Secret == "" {
+            log.Printf("Webhook endpoint %s has no secret: requests will not be signed", e.URL)
+        }
+    }
+    return endpoints, nil
+}
+
+// startWebhooks загружает адреса и запускает обработчики доставки
+func startWebhooks() {
+    endpoints, err := loadWebhookEndpoints(webhookConfig)
+    if err != nil {
+        log.Printf("Webhooks disabled: %v", err)
+        return
+    }
+    if len(endpoints) == 0 {
+        return
+    }
+    webhookClient.Timeout = webhookConfig.Timeout
+    queueSize, workers := webhookConfig.QueueSize, webhookConfig.Workers
+    if queueSize <= 0 {
+        queueSize = 1000
+    }
+    if workers <= 0 {
+        workers = 1
+    }
+    webhookQueue = make(chan *webhookDelivery, queueSize)
+    webhookEndpoints = endpoints
+    for i := 0; i < workers; i++ {
+        go webhookWorker()
+    }
+    log.Printf("Webhooks: %d endpoints, up to %d attempts, dead letters in %s", len(endpoints), webhookConfig.MaxAttempts, webhookConfig.DeadLetterFile)
+}
+
+// notifyWebhooks ставит событие в очередь для всех подходящих адресов; не блокирует вызывающего
+func notifyWebhooks(eventType, room, username string, data map[string]interface{}) {
+    if webhookQueue == nil {
+        return
+    }
+    now := time.Now().UTC()
+    for _, e := range webhookEndpoints {
+        if !e.matches(eventType, room) {
+            continue
+        }
+        id := make([]byte, 8)
+        _, _ = rand.Read(id)
+        payload := webhookPayload{ID: hex.EncodeToString(id), Event: eventType, Room: room, Tenant: e.Tenant,
+            Username: username, Timestamp: now, Data: data}
+        body, err := json.Marshal(payload)
+        if err != nil {
+            log.Printf("Webhook %s for room %s: failed to encode payload: %v", eventType, room, err)
+            continue
+        }
+        enqueueWebhook(&webhookDelivery{endpoint: e, payload: payload, body: body})
+    }
+}
+
+// notifyLifecycleWebhooks переводит событие жизненного цикла в события вебхуков
+func notifyLifecycleWebhooks(eventType, room, username string, data map[string]interface{}) {
+    isLeader, _ := data["isLeader"].(bool)
+    switch eventType {
+    case lifecyclePeerJoined:
+        if isLeader {
+            notifyWebhooks(webhookLeaderOnline, room, username, data)
+        } else {
+            notifyWebhooks(webhookFollowerJoined, room, username, data)
+        }
+    case lifecyclePeerLeft:
+        if !isLeader {
+            notifyWebhooks(webhookFollowerLeft, room, username, data)
+        }
+    case lifecycleLeaderOffline:
+        notifyWebhooks(webhookLeaderOffline, room, username, data)
+    case lifecycleFollowerReplaced:
+        notifyWebhooks(webhookFollowerReplaced, room, username, data)
+    }
+}
+
+// notifyRoomEventWebhooks переводит события комнаты (emitRoomEvent) в события вебхуков
+func notifyRoomEventWebhooks(eventType, room string, data map[string]interface{}) {
+    switch eventType {
+    case "video_stalled":
+        notifyWebhooks(webhookStreamStalled, room, "", data)
+    case "video_resumed":
+        notifyWebhooks(webhookStreamResumed, room, "", data)
+    }
+}
+
+func enqueueWebhook(d *webhookDelivery) {
+    select {
+    case webhookQueue <- d:
+    default:
+        d.lastError = "delivery queue is full"
+        deadLetterWebhook(d)
+    }
+}
+
+func webhookWorker() {
+    for d := range webhookQueue {
+        deliverWebhook(d)
+    }
+}
+
+// signWebhook возвращает подпись тела запроса
+func signWebhook(secret, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverWebhook выполняет одну попытку доставки и планирует повтор
+func deliverWebhook(d *webhookDelivery) {
+    d.attempt++
+    retryable, err := postWebhook(d)
+    if err == nil {
+        webhookDeliveriesTotal.inc(d.payload.Event, "delivered")
+        return
+    }
+    d.lastError = err.Error()
+    if !retryable || d.attempt >= webhookConfig.MaxAttempts {
+        deadLetterWebhook(d)
+        return
+    }
+    webhookDeliveriesTotal.inc(d.payload.Event, "retry")
+    delay := webhookRetryDelay(d.attempt)
+    log.Printf("Webhook %s for room %s to %s failed (attempt %d): %v; retrying in %s",
+        d.payload.Event, d.payload.Room, d.endpoint.URL, d.attempt, err, delay)
+    time.AfterFunc(delay, func() { enqueueWebhook(d) })
+}
+
+// webhookRetryDelay - экспоненциальная задержка перед повтором со случайной добавкой до 20%
+func webhookRetryDelay(attempt int) time.Duration {
+    delay := webhookConfig.RetryBase
+    for i := 1; i < attempt && delay < webhookConfig.RetryMax; i++ {
+        delay *= 2
+    }
+    if delay > webhookConfig.RetryMax {
+        delay = webhookConfig.RetryMax
+    }
+    jitter := make([]byte, 1)
+    _, _ = rand.Read(jitter)
+    return delay + delay*time.Duration(jitter[0])/(5*255)
+}
+
+// postWebhook отправляет запрос; retryable - стоит ли повторять при ошибке
+func postWebhook(d *webhookDelivery) (retryable bool, err error) {
+    req, err := http.NewRequest(http.MethodPost, d.endpoint.URL, bytes.NewReader(d.body))
+    if err != nil {
+        return false, err
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "webrtc-server-webhooks")
+    req.Header.Set("X-Webhook-ID", d.payload.ID)
+    req.Header.Set("X-Webhook-Event", d.payload.Event)
+    req.Header.Set("X-Webhook-Timestamp", timestamp)
+    req.Header.Set("X-Webhook-Attempt", strconv.Itoa(d.attempt))
+    if d.endpoint.Secret != "" {
+        req.Header.Set("X-Webhook-Signature", signWebhook(d.endpoint.Secret, timestamp, d.body))
+    }
+    resp, err := webhookClient.Do(req)
+    if err != nil {
+        return true, err
+    }
+    _, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    resp.Body.Close()
+    switch {
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        return false, nil
+    case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+        return true, fmt.Errorf("HTTP %d", resp.StatusCode)
+    default:
+        return false, fmt.Errorf("HTTP %d", resp.StatusCode)
+    }
+}
+
+// deadLetterEntry - строка журнала недоставленных вебхуков
+type deadLetterEntry struct {
+    URL       string         `json:"url"`
+    Tenant    string         `json:"tenant,omitempty"`
+    Attempts  int            `json:"attempts"`
+    LastError string         `json:"lastError"`
+    FailedAt  time.Time      `json:"failedAt"`
+    Payload   webhookPayload `json:"payload"`
+}
+
+// deadLetterWebhook пишет недоставленное событие в журнал
+func deadLetterWebhook(d *webhookDelivery) {
+    webhookDeliveriesTotal.inc(d.payload.Event, "dead_letter")
+    log.Printf("Webhook %s for room %s to %s dead-lettered after %d attempts: %s",
+        d.payload.Event, d.payload.Room, d.endpoint.URL, d.attempt, d.lastError)
+    line, err := json.Marshal(deadLetterEntry{URL: d.endpoint.URL, Tenant: d.endpoint.Tenant, Attempts: d.attempt,
+        LastError: d.lastError, FailedAt: time.Now().UTC(), Payload: d.payload})
+    if err != nil {
+        return
+    }
+    deadLetterMu.Lock()
+    defer deadLetterMu.Unlock()
+    if dir := filepath.Dir(webhookConfig.DeadLetterFile); dir != "." {
+        _ = os.MkdirAll(dir, 0o755)
+    }
+    f, err := os.OpenFile(webhookConfig.DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        log.Printf("Failed to write webhook dead letter: %v", err)
+        return
+    }
+    defer f.Close()
+    if _, err := f.Write(append(line, '\n')); err != nil {
+        log.Printf("Failed to write webhook dead letter: %v", err)
+    }
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Все исходящие сообщения пира (включая ping контроля живости) пишет в WebSocket одна горутина
+// peerWriter: gorilla/websocket допускает только одного пишущего. Отправители только ставят
+// сообщение в ограниченную очередь и никогда не ждут сеть.
+// При переполнении очереди сообщения, которые теряют смысл с задержкой (ICE-кандидаты, статистика,
+// clock_sync), отбрасываются; любое другое сообщение означает медленного получателя, и он отключается.
+
+var sendQueueSize = envInt("WS_SEND_QUEUE", 256)
+
+// Типы сообщений, которые можно отбросить при переполнении очереди
+var droppableMessageTypes = map[string]bool{
+    "ice_candidate":        true,
+    "server_ice_candidate": true,
+    "stats":                true,
+    "clock_sync":           true,
+}
+
+var (
+    errConnectionClosed = errors.New("connection is closed")
+    errSlowConsumer     = errors.New("outbound queue is full, slow consumer disconnected")
+
+    outboundDroppedTotal = newCounterVec("webrtc_ws_outbound_dropped_total",
+        "Outbound WebSocket messages dropped because the peer's send queue was full.", "type")
+    slowConsumersTotal = newCounterVec("webrtc_ws_slow_consumers_total",
+        "Peers disconnected because their WebSocket send queue overflowed.", "role")
+
+    // Очереди всех открытых соединений (для метрик глубины очереди)
+    peerWriters   = make(map[*peerWriter]struct{})
+    peerWritersMu sync.Mutex
+)
+
+func init() {
+    newGaugeFunc("webrtc_ws_send_queue_messages", "Messages waiting in WebSocket send queues of all peers.", func() float64 {
+        total, _ := sendQueueDepth()
+        return float64(total)
+    })
+    newGaugeFunc("webrtc_ws_send_queue_max", "Deepest WebSocket send queue among peers.", func() float64 {
+        _, deepest := sendQueueDepth()
+        return float64(deepest)
+    })
+}
+
+func sendQueueDepth() (total, deepest int) {
+    peerWritersMu.Lock()
+    defer peerWritersMu.Unlock()
+    for w := range peerWriters {
+        n := len(w.queue)
+        total += n
+        if n > deepest {
+            deepest = n
+        }
+    }
+    return total, deepest
+}
+
+// peerWriter - очередь и горутина записи одного соединения
+type peerWriter struct {
+    conn     *websocket.Conn
+    username string
+    role     string
+    queue    chan []byte
+    done     chan struct{} // закрывается, когда горутина записи завершилась
+
+    mu          sync.Mutex // защищает closed, closeReason и закрытие queue
+    closed      bool
+    closeReason string
+}
+
+func newPeerWriter(conn *websocket.Conn, username string, isLeader bool) *peerWriter {
+    size := sendQueueSize
+    if size <= 0 {
+        size = 256
+    }
+    w := &peerWriter{
+        conn:     conn,
+        username: username,
+        role:     map[bool]string{true: "leader", false: "follower"}[isLeader],
+        queue:    make(chan []byte, size),
+        done:     make(chan struct{}),
+    }
+    peerWritersMu.Lock()
+    peerWriters[w] = struct{}{}
+    peerWritersMu.Unlock()
+    go w.run()
+    return w
+}
+
+// messageType возвращает поле type сообщения (для политики переполнения)
+func messageType(msg []byte) string {
+    var head struct {
+        Type string `json:"type"`
+    }
+    _ = json.Unmarshal(msg, &head)
+    return head.Type
+}
+
+// send ставит сообщение в очередь; не блокирует
+func (w *peerWriter) send(msg []byte) error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.closed {
+        return errConnectionClosed
+    }
+    select {
+    case w.queue <- msg:
+        return nil
+    default:
+    }
+    if msgType := messageType(msg); droppableMessageTypes[msgType] {
+        outboundDroppedTotal.inc(msgType)
+        return nil
+    }
+    log.Printf("Send queue of %s is full (%d messages), disconnecting slow consumer", w.username, cap(w.queue))
+    slowConsumersTotal.inc(w.role)
+    w.closeLocked("Slow consumer")
+    // Очередь не дописываем: закрытие соединения прерывает запись, горутина только вычитает остаток
+    w.conn.Close()
+    return errSlowConsumer
+}
+
+func (w *peerWriter) closeLocked(reason string) {
+    if w.closed {
+        return
+    }
+    w.closed = true
+    w.closeReason = reason
+    close(w.queue)
+}
+
+// close дописывает очередь, отправляет кадр закрытия и закрывает соединение.
+// Ждет завершения записи не дольше WS_WRITE_TIMEOUT.
+func (w *peerWriter) close(reason string) {
+    w.mu.Lock()
+    w.closeLocked(reason)
+    w.mu.Unlock()
+    select {
+    case <-w.done:
+    case <-time.After(heartbeatConfig.WriteTimeout):
+        w.conn.Close()
+    }
+}
+
+// fail останавливает запись после ошибки сети
+func (w *peerWriter) fail(err error) {
+    if !errors.Is(err, websocket.ErrCloseSent) && !isClosedConnError(err) {
+        log.Printf("Error writing to %s, closing connection: %v", w.username, err)
+    }
+    w.mu.Lock()
+    w.closeLocked("Write failed")
+    w.mu.Unlock()
+    // Закрытие будит ReadMessage в handleWebSocket, дальше - обычная очистка пира
+    w.conn.Close()
+}
+
+// run пишет сообщения очереди и ping контроля живости
+func (w *peerWriter) run() {
+    defer func() {
+        peerWritersMu.Lock()
+        delete(peerWriters, w)
+        peerWritersMu.Unlock()
+        close(w.done)
+    }()
+    ticker := time.NewTicker(heartbeatConfig.PingInterval)
+    defer ticker.Stop()
+    failed := false
+    for {
+        select {
+        case msg, ok := <-w.queue:
+            if !ok {
+                if !failed {
+                    w.mu.Lock()
+                    reason := w.closeReason
+                    w.mu.Unlock()
+                    _ = w.conn.WriteControl(websocket.CloseMessage,
+                        websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason),
+                        time.Now().Add(time.Second))
+                }
+                w.conn.Close()
+                return
+            }
+            if failed {
+                continue
+            }
+            _ = w.conn.SetWriteDeadline(time.Now().Add(heartbeatConfig.WriteTimeout))
+            if err := w.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+                failed = true
+                w.fail(err)
+            }
+        case <-ticker.C:
+            if failed {
+                continue
+            }
+            if err := w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeatConfig.WriteTimeout)); err != nil {
+                failed = true
+                w.fail(err)
+            }
+        }
+    }
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// testWebSocketPair возвращает серверную и клиентскую стороны WebSocket-соединения
+func testWebSocketPair(t *testing.T) (server, client *websocket.Conn) {
+    t.Helper()
+    conns := make(chan *websocket.Conn, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        conns <- conn
+    }))
+    t.Cleanup(srv.Close)
+    client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    t.Cleanup(func() { client.Close() })
+    server = <-conns
+    t.Cleanup(func() { server.Close() })
+    return server, client
+}
+
+func TestPeerWriterOverflowPolicy(t *testing.T) {
+    tests := []struct {
+        name       string
+        msg        string
+        wantErr    error
+        wantClosed bool
+    }{
+        {name: "ice candidate is dropped", msg: `{"type":"ice_candidate"}`},
+        {name: "server ice candidate is dropped", msg: `{"type":"server_ice_candidate"}`},
+        {name: "stats are dropped", msg: `{"type":"stats"}`},
+        {name: "clock sync is dropped", msg: `{"type":"clock_sync"}`},
+        {name: "room info disconnects", msg: `{"type":"room_info"}`, wantErr: errSlowConsumer, wantClosed: true},
+        {name: "untyped message disconnects", msg: `not json`, wantErr: errSlowConsumer, wantClosed: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            server, _ := testWebSocketPair(t)
+            // Без горутины записи очередь из двух сообщений заполняется детерминированно
+            w := &peerWriter{conn: server, username: "alice", role: "follower", queue: make(chan []byte, 2), done: make(chan struct{})}
+            for i := 0; i < 2; i++ {
+                if err := w.send([]byte(`{"type":"offer"}`)); err != nil {
+                    t.Fatalf("send %d into a queue with room: %v", i, err)
+                }
+            }
+            if err := w.send([]byte(tt.msg)); err != tt.wantErr {
+                t.Fatalf("send on full queue = %v, want %v", err, tt.wantErr)
+            }
+            w.mu.Lock()
+            closed := w.closed
+            w.mu.Unlock()
+            if closed != tt.wantClosed {
+                t.Fatalf("closed = %v, want %v", closed, tt.wantClosed)
+            }
+            if closed {
+                if err := w.send([]byte(`{"type":"stats"}`)); err != errConnectionClosed {
+                    t.Errorf("send after disconnect = %v, want %v", err, errConnectionClosed)
+                }
+                return
+            }
+            if len(w.queue) != 2 {
+                t.Errorf("queue has %d messages, want 2", len(w.queue))
+            }
+        })
+    }
+}
+
+func TestPeerWriterDeliversInOrderAndCloses(t *testing.T) {
+    server, client := testWebSocketPair(t)
+    w := newPeerWriter(server, "alice", false)
+    want := []string{`{"type":"room_info","n":1}`, `{"type":"offer","n":2}`, `{"type":"force_disconnect","n":3}`}
+    for _, msg := range want {
+        if err := w.send([]byte(msg)); err != nil {
+            t.Fatalf("send: %v", err)
+        }
+    }
+    go w.close("Test is over")
+
+    _ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    for i, msg := range want {
+        _, data, err := client.ReadMessage()
+        if err != nil {
+            t.Fatalf("read message %d: %v", i, err)
+        }
+        if string(data) != msg {
+            t.Fatalf("message %d = %s, want %s", i, data, msg)
+        }
+    }
+    _, _, err := client.ReadMessage()
+    if !websocket.IsCloseError(err, websocket.CloseNormalClosure) || !strings.Contains(err.Error(), "Test is over") {
+        t.Fatalf("after queued messages got %v, want a normal close with the reason", err)
+    }
+    select {
+    case <-w.done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("writer goroutine did not finish")
+    }
+    if err := w.send([]byte(`{"type":"offer"}`)); err != errConnectionClosed {
+        t.Errorf("send after close = %v, want %v", err, errConnectionClosed)
+    }
+}